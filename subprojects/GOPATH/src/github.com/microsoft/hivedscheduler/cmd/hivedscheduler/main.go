@@ -23,8 +23,13 @@
 package main
 
 import (
+	"flag"
+	"github.com/microsoft/hivedscheduler/pkg/algorithm"
+	"github.com/microsoft/hivedscheduler/pkg/api"
 	"github.com/microsoft/hivedscheduler/pkg/common"
 	"github.com/microsoft/hivedscheduler/pkg/scheduler"
+	"k8s.io/klog"
+	"os"
 )
 
 func init() {
@@ -32,5 +37,24 @@ func init() {
 }
 
 func main() {
+	if flag.Arg(0) == "replay" {
+		replay(flag.Arg(1))
+		return
+	}
 	scheduler.NewHivedScheduler().Run(common.NewStopChannel())
 }
+
+// replay replays the audit log (the specified file or the one in the config) with the config by
+// "hivedscheduler replay [auditLogFilePath]", and exits with a non-zero code if any replayed call
+// does not return the recorded result.
+func replay(auditLogFilePath string) {
+	sConfig := api.NewConfig(api.InitRawConfig(nil))
+	if auditLogFilePath == "" {
+		auditLogFilePath = *sConfig.AuditLogFilePath
+	}
+	mismatches := algorithm.ReplayAuditLog(sConfig, auditLogFilePath)
+	klog.Flush()
+	if len(mismatches) > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,212 @@
+// MIT License
+//
+// Copyright (c) Microsoft Corporation. All rights reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE
+
+package algorithm
+
+import (
+	"fmt"
+	"github.com/microsoft/hivedscheduler/pkg/api"
+	"github.com/microsoft/hivedscheduler/pkg/common"
+	"github.com/microsoft/hivedscheduler/pkg/internal"
+	"sort"
+)
+
+// GetCapacity returns the largest pod and affinity group of each GPU type that can be scheduled immediately
+// in each VC, with and without preemption at the priority, and the fragmentation of each chain.
+// The capacity is found by dry run scheduling, which does not change the scheduling state.
+func (h *HivedAlgorithm) GetCapacity(priority int32) api.Capacity {
+	// the dry run temporarily changes the cluster views and the pre-bindings of the cells
+	h.algorithmLock.Lock()
+	defer h.algorithmLock.Unlock()
+
+	p := CellPriority(priority)
+	if p != opportunisticPriority && (p < minGuaranteedPriority || p > maxGuaranteedPriority) {
+		panic(internal.NewBadRequestError(fmt.Sprintf(
+			"Priority %v is out of range: [%v, %v] or %v",
+			priority, api.MinGuaranteedPriority, api.MaxGuaranteedPriority, api.OpportunisticPriority)))
+	}
+	capacity := api.Capacity{
+		Priority:        priority,
+		VirtualClusters: []api.VirtualClusterCapacity{},
+		Chains:          []api.ChainFragmentation{},
+	}
+	var vcs []api.VirtualClusterName
+	for vc := range h.vcSchedulers {
+		vcs = append(vcs, vc)
+	}
+	sort.Slice(vcs, func(i, j int) bool { return vcs[i] < vcs[j] })
+	var gpuTypes []string
+	for gpuType := range h.chains {
+		gpuTypes = append(gpuTypes, gpuType)
+	}
+	sort.Strings(gpuTypes)
+	var allChains []CellChain
+	for chain := range h.fullCellList {
+		allChains = append(allChains, chain)
+	}
+	sort.Slice(allChains, func(i, j int) bool { return allChains[i] < allChains[j] })
+	nodeSet := h.getAllNodeSet()
+
+	for _, vc := range vcs {
+		for _, gpuType := range gpuTypes {
+			var chains []CellChain
+			for _, chain := range h.chains[gpuType] {
+				if p < minGuaranteedPriority || h.vcSchedulers[vc].getNonReservedCellList()[chain] != nil {
+					chains = append(chains, chain)
+				}
+			}
+			if len(chains) == 0 {
+				continue
+			}
+			sr := schedulingRequest{vc: vc, priority: p, dryRun: true}
+			capacity.VirtualClusters = append(capacity.VirtualClusters, api.VirtualClusterCapacity{
+				VirtualCluster:    vc,
+				GpuType:           gpuType,
+				WithoutPreemption: h.getPlaceableCapacity(sr, chains, nodeSet, false),
+				WithPreemption:    h.getPlaceableCapacity(sr, chains, nodeSet, true),
+			})
+		}
+	}
+	for _, chain := range allChains {
+		capacity.Chains = append(capacity.Chains, h.getChainFragmentation(chain))
+	}
+	return capacity
+}
+
+// getAllNodeSet returns the set of all the nodes in the physical cluster.
+func (h *HivedAlgorithm) getAllNodeSet() common.Set {
+	nodeSet := common.NewSet()
+	for _, ccl := range h.fullCellList {
+		for _, c := range ccl[CellLevel(len(ccl))] {
+			nodes, _ := c.(*PhysicalCell).GetPhysicalPlacement()
+			for _, n := range nodes {
+				nodeSet.Add(n)
+			}
+		}
+	}
+	return nodeSet
+}
+
+// getPlaceableCapacity finds the largest pod and affinity group (of identical pods) that can be scheduled
+// in the chains, assuming that a group cannot be scheduled if a smaller one cannot.
+func (h *HivedAlgorithm) getPlaceableCapacity(
+	sr schedulingRequest,
+	chains []CellChain,
+	suggestedNodeSet common.Set,
+	preemptionEnable bool) api.PlaceableCapacity {
+
+	totalGpuNum := int32(0)
+	for _, chain := range chains {
+		ccl := h.fullCellList[chain]
+		for _, c := range ccl[CellLevel(len(ccl))] {
+			totalGpuNum += c.GetTotalGpuNum()
+		}
+	}
+	isPlaceable := func(podNum int32, gpuNum int32) bool {
+		sr.affinityGroupPodNums = map[int32]int32{gpuNum: podNum}
+		return h.isPlaceable(sr, chains, suggestedNodeSet, preemptionEnable)
+	}
+	pc := api.PlaceableCapacity{}
+	for pc.MaxPodGpuNumber < totalGpuNum && isPlaceable(1, pc.MaxPodGpuNumber+1) {
+		pc.MaxPodGpuNumber++
+	}
+	for gpuNum := int32(1); gpuNum <= pc.MaxPodGpuNumber; gpuNum++ {
+		// binary search for the max pod number
+		low, high := int32(1), totalGpuNum/gpuNum
+		for low < high {
+			mid := (low + high + 1) / 2
+			if isPlaceable(mid, gpuNum) {
+				low = mid
+			} else {
+				high = mid - 1
+			}
+		}
+		if low*gpuNum >= pc.MaxAffinityGroupPodNumber*pc.MaxAffinityGroupGpuNumber {
+			pc.MaxAffinityGroupPodNumber, pc.MaxAffinityGroupGpuNumber = low, gpuNum
+		}
+	}
+	return pc
+}
+
+// isPlaceable checks if a dry run scheduling request can be scheduled in any of the chains
+// (without any preemption victim if preemption is not enabled).
+func (h *HivedAlgorithm) isPlaceable(
+	sr schedulingRequest,
+	chains []CellChain,
+	suggestedNodeSet common.Set,
+	preemptionEnable bool) bool {
+
+	for _, chain := range chains {
+		sr.chain = chain
+		physicalPlacement, _ := h.processSchedulingRequest(sr, suggestedNodeSet)
+		if physicalPlacement == nil {
+			continue
+		}
+		if preemptionEnable {
+			return true
+		}
+		if _, _, victimGroups := collectPreemptionVictims(
+			physicalPlacement, sr.priority, sr.affinityGroupName); len(victimGroups) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// getChainFragmentation returns the fragmentation of the free cells in the free cell list of a chain.
+// The GPUs of the free cells used by the opportunistic pods are not free.
+func (h *HivedAlgorithm) getChainFragmentation(chain CellChain) api.ChainFragmentation {
+	cf := api.ChainFragmentation{CellChain: string(chain)}
+	for _, cl := range h.freeCellList[chain] {
+		for _, c := range cl {
+			freeGpuNum, maxFreeCellGpuNum := getUnusedGpuNums(c)
+			cf.FreeGpuNumber += freeGpuNum
+			if maxFreeCellGpuNum > cf.MaxFreeCellGpuNumber {
+				cf.MaxFreeCellGpuNumber = maxFreeCellGpuNum
+			}
+		}
+	}
+	if cf.FreeGpuNumber > 0 {
+		cf.FragmentationIndex = 1 - float64(cf.MaxFreeCellGpuNumber)/float64(cf.FreeGpuNumber)
+	}
+	return cf
+}
+
+// getUnusedGpuNums returns the number of the GPUs in a cell not used at any priority, and the GPU number of
+// the largest cell in it (or itself) with no GPU used.
+func getUnusedGpuNums(c Cell) (unusedGpuNum int32, maxUnusedCellGpuNum int32) {
+	usedGpuNum := int32(0)
+	for _, n := range c.GetUsedGpuNumAtPriorities() {
+		usedGpuNum += n
+	}
+	if usedGpuNum == 0 {
+		return c.GetTotalGpuNum(), c.GetTotalGpuNum()
+	}
+	for _, child := range c.GetChildren() {
+		n, maxN := getUnusedGpuNums(child)
+		unusedGpuNum += n
+		if maxN > maxUnusedCellGpuNum {
+			maxUnusedCellGpuNum = maxN
+		}
+	}
+	return unusedGpuNum, maxUnusedCellGpuNum
+}
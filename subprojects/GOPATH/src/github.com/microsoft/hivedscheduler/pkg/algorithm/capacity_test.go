@@ -0,0 +1,113 @@
+// MIT License
+//
+// Copyright (c) Microsoft Corporation. All rights reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE
+
+package algorithm
+
+import (
+	"github.com/microsoft/hivedscheduler/pkg/api"
+	"github.com/microsoft/hivedscheduler/pkg/common"
+	"reflect"
+	"testing"
+)
+
+func TestCapacity(t *testing.T) {
+	h := newTestAlgorithm(newTestConfig())
+	checkCapacity := func(priority int32, expected api.VirtualClusterCapacity, expectedChain api.ChainFragmentation) {
+		capacity := h.GetCapacity(priority)
+		found := false
+		for _, c := range capacity.VirtualClusters {
+			if c.VirtualCluster == expected.VirtualCluster && c.GpuType == expected.GpuType {
+				found = true
+				if !reflect.DeepEqual(c, expected) {
+					t.Errorf("Expected capacity %v at priority %v, but got %v",
+						common.ToJson(expected), priority, common.ToJson(c))
+				}
+			}
+		}
+		if !found {
+			t.Errorf("Expected capacity of GPU type %v in VC %v", expected.GpuType, expected.VirtualCluster)
+		}
+		for _, cf := range capacity.Chains {
+			if cf.CellChain == expectedChain.CellChain && !reflect.DeepEqual(cf, expectedChain) {
+				t.Errorf("Expected fragmentation %v, but got %v", common.ToJson(expectedChain), common.ToJson(cf))
+			}
+		}
+	}
+
+	// a group spanning the preassigned cells at different levels
+	checkCapacity(1, api.VirtualClusterCapacity{
+		VirtualCluster:    "VC1",
+		GpuType:           "DGX2-V100",
+		WithoutPreemption: api.PlaceableCapacity{MaxPodGpuNumber: 16, MaxAffinityGroupPodNumber: 4, MaxAffinityGroupGpuNumber: 16},
+		WithPreemption:    api.PlaceableCapacity{MaxPodGpuNumber: 16, MaxAffinityGroupPodNumber: 4, MaxAffinityGroupGpuNumber: 16},
+	}, api.ChainFragmentation{CellChain: "DGX2-V100-NODE", FreeGpuNumber: 32, MaxFreeCellGpuNumber: 16, FragmentationIndex: 0.5})
+	emptyVc2Capacity := api.PlaceableCapacity{MaxPodGpuNumber: 8, MaxAffinityGroupPodNumber: 6, MaxAffinityGroupGpuNumber: 4}
+	checkCapacity(1, api.VirtualClusterCapacity{
+		VirtualCluster:    "VC2",
+		GpuType:           "DGX1-P100",
+		WithoutPreemption: emptyVc2Capacity,
+		WithPreemption:    emptyVc2Capacity,
+	}, api.ChainFragmentation{CellChain: "3-DGX1-P100-NODE", FreeGpuNumber: 24, MaxFreeCellGpuNumber: 24})
+
+	scheduleAndAllocate(t, h, newTestPod("capacity-0", api.PodSchedulingSpec{
+		VirtualCluster:       "VC2",
+		Priority:             1,
+		LazyPreemptionEnable: true,
+		GpuType:              "DGX1-P100",
+		GpuNumber:            8,
+	}))
+	usedVc2Capacity := api.PlaceableCapacity{MaxPodGpuNumber: 8, MaxAffinityGroupPodNumber: 4, MaxAffinityGroupGpuNumber: 4}
+	checkCapacity(1, api.VirtualClusterCapacity{
+		VirtualCluster:    "VC2",
+		GpuType:           "DGX1-P100",
+		WithoutPreemption: usedVc2Capacity,
+		WithPreemption:    usedVc2Capacity,
+	}, api.ChainFragmentation{CellChain: "3-DGX1-P100-NODE", FreeGpuNumber: 16, MaxFreeCellGpuNumber: 8, FragmentationIndex: 0.5})
+	checkCapacity(2, api.VirtualClusterCapacity{
+		VirtualCluster:    "VC2",
+		GpuType:           "DGX1-P100",
+		WithoutPreemption: usedVc2Capacity,
+		WithPreemption:    emptyVc2Capacity,
+	}, api.ChainFragmentation{CellChain: "3-DGX1-P100-NODE", FreeGpuNumber: 16, MaxFreeCellGpuNumber: 8, FragmentationIndex: 0.5})
+	// the dry run does not lazy preempt the group
+	if g := h.allocatedAffinityGroups["test/capacity-0"]; g.virtualGpuPlacement == nil || g.lazyPreemptionStatus != nil {
+		t.Errorf("Expected group %v not lazy preempted by the dry run", g.name)
+	}
+
+	// the GPUs of the free cells used by the opportunistic pods are not free
+	scheduleAndAllocate(t, h, newTestPod("capacity-1", api.PodSchedulingSpec{
+		VirtualCluster: "VC1",
+		Priority:       api.OpportunisticPriority,
+		GpuType:        "DGX2-V100",
+		GpuNumber:      4,
+	}))
+	freeGpuNum, maxFreeCellGpuNum := int32(28), int32(16)
+	expectedChain := api.ChainFragmentation{CellChain: "DGX2-V100-NODE", FreeGpuNumber: freeGpuNum,
+		MaxFreeCellGpuNumber: maxFreeCellGpuNum, FragmentationIndex: 1 - float64(maxFreeCellGpuNum)/float64(freeGpuNum)}
+	for _, cf := range h.GetCapacity(1).Chains {
+		if cf.CellChain == expectedChain.CellChain && !reflect.DeepEqual(cf, expectedChain) {
+			t.Errorf("Expected fragmentation %v, but got %v", common.ToJson(expectedChain), common.ToJson(cf))
+		}
+	}
+
+	expectBadRequest(t, "getting capacity at an invalid priority", func() { h.GetCapacity(api.MaxGuaranteedPriority + 1) })
+}
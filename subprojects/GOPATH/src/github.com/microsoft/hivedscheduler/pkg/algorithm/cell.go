@@ -128,6 +128,7 @@ type PhysicalCell struct {
 	preBoundVirtualCell *VirtualCell       // points to the temporarily bound virtual cell (before the binding is confirmed)
 	split               bool               // true when the cell has been split
 	reserved            bool               // true when this is a reserved cell
+	cordoned            bool               // true when the cell has been cordoned for maintenance
 }
 
 func NewPhysicalCell(c CellChain, l CellLevel, g bool, n int32) *PhysicalCell {
@@ -211,6 +212,14 @@ func (c *PhysicalCell) SetReserved(reserved bool) {
 	c.reserved = reserved
 }
 
+func (c *PhysicalCell) IsCordoned() bool {
+	return c.cordoned
+}
+
+func (c *PhysicalCell) SetCordoned(cordoned bool) {
+	c.cordoned = cordoned
+}
+
 // VirtualCell defines a cell in a VC.
 type VirtualCell struct {
 	GenericCell
@@ -220,6 +229,8 @@ type VirtualCell struct {
 	preAssignedCell      *VirtualCell           // top level cell of this cell chain
 	physicalCell         *PhysicalCell          // points to the bound physical cell
 	preBoundPhysicalCell *PhysicalCell          // points to the temporarily bound physical cell (before the binding is confirmed)
+	timeWindows          timeWindows            // time windows in which the cell is in its VC (only for a preassigned cell)
+	inactive             bool                   // the preassigned cell is out of its VC (its time windows are closed or it is pending)
 }
 
 func NewVirtualCell(vc api.VirtualClusterName,
@@ -288,3 +299,19 @@ func (c *VirtualCell) GetPreBoundPhysicalCell() *PhysicalCell {
 func (c *VirtualCell) SetPreBoundPhysicalCell(pc *PhysicalCell) {
 	c.preBoundPhysicalCell = pc
 }
+
+func (c *VirtualCell) GetTimeWindows() timeWindows {
+	return c.timeWindows
+}
+
+func (c *VirtualCell) SetTimeWindows(windows timeWindows) {
+	c.timeWindows = windows
+}
+
+func (c *VirtualCell) IsInactive() bool {
+	return c.inactive
+}
+
+func (c *VirtualCell) SetInactive(inactive bool) {
+	c.inactive = inactive
+}
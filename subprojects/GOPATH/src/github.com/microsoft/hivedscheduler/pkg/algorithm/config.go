@@ -26,6 +26,9 @@ import (
 	"fmt"
 	"github.com/microsoft/hivedscheduler/pkg/api"
 	"github.com/microsoft/hivedscheduler/pkg/common"
+	core "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"sort"
 	"strings"
 )
 
@@ -63,8 +66,8 @@ func (c *cellTypeConstructor) addCellChain(ct api.CellType) {
 	}
 
 	ctSpec, ok := c.cellTypeSpecs[ct]
-	if !ok {
-		// not found in raw spec, it's leaf cell
+	if !ok || ctSpec.ChildCellType == "" {
+		// not found in raw spec or has no child, it's leaf cell
 		c.cellChainElements[ct] = &cellChainElement{
 			cellType:      ct,
 			level:         lowestLevel,
@@ -334,6 +337,7 @@ func (c *virtualCellConstructor) build() (
 	map[api.VirtualClusterName]map[api.ReservationId]ChainCellList,
 	map[api.VirtualClusterName]map[api.ReservationId]*PhysicalCell) {
 
+	c.specs = c.carveChildVirtualCells()
 	for vc, spec := range c.specs {
 		c.virtualNonReservedCellList[vc] = map[CellChain]ChainCellList{}
 		c.virtualReservedCellList[vc] = map[api.ReservationId]ChainCellList{}
@@ -341,9 +345,10 @@ func (c *virtualCellConstructor) build() (
 
 		for _, virtualCell := range spec.VirtualCells {
 			sl := strings.Split(string(virtualCell.CellType), ".")
+			windows := parseTimeWindows(vc, virtualCell.TimeWindows)
 			for i := int32(0); i < virtualCell.CellNumber; i++ {
 				c.updateInternalStatus(vc, CellChain(sl[0]), api.CellType(sl[len(sl)-1]), nil, "")
-				c.buildFullTree()
+				c.buildFullTree().SetTimeWindows(windows)
 			}
 		}
 
@@ -354,17 +359,235 @@ func (c *virtualCellConstructor) build() (
 				panic(fmt.Sprintf("reservationId not found in physicalCells: VC: %v, ID: %v", vc, rid))
 			}
 			c.reservedPhysicalCells[vc][rid] = pc
-			// get cellType by reservationId
-			buildingChild := api.CellType(pc.chain)
-			for c.cellChainElements[buildingChild].level > pc.level {
-				buildingChild = c.cellChainElements[buildingChild].childCellType
+			c.buildReservedCell(vc, rid, pc).SetTimeWindows(parseTimeWindows(vc, reservedCell.TimeWindows))
+		}
+	}
+	return c.virtualNonReservedCellList, c.virtualReservedCellList, c.reservedPhysicalCells
+}
+
+// carveChildVirtualCells returns the VC specs where the VirtualCells (without time windows) of each
+// child VC are carved out of those of its parent, by splitting the parent cells like buddy alloc.
+func (c *virtualCellConstructor) carveChildVirtualCells() map[api.VirtualClusterName]api.VirtualClusterSpec {
+	specs := map[api.VirtualClusterName]api.VirtualClusterSpec{}
+	children := map[api.VirtualClusterName][]api.VirtualClusterName{}
+	for vc, spec := range c.specs {
+		specs[vc] = spec
+		if spec.Parent == "" {
+			continue
+		}
+		for p, depth := spec.Parent, 0; p != ""; p, depth = c.specs[p].Parent, depth+1 {
+			if _, ok := c.specs[p]; !ok {
+				panic(fmt.Sprintf("parent VC %v of VC %v is not found", p, vc))
+			}
+			if p == vc || depth >= len(c.specs) {
+				panic(fmt.Sprintf("VC %v is an ancestor of itself", vc))
 			}
+		}
+		children[spec.Parent] = append(children[spec.Parent], vc)
+	}
 
-			c.updateInternalStatus(vc, pc.chain, buildingChild, nil, rid)
-			c.buildFullTree()
+	type carving struct {
+		vc       api.VirtualClusterName
+		chain    CellChain
+		cellType api.CellType
+	}
+	for parent, childVcs := range children {
+		sort.Slice(childVcs, func(i, j int) bool { return childVcs[i] < childVcs[j] })
+		// chain -> cell type -> number of the parent cells left
+		leftCells := map[CellChain]map[api.CellType]int32{}
+		var windowedCells []api.VirtualCellSpec
+		for _, virtualCell := range c.specs[parent].VirtualCells {
+			if len(virtualCell.TimeWindows) != 0 {
+				windowedCells = append(windowedCells, virtualCell)
+				continue
+			}
+			chain, ct := c.parseVirtualCellType(parent, virtualCell.CellType)
+			if leftCells[chain] == nil {
+				leftCells[chain] = map[api.CellType]int32{}
+			}
+			leftCells[chain][ct] += virtualCell.CellNumber
+		}
+		var carvings []carving
+		for _, vc := range childVcs {
+			for _, virtualCell := range c.specs[vc].VirtualCells {
+				if len(virtualCell.TimeWindows) != 0 {
+					panic(fmt.Sprintf("VirtualCells of child VC %v cannot have time windows: %v",
+						vc, virtualCell.CellType))
+				}
+				chain, ct := c.parseVirtualCellType(vc, virtualCell.CellType)
+				for i := int32(0); i < virtualCell.CellNumber; i++ {
+					carvings = append(carvings, carving{vc: vc, chain: chain, cellType: ct})
+				}
+			}
 		}
+		// carve the higher level cells first, so that the lower ones are split from the rest
+		sort.SliceStable(carvings, func(i, j int) bool {
+			return c.cellChainElements[carvings[i].cellType].level > c.cellChainElements[carvings[j].cellType].level
+		})
+		for _, cv := range carvings {
+			if !c.carveCell(leftCells[cv.chain], cv.chain, cv.cellType) {
+				panic(fmt.Sprintf("VirtualCells of VC %v exceed those left in its parent VC %v: %v.%v",
+					cv.vc, parent, cv.chain, cv.cellType))
+			}
+		}
+
+		spec := specs[parent]
+		spec.VirtualCells = windowedCells
+		var chains []CellChain
+		for chain := range leftCells {
+			chains = append(chains, chain)
+		}
+		sort.Slice(chains, func(i, j int) bool { return chains[i] < chains[j] })
+		for _, chain := range chains {
+			for _, ct := range c.getChainCellTypes(chain) {
+				if n := leftCells[chain][ct]; n > 0 {
+					cellType := api.CellType(fmt.Sprintf("%v.%v", chain, ct))
+					if ct == api.CellType(chain) {
+						cellType = ct
+					}
+					spec.VirtualCells = append(spec.VirtualCells, api.VirtualCellSpec{CellType: cellType, CellNumber: n})
+				}
+			}
+		}
+		specs[parent] = spec
 	}
-	return c.virtualNonReservedCellList, c.virtualReservedCellList, c.reservedPhysicalCells
+	return specs
+}
+
+// parseVirtualCellType parses the chain and the cell type of a VirtualCellSpec.CellType (a.b.c).
+func (c *virtualCellConstructor) parseVirtualCellType(
+	vc api.VirtualClusterName, cellType api.CellType) (CellChain, api.CellType) {
+
+	sl := strings.Split(string(cellType), ".")
+	chain, ct := CellChain(sl[0]), api.CellType(sl[len(sl)-1])
+	if indexOfCellType(c.getChainCellTypes(chain), ct) == -1 {
+		panic(fmt.Sprintf("cellType %v in VirtualCells of VC %v is not found in cell types definition", cellType, vc))
+	}
+	return chain, ct
+}
+
+// getChainCellTypes returns the cell types in a chain, from the top level to the lowest.
+func (c *virtualCellConstructor) getChainCellTypes(chain CellChain) []api.CellType {
+	var cellTypes []api.CellType
+	for ct := api.CellType(chain); ct != ""; ct = c.cellChainElements[ct].childCellType {
+		if c.cellChainElements[ct] == nil {
+			break
+		}
+		cellTypes = append(cellTypes, ct)
+	}
+	return cellTypes
+}
+
+func indexOfCellType(cellTypes []api.CellType, ct api.CellType) int {
+	for i, t := range cellTypes {
+		if t == ct {
+			return i
+		}
+	}
+	return -1
+}
+
+// carveCell takes a cell of the cell type from the left cells of a chain, splitting the lowest
+// higher level cell into its children if there is no cell of the type left.
+func (c *virtualCellConstructor) carveCell(
+	leftCells map[api.CellType]int32, chain CellChain, ct api.CellType) bool {
+
+	cellTypes := c.getChainCellTypes(chain)
+	i := indexOfCellType(cellTypes, ct)
+	j := i
+	for j >= 0 && leftCells[cellTypes[j]] == 0 {
+		j--
+	}
+	if j < 0 {
+		return false
+	}
+	for ; j < i; j++ {
+		leftCells[cellTypes[j]]--
+		leftCells[cellTypes[j+1]] += c.cellChainElements[cellTypes[j]].childNumber
+	}
+	leftCells[ct]--
+	return true
+}
+
+// buildReservedCell builds the virtual cells of a VC for a reservation of a physical cell,
+// and returns the top one.
+func (c *virtualCellConstructor) buildReservedCell(
+	vc api.VirtualClusterName,
+	rid api.ReservationId,
+	pc *PhysicalCell) *VirtualCell {
+
+	// get cellType by reservationId
+	buildingChild := api.CellType(pc.chain)
+	for c.cellChainElements[buildingChild].level > pc.level {
+		buildingChild = c.cellChainElements[buildingChild].childCellType
+	}
+
+	c.updateInternalStatus(vc, pc.chain, buildingChild, nil, rid)
+	return c.buildFullTree()
+}
+
+// buildReservedVirtualCells builds the virtual cells of a VC for a reservation created at runtime.
+func buildReservedVirtualCells(
+	cellTypes map[api.CellType]api.CellTypeSpec,
+	vc api.VirtualClusterName,
+	rid api.ReservationId,
+	pc *PhysicalCell) ChainCellList {
+
+	c := newVirtualCellConstructor(newCellTypeConstructor(cellTypes).buildCellChains(), nil, nil)
+	c.buildReservedCell(vc, rid, pc)
+	return c.virtualReservedCellList[vc][rid]
+}
+
+// parseVcResourceQuotas parses the CPU and memory quota of each VC. A VC without quota is not in the result.
+func parseVcResourceQuotas(
+	virtualSpecs map[api.VirtualClusterName]api.VirtualClusterSpec) map[api.VirtualClusterName]core.ResourceList {
+
+	quotas := map[api.VirtualClusterName]core.ResourceList{}
+	for vc, spec := range virtualSpecs {
+		for name, value := range map[core.ResourceName]string{
+			core.ResourceCPU:    spec.CpuQuota,
+			core.ResourceMemory: spec.MemoryQuota,
+		} {
+			if value == "" {
+				continue
+			}
+			q, err := resource.ParseQuantity(value)
+			if err != nil {
+				panic(fmt.Sprintf("invalid %v quota of VC %v: %v", name, vc, err))
+			}
+			if quotas[vc] == nil {
+				quotas[vc] = core.ResourceList{}
+			}
+			quotas[vc][name] = q
+		}
+	}
+	return quotas
+}
+
+// parseUserQuotas validates the user quota of each VC. A VC without user quota is not in the result.
+func parseUserQuotas(
+	virtualSpecs map[api.VirtualClusterName]api.VirtualClusterSpec) map[api.VirtualClusterName]*api.UserQuotaSpec {
+
+	quotas := map[api.VirtualClusterName]*api.UserQuotaSpec{}
+	for vc, spec := range virtualSpecs {
+		if spec.UserQuota == nil {
+			continue
+		}
+		q := *spec.UserQuota
+		if q.LabelKey == "" {
+			q.LabelKey = api.LabelKeyUser
+		}
+		for user, limits := range q.Users {
+			for _, l := range limits {
+				if l.MinPriority < api.MinGuaranteedPriority || l.MaxPriority > api.MaxGuaranteedPriority ||
+					l.MinPriority > l.MaxPriority || l.GpuNumber < 0 {
+					panic(fmt.Sprintf("invalid GPU limit of user %q in VC %v: %v", user, vc, common.ToJson(l)))
+				}
+			}
+		}
+		quotas[vc] = &q
+	}
+	return quotas
 }
 
 func calculateGpuNumber(cellChainElements map[api.CellType]*cellChainElement, chains []CellChain) map[CellChain]map[CellLevel]int32 {
@@ -421,6 +644,10 @@ func ParseConfig(sConfig *api.Config) (
 	for k := range physicalCells {
 		cellChains = append(cellChains, k)
 	}
+	// the chains of a GPU type are tried in a deterministic order
+	sort.Slice(cellChains, func(i, j int) bool {
+		return cellChains[i] < cellChains[j]
+	})
 	gpuNums := calculateGpuNumber(cellChainElements, cellChains)
 	gpuTypeToChain := calculateGpuType(cellChainElements, cellChains)
 	cellLevelToType := calculateCellType(cellChainElements, cellChains)
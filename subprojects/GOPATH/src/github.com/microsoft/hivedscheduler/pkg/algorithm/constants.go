@@ -25,6 +25,7 @@ package algorithm
 import (
 	"github.com/microsoft/hivedscheduler/pkg/api"
 	"math"
+	"time"
 )
 
 const (
@@ -37,4 +38,8 @@ const (
 	// lowest and highest levels in a cell chain
 	lowestLevel  = CellLevel(1)
 	highestLevel = CellLevel(math.MaxInt32)
+
+	// a preempting affinity group whose preemption is not retried within the timeout
+	// (e.g., its pods are deleted before preemption) is no longer tracked
+	preemptingAffinityGroupTimeout = 10 * time.Minute
 )
@@ -0,0 +1,308 @@
+// MIT License
+//
+// Copyright (c) Microsoft Corporation. All rights reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE
+
+package algorithm
+
+import (
+	"fmt"
+	"github.com/microsoft/hivedscheduler/pkg/api"
+	"github.com/microsoft/hivedscheduler/pkg/common"
+	"github.com/microsoft/hivedscheduler/pkg/internal"
+	"k8s.io/klog"
+	"sort"
+)
+
+func (h *HivedAlgorithm) GetCellCordons() api.CellCordonList {
+	h.algorithmLock.RLock()
+	defer h.algorithmLock.RUnlock()
+
+	ccs := api.CellCordonList{}
+	for name := range h.cellCordons {
+		ccs.Items = append(ccs.Items, h.toCellCordon(name))
+	}
+	sort.SliceStable(ccs.Items, func(i, j int) bool {
+		return ccs.Items[i].Name < ccs.Items[j].Name
+	})
+	return ccs
+}
+
+func (h *HivedAlgorithm) GetCellCordon(name string) api.CellCordon {
+	h.algorithmLock.RLock()
+	defer h.algorithmLock.RUnlock()
+
+	h.getCellCordon(name)
+	return h.toCellCordon(name)
+}
+
+// CreateCellCordon cordons a physical cell, so that no new affinity group will be placed in it.
+// If drain is specified, the idle reservations in the cell are also moved elsewhere.
+func (h *HivedAlgorithm) CreateCellCordon(cc api.CellCordon) (result api.CellCordon) {
+	h.algorithmLock.Lock()
+	defer h.algorithmLock.Unlock()
+	defer h.audit(internal.AuditCreateCellCordon, &result, cc)()
+
+	if cc.Name == "" {
+		panic(internal.NewBadRequestError("Cell cordon name is empty"))
+	}
+	if h.cellCordons[cc.Name] != nil {
+		panic(internal.NewBadRequestError(fmt.Sprintf(
+			"Cell cordon %v already exists", cc.Name)))
+	}
+	var cells []*PhysicalCell
+	if cc.Spec.CellType == "" {
+		if len(cc.Spec.Nodes) != 1 {
+			panic(internal.NewBadRequestError(
+				"Exactly one node should be specified to cordon a node without the cell type"))
+		}
+		cells = h.findNodeCells(cc.Spec.Nodes[0])
+	} else if chainLevels := h.getCellTypeChainLevels(cc.Spec.CellType); len(chainLevels) == 0 {
+		panic(internal.NewBadRequestError(fmt.Sprintf(
+			"Cell type %v does not exist in the physical cluster", cc.Spec.CellType)))
+	} else {
+		cells = []*PhysicalCell{h.findPhysicalCell(chainLevels, cc.Spec.CellType, cc.Spec.Nodes, cc.Spec.GpuIndices)}
+	}
+	for _, pc := range cells {
+		if pc.IsCordoned() {
+			panic(internal.NewBadRequestError(fmt.Sprintf(
+				"Cell %v has been cordoned", pc.GetName())))
+		}
+	}
+
+	h.cellCordons[cc.Name] = &cellCordon{spec: cc.Spec, cells: cells}
+	for _, pc := range cells {
+		pc.SetCordoned(true)
+		klog.Infof("Cell %v cordoned by %v", pc.GetName(), cc.Name)
+	}
+	if cc.Spec.Drain {
+		h.drainCells(cells)
+	}
+	return h.toCellCordon(cc.Name)
+}
+
+// DeleteCellCordon uncordons a physical cell. The reservations moved by the drain are not moved back.
+func (h *HivedAlgorithm) DeleteCellCordon(name string) (result api.CellCordon) {
+	h.algorithmLock.Lock()
+	defer h.algorithmLock.Unlock()
+	defer h.audit(internal.AuditDeleteCellCordon, &result, name)()
+
+	cordon := h.getCellCordon(name)
+	cc := h.toCellCordon(name)
+	for _, pc := range cordon.cells {
+		pc.SetCordoned(false)
+		klog.Infof("Cell %v uncordoned by %v", pc.GetName(), name)
+	}
+	delete(h.cellCordons, name)
+	return cc
+}
+
+// getCellCordon returns a cell cordon by name.
+func (h *HivedAlgorithm) getCellCordon(name string) *cellCordon {
+	if cordon := h.cellCordons[name]; cordon != nil {
+		return cordon
+	}
+	panic(internal.NewBadRequestError(fmt.Sprintf(
+		"Cell cordon %v does not exist", name)))
+}
+
+// toCellCordon returns the cell cordon exposed by the inspect API, with its current drain status.
+func (h *HivedAlgorithm) toCellCordon(name string) api.CellCordon {
+	cordon := h.cellCordons[name]
+	cc := api.CellCordon{}
+	cc.Name = name
+	cc.Spec = cordon.spec
+	groups := common.NewSet()
+	rids, vcs := h.getReservationsInCells(cordon.cells)
+	drained := len(rids) == 0
+	for _, pc := range cordon.cells {
+		cc.Status.Cells = append(cc.Status.Cells, pc.GetName())
+		collectAffinityGroupsInCell(pc, groups)
+		drained = drained && !hasBoundVirtualCell(pc)
+	}
+	for _, rid := range rids {
+		if reserved := h.reservedCells[vcs[rid]][rid]; reserved.GetVirtualCell().GetPriority() == freePriority {
+			cc.Status.BlockingReservations = append(cc.Status.BlockingReservations, string(rid))
+		} else {
+			// the groups in the reservation block it from being moved out of the cell
+			collectAffinityGroupsInCell(reserved, groups)
+		}
+	}
+	for g := range groups.Items() {
+		cc.Status.BlockingAffinityGroups = append(cc.Status.BlockingAffinityGroups, g.(string))
+	}
+	sort.Strings(cc.Status.BlockingAffinityGroups)
+	cc.Status.Drained = drained && groups.IsEmpty()
+	return cc
+}
+
+// findNodeCells finds the node-level physical cells of a node in all the chains.
+func (h *HivedAlgorithm) findNodeCells(node string) []*PhysicalCell {
+	var cells []*PhysicalCell
+	for _, chain := range getSortedChains(h.getNodeLevels()) {
+		ccl := h.fullCellList[chain]
+		for l := lowestLevel; l <= CellLevel(len(ccl)); l++ {
+			if !ccl[l][0].AtOrHigherThanNode() {
+				continue
+			}
+			for _, c := range ccl[l] {
+				if pc := c.(*PhysicalCell); isCellAtPlacement(pc, []string{node}, nil) {
+					cells = append(cells, pc)
+				}
+			}
+			break
+		}
+	}
+	if len(cells) == 0 {
+		panic(internal.NewBadRequestError(fmt.Sprintf(
+			"Node %v does not exist in the physical cluster", node)))
+	}
+	return cells
+}
+
+// getNodeLevels returns the node level in each chain.
+func (h *HivedAlgorithm) getNodeLevels() map[CellChain]CellLevel {
+	chainLevels := map[CellChain]CellLevel{}
+	for chain, ccl := range h.fullCellList {
+		for l := lowestLevel; l <= CellLevel(len(ccl)); l++ {
+			if ccl[l][0].AtOrHigherThanNode() {
+				chainLevels[chain] = l
+				break
+			}
+		}
+	}
+	return chainLevels
+}
+
+// drainCordonedCells drains the cordoned cells which are specified to be drained.
+func (h *HivedAlgorithm) drainCordonedCells() {
+	var names []string
+	for name, cordon := range h.cellCordons {
+		if cordon.spec.Drain {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		h.drainCells(h.cellCordons[name].cells)
+	}
+}
+
+// drainCells moves the idle reservations overlapping the cordoned cells to other free cells.
+// The other VC bindings in the cells are released once the affinity groups using them complete,
+// and will not be bound in the cells again as they are excluded from buddy alloc.
+func (h *HivedAlgorithm) drainCells(cells []*PhysicalCell) {
+	rids, vcs := h.getReservationsInCells(cells)
+	for _, rid := range rids {
+		if h.reservedCells[vcs[rid]][rid].GetVirtualCell().GetPriority() != freePriority {
+			continue
+		}
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					klog.Warningf("Reservation %v cannot be moved out of the cordoned cells: %v", rid, r)
+				}
+			}()
+			h.moveReservation(vcs[rid], rid, api.ReservationSpec{})
+		}()
+	}
+}
+
+// getReservationsInCells returns the IDs of the reservations overlapping any of the physical cells (sorted),
+// and the VC of each reservation.
+func (h *HivedAlgorithm) getReservationsInCells(
+	cells []*PhysicalCell) ([]api.ReservationId, map[api.ReservationId]api.VirtualClusterName) {
+
+	var rids []api.ReservationId
+	vcs := map[api.ReservationId]api.VirtualClusterName{}
+	for vc, vcReservation := range h.reservedCells {
+		for rid, reserved := range vcReservation {
+			for _, c := range cells {
+				if isAncestorOrSelf(c, reserved) || isAncestorOrSelf(reserved, c) {
+					rids = append(rids, rid)
+					vcs[rid] = vc
+					break
+				}
+			}
+		}
+	}
+	sort.SliceStable(rids, func(i, j int) bool {
+		return rids[i] < rids[j]
+	})
+	return rids, vcs
+}
+
+// collectAffinityGroupsInCell collects the names of the affinity groups using the GPUs in a physical cell.
+func collectAffinityGroupsInCell(c *PhysicalCell, groups common.Set) {
+	if c.GetLevel() > lowestLevel {
+		for _, cc := range c.GetChildren() {
+			collectAffinityGroupsInCell(cc.(*PhysicalCell), groups)
+		}
+	} else if g := c.GetAffinityGroup(); g != nil {
+		groups.Add(g.name)
+	}
+}
+
+// hasBoundVirtualCell checks if a physical cell or any of its descendants is bound to a virtual cell.
+func hasBoundVirtualCell(c *PhysicalCell) bool {
+	if c.GetVirtualCell() != nil {
+		return true
+	}
+	for _, cc := range c.GetChildren() {
+		if hasBoundVirtualCell(cc.(*PhysicalCell)) {
+			return true
+		}
+	}
+	return false
+}
+
+// filterCordonedCells returns the cells in a list that are not in cordoned cells. If the cells are not to be split,
+// the cells containing cordoned cells are also filtered out.
+func filterCordonedCells(cl CellList, split bool) CellList {
+	filtered := CellList{}
+	for _, c := range cl {
+		pc := c.(*PhysicalCell)
+		if isInCordonedCell(pc) || (!split && hasCordonedDescendant(pc)) {
+			continue
+		}
+		filtered = append(filtered, c)
+	}
+	return filtered
+}
+
+// isInCordonedCell checks if a physical cell or any of its ancestors is cordoned.
+func isInCordonedCell(c *PhysicalCell) bool {
+	for ; c != nil; c, _ = c.GetParent().(*PhysicalCell) {
+		if c.IsCordoned() {
+			return true
+		}
+	}
+	return false
+}
+
+// hasCordonedDescendant checks if any descendant of a physical cell is cordoned.
+func hasCordonedDescendant(c *PhysicalCell) bool {
+	for _, cc := range c.GetChildren() {
+		if child := cc.(*PhysicalCell); child.IsCordoned() || hasCordonedDescendant(child) {
+			return true
+		}
+	}
+	return false
+}
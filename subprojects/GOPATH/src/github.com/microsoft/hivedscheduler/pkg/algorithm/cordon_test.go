@@ -0,0 +1,106 @@
+// MIT License
+//
+// Copyright (c) Microsoft Corporation. All rights reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE
+
+package algorithm
+
+import (
+	"github.com/microsoft/hivedscheduler/pkg/api"
+	core "k8s.io/api/core/v1"
+	"reflect"
+	"testing"
+)
+
+func TestCellCordon(t *testing.T) {
+	h := newTestAlgorithm(newTestConfig())
+	newPod := func(name string, vc api.VirtualClusterName, priority int32, gpuNumber int32) *core.Pod {
+		return newTestPod(name, api.PodSchedulingSpec{
+			VirtualCluster: vc,
+			Priority:       priority,
+			GpuType:        "CT1",
+			GpuNumber:      gpuNumber,
+		})
+	}
+	cordonNode := func(node string, drain bool) api.CellCordon {
+		return h.CreateCellCordon(api.CellCordon{
+			ObjectMeta: api.ObjectMeta{Name: node},
+			Spec:       api.CellCordonSpec{Nodes: []string{node}, Drain: drain},
+		})
+	}
+
+	// the idle reservation on a drained node is moved to the only node not cordoned
+	if cc := cordonNode("0.0.0.1", false); !cc.Status.Drained {
+		t.Errorf("Expected cell cordon %v drained, but got %v", cc.Name, cc.Status)
+	}
+	if cc := cordonNode("1.0.0.2", true); !cc.Status.Drained {
+		t.Errorf("Expected cell cordon %v drained, but got %v", cc.Name, cc.Status)
+	}
+	if r := h.GetReservation("VC1-YQW-CT1"); r.Spec.Nodes[0] != "0.0.0.0" {
+		t.Errorf("Expected reservation %v moved to node 0.0.0.0, but got %v", r.Name, r.Spec.Nodes)
+	}
+	expectBadRequest(t, "creating an existing cell cordon", func() { cordonNode("0.0.0.1", false) })
+	expectBadRequest(t, "cordoning a cordoned cell", func() {
+		h.CreateCellCordon(api.CellCordon{
+			ObjectMeta: api.ObjectMeta{Name: "CT1-NODE-0.0.0.1"},
+			Spec:       api.CellCordonSpec{CellType: "CT1-NODE", Nodes: []string{"0.0.0.1"}},
+		})
+	})
+	expectBadRequest(t, "cordoning multiple nodes without the cell type", func() {
+		h.CreateCellCordon(api.CellCordon{
+			ObjectMeta: api.ObjectMeta{Name: "nodes"},
+			Spec:       api.CellCordonSpec{Nodes: []string{"0.0.0.0", "0.0.0.1"}},
+		})
+	})
+
+	// opportunistic pods and buddy alloc only use the cells not cordoned
+	allocatedPod := scheduleAndAllocate(t, h, newPod("opportunistic-pod", "VC2", api.OpportunisticPriority, 2))
+	if allocatedPod.Spec.NodeName != "0.0.0.0" {
+		t.Fatalf("Expected pod %v bound to node 0.0.0.0, but got %v", allocatedPod.Name, allocatedPod.Spec.NodeName)
+	}
+	for _, pod := range []*core.Pod{
+		newPod("opportunistic-pod-2", "VC2", api.OpportunisticPriority, 1),
+		newPod("guaranteed-pod", "VC2", 1, 1),
+	} {
+		if psr := h.Schedule(pod, allNodes); psr.PodBindInfo != nil || psr.PodPreemptInfo != nil {
+			t.Errorf("Expected pod %v waiting, but got %v", pod.Name, psr)
+		}
+	}
+
+	// the drain is blocked by the running group, and by the reservation without free cells to move to
+	cc := cordonNode("0.0.0.0", true)
+	if cc.Status.Drained || !reflect.DeepEqual(cc.Status.BlockingAffinityGroups, []string{"test/opportunistic-pod"}) ||
+		!reflect.DeepEqual(cc.Status.BlockingReservations, []string{"VC1-YQW-CT1"}) {
+		t.Errorf("Expected cell cordon %v blocked, but got %v", cc.Name, cc.Status)
+	}
+	h.DeleteCellCordon("0.0.0.1")
+	h.Reconcile()
+	if r := h.GetReservation("VC1-YQW-CT1"); r.Spec.Nodes[0] != "0.0.0.1" {
+		t.Errorf("Expected reservation %v moved to node 0.0.0.1, but got %v", r.Name, r.Spec.Nodes)
+	}
+	h.DeleteAllocatedPod(allocatedPod)
+	if cc := h.GetCellCordon("0.0.0.0"); !cc.Status.Drained {
+		t.Errorf("Expected cell cordon %v drained, but got %v", cc.Name, cc.Status)
+	}
+	if n := len(h.GetCellCordons().Items); n != 2 {
+		t.Errorf("Expected 2 cell cordons, but got %v", n)
+	}
+	expectBadRequest(t, "getting a deleted cell cordon", func() { h.GetCellCordon("0.0.0.1") })
+}
@@ -0,0 +1,204 @@
+// MIT License
+//
+// Copyright (c) Microsoft Corporation. All rights reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE
+
+package algorithm
+
+import (
+	"github.com/microsoft/hivedscheduler/pkg/api"
+	"github.com/microsoft/hivedscheduler/pkg/common"
+	"github.com/microsoft/hivedscheduler/pkg/internal"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog"
+	"sort"
+	"time"
+)
+
+// Defragment selects at most maxMoves opportunistic affinity groups to be evicted, so that they are
+// rescheduled more compactly. A group can be moved if all its pods are allocated and opt in to
+// the defragmentation, and it has run (and not been selected) for minRuntime. The groups whose moves
+// free the most nodes are selected, where the new placement of a group is found by dry run scheduling.
+func (h *HivedAlgorithm) Defragment(maxMoves int32, minRuntime time.Duration) (moves []api.DefragmentationMove) {
+	// the dry run temporarily changes the cluster views
+	h.algorithmLock.Lock()
+	defer h.algorithmLock.Unlock()
+	defer h.audit(internal.AuditDefragment, &moves, maxMoves, minRuntime)()
+
+	now := h.now()
+	var names []string
+	for name := range h.allocatedAffinityGroups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	nodeSet := h.getAllNodeSet()
+	var candidates []api.DefragmentationMove
+	for _, name := range names {
+		g := h.allocatedAffinityGroups[name]
+		if g.priority >= minGuaranteedPriority || !isDefragmentationEnabled(g) ||
+			now.Sub(g.startTime) < minRuntime || now.Sub(g.defragmentationTime) < minRuntime {
+			continue
+		}
+		if move := h.planAffinityGroupMove(g, nodeSet); move != nil && move.FreedNodeNumber > 0 {
+			move.Time = meta.NewTime(now)
+			candidates = append(candidates, *move)
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].FreedNodeNumber > candidates[j].FreedNodeNumber
+	})
+
+	// the moves are planned independently, so the ones involving the same nodes are not selected together
+	moves = []api.DefragmentationMove{}
+	usedNodes := common.NewSet()
+	for _, move := range candidates {
+		if int32(len(moves)) >= maxMoves {
+			break
+		}
+		overlapped := false
+		for _, n := range append(append([]string{}, move.FromNodes...), move.ToNodes...) {
+			if usedNodes.Contains(n) {
+				overlapped = true
+				break
+			}
+		}
+		if overlapped {
+			continue
+		}
+		for _, n := range append(append([]string{}, move.FromNodes...), move.ToNodes...) {
+			usedNodes.Add(n)
+		}
+		h.allocatedAffinityGroups[move.AffinityGroup].defragmentationTime = now
+		klog.Infof("Affinity group %v is selected to be moved from nodes %v to %v, freeing %v nodes",
+			move.AffinityGroup, move.FromNodes, move.ToNodes, move.FreedNodeNumber)
+		moves = append(moves, move)
+	}
+	return moves
+}
+
+// isDefragmentationEnabled checks if all the pods of an affinity group are allocated,
+// and they all opt in to the defragmentation.
+func isDefragmentationEnabled(g *AlgoAffinityGroup) bool {
+	for _, pods := range g.allocatedPods {
+		for _, pod := range pods {
+			if pod == nil || pod.Annotations[api.AnnotationKeyPodDefragmentationEnable] != "true" {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// planAffinityGroupMove finds the placement where an opportunistic affinity group would be rescheduled
+// if it is evicted now, by dry run scheduling it in its chain out of its current GPUs and the nodes only
+// used by it (which will be idle after the eviction), and counts the nodes freed by the move: the nodes
+// only used by the group, minus the idle nodes of the new placement.
+// Nil is returned if the group cannot be rescheduled, or its members use multiple chains.
+func (h *HivedAlgorithm) planAffinityGroupMove(g *AlgoAffinityGroup, nodeSet common.Set) *api.DefragmentationMove {
+	var (
+		pods  []string
+		chain CellChain
+		s     *api.PodSchedulingSpec
+	)
+	gpuNums := map[*PhysicalCell]int32{}
+	for gpuNum, podPlacements := range g.physicalGpuPlacement {
+		for i, podPlacement := range podPlacements {
+			pod := g.allocatedPods[gpuNum][i]
+			pods = append(pods, pod.Namespace+"/"+pod.Name)
+			if s == nil {
+				s = internal.ExtractPodSchedulingSpec(pod)
+			}
+			for _, gpu := range podPlacement {
+				pGpu := gpu.(*PhysicalCell)
+				if chain != "" && pGpu.GetChain() != chain {
+					return nil
+				}
+				chain = pGpu.GetChain()
+				gpuNums[ancestorNoHigherThanNode(pGpu).(*PhysicalCell)]++
+			}
+		}
+	}
+	if chain == "" {
+		return nil
+	}
+	move := &api.DefragmentationMove{
+		AffinityGroup:  g.name,
+		VirtualCluster: g.vc,
+		Pods:           pods,
+	}
+	freedNodes := common.NewSet()
+	for node, n := range gpuNums {
+		if getUsedGpuNum(node) == n {
+			freedNodes.Add(getNodeName(node))
+		}
+		move.FromNodes = append(move.FromNodes, getNodeName(node))
+	}
+	suggestedNodeSet := common.NewSet()
+	for n := range nodeSet.Items() {
+		if !freedNodes.Contains(n) {
+			suggestedNodeSet.Add(n)
+		}
+	}
+
+	sr, _ := newSchedulingRequest(s)
+	delete(sr.affinityGroupPodNums, 0)
+	sr.chain = chain
+	sr.priority = opportunisticPriority
+	sr.dryRun = true
+	physicalPlacement, _ := h.processSchedulingRequest(sr, suggestedNodeSet)
+	if physicalPlacement == nil {
+		return nil
+	}
+	freedNodeNum := int32(len(freedNodes.Items()))
+	toNodes := map[*PhysicalCell]bool{}
+	for _, podPlacements := range physicalPlacement {
+		for _, podPlacement := range podPlacements {
+			for _, gpu := range podPlacement {
+				toNodes[ancestorNoHigherThanNode(gpu).(*PhysicalCell)] = true
+			}
+		}
+	}
+	for node := range toNodes {
+		if getUsedGpuNum(node) == 0 {
+			freedNodeNum--
+		}
+		move.ToNodes = append(move.ToNodes, getNodeName(node))
+	}
+	sort.Strings(move.Pods)
+	sort.Strings(move.FromNodes)
+	sort.Strings(move.ToNodes)
+	move.FreedNodeNumber = freedNodeNum
+	return move
+}
+
+// getUsedGpuNum returns the number of GPUs used at all priorities in a cell.
+func getUsedGpuNum(c Cell) int32 {
+	n := int32(0)
+	for _, num := range c.GetUsedGpuNumAtPriorities() {
+		n += num
+	}
+	return n
+}
+
+// getNodeName returns the node of a cell at or lower than the node level.
+func getNodeName(c *PhysicalCell) string {
+	nodes, _ := c.GetPhysicalPlacement()
+	return nodes[0]
+}
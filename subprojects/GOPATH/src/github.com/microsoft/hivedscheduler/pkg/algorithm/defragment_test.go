@@ -0,0 +1,82 @@
+// MIT License
+//
+// Copyright (c) Microsoft Corporation. All rights reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE
+
+package algorithm
+
+import (
+	"github.com/microsoft/hivedscheduler/pkg/api"
+	"github.com/microsoft/hivedscheduler/pkg/common"
+	core "k8s.io/api/core/v1"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDefragment(t *testing.T) {
+	h := newTestAlgorithm(newTestConfig())
+	now := time.Now()
+	h.now = func() time.Time { return now }
+	schedule := func(name string, defragmentationEnable bool) *core.Pod {
+		pod := newTestPod(name, api.PodSchedulingSpec{
+			VirtualCluster: "VC2",
+			Priority:       api.OpportunisticPriority,
+			GpuType:        "DGX1-P100",
+			GpuNumber:      4,
+		})
+		if defragmentationEnable {
+			pod.Annotations[api.AnnotationKeyPodDefragmentationEnable] = "true"
+		}
+		return scheduleAndAllocate(t, h, pod)
+	}
+
+	// the groups are packed in 2 nodes, and then scattered when b and c complete
+	a := schedule("a", true)
+	b := schedule("b", true)
+	c := schedule("c", true)
+	d := schedule("d", false)
+	if a.Spec.NodeName != b.Spec.NodeName || c.Spec.NodeName != d.Spec.NodeName || a.Spec.NodeName == d.Spec.NodeName {
+		t.Fatalf("Expected groups packed in 2 nodes, but got %v, %v, %v, %v",
+			a.Spec.NodeName, b.Spec.NodeName, c.Spec.NodeName, d.Spec.NodeName)
+	}
+	h.DeleteAllocatedPod(b)
+	h.DeleteAllocatedPod(c)
+	now = now.Add(2 * time.Hour)
+
+	// a is moved to the node of d, while d does not opt in
+	expectedMoves := []api.DefragmentationMove{{
+		Time:            meta.NewTime(now),
+		AffinityGroup:   "test/a",
+		VirtualCluster:  "VC2",
+		Pods:            []string{"test/a"},
+		FromNodes:       []string{a.Spec.NodeName},
+		ToNodes:         []string{d.Spec.NodeName},
+		FreedNodeNumber: 1,
+	}}
+	if moves := h.Defragment(2, time.Hour); !reflect.DeepEqual(moves, expectedMoves) {
+		t.Errorf("Expected moves %v, but got %v", common.ToJson(expectedMoves), common.ToJson(moves))
+	}
+	// a is not moved again within the min runtime
+	if moves := h.Defragment(2, time.Hour); len(moves) != 0 {
+		t.Errorf("Expected no move, but got %v", common.ToJson(moves))
+	}
+}
@@ -29,11 +29,15 @@ import (
 	"github.com/microsoft/hivedscheduler/pkg/internal"
 	core "k8s.io/api/core/v1"
 	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/klog"
 	"math"
 	"math/rand"
+	"reflect"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 )
 
 // HivedAlgorithm implements an internal.SchedulerAlgorithm. It schedules pods using the algorithm of HiveD.
@@ -52,37 +56,102 @@ type HivedAlgorithm struct {
 	chains map[string][]CellChain
 	// map each level in a chain to the specific cell type name
 	cellTypes map[CellChain]map[CellLevel]api.CellType
+	// spec of each cell type (a leaf cell type not found in the specs is a GPU)
+	cellTypeSpecs map[api.CellType]api.CellTypeSpec
 	// all affinity groups that have been allocated cells
 	allocatedAffinityGroups map[string]*AlgoAffinityGroup
 	// all reserved physical cells (VC -> reservation ID -> cells)
 	reservedCells map[api.VirtualClusterName]map[api.ReservationId]*PhysicalCell
+	// cost model used to select preemption victims
+	costModel *preemptionCostModel
+	// preemption decisions of the affinity groups that are preempting others but have not been allocated
+	preemptingAffinityGroups map[string]*api.PreemptionStatus
+	// CPU and memory quota of the VCs for the guaranteed pods requesting zero GPU
+	vcResourceQuotas map[api.VirtualClusterName]core.ResourceList
+	// CPU and memory used by the allocated guaranteed pods requesting zero GPU in each VC
+	vcResourceUsages map[api.VirtualClusterName]core.ResourceList
+	// GPU quota of each user in the VCs
+	userQuotas map[api.VirtualClusterName]*api.UserQuotaSpec
+	// parent of each child VC
+	vcParents map[api.VirtualClusterName]api.VirtualClusterName
+	// ledger of the GPUs held by the affinity groups, nil if disabled
+	ledger *internal.Ledger
+	// audit log of the calls changing the scheduling state, nil if disabled
+	auditLog *internal.AuditLog
+	// source of the random decisions, seeded by a seed recorded in the audit log
+	random *rand.Rand
+	// physical cells cordoned for maintenance (cordon name -> cordon)
+	cellCordons map[string]*cellCordon
+	// preassigned and reserved cells with time windows (sorted by VC and name)
+	timeWindowCells []*timeWindowCell
+	// allocated pods found inconsistent when added (pod UID -> pod), quarantined in degraded mode
+	inconsistentPods map[types.UID]*api.RecoveredPod
+	// whether the inconsistent allocated pods are quarantined, i.e., tracked but not accounted (degraded mode)
+	degradedModeEnable bool
+	// current time used to check the time windows
+	now func() time.Time
 	// lock
 	algorithmLock sync.RWMutex
 }
 
 // NewHivedAlgorithm initializes a HivedAlgorithm from the config file
 func NewHivedAlgorithm(sConfig *api.Config) *HivedAlgorithm {
+	return newHivedAlgorithm(sConfig, time.Now, rand.Int63())
+}
+
+// newHivedAlgorithm initializes a HivedAlgorithm with the clock and the seed of the random decisions,
+// which are the recorded ones when replaying an audit log.
+func newHivedAlgorithm(sConfig *api.Config, now func() time.Time, seed int64) *HivedAlgorithm {
 	pcl, gpuNums, gpuTypeToChain, cellLevelToType, nonReservedVcl, reservedVcl, reservedPc := ParseConfig(sConfig)
 	h := &HivedAlgorithm{
-		vcSchedulers:            make(map[api.VirtualClusterName]intraVCScheduler),
-		opportunisticSchedulers: map[CellChain]*topologyAwareScheduler{},
-		fullCellList:            pcl,
-		freeCellList:            make(map[CellChain]ChainCellList),
-		chains:                  gpuTypeToChain,
-		cellTypes:               cellLevelToType,
-		allocatedAffinityGroups: make(map[string]*AlgoAffinityGroup),
-		reservedCells:           reservedPc,
+		vcSchedulers:             make(map[api.VirtualClusterName]intraVCScheduler),
+		opportunisticSchedulers:  map[CellChain]*topologyAwareScheduler{},
+		fullCellList:             pcl,
+		freeCellList:             make(map[CellChain]ChainCellList),
+		chains:                   gpuTypeToChain,
+		cellTypes:                cellLevelToType,
+		cellTypeSpecs:            sConfig.PhysicalCluster.CellTypes,
+		allocatedAffinityGroups:  make(map[string]*AlgoAffinityGroup),
+		reservedCells:            reservedPc,
+		costModel:                newPreemptionCostModel(sConfig.PreemptionCostWeights),
+		preemptingAffinityGroups: map[string]*api.PreemptionStatus{},
+		vcResourceQuotas:         parseVcResourceQuotas(*sConfig.VirtualClusters),
+		vcResourceUsages:         map[api.VirtualClusterName]core.ResourceList{},
+		userQuotas:               parseUserQuotas(*sConfig.VirtualClusters),
+		vcParents:                map[api.VirtualClusterName]api.VirtualClusterName{},
+		cellCordons:              map[string]*cellCordon{},
+		inconsistentPods:         map[types.UID]*api.RecoveredPod{},
+		degradedModeEnable:       *sConfig.RecoveryDegradedModeEnable,
+		random:                   rand.New(rand.NewSource(seed)),
+		now:                      now,
+	}
+	// the runtime cost of the victims is calculated at the current time of the algorithm
+	h.costModel.now = func() time.Time { return h.now() }
+	if *sConfig.AuditLogFilePath != "" {
+		h.auditLog = internal.NewAuditLog(
+			*sConfig.AuditLogFilePath, *sConfig.AuditLogMaxFileBytes, *sConfig.AuditLogMaxBackups)
+		h.auditLog.Append(internal.NewAuditRecord(h.now(), internal.AuditInit, seed, getConfigHash(sConfig)))
 	}
 	for vc := range nonReservedVcl {
 		// TODO: Support per-VC configurable intra VC scheduling algo.
-		h.vcSchedulers[vc] = newDefaultIntraVCScheduler(nonReservedVcl[vc], reservedVcl[vc], gpuNums)
+		h.vcSchedulers[vc] = newDefaultIntraVCScheduler(nonReservedVcl[vc], reservedVcl[vc], gpuNums, h.costModel)
+	}
+	if *sConfig.LedgerFilePath != "" {
+		h.ledger = internal.NewLedger(*sConfig.LedgerFilePath, *sConfig.LedgerMaxFileBytes, *sConfig.LedgerMaxBackups)
+	}
+	for vc, spec := range *sConfig.VirtualClusters {
+		if spec.Parent != "" {
+			h.vcParents[vc] = spec.Parent
+		}
 	}
 	for chain, ccl := range h.fullCellList {
-		h.opportunisticSchedulers[chain] = NewTopologyAwareScheduler(ccl, gpuNums[chain], false, true)
+		h.opportunisticSchedulers[chain] = NewTopologyAwareScheduler(ccl, gpuNums[chain], false, true, h.costModel)
 	}
+	h.initTimeWindows()
 	h.validateInitialAssignment()
 	h.initFreeCellList()
 	h.initReservations()
+	h.updateTimeWindows()
 	return h
 }
 
@@ -98,12 +167,27 @@ func (h *HivedAlgorithm) DeleteNode(node *core.Node) {
 	// TODO
 }
 
-func (h *HivedAlgorithm) Schedule(pod *core.Pod, suggestedNodes []string) internal.PodScheduleResult {
+func (h *HivedAlgorithm) Schedule(pod *core.Pod, suggestedNodes []string) (result internal.PodScheduleResult) {
 	h.algorithmLock.Lock()
 	defer h.algorithmLock.Unlock()
+	defer h.audit(internal.AuditSchedule, &result, pod, suggestedNodes)()
 
 	klog.Infof("[%v]: Scheduling pod...", internal.Key(pod))
 	s := internal.ExtractPodSchedulingSpec(pod)
+	// the preemption cost takes effect once the pod is allocated
+	internal.ValidatePodPreemptionCost(pod)
+	// a pod of an allocated group is allocated at the priority of the group
+	priority := CellPriority(s.Priority)
+	if g := h.allocatedAffinityGroups[s.AffinityGroup.Name]; g != nil {
+		priority = g.priority
+	}
+	if s.GpuNumber == 0 && priority >= minGuaranteedPriority {
+		if r := h.getExceededVcResource(s.VirtualCluster, internal.GetPodResourceRequests(pod)); r != "" {
+			delete(h.preemptingAffinityGroups, s.AffinityGroup.Name)
+			return internal.PodScheduleResult{PodWaitInfo: &internal.PodWaitInfo{
+				Reason: fmt.Sprintf("insufficient %v quota in VC %v", r, s.VirtualCluster)}}
+		}
+	}
 	// gpu number -> a set of pods -> a set of GPUs of each pod
 	groupPhysicalPlacement := map[int32][]CellList{}
 	groupVirtualPlacement := map[int32][]CellList{}
@@ -114,17 +198,33 @@ func (h *HivedAlgorithm) Schedule(pod *core.Pod, suggestedNodes []string) intern
 	}
 
 	group := h.allocatedAffinityGroups[s.AffinityGroup.Name]
+	downgraded := false
+	var lender api.VirtualClusterName
 	if group == nil {
+		if r := h.getExceededUserQuota(s.VirtualCluster, h.getQuotaUser(s.VirtualCluster, pod),
+			CellPriority(s.Priority), getRequestedGpuNum(s), nil); r != "" {
+			if s.ReservationId != "" || !h.userQuotas[s.VirtualCluster].DowngradeToOpportunistic {
+				delete(h.preemptingAffinityGroups, s.AffinityGroup.Name)
+				return internal.PodScheduleResult{PodWaitInfo: &internal.PodWaitInfo{Reason: r}}
+			}
+			klog.Infof("[%v]: Downgrading affinity group %v to opportunistic: %v",
+				internal.Key(pod), s.AffinityGroup.Name, r)
+			s.Priority = api.OpportunisticPriority
+			downgraded = true
+		}
 		klog.Infof("[%v]: Scheduling new affinity group %v", internal.Key(pod), s.AffinityGroup.Name)
-		groupPhysicalPlacement, groupVirtualPlacement = h.scheduleNewAffinityGroup(pod, s, suggestedNodeSet)
+		groupPhysicalPlacement, groupVirtualPlacement, lender = h.scheduleNewAffinityGroup(pod, s, suggestedNodeSet)
+		podIndex = getMemberPodIndices(s.AffinityGroup.Members, s.GpuNumber, s.GpuTypes)[0]
 	} else {
 		klog.Infof("[%v]: Pod from existing affinity group: %v", internal.Key(pod), s.AffinityGroup.Name)
 		groupPhysicalPlacement = group.physicalGpuPlacement
 		groupVirtualPlacement = group.virtualGpuPlacement
+		downgraded = group.priority < minGuaranteedPriority && CellPriority(s.Priority) >= minGuaranteedPriority
+		lender = group.lender
 		podIndex = -1
-		for i, p := range group.allocatedPods[s.GpuNumber] {
-			if p == nil {
-				podIndex = int32(i)
+		for _, i := range getMemberPodIndices(s.AffinityGroup.Members, s.GpuNumber, s.GpuTypes) {
+			if i < int32(len(group.allocatedPods[s.GpuNumber])) && group.allocatedPods[s.GpuNumber][i] == nil {
+				podIndex = i
 				break
 			}
 		}
@@ -134,32 +234,104 @@ func (h *HivedAlgorithm) Schedule(pod *core.Pod, suggestedNodes []string) intern
 				s.GpuNumber, group.totalPodNums[s.GpuNumber], s.AffinityGroup.Name)))
 		}
 	}
-	return generatePodScheduleResult(
+	priority = CellPriority(s.Priority)
+	if group != nil {
+		// the group may have been upgraded from opportunistic
+		priority = group.priority
+	}
+	var vcNodes []string
+	if s.GpuNumber == 0 {
+		vcNodes = h.getVcNodes(s.VirtualCluster, s.ReservationId)
+	}
+	result, preemptionStatus := generatePodScheduleResult(
 		groupPhysicalPlacement,
 		groupVirtualPlacement,
-		CellPriority(s.Priority),
+		priority,
 		h.cellTypes,
+		h.cellTypeSpecs,
 		s.GpuNumber,
 		podIndex,
 		group,
 		s.AffinityGroup.Name,
 		suggestedNodeSet,
 		s.VirtualCluster,
+		vcNodes,
+		h.costModel,
+		h.random,
 		pod)
+	if result.PodBindInfo != nil {
+		leafSpec := h.cellTypeSpecs[h.cellTypes[CellChain(result.PodBindInfo.CellChain)][lowestLevel]]
+		result.PodBindInfo.DeviceIsolationAnnotation = leafSpec.DeviceIsolationAnnotation
+		result.PodBindInfo.Downgraded = downgraded
+		result.PodBindInfo.LenderVirtualCluster = lender
+		if group != nil && !downgraded && group.priority != CellPriority(s.Priority) {
+			// the group was upgraded or re-prioritized at runtime
+			result.PodBindInfo.AffinityGroupPriority = common.PtrInt32(int32(group.priority))
+		}
+	}
+	if preemptionStatus != nil {
+		preemptionStatus.PreemptionTime = meta.NewTime(h.now())
+	}
+	if group != nil {
+		if preemptionStatus != nil {
+			group.preemptionStatus = preemptionStatus
+		}
+	} else if preemptionStatus != nil {
+		h.preemptingAffinityGroups[s.AffinityGroup.Name] = preemptionStatus
+	} else {
+		delete(h.preemptingAffinityGroups, s.AffinityGroup.Name)
+	}
+	return result
 }
 
 func (h *HivedAlgorithm) AddAllocatedPod(pod *core.Pod) {
 	h.algorithmLock.Lock()
 	defer h.algorithmLock.Unlock()
+	defer h.audit(internal.AuditAddAllocatedPod, nil, pod)()
 
 	klog.Infof("[%v]: adding allocated pod...", internal.Key(pod))
 	s := internal.ExtractPodSchedulingSpec(pod)
 	info := internal.ExtractPodBindInfo(pod)
+	preemptionCost := internal.ExtractPodPreemptionCost(pod)
 	klog.Infof("[%v]: adding to node %v, GPUs %v", internal.Key(pod), info.Node, info.GpuIsolation)
+	if info.Downgraded {
+		s.Priority = api.OpportunisticPriority
+	}
+	if info.AffinityGroupPriority != nil {
+		s.Priority = *info.AffinityGroupPriority
+	}
+	if h.allocatedAffinityGroups[s.AffinityGroup.Name] == nil {
+		h.rebindTimeWindowReservation(s, info)
+	}
+	if h.checkAllocatedPod(pod, s, info) {
+		return
+	}
+	// the GPUs reallocated to the pod in an allocated group, which are released if adding the pod fails
+	var reallocatedGpus []*PhysicalCell
+	if h.degradedModeEnable {
+		defer h.quarantineFailedPod(
+			pod, s, info, h.allocatedAffinityGroups[s.AffinityGroup.Name] == nil, &reallocatedGpus)
+	}
 
 	podIndex := int32(0)
+	reallocated := false
 	if group := h.allocatedAffinityGroups[s.AffinityGroup.Name]; group == nil {
 		h.createAllocatedAffinityGroup(pod, s, info)
+		// the first pod is not the first in its placements if the members with its GPU number use other GPU types
+		for _, gms := range info.AffinityGroupBindInfo {
+			if gpuNumber := int32(len(gms.PodPlacements[0].PhysicalGpuIndices)); gpuNumber == s.GpuNumber && gpuNumber > 0 {
+				if i := getPodIndex(gms.PodPlacements, info.Node, info.GpuIsolation[0]); i != -1 {
+					podIndex = i
+				}
+			}
+		}
+	} else if s.GpuNumber == 0 {
+		// a pod requesting zero GPU has no placement in the group, so it just takes a free slot
+		if podIndex = getZeroGpuPodIndex(group, nil); podIndex == -1 {
+			klog.Errorf("[%v]: no free slot for pod requesting zero GPU in group %v",
+				internal.Key(pod), s.AffinityGroup.Name)
+			return
+		}
 	} else {
 		for _, gms := range info.AffinityGroupBindInfo {
 			if gpuNumber := int32(len(gms.PodPlacements[0].PhysicalGpuIndices)); gpuNumber == s.GpuNumber {
@@ -177,45 +349,79 @@ func (h *HivedAlgorithm) AddAllocatedPod(pod *core.Pod) {
 						gpuIndex,
 						gms.PodPlacements[podIndex].PhysicalGpuIndices,
 						gms.PodPlacements[podIndex].PreassignedCellTypes,
-						CellChain(info.CellChain), info.Node, false, s, group, pod)
+						getPodCellChain(info, gms, gms.PodPlacements[podIndex]), info.Node, false, s, group, pod)
 					if pGpu == nil {
 						break
 					} else if pGpu.GetAffinityGroup() == nil {
 						if vGpu != nil && vGpu.GetPhysicalCell() != nil {
-							groupToPreempt := vGpu.GetPhysicalCell().GetAffinityGroup()
-							h.lazyPreemptAffinityGroup(groupToPreempt, group.name)
+							if groupToPreempt := vGpu.GetPhysicalCell().GetAffinityGroup(); groupToPreempt != nil {
+								h.lazyPreemptAffinityGroup(groupToPreempt, group.name)
+							}
 						}
-						h.confirmAllocatedGpu(pGpu, vGpu, CellPriority(s.Priority), group)
+						h.confirmAllocatedGpu(pGpu, vGpu, group.priority, group)
+						reallocatedGpus = append(reallocatedGpus, pGpu)
+						reallocated = true
 					}
 				}
+				break
 			}
-			break
+		}
+		if reallocated {
+			h.recordLedger(group, api.LedgerAllocate)
 		}
 	}
-	h.allocatedAffinityGroups[s.AffinityGroup.Name].allocatedPods[s.GpuNumber][podIndex] = pod
+	group := h.allocatedAffinityGroups[s.AffinityGroup.Name]
+	group.allocatedPods[s.GpuNumber][podIndex] = pod
+	group.updatePodInfo(pod, preemptionCost)
+	if s.GpuNumber == 0 {
+		h.countVcResourceUsage(group, podIndex, pod)
+	}
 }
 
 func (h *HivedAlgorithm) DeleteAllocatedPod(pod *core.Pod) {
 	h.algorithmLock.Lock()
 	defer h.algorithmLock.Unlock()
+	defer h.audit(internal.AuditDeleteAllocatedPod, nil, pod)()
 
 	klog.Infof("[%v]: deleting allocated pod...", internal.Key(pod))
+	if p := h.inconsistentPods[pod.UID]; p != nil {
+		delete(h.inconsistentPods, pod.UID)
+		if p.Quarantined {
+			klog.Infof("[%v]: quarantined pod deleted", internal.Key(pod))
+			return
+		}
+	}
 	s := internal.ExtractPodSchedulingSpec(pod)
 	info := internal.ExtractPodBindInfo(pod)
 	klog.Infof("[%v]: deleting from node %v, GPUs %v", internal.Key(pod), info.Node, info.GpuIsolation)
+	delete(h.preemptingAffinityGroups, s.AffinityGroup.Name)
+	if info.Downgraded {
+		s.Priority = api.OpportunisticPriority
+	}
+	if info.AffinityGroupPriority != nil {
+		s.Priority = *info.AffinityGroupPriority
+	}
 
 	if group := h.allocatedAffinityGroups[s.AffinityGroup.Name]; group == nil {
 		klog.Errorf("[%v]: group %v not found when deleting pod", internal.Key(pod), s.AffinityGroup.Name)
 		return
 	} else {
 		var podIndex int32
-		for _, gms := range info.AffinityGroupBindInfo {
-			if gpuNumber := int32(len(gms.PodPlacements[0].PhysicalGpuIndices)); gpuNumber == s.GpuNumber {
-				podIndex = getPodIndex(gms.PodPlacements, info.Node, info.GpuIsolation[0])
-				if podIndex == -1 {
-					klog.Errorf("[%v]: pod placement not found in group %v: node %v, GPUs %v",
-						internal.Key(pod), s.AffinityGroup.Name, info.Node, info.GpuIsolation)
-					return
+		if s.GpuNumber == 0 {
+			if podIndex = getZeroGpuPodIndex(group, pod); podIndex == -1 {
+				klog.Errorf("[%v]: pod requesting zero GPU not found in group %v", internal.Key(pod), s.AffinityGroup.Name)
+				return
+			}
+			h.uncountVcResourceUsage(group, podIndex)
+		} else {
+			for _, gms := range info.AffinityGroupBindInfo {
+				if gpuNumber := int32(len(gms.PodPlacements[0].PhysicalGpuIndices)); gpuNumber == s.GpuNumber {
+					podIndex = getPodIndex(gms.PodPlacements, info.Node, info.GpuIsolation[0])
+					if podIndex == -1 {
+						klog.Errorf("[%v]: pod placement not found in group %v: node %v, GPUs %v",
+							internal.Key(pod), s.AffinityGroup.Name, info.Node, info.GpuIsolation)
+						return
+					}
 				}
 			}
 		}
@@ -244,10 +450,49 @@ func (h *HivedAlgorithm) DeleteAllocatedPod(pod *core.Pod) {
 					}
 				}
 			}
+			h.recordLedger(group, api.LedgerRelease)
 			delete(h.allocatedAffinityGroups, s.AffinityGroup.Name)
 			klog.Infof("[%v]: All pods complete, affinity group deleted: %v", internal.Key(pod), s.AffinityGroup.Name)
+		} else if !group.gangReleaseEnable {
+			h.recordLedger(group, api.LedgerAllocate)
 		}
 	}
+	h.promoteAffinityGroups()
+}
+
+func (h *HivedAlgorithm) DeleteUnallocatedPod(pod *core.Pod) {
+	h.algorithmLock.Lock()
+	defer h.algorithmLock.Unlock()
+	defer h.audit(internal.AuditDeleteUnallocatedPod, nil, pod)()
+
+	s := internal.ExtractPodSchedulingSpec(pod)
+	if ps := h.preemptingAffinityGroups[s.AffinityGroup.Name]; ps != nil {
+		klog.Infof("[%v]: preempting pod deleted, canceling the preemption of affinity group %v",
+			internal.Key(pod), s.AffinityGroup.Name)
+		delete(h.preemptingAffinityGroups, s.AffinityGroup.Name)
+	}
+}
+
+// expirePreemptingAffinityGroups stops tracking the preempting affinity groups whose preemption
+// is not retried within the timeout.
+func (h *HivedAlgorithm) expirePreemptingAffinityGroups() {
+	for name, ps := range h.preemptingAffinityGroups {
+		if h.now().Sub(ps.PreemptionTime.Time) > preemptingAffinityGroupTimeout {
+			klog.Infof("Preemption of affinity group %v expired: victims %v", name, ps.Victims)
+			delete(h.preemptingAffinityGroups, name)
+		}
+	}
+}
+
+func (h *HivedAlgorithm) Reconcile() {
+	h.algorithmLock.Lock()
+	defer h.algorithmLock.Unlock()
+	defer h.audit(internal.AuditReconcile, nil)()
+
+	h.updateTimeWindows()
+	h.expirePreemptingAffinityGroups()
+	h.promoteAffinityGroups()
+	h.drainCordonedCells()
 }
 
 func (h *HivedAlgorithm) GetAffinityGroups() api.AffinityGroupList {
@@ -269,12 +514,99 @@ func (h *HivedAlgorithm) GetAffinityGroup(name string) api.AffinityGroup {
 	if aag := h.allocatedAffinityGroups[name]; aag != nil {
 		return aag.ToAffinityGroup()
 	}
+	if ps := h.preemptingAffinityGroups[name]; ps != nil {
+		ag := api.AffinityGroup{}
+		ag.Name = name
+		ag.Status.PreemptionStatus = ps
+		return ag
+	}
 
 	panic(internal.NewBadRequestError(fmt.Sprintf(
 		"Affinity group %v does not exist since it is not allocated",
 		name)))
 }
 
+func (h *HivedAlgorithm) UpdateAffinityGroupPriority(name string, priority int32) (result api.AffinityGroup) {
+	h.algorithmLock.Lock()
+	defer h.algorithmLock.Unlock()
+	defer h.audit(internal.AuditUpdateAffinityGroupPriority, &result, name, priority)()
+
+	g := h.allocatedAffinityGroups[name]
+	if g == nil {
+		panic(internal.NewBadRequestError(fmt.Sprintf(
+			"Affinity group %v does not exist since it is not allocated",
+			name)))
+	}
+	p := CellPriority(priority)
+	if p < minGuaranteedPriority || p > maxGuaranteedPriority {
+		panic(internal.NewBadRequestError(fmt.Sprintf(
+			"Priority %v is out of the guaranteed range [%v, %v]",
+			priority, minGuaranteedPriority, maxGuaranteedPriority)))
+	}
+	if g.priority < minGuaranteedPriority {
+		panic(internal.NewBadRequestError(fmt.Sprintf(
+			"Affinity group %v is opportunistic, its priority cannot be updated",
+			name)))
+	}
+	if h.vcSchedulers[g.vc] == nil {
+		panic(internal.NewBadRequestError(fmt.Sprintf(
+			"Affinity group %v is in VC %v which does not exist",
+			name, g.vc)))
+	}
+	if g.virtualGpuPlacement != nil {
+		// the group keeps using its VC quota, so the quota of its user at the new priority is checked
+		if r := h.getExceededUserQuota(g.vc, g.user, p, g.getTotalGpuNum(), g); r != "" {
+			panic(internal.NewBadRequestError(fmt.Sprintf(
+				"Priority of affinity group %v cannot be updated to %v: %v", name, priority, r)))
+		}
+	}
+
+	klog.Infof("Updating priority of affinity group %v from %v to %v", name, g.priority, p)
+	if g.virtualGpuPlacement != nil {
+		// a lazy preempted group has no cells in its VC, so only its own priority is updated
+		for gpuNum, podPlacements := range g.physicalGpuPlacement {
+			for podIndex, podPlacement := range podPlacements {
+				for gpuIndex, gpu := range podPlacement {
+					if gpu == nil || gpu.(*PhysicalCell).GetAffinityGroup() != g {
+						// not allocated or already released
+						continue
+					}
+					for _, c := range []Cell{gpu, g.virtualGpuPlacement[gpuNum][podIndex][gpuIndex]} {
+						updateUsedGpuNumAtPriority(c, c.GetPriority(), false)
+						setPriority(c, p)
+						updateUsedGpuNumAtPriority(c, p, true)
+					}
+				}
+			}
+		}
+	}
+	g.priority = p
+	g.bindInfoChanged = true
+	return g.ToAffinityGroup()
+}
+
+// ValidatePod checks the scheduling spec of a pod to be created against the current scheduling view,
+// so that a pod which can never be scheduled is rejected at its creation.
+func (h *HivedAlgorithm) ValidatePod(pod *core.Pod) {
+	h.algorithmLock.RLock()
+	defer h.algorithmLock.RUnlock()
+
+	s := internal.ExtractPodSchedulingSpec(pod)
+	internal.ValidatePodPreemptionCost(pod)
+	sr, typedMembers := newSchedulingRequest(s)
+	h.validateSchedulingRequest(sr, pod)
+	message := h.validateGpuTypes(sr, s.GpuTypes, typedMembers)
+	if g := h.allocatedAffinityGroups[s.AffinityGroup.Name]; g != nil && message == "" {
+		message = validateAffinityGroupMember(g, sr)
+	}
+	if r := internal.GetRequestedDeviceResources(pod, h.cellTypeSpecs); message == "" && len(r) != 0 {
+		message = fmt.Sprintf("devices %v are allocated by the scheduler and cannot be requested by the pod", r)
+	}
+	if message != "" {
+		panic(internal.NewBadRequestError(fmt.Sprintf("[%v]: %v", internal.Key(pod), message)))
+	}
+}
+
 // validateInitialAssignment makes sure that the initial cell assignments
 // to all VCs can be fit into the configured physical cells.
 func (h *HivedAlgorithm) validateInitialAssignment() {
@@ -285,7 +617,12 @@ func (h *HivedAlgorithm) validateInitialAssignment() {
 				totalQuota[chain] = map[CellLevel]int32{}
 			}
 			l := CellLevel(len(ccl))
-			totalQuota[chain][l] += int32(len(ccl[l]))
+			for _, c := range ccl[l] {
+				// the cells with time windows are added to the VCs only if there are free cells
+				if c.(*VirtualCell).GetTimeWindows() == nil {
+					totalQuota[chain][l]++
+				}
+			}
 		}
 		for _, reserved := range h.reservedCells[vc] {
 			reservedChain := reserved.GetChain()
@@ -327,106 +664,295 @@ func (h *HivedAlgorithm) initFreeCellList() {
 	}
 }
 
-// initReservations creates static bindings for the reserved cells, and removes the
-// reserved physical cells from the free cell list.
-func (h *HivedAlgorithm) initReservations() {
-	for vc, vcReservation := range h.reservedCells {
-		for rid, physical := range vcReservation {
-			h.removeCellFromFreeList(physical)
-			virtualList := h.vcSchedulers[vc].getReservedCellList()[rid]
-			virtual := virtualList[CellLevel(len(virtualList))][0].(*VirtualCell)
-			virtual.SetPhysicalCell(physical)
-			physical.SetVirtualCell(virtual)
-			klog.Infof("Cells bound: %v and %v (reservation)", virtual.GetName(), physical.GetName())
-		}
-	}
-}
-
 // scheduleNewAffinityGroup schedules each pod of a new affinity group to a set of GPUs
-// (in both the physical cluster and the VC).
+// (in both the physical cluster and the VC). It also returns the sibling VC whose idle
+// quota is borrowed by the group, if any.
 func (h *HivedAlgorithm) scheduleNewAffinityGroup(
 	pod *core.Pod,
 	s *api.PodSchedulingSpec,
-	suggestedNodeSet common.Set) (map[int32][]CellList, map[int32][]CellList) {
+	suggestedNodeSet common.Set) (map[int32][]CellList, map[int32][]CellList, api.VirtualClusterName) {
 
 	var (
 		physicalPlacement map[int32][]CellList
 		virtualPlacement  map[int32][]CellList
-		priority          CellPriority
+		lender            api.VirtualClusterName
 	)
 
-	priority = CellPriority(s.Priority)
+	sr, typedMembers := newSchedulingRequest(s)
+	// members requesting zero GPU are not scheduled to any cell
+	zeroGpuPodNum := sr.affinityGroupPodNums[0]
+	delete(sr.affinityGroupPodNums, 0)
+	h.validateSchedulingRequest(sr, pod)
+	if len(sr.affinityGroupPodNums) == 0 {
+		physicalPlacement = map[int32][]CellList{}
+		if sr.priority >= minGuaranteedPriority {
+			virtualPlacement = map[int32][]CellList{}
+		}
+	} else if sr.reservationId != "" {
+		klog.Infof("Use reservation %v", s.ReservationId)
+		if reserved := h.reservedCells[sr.vc][sr.reservationId]; reserved == nil {
+			klog.Infof("Reservation %v is out of VC %v since its time windows are closed", sr.reservationId, sr.vc)
+		} else {
+			sr.chain = reserved.GetChain()
+			physicalPlacement, virtualPlacement = h.processSchedulingRequest(sr, suggestedNodeSet)
+		}
+	} else {
+		physicalPlacement, virtualPlacement = h.scheduleAffinityGroupInVc(
+			sr, typedMembers, pod, s, suggestedNodeSet)
+		if physicalPlacement == nil && sr.priority >= minGuaranteedPriority {
+			physicalPlacement, virtualPlacement, lender = h.scheduleAffinityGroupWithLentCells(
+				sr, typedMembers, pod, s, suggestedNodeSet)
+		}
+	}
+	if physicalPlacement != nil && zeroGpuPodNum > 0 {
+		physicalPlacement[0] = make([]CellList, zeroGpuPodNum)
+		if virtualPlacement != nil {
+			virtualPlacement[0] = make([]CellList, zeroGpuPodNum)
+		}
+	}
+	if physicalPlacement != nil {
+		klog.Infof("Succeeded in scheduling group %v", s.AffinityGroup.Name)
+	} else {
+		klog.Infof("Failed to schedule group %v", s.AffinityGroup.Name)
+	}
+	return physicalPlacement, virtualPlacement, lender
+}
+
+// scheduleAffinityGroupInVc schedules a new affinity group (not using a reservation) in the VC of the request.
+func (h *HivedAlgorithm) scheduleAffinityGroupInVc(
+	sr schedulingRequest,
+	typedMembers []api.AffinityGroupMemberSpec,
+	pod *core.Pod,
+	s *api.PodSchedulingSpec,
+	suggestedNodeSet common.Set) (map[int32][]CellList, map[int32][]CellList) {
+
+	if len(typedMembers) != 0 {
+		return h.scheduleHeterogeneousAffinityGroup(sr, typedMembers, pod, suggestedNodeSet)
+	}
+	return h.scheduleAffinityGroupForGpuTypes(sr, getAcceptableGpuTypes(s, pod, h.now()), pod, suggestedNodeSet)
+}
+
+// newSchedulingRequest creates the scheduling request of a new affinity group, and returns
+// the members if they specify their GPU types (nil otherwise).
+func newSchedulingRequest(s *api.PodSchedulingSpec) (schedulingRequest, []api.AffinityGroupMemberSpec) {
 	sr := schedulingRequest{
 		vc:                   s.VirtualCluster,
 		reservationId:        s.ReservationId,
-		priority:             priority,
+		priority:             CellPriority(s.Priority),
 		affinityGroupName:    s.AffinityGroup.Name,
 		affinityGroupPodNums: map[int32]int32{},
+		maxCellType:          s.AffinityGroup.MaxCellType,
+		maxCellLevel:         CellLevel(s.AffinityGroup.MaxCellLevel),
+		antiAffinity:         s.AffinityGroup.AntiAffinity,
 	}
 	for _, m := range s.AffinityGroup.Members {
 		// we will merge group members with same GPU number
 		sr.affinityGroupPodNums[m.GpuNumber] += m.PodNumber
 	}
-	h.validateSchedulingRequest(sr, pod)
-	if sr.reservationId != "" {
-		klog.Infof("Use reservation %v", s.ReservationId)
-		sr.chain = h.reservedCells[sr.vc][sr.reservationId].GetChain()
-		physicalPlacement, virtualPlacement = h.processSchedulingRequest(sr, suggestedNodeSet)
-	} else {
-		physicalPlacement, virtualPlacement = h.scheduleAffinityGroupForGpuType(sr, s.GpuType, pod, suggestedNodeSet)
+	if s.AffinityGroup.Members[0].GpuType != "" {
+		return sr, s.AffinityGroup.Members
 	}
-	if physicalPlacement != nil {
-		klog.Infof("Succeeded in scheduling group %v", s.AffinityGroup.Name)
-	} else {
-		klog.Infof("Failed to schedule group %v", s.AffinityGroup.Name)
+	return sr, nil
+}
+
+// getMemberPodIndices returns the indices of the pods (in the placements of the GPU number) of the members
+// which a pod with the GPU number and GPU types can belong to. The pods of the members with the same
+// GPU number are placed in the order of the members.
+func getMemberPodIndices(members []api.AffinityGroupMemberSpec, gpuNum int32, gpuTypes []string) []int32 {
+	var podIndices []int32
+	podIndex := int32(0)
+	for _, m := range members {
+		if m.GpuNumber != gpuNum {
+			continue
+		}
+		matched := m.GpuType == "" || len(gpuTypes) == 0 || common.StringsContains(gpuTypes, m.GpuType)
+		for i := int32(0); i < m.PodNumber; i++ {
+			if matched {
+				podIndices = append(podIndices, podIndex)
+			}
+			podIndex++
+		}
 	}
-	return physicalPlacement, virtualPlacement
+	return podIndices
 }
 
-// scheduleAffinityGroupForGpuType schedules an affinity group in a certain cell chain.
-// If a GPU type is specified, it will be scheduled to a chain that contains this GPU type.
-// Otherwise any GPU type will be tried.
-func (h *HivedAlgorithm) scheduleAffinityGroupForGpuType(
+// scheduleAffinityGroupForGpuTypes schedules an affinity group in a certain cell chain.
+// If GPU types are specified, they are tried in order, and the group will be scheduled to a chain
+// that contains one of these GPU types. Otherwise any GPU type will be tried (in the order of names).
+// All the pods of the group are placed within the suggested nodes.
+func (h *HivedAlgorithm) scheduleAffinityGroupForGpuTypes(
 	sr schedulingRequest,
-	gpuType string,
+	gpuTypes []string,
 	pod *core.Pod,
 	suggestedNodeSet common.Set) (map[int32][]CellList, map[int32][]CellList) {
 
-	if gpuType != "" {
-		if chains := h.chains[gpuType]; chains == nil {
-			panic(internal.NewBadRequestError(fmt.Sprintf(
-				"[%v]: pod requesting GPU type %v which the whole cluster does not have",
-				internal.Key(pod), gpuType)))
-		} else {
-			vcHasType := false
-			for _, chain := range chains {
+	var chains []CellChain
+	vcHasType := false
+	if len(gpuTypes) != 0 {
+		for _, gpuType := range gpuTypes {
+			if h.chains[gpuType] == nil {
+				panic(internal.NewBadRequestError(fmt.Sprintf(
+					"[%v]: pod requesting GPU type %v which the whole cluster does not have",
+					internal.Key(pod), gpuType)))
+			}
+			for _, chain := range h.chains[gpuType] {
 				if h.vcSchedulers[sr.vc].getNonReservedCellList()[chain] != nil {
 					vcHasType = true
 				}
-				sr.chain = chain
-				if physicalPlacement, virtualPlacement := h.processSchedulingRequest(sr, suggestedNodeSet); physicalPlacement != nil {
-					return physicalPlacement, virtualPlacement
-				}
-			}
-			if sr.priority >= minGuaranteedPriority && !vcHasType {
-				panic(internal.NewBadRequestError(fmt.Sprintf(
-					"[%v]: pod requesting GPU type %v which VC %v does not have",
-					internal.Key(pod), gpuType, sr.vc)))
+				chains = append(chains, chain)
 			}
 		}
 	} else {
-		for _, chains := range h.chains {
-			for _, chain := range chains {
-				sr.chain = chain
-				if physicalPlacement, virtualPlacement := h.processSchedulingRequest(sr, suggestedNodeSet); physicalPlacement != nil {
-					return physicalPlacement, virtualPlacement
-				}
-			}
+		var allGpuTypes []string
+		for gpuType := range h.chains {
+			allGpuTypes = append(allGpuTypes, gpuType)
+		}
+		sort.Strings(allGpuTypes)
+		for _, gpuType := range allGpuTypes {
+			chains = append(chains, h.chains[gpuType]...)
 		}
 	}
+	for _, chain := range chains {
+		sr.chain = chain
+		if physicalPlacement, virtualPlacement := h.processSchedulingRequest(sr, suggestedNodeSet); physicalPlacement != nil {
+			return physicalPlacement, virtualPlacement
+		}
+	}
+	if len(gpuTypes) != 0 && sr.priority >= minGuaranteedPriority && !vcHasType {
+		panic(internal.NewBadRequestError(fmt.Sprintf(
+			"[%v]: pod requesting GPU types %v which VC %v does not have",
+			internal.Key(pod), gpuTypes, sr.vc)))
+	}
 	return nil, nil
 }
 
+// scheduleHeterogeneousAffinityGroup schedules an affinity group whose members specify their own GPU types.
+// The members with the same GPU type are scheduled together to a chain of that type, and the placements
+// of the members with the same GPU number are merged in the order of the members. A guaranteed group is
+// scheduled in a dry run first, so that no group is lazy preempted unless all the members can be scheduled.
+func (h *HivedAlgorithm) scheduleHeterogeneousAffinityGroup(
+	sr schedulingRequest,
+	members []api.AffinityGroupMemberSpec,
+	pod *core.Pod,
+	suggestedNodeSet common.Set) (map[int32][]CellList, map[int32][]CellList) {
+
+	gpuTypeToPodNums := map[string]map[int32]int32{}
+	var gpuTypes []string
+	for _, m := range members {
+		// members requesting zero GPU are not scheduled to any cell
+		if m.GpuNumber == 0 {
+			continue
+		}
+		if gpuTypeToPodNums[m.GpuType] == nil {
+			gpuTypeToPodNums[m.GpuType] = map[int32]int32{}
+			gpuTypes = append(gpuTypes, m.GpuType)
+		}
+		gpuTypeToPodNums[m.GpuType][m.GpuNumber] += m.PodNumber
+	}
+	sort.Strings(gpuTypes)
+	schedule := func(gpuType string, dryRun bool) (map[int32][]CellList, map[int32][]CellList) {
+		typeSr := sr
+		typeSr.affinityGroupPodNums = gpuTypeToPodNums[gpuType]
+		typeSr.dryRun = dryRun
+		physicalPlacement, virtualPlacement := h.scheduleAffinityGroupForGpuTypes(
+			typeSr, []string{gpuType}, pod, suggestedNodeSet)
+		if physicalPlacement == nil {
+			klog.Infof("[%v]: cannot schedule members with GPU type %v in group %v",
+				internal.Key(pod), gpuType, sr.affinityGroupName)
+		}
+		return physicalPlacement, virtualPlacement
+	}
+	if sr.priority >= minGuaranteedPriority && !sr.dryRun {
+		for _, gpuType := range gpuTypes {
+			if physicalPlacement, _ := schedule(gpuType, true); physicalPlacement == nil {
+				return nil, nil
+			}
+		}
+	}
+	typePhysicalPlacements := map[string]map[int32][]CellList{}
+	typeVirtualPlacements := map[string]map[int32][]CellList{}
+	for _, gpuType := range gpuTypes {
+		physicalPlacement, virtualPlacement := schedule(gpuType, sr.dryRun)
+		if physicalPlacement == nil {
+			// the GPU types are in distinct chains, so this only happens if the lazy preemptions
+			// changed the mapping to the physical cluster, same as scheduleGuaranteedAffinityGroup
+			return nil, nil
+		}
+		typePhysicalPlacements[gpuType] = physicalPlacement
+		typeVirtualPlacements[gpuType] = virtualPlacement
+	}
+	physicalPlacement := mergeMemberPlacements(members, typePhysicalPlacements)
+	if sr.priority < minGuaranteedPriority {
+		return physicalPlacement, nil
+	}
+	return physicalPlacement, mergeMemberPlacements(members, typeVirtualPlacements)
+}
+
+// mergeMemberPlacements merges the placements of the members scheduled for each GPU type, so that the
+// pods of the members with the same GPU number are placed in the order of the members.
+func mergeMemberPlacements(
+	members []api.AffinityGroupMemberSpec,
+	typePlacements map[string]map[int32][]CellList) map[int32][]CellList {
+
+	placement := map[int32][]CellList{}
+	used := map[string]map[int32]int32{}
+	for _, m := range members {
+		if m.GpuNumber == 0 {
+			continue
+		}
+		if used[m.GpuType] == nil {
+			used[m.GpuType] = map[int32]int32{}
+		}
+		start := used[m.GpuType][m.GpuNumber]
+		placement[m.GpuNumber] = append(placement[m.GpuNumber],
+			typePlacements[m.GpuType][m.GpuNumber][start:start+m.PodNumber]...)
+		used[m.GpuType][m.GpuNumber] += m.PodNumber
+	}
+	return placement
+}
+
+// getAcceptableGpuTypes returns the GPU types which the pod can be scheduled to now. Only the most
+// preferred GPU type is acceptable before the pod has waited for GpuTypeFallbackWaitSec.
+func getAcceptableGpuTypes(s *api.PodSchedulingSpec, pod *core.Pod, now time.Time) []string {
+	if len(s.GpuTypes) <= 1 || s.GpuTypeFallbackWaitSec == 0 {
+		return s.GpuTypes
+	}
+	waitTime := time.Duration(s.GpuTypeFallbackWaitSec) * time.Second
+	if s.GpuTypeFallbackWaitSec == api.UnlimitedValue || now.Sub(pod.CreationTimestamp.Time) < waitTime {
+		klog.Infof("[%v]: waiting for the most preferred GPU type %v", internal.Key(pod), s.GpuTypes[0])
+		return s.GpuTypes[:1]
+	}
+	return s.GpuTypes
+}
+
+// getVcNodes returns the sorted nodes of the chains in a VC (or of the reservation if specified).
+func (h *HivedAlgorithm) getVcNodes(vc api.VirtualClusterName, rid api.ReservationId) []string {
+	var cells CellList
+	if rid != "" {
+		if c := h.reservedCells[vc][rid]; c != nil {
+			cells = append(cells, c)
+		}
+	} else if vcs := h.vcSchedulers[vc]; vcs != nil {
+		for chain := range vcs.getNonReservedCellList() {
+			ccl := h.fullCellList[chain]
+			cells = append(cells, ccl[CellLevel(len(ccl))]...)
+		}
+	}
+	nodeSet := common.NewSet()
+	for _, c := range cells {
+		nodes, _ := c.(*PhysicalCell).GetPhysicalPlacement()
+		for _, n := range nodes {
+			nodeSet.Add(n)
+		}
+	}
+	var vcNodes []string
+	for n := range nodeSet.Items() {
+		vcNodes = append(vcNodes, n.(string))
+	}
+	sort.Strings(vcNodes)
+	return vcNodes
+}
+
 // validateSchedulingRequest checks the existence of VC and reservation ID, and the legality of priority.
 func (h *HivedAlgorithm) validateSchedulingRequest(sr schedulingRequest, pod *core.Pod) {
 	var message string
@@ -439,17 +965,134 @@ func (h *HivedAlgorithm) validateSchedulingRequest(sr schedulingRequest, pod *co
 			message = fmt.Sprintf("opportunistic pod not supported to use reservation %v", sr.reservationId)
 		}
 	}
+	if message == "" {
+		message = h.validateTopologyConstraint(sr)
+	}
 	if message != "" {
 		panic(internal.NewBadRequestError(fmt.Sprintf("[%v]: %v", internal.Key(pod), message)))
 	}
 }
 
+// validateGpuTypes checks that the GPU types requested by a pod (or by its group members) exist in
+// the cluster, and that a guaranteed pod can use at least one of them (each of them for the members) in its VC.
+func (h *HivedAlgorithm) validateGpuTypes(
+	sr schedulingRequest,
+	gpuTypes []string,
+	typedMembers []api.AffinityGroupMemberSpec) string {
+
+	vcHasType := func(gpuType string) bool {
+		for _, chain := range h.chains[gpuType] {
+			if h.vcSchedulers[sr.vc].getNonReservedCellList()[chain] != nil {
+				return true
+			}
+		}
+		return false
+	}
+	guaranteed := sr.priority >= minGuaranteedPriority && sr.reservationId == ""
+	for _, gpuType := range gpuTypes {
+		if h.chains[gpuType] == nil {
+			return fmt.Sprintf("GPU type %v does not exist in the cluster", gpuType)
+		}
+	}
+	if guaranteed && len(gpuTypes) != 0 {
+		found := false
+		for _, gpuType := range gpuTypes {
+			found = found || vcHasType(gpuType)
+		}
+		if !found {
+			return fmt.Sprintf("VC %v does not have GPU types %v", sr.vc, gpuTypes)
+		}
+	}
+	for _, m := range typedMembers {
+		if h.chains[m.GpuType] == nil {
+			return fmt.Sprintf("GPU type %v does not exist in the cluster", m.GpuType)
+		}
+		if guaranteed && !vcHasType(m.GpuType) {
+			return fmt.Sprintf("VC %v does not have GPU type %v", sr.vc, m.GpuType)
+		}
+	}
+	return ""
+}
+
+// validateAffinityGroupMember checks that a new pod of an allocated affinity group has the same
+// VC, reservation and members as the other pods of the group.
+func validateAffinityGroupMember(g *AlgoAffinityGroup, sr schedulingRequest) string {
+	if sr.vc != g.vc {
+		return fmt.Sprintf("affinity group %v is in VC %v, not in VC %v", g.name, g.vc, sr.vc)
+	}
+	if sr.reservationId != g.reservationId {
+		return fmt.Sprintf("affinity group %v uses reservation %q, not %q", g.name, g.reservationId, sr.reservationId)
+	}
+	if !reflect.DeepEqual(sr.affinityGroupPodNums, g.totalPodNums) {
+		return fmt.Sprintf("affinity group %v has members %v (GPU number -> pod number), not %v",
+			g.name, g.totalPodNums, sr.affinityGroupPodNums)
+	}
+	return ""
+}
+
+// validateTopologyConstraint checks the existence of the cell types in the topology constraint of a request,
+// and that the anti-affinity is not lower than node level.
+func (h *HivedAlgorithm) validateTopologyConstraint(sr schedulingRequest) string {
+	maxCellTypeFound := sr.maxCellType == ""
+	antiAffinityFound := sr.antiAffinity == "" || sr.antiAffinity == api.AntiAffinityNode
+	for chain, levelToType := range h.cellTypes {
+		for l, cellType := range levelToType {
+			if cellType == sr.maxCellType {
+				maxCellTypeFound = true
+			}
+			if string(cellType) == sr.antiAffinity {
+				antiAffinityFound = true
+				if !h.fullCellList[chain][l][0].AtOrHigherThanNode() {
+					return fmt.Sprintf("anti-affinity cell type %v is lower than node level", sr.antiAffinity)
+				}
+			}
+		}
+	}
+	if !maxCellTypeFound {
+		return fmt.Sprintf("max cell type %v does not exist in the cluster", sr.maxCellType)
+	}
+	if !antiAffinityFound {
+		return fmt.Sprintf("anti-affinity cell type %v does not exist in the cluster", sr.antiAffinity)
+	}
+	return ""
+}
+
+// getTopologyConstraint resolves the topology constraint of a request to the levels in its chain.
+// False is returned if the chain does not have the cell types in the constraint.
+func (h *HivedAlgorithm) getTopologyConstraint(sr schedulingRequest) (topologyConstraint, bool) {
+	tc := topologyConstraint{}
+	ccl := h.fullCellList[sr.chain]
+	top := CellLevel(len(ccl))
+	if sr.maxCellLevel > top {
+		tc.maxLevel = top
+	} else {
+		tc.maxLevel = sr.maxCellLevel
+	}
+	for l := CellLevel(1); l <= top; l++ {
+		cellType := h.cellTypes[sr.chain][l]
+		if cellType == sr.maxCellType {
+			tc.maxLevel = l
+		}
+		if string(cellType) == sr.antiAffinity ||
+			(sr.antiAffinity == api.AntiAffinityNode && tc.antiAffinityLevel == 0 && ccl[l][0].AtOrHigherThanNode()) {
+			tc.antiAffinityLevel = l
+		}
+	}
+	return tc, (sr.maxCellType == "" || tc.maxLevel != 0) && (sr.antiAffinity == "" || tc.antiAffinityLevel != 0)
+}
+
 // processSchedulingRequest feeds a request to a VC scheduler
 // or the opportunistic scheduler according to its priority.
 func (h *HivedAlgorithm) processSchedulingRequest(
 	sr schedulingRequest,
 	suggestedNodeSet common.Set) (map[int32][]CellList, map[int32][]CellList) {
 
+	var ok bool
+	if sr.topologyConstraint, ok = h.getTopologyConstraint(sr); !ok {
+		klog.Infof("Chain %v does not have the cell types in the topology constraint of group %v",
+			sr.chain, sr.affinityGroupName)
+		return nil, nil
+	}
 	if sr.priority >= minGuaranteedPriority {
 		return h.scheduleGuaranteedAffinityGroup(sr, suggestedNodeSet)
 	} else {
@@ -458,13 +1101,15 @@ func (h *HivedAlgorithm) processSchedulingRequest(
 }
 
 // scheduleGuaranteedAffinityGroup schedules an affinity group in its VC, and
-// then maps the placement in VC to the physical cluster.
+// then maps the placement in VC to the physical cluster. If the group has a topology constraint,
+// the mapping may fail when buddy alloc cannot find physical cells satisfying it (note that the groups
+// lazy preempted before the failure are not reverted, but will be restored to their VCs later).
 func (h *HivedAlgorithm) scheduleGuaranteedAffinityGroup(
 	sr schedulingRequest,
 	suggestedNodeSet common.Set) (map[int32][]CellList, map[int32][]CellList) {
 
 	// schedule in VC
-	virtualPlacement := h.vcSchedulers[sr.vc].schedule(sr)
+	virtualPlacement := h.vcSchedulers[sr.vc].schedule(sr, suggestedNodeSet)
 	if virtualPlacement == nil {
 		return nil, nil
 	}
@@ -477,6 +1122,8 @@ func (h *HivedAlgorithm) scheduleGuaranteedAffinityGroup(
 	}
 	common.SortInt32(gpuNums)
 	physicalPlacement := map[int32][]CellList{}
+	// the scopes are collected before the lazy preemptions, which may unbind the preassigned cells
+	scopes := newPreassignedCellScopes(virtualPlacement, sr.topologyConstraint)
 	for _, podGpuNum := range gpuNums {
 		podPlacements := virtualPlacement[podGpuNum]
 		physicalPlacement[podGpuNum] = make([]CellList, len(podPlacements))
@@ -484,8 +1131,10 @@ func (h *HivedAlgorithm) scheduleGuaranteedAffinityGroup(
 			physicalPlacement[podGpuNum][i] = make(CellList, len(podGpus))
 			for j, gpu := range podGpus {
 				vGpu := gpu.(*VirtualCell)
+				// a reserved GPU is always bound to its physical GPU, even if not used by any group
 				if vGpu.GetPhysicalCell() != nil {
-					if groupToPreempt := vGpu.GetPhysicalCell().GetAffinityGroup(); groupToPreempt.lazyPreemptionEnable {
+					if groupToPreempt := vGpu.GetPhysicalCell().GetAffinityGroup(); groupToPreempt != nil &&
+						groupToPreempt.lazyPreemptionEnable && !sr.dryRun {
 						h.lazyPreemptAffinityGroup(groupToPreempt, sr.affinityGroupName)
 					}
 				}
@@ -498,8 +1147,15 @@ func (h *HivedAlgorithm) scheduleGuaranteedAffinityGroup(
 				if preassignedPhysical == nil {
 					// allocate a new physical cell to the preassigned cell. input a copy of the free cell list
 					// because during the scheduling we should not make in-place change to the data structures
-					c := buddyAlloc(h.getTmpFreeCellList(sr.chain), pac.GetLevel(), suggestedNodeSet)
-					if c == nil {
+					c := buddyAlloc(h.getTmpFreeCellList(sr.chain), pac.GetLevel(),
+						suggestedNodeSet, h.costModel, scopes.getAllocScope(pac))
+					if c == nil && (scopes != nil || len(h.cellCordons) != 0 || buddyAlloc(h.getTmpFreeCellList(
+						sr.chain), pac.GetLevel(), h.getAllNodeSet(), h.costModel, nil) != nil) {
+						klog.Infof("Cannot find physical cell satisfying the topology constraint, "+
+							"out of the cordoned cells or within the suggested nodes for a VC cell: %v", pac.GetName())
+						clearPreBindings(virtualPlacement)
+						return nil, nil
+					} else if c == nil {
 						panic(fmt.Sprintf(
 							"VC Safety Broken: Cannot find physical cell for a VC cell: %v", pac.GetName()))
 					} else {
@@ -508,9 +1164,15 @@ func (h *HivedAlgorithm) scheduleGuaranteedAffinityGroup(
 						// same reason as above)
 						pac.SetPreBoundPhysicalCell(preassignedPhysical)
 						preassignedPhysical.SetPreBoundVirtualCell(pac)
+						scopes.add(pac, preassignedPhysical)
 					}
 				}
-				physicalPlacement[podGpuNum][i][j] = mapNonPreassignedCellToPhysical(vGpu, suggestedNodeSet)
+				if physicalPlacement[podGpuNum][i][j] = mapNonPreassignedCellToPhysical(
+					vGpu, suggestedNodeSet, h.costModel); physicalPlacement[podGpuNum][i][j] == nil {
+					klog.Infof("Cannot find physical cell within the suggested nodes for a VC cell: %v", vGpu.GetName())
+					clearPreBindings(virtualPlacement)
+					return nil, nil
+				}
 			}
 		}
 	}
@@ -524,7 +1186,7 @@ func (h *HivedAlgorithm) scheduleOpportunisticAffinityGroup(
 	suggestedNodeSet common.Set) map[int32][]CellList {
 
 	placement := h.opportunisticSchedulers[sr.chain].Schedule(
-		sr.affinityGroupPodNums, opportunisticPriority, suggestedNodeSet)
+		sr.affinityGroupPodNums, opportunisticPriority, suggestedNodeSet, sr.topologyConstraint)
 	if placement == nil {
 		klog.Infof("Insufficient capacity in PC for scheduling request: GPU numbers %v, priority %v",
 			sr.affinityGroupPodNums, sr.priority)
@@ -547,7 +1209,13 @@ func (h *HivedAlgorithm) getTmpFreeCellList(chain CellChain) ChainCellList {
 
 // createAllocatedAffinityGroup creates a new affinity group, and confirms the allocated resources.
 func (h *HivedAlgorithm) createAllocatedAffinityGroup(pod *core.Pod, s *api.PodSchedulingSpec, info *api.PodBindInfo) {
-	newGroup := newAlgoAffinityGroup(s.AffinityGroup, s.GangReleaseEnable, s.LazyPreemptionEnable)
+	newGroup := newAlgoAffinityGroup(s, h.now())
+	newGroup.user = h.getQuotaUser(s.VirtualCluster, pod)
+	newGroup.lender = info.LenderVirtualCluster
+	if newGroup.priority < minGuaranteedPriority {
+		// an upgraded opportunistic group is recovered as opportunistic, and will be upgraded again when possible
+		newGroup.virtualGpuPlacement = nil
+	}
 	shouldLazyPreempt := false
 	for _, gms := range info.AffinityGroupBindInfo {
 		gpuNumber := int32(len(gms.PodPlacements[0].PhysicalGpuIndices))
@@ -559,7 +1227,7 @@ func (h *HivedAlgorithm) createAllocatedAffinityGroup(pod *core.Pod, s *api.PodS
 					gpuIndex,
 					gms.PodPlacements[podIndex].PhysicalGpuIndices,
 					gms.PodPlacements[podIndex].PreassignedCellTypes,
-					CellChain(info.CellChain), node, shouldLazyPreempt, s, newGroup, pod)
+					getPodCellChain(info, gms, gms.PodPlacements[podIndex]), node, shouldLazyPreempt, s, newGroup, pod)
 				if pGpu == nil {
 					break
 				} else {
@@ -569,8 +1237,9 @@ func (h *HivedAlgorithm) createAllocatedAffinityGroup(pod *core.Pod, s *api.PodS
 					} else if vGpu != nil {
 						newGroup.virtualGpuPlacement[gpuNumber][podIndex][gpuIndex] = vGpu
 						if vGpu.GetPhysicalCell() != nil {
-							groupToPreempt := vGpu.GetPhysicalCell().GetAffinityGroup()
-							h.lazyPreemptAffinityGroup(groupToPreempt, newGroup.name)
+							if groupToPreempt := vGpu.GetPhysicalCell().GetAffinityGroup(); groupToPreempt != nil {
+								h.lazyPreemptAffinityGroup(groupToPreempt, newGroup.name)
+							}
 						}
 					} else {
 						shouldLazyPreempt = shouldLazyPreempt || *lazyPreempt
@@ -582,8 +1251,13 @@ func (h *HivedAlgorithm) createAllocatedAffinityGroup(pod *core.Pod, s *api.PodS
 	}
 	if shouldLazyPreempt {
 		h.lazyPreemptAffinityGroup(newGroup, newGroup.name)
+	} else if newGroup.virtualGpuPlacement == nil {
+		newGroup.lender = ""
 	}
+	newGroup.preemptionStatus = h.preemptingAffinityGroups[s.AffinityGroup.Name]
+	delete(h.preemptingAffinityGroups, s.AffinityGroup.Name)
 	h.allocatedAffinityGroups[s.AffinityGroup.Name] = newGroup
+	h.recordLedger(newGroup, api.LedgerAllocate)
 	klog.Infof("[%v]: New affinity group created: %v", internal.Key(pod), s.AffinityGroup.Name)
 }
 
@@ -602,6 +1276,10 @@ func (h *HivedAlgorithm) findAllocatedGpu(
 	pod *core.Pod) (*PhysicalCell, *VirtualCell, *bool) {
 
 	priority := CellPriority(s.Priority)
+	vc := s.VirtualCluster
+	if group.lender != "" {
+		vc = group.lender
+	}
 	physicalGpuIndex := physicalGpuIndices[index]
 	if pGpu := h.findPhysicalGpu(chain, node, physicalGpuIndex); pGpu == nil {
 		klog.Warningf(
@@ -628,8 +1306,8 @@ func (h *HivedAlgorithm) findAllocatedGpu(
 				var message string
 				if !typeFound {
 					message = fmt.Sprintf("preassigned cell type %v not found in chain %v", preassignedType, pGpu.GetChain())
-				} else if vcs := h.vcSchedulers[s.VirtualCluster]; vcs == nil {
-					message = fmt.Sprintf("VC %v not found", s.VirtualCluster)
+				} else if vcs := h.vcSchedulers[vc]; vcs == nil {
+					message = fmt.Sprintf("VC %v not found", vc)
 				} else {
 					vccl := vcs.getNonReservedCellList()[pGpu.GetChain()]
 					str := string(pGpu.GetChain())
@@ -638,9 +1316,9 @@ func (h *HivedAlgorithm) findAllocatedGpu(
 						str = string(s.ReservationId)
 					}
 					if vccl == nil {
-						message = fmt.Sprintf("VC %v has no cell for %v", s.VirtualCluster, str)
+						message = fmt.Sprintf("VC %v has no cell for %v", vc, str)
 					} else {
-						vGpu, message = mapNonPreassignedCellToVirtual(pGpu, vccl, preassignedLevel, priority)
+						vGpu, message = mapNonPreassignedCellToVirtual(pGpu, vccl, preassignedLevel, priority, h.costModel)
 					}
 				}
 				if vGpu == nil {
@@ -694,6 +1372,17 @@ func getPodIndex(podPlacements []api.PodPlacementInfo, node string, gpuIndex int
 	return -1
 }
 
+// getZeroGpuPodIndex returns the index of a pod among the pods requesting zero GPU in a group,
+// or the first free index if the pod is nil. It returns -1 if not found.
+func getZeroGpuPodIndex(g *AlgoAffinityGroup, pod *core.Pod) int32 {
+	for i, p := range g.allocatedPods[0] {
+		if (pod == nil && p == nil) || (pod != nil && p != nil && p.UID == pod.UID) {
+			return int32(i)
+		}
+	}
+	return -1
+}
+
 // confirmReleasedGpu destroys the cell bindings, adds the physical cell back to the free list
 // (if necessary), and resets the priority.
 func (h *HivedAlgorithm) confirmReleasedGpu(pGpu *PhysicalCell, g *AlgoAffinityGroup) {
@@ -730,13 +1419,80 @@ func (h *HivedAlgorithm) lazyPreemptAffinityGroup(
 		}
 	}
 	victim.virtualGpuPlacement = nil
+	// a group borrowing the quota of a sibling VC is restored to its own VC
+	victim.lender = ""
 	victim.lazyPreemptionStatus = &api.LazyPreemptionStatus{
 		Preemptor:      preemptor,
-		PreemptionTime: meta.Now(),
+		PreemptionTime: meta.NewTime(h.now()),
+	}
+	if h.allocatedAffinityGroups[victim.name] == victim {
+		h.recordLedger(victim, api.LedgerAllocate)
 	}
 	klog.Infof("Affinity group %v is lazy preempted from VC by %v", victim.name, preemptor)
 }
 
+// recordLedger appends to the ledger the GPUs currently held by an affinity group (of each GPU type),
+// or the release of all its GPUs.
+func (h *HivedAlgorithm) recordLedger(g *AlgoAffinityGroup, event api.LedgerEvent) {
+	if h.ledger == nil {
+		return
+	}
+	r := api.LedgerRecord{
+		Time:           meta.NewTime(h.now()),
+		Event:          event,
+		AffinityGroup:  g.name,
+		VirtualCluster: g.vc,
+		User:           g.user,
+		Guaranteed:     g.virtualGpuPlacement != nil,
+	}
+	if event == api.LedgerAllocate {
+		r.GpuNumbers = map[string]int32{}
+		for _, podPlacements := range g.physicalGpuPlacement {
+			for _, podPlacement := range podPlacements {
+				for _, gpu := range podPlacement {
+					if gpu != nil && gpu.(*PhysicalCell).GetAffinityGroup() == g {
+						r.GpuNumbers[string(h.cellTypes[gpu.GetChain()][lowestLevel])]++
+					}
+				}
+			}
+		}
+	}
+	h.ledger.Append(r)
+}
+
+// audit records a call in the audit log with its arguments when the call returns, with its result
+// (pointed by result, if not nil) or its panic. It is deferred at the beginning of the call holding the lock,
+// i.e. "defer h.audit(call, result, args...)()", so that the calls are recorded in the order of execution.
+func (h *HivedAlgorithm) audit(call internal.AuditCall, result interface{}, args ...interface{}) func() {
+	if h.auditLog == nil {
+		return func() {}
+	}
+	r := internal.NewAuditRecord(h.now(), call, args...)
+	return func() {
+		if err := recover(); err != nil {
+			r.Error = fmt.Sprint(err)
+			h.auditLog.Append(r)
+			panic(err)
+		}
+		if result != nil {
+			r.Result = internal.NewAuditResult(result)
+		}
+		h.auditLog.Append(r)
+	}
+}
+
+// GetGpuHours returns the GpuHours aggregated from the ledger in the time range [start, end),
+// of a VC and of a user if they are not empty.
+func (h *HivedAlgorithm) GetGpuHours(start, end time.Time, vc, user string) api.GpuHoursList {
+	h.algorithmLock.RLock()
+	defer h.algorithmLock.RUnlock()
+
+	if h.ledger == nil {
+		panic(internal.NewBadRequestError("Ledger is not enabled by ledgerFilePath"))
+	}
+	return h.ledger.GetGpuHours(start, end, h.now(), api.VirtualClusterName(vc), user)
+}
+
 // removeCellFromFreeList removes a cell from the free cell list and splits its parent recursively if needed.
 func (h *HivedAlgorithm) removeCellFromFreeList(c *PhysicalCell) {
 	chain := c.GetChain()
@@ -774,7 +1530,7 @@ func (h *HivedAlgorithm) addCellToFreeList(c *PhysicalCell) {
 		if parent != nil {
 			allBuddyFree := true
 			for _, buddy := range parent.GetChildren() {
-				if buddy.(*PhysicalCell).GetVirtualCell() != nil {
+				if pb := buddy.(*PhysicalCell); pb.GetVirtualCell() != nil || pb.IsSplit() {
 					allBuddyFree = false
 					break
 				}
@@ -861,35 +1617,44 @@ func generatePodScheduleResult(
 	groupVirtualPlacement map[int32][]CellList,
 	priority CellPriority,
 	cellLevelToType map[CellChain]map[CellLevel]api.CellType,
+	cellTypeSpecs map[api.CellType]api.CellTypeSpec,
 	currentGpuNum int32,
 	currentPodIndex int32,
 	group *AlgoAffinityGroup,
 	groupName string,
 	suggestedNodeSet common.Set,
 	vc api.VirtualClusterName,
-	pod *core.Pod) internal.PodScheduleResult {
+	vcNodes []string,
+	costModel *preemptionCostModel,
+	random *rand.Rand,
+	pod *core.Pod) (internal.PodScheduleResult, *api.PreemptionStatus) {
 
-	preemptionVictims, nodesHaveVictims := collectPreemptionVictims(groupPhysicalPlacement, priority, groupName)
+	preemptionVictims, nodesHaveVictims, victimGroups := collectPreemptionVictims(
+		groupPhysicalPlacement, priority, groupName)
 	if len(preemptionVictims) > 0 {
 		// we collect victims on a random node, as K8S preempts victims from only one node once.
 		// random is to let different pods preempt victims on different nodes
 		// (note that this randomness is not necessary for the eventual-completeness of preemption).
-		nodeToPreempt := nodesHaveVictims[rand.Int31n(int32(len(nodesHaveVictims)))]
+		nodeToPreempt := nodesHaveVictims[random.Int31n(int32(len(nodesHaveVictims)))]
 		var victimPods []*core.Pod
 		var victimNames []string
 		for v := range preemptionVictims[nodeToPreempt].Items() {
 			victimPods = append(victimPods, v.(*core.Pod))
 			victimNames = append(victimNames, internal.Key(v.(*core.Pod)))
 		}
+		preemptionStatus := newPreemptionStatus(victimGroups, groupPhysicalPlacement, costModel)
 		klog.Infof("[%v]: need to preempt pods %v", internal.Key(pod), strings.Join(victimNames, ", "))
+		klog.Infof("[%v]: preemption victim groups %v, cost %v",
+			internal.Key(pod), preemptionStatus.Victims, preemptionStatus.Cost)
 		return internal.PodScheduleResult{
 			PodPreemptInfo: &internal.PodPreemptInfo{VictimPods: victimPods},
-		}
+		}, preemptionStatus
 	} else {
 		// we find the selected node after the preemption is done, otherwise the preemption victims
 		// may cause the selected node to be excluded from the suggested nodes
 		affinityGroupBindInfo, selectedNode, selectedGpuIndices, cellChain := generateAffinityGroupBindInfo(
-			groupPhysicalPlacement, groupVirtualPlacement, cellLevelToType, currentGpuNum, currentPodIndex, group, groupName, suggestedNodeSet)
+			groupPhysicalPlacement, groupVirtualPlacement, cellLevelToType, currentGpuNum, currentPodIndex, group, groupName,
+			suggestedNodeSet, vcNodes)
 		var waitReason string
 		if affinityGroupBindInfo == nil {
 			waitReason = "insufficient capacity in physical cluster"
@@ -901,9 +1666,13 @@ func generatePodScheduleResult(
 			if priority >= minGuaranteedPriority {
 				waitReason = fmt.Sprintf("cannot find a K8s candidate node within VC %v's quota", vc)
 			}
+		} else if (group == nil || priority >= minGuaranteedPriority) && !suggestedNodeSet.Contains(selectedNode) {
+			// a pod of an allocated opportunistic group still insists on the placement of the group
+			waitReason = fmt.Sprintf("node %v allocated to the pod is not within the K8s candidate nodes "+
+				"(it may be excluded by the pod's node selector, tolerations or affinity)", selectedNode)
 		}
 		if waitReason != "" {
-			return internal.PodScheduleResult{PodWaitInfo: &internal.PodWaitInfo{Reason: waitReason}}
+			return internal.PodScheduleResult{PodWaitInfo: &internal.PodWaitInfo{Reason: waitReason}}, nil
 		}
 		klog.Infof("[%v]: scheduled to node %v, GPUs %v",
 			internal.Key(pod), selectedNode, selectedGpuIndices)
@@ -912,10 +1681,114 @@ func generatePodScheduleResult(
 				Node:                  selectedNode,
 				GpuIsolation:          selectedGpuIndices,
 				CellChain:             cellChain,
+				GpuType:               string(cellLevelToType[CellChain(cellChain)][lowestLevel]),
 				AffinityGroupBindInfo: affinityGroupBindInfo,
+				CpuIsolation: getLocalCpuSet(
+					groupPhysicalPlacement[currentGpuNum][currentPodIndex], cellLevelToType, cellTypeSpecs),
+				NicIsolation: getLocalNics(
+					groupPhysicalPlacement[currentGpuNum][currentPodIndex], cellLevelToType, cellTypeSpecs),
 			},
+		}, nil
+	}
+}
+
+// getLocalCpuSet returns the CPUs local to a set of GPUs, i.e., the union of the CPU sets of the lowest
+// cells (the GPUs or their ancestors) whose cell types specify the CPU sets. Empty if not specified.
+func getLocalCpuSet(
+	gpus CellList,
+	cellLevelToType map[CellChain]map[CellLevel]api.CellType,
+	cellTypeSpecs map[api.CellType]api.CellTypeSpec) string {
+
+	var cpus []int32
+	for _, gpu := range gpus {
+		for c := gpu; c != nil; c = c.GetParent() {
+			cpuSet := cellTypeSpecs[cellLevelToType[c.GetChain()][c.GetLevel()]].CpuSet
+			if len(cpuSet) == 0 {
+				continue
+			}
+			for _, cpu := range common.FromCpuSetString(getCellItem(c, cpuSet)) {
+				if !common.Int32SliceContains(cpus, cpu) {
+					cpus = append(cpus, cpu)
+				}
+			}
+			break
 		}
 	}
+	return common.ToCpuSetString(cpus)
+}
+
+// getLocalNics returns the NICs local to a set of GPUs, i.e., the NICs attached to the lowest common
+// ancestor cell of the GPUs and its descendants. Empty if not specified.
+func getLocalNics(
+	gpus CellList,
+	cellLevelToType map[CellChain]map[CellLevel]api.CellType,
+	cellTypeSpecs map[api.CellType]api.CellTypeSpec) string {
+
+	var lca Cell
+	for _, gpu := range gpus {
+		if gpu == nil {
+			continue
+		}
+		if lca == nil {
+			lca = gpu
+		} else if lca = findLCA(gpu, lca); lca == nil {
+			return ""
+		}
+	}
+	if lca == nil {
+		return ""
+	}
+	var nics []string
+	var collect func(c Cell)
+	collect = func(c Cell) {
+		if cellNics := cellTypeSpecs[cellLevelToType[c.GetChain()][c.GetLevel()]].Nics; len(cellNics) != 0 {
+			for _, nic := range strings.Split(getCellItem(c, cellNics), ",") {
+				if nic = strings.TrimSpace(nic); nic != "" && !common.StringsContains(nics, nic) {
+					nics = append(nics, nic)
+				}
+			}
+		}
+		for _, child := range c.GetChildren() {
+			collect(child)
+		}
+	}
+	collect(lca)
+	return strings.Join(nics, ",")
+}
+
+// getCellItem returns the item for a cell from the items specified for its cell type, which are either
+// for all the cells (a single item), or for the cells which are the i-th child of their parents.
+func getCellItem(c Cell, items []string) string {
+	if len(items) == 1 || c.GetParent() == nil {
+		return items[0]
+	}
+	for i, sibling := range c.GetParent().GetChildren() {
+		if CellEqual(sibling, c) && i < len(items) {
+			return items[i]
+		}
+	}
+	return ""
+}
+
+// newPreemptionStatus summarizes the preemption victims of an affinity group and the preemption cost.
+func newPreemptionStatus(
+	victimGroups map[string]*AlgoAffinityGroup,
+	groupPhysicalPlacement map[int32][]CellList,
+	costModel *preemptionCostModel) *api.PreemptionStatus {
+
+	neededGpuNum := int32(0)
+	for gpuNum, podPlacements := range groupPhysicalPlacement {
+		neededGpuNum += gpuNum * int32(len(podPlacements))
+	}
+	var victims []string
+	for name := range victimGroups {
+		victims = append(victims, name)
+	}
+	sort.Strings(victims)
+	return &api.PreemptionStatus{
+		Victims: victims,
+		Cost:    costModel.victimSetCost(victimGroups, neededGpuNum),
+	}
 }
 
 // generateAffinityGroupBindInfo writes the physical and virtual placements of an affinity group
@@ -929,7 +1802,8 @@ func generateAffinityGroupBindInfo(
 	currentPodIndex int32,
 	group *AlgoAffinityGroup,
 	groupName string,
-	suggestedNodeSet common.Set) ([]api.AffinityGroupMemberBindInfo, string, []int32, string) {
+	suggestedNodeSet common.Set,
+	vcNodes []string) ([]api.AffinityGroupMemberBindInfo, string, []int32, string) {
 
 	if groupPhysicalPlacement == nil {
 		return nil, "", nil, ""
@@ -943,6 +1817,7 @@ func generateAffinityGroupBindInfo(
 		mbi := api.AffinityGroupMemberBindInfo{
 			PodPlacements: make([]api.PodPlacementInfo, len(podPhysicalPlacements)),
 		}
+		podChains := make([]string, len(podPhysicalPlacements))
 		for podIndex := int32(0); podIndex < int32(len(podPhysicalPlacements)); podIndex++ {
 			mbi.PodPlacements[podIndex].PhysicalGpuIndices = make([]int32, podGpuNum)
 			mbi.PodPlacements[podIndex].PreassignedCellTypes = make([]api.CellType, podGpuNum)
@@ -954,11 +1829,12 @@ func generateAffinityGroupBindInfo(
 					}
 					// if the physical placement of this pod is not found (e.g., removed due to reconfiguration),
 					// we will insist the decision by retrieving it from other pods
-					mbi.PodPlacements[podIndex], chain = retrieveMissingPodPlacement(group, podGpuNum, podIndex)
+					mbi.PodPlacements[podIndex], podChains[podIndex] = retrieveMissingPodPlacement(group, podGpuNum, podIndex)
 					klog.Warningf(
 						"pod placement has been invalid and is retrieved from annotation of other pods: node %v, GPU %v",
 						mbi.PodPlacements[podIndex].PhysicalNode, mbi.PodPlacements[podIndex].PhysicalGpuIndices[gpuIndex])
 				} else {
+					podChains[podIndex] = string(pGpu.GetChain())
 					nodes, gpuIndices := pGpu.(*PhysicalCell).GetPhysicalPlacement()
 					// here each cell (i.e., pGpu) is only one GPU, hence we takes the first element
 					// in its "nodes" and "gpuIndices" as the node and GPU address
@@ -975,14 +1851,24 @@ func generateAffinityGroupBindInfo(
 					}
 				}
 			}
+			// the chain of the member is that of its first pod, and a pod in another chain records its own
+			if mbi.CellChain == "" {
+				mbi.CellChain = podChains[podIndex]
+			}
+			if podChains[podIndex] != mbi.CellChain {
+				mbi.PodPlacements[podIndex].CellChain = podChains[podIndex]
+			} else {
+				mbi.PodPlacements[podIndex].CellChain = ""
+			}
 		}
-		if podGpuNum == currentGpuNum &&
+		if podGpuNum == 0 && currentGpuNum == 0 {
+			selectedNode = selectNodeForZeroGpuPod(groupPhysicalPlacement, vcNodes, suggestedNodeSet)
+			selectedGpuIndices = []int32{}
+		} else if podGpuNum == currentGpuNum &&
 			(group != nil || suggestedNodeSet.Contains(mbi.PodPlacements[currentPodIndex].PhysicalNode)) {
 			selectedNode = mbi.PodPlacements[currentPodIndex].PhysicalNode
 			selectedGpuIndices = mbi.PodPlacements[currentPodIndex].PhysicalGpuIndices
-			if pGpu := groupPhysicalPlacement[currentGpuNum][currentPodIndex][0]; pGpu != nil {
-				chain = string(pGpu.GetChain())
-			}
+			chain = podChains[currentPodIndex]
 		}
 		affinityGroupBindInfo[groupMemberIndex] = mbi
 		groupMemberIndex++
@@ -996,10 +1882,11 @@ func generateAffinityGroupBindInfo(
 func collectPreemptionVictims(
 	groupPhysicalPlacement map[int32][]CellList,
 	priority CellPriority,
-	groupName string) (map[string]common.Set, []string) {
+	groupName string) (map[string]common.Set, []string, map[string]*AlgoAffinityGroup) {
 
 	preemptionVictims := map[string]common.Set{}
 	var nodesHaveVictims []string
+	victimGroups := map[string]*AlgoAffinityGroup{}
 	for gpuNum := range groupPhysicalPlacement {
 		for podIndex := range groupPhysicalPlacement[gpuNum] {
 			for _, gpu := range groupPhysicalPlacement[gpuNum][podIndex] {
@@ -1022,6 +1909,7 @@ func collectPreemptionVictims(
 								"another non-preemptible group %v; pod should wait",
 							pGpu.GetPhysicalPlacementString(), victimGroup.name))
 					}
+					victimGroups[victimGroup.name] = victimGroup
 					// for any victim pod, gang-preempt all the other pods from the same affinity group
 					for _, victims := range victimGroup.allocatedPods {
 						for _, v := range victims {
@@ -1038,7 +1926,7 @@ func collectPreemptionVictims(
 			}
 		}
 	}
-	return preemptionVictims, nodesHaveVictims
+	return preemptionVictims, nodesHaveVictims, victimGroups
 }
 
 // retrieveMissingPodPlacement finds the placement of a pod from the annotation of other pods in the same group
@@ -1050,7 +1938,7 @@ func retrieveMissingPodPlacement(group *AlgoAffinityGroup, gpuNum int32, podInde
 				info := internal.ExtractPodBindInfo(p)
 				for _, mbi := range info.AffinityGroupBindInfo {
 					if gpuNum == int32(len(mbi.PodPlacements[0].PhysicalGpuIndices)) {
-						return mbi.PodPlacements[podIndex], info.CellChain
+						return mbi.PodPlacements[podIndex], string(getPodCellChain(info, mbi, mbi.PodPlacements[podIndex]))
 					}
 				}
 			}
@@ -1060,68 +1948,270 @@ func retrieveMissingPodPlacement(group *AlgoAffinityGroup, gpuNum int32, podInde
 		"No allocated pod found in an allocated group %v when retrieving placement for pod %v with GPU number %v", group.name, podIndex, gpuNum))
 }
 
+// getPodCellChain returns the cell chain of a pod placement of an affinity group member in the bind info,
+// i.e., the chain recorded in the placement if the pod is in another chain than its member, or the chain of
+// the member. The chain of the pod being bound is returned if the member has no chain recorded (i.e., the
+// bind info was generated by an older version).
+func getPodCellChain(
+	info *api.PodBindInfo,
+	mbi api.AffinityGroupMemberBindInfo,
+	placement api.PodPlacementInfo) CellChain {
+
+	if placement.CellChain != "" {
+		return CellChain(placement.CellChain)
+	}
+	if mbi.CellChain != "" {
+		return CellChain(mbi.CellChain)
+	}
+	return CellChain(info.CellChain)
+}
+
+// selectNodeForZeroGpuPod selects a node for a pod requesting zero GPU. The pod is placed on a node
+// of the cells allocated to its group, or on a node of its VC if no cell is allocated to the group.
+func selectNodeForZeroGpuPod(
+	groupPhysicalPlacement map[int32][]CellList,
+	vcNodes []string,
+	suggestedNodeSet common.Set) string {
+
+	nodeSet := common.NewSet()
+	for _, podPlacements := range groupPhysicalPlacement {
+		for _, podPlacement := range podPlacements {
+			for _, gpu := range podPlacement {
+				if gpu != nil {
+					nodes, _ := gpu.(*PhysicalCell).GetPhysicalPlacement()
+					nodeSet.Add(nodes[0])
+				}
+			}
+		}
+	}
+	candidates := vcNodes
+	if !nodeSet.IsEmpty() {
+		candidates = nil
+		for n := range nodeSet.Items() {
+			candidates = append(candidates, n.(string))
+		}
+		sort.Strings(candidates)
+	}
+	for _, n := range candidates {
+		if suggestedNodeSet.Contains(n) {
+			return n
+		}
+	}
+	return ""
+}
+
 // buddyAlloc allocates a free cell at a certain level from a free list.
-// It splits a higher-level cell when there is no free cell at the current level.
-// As the input cell list is a copy of the real free list and hence is one-off,
+// It splits a higher-level cell when there is no free cell (within the scope, if any) at the current level.
+// A cell overlapping a cordoned cell is never allocated, while a higher-level cell containing cordoned cells
+// can still be split. As the input cell list is a copy of the real free list and hence is one-off,
 // we won't remove a returned cell from it.
-func buddyAlloc(freeList ChainCellList, level CellLevel, suggestedNodeSet common.Set) *PhysicalCell {
-	if len(freeList[level]) == 0 && level < CellLevel(len(freeList)) {
-		higherCell := buddyAlloc(freeList, level+1, suggestedNodeSet)
+func buddyAlloc(
+	freeList ChainCellList,
+	level CellLevel,
+	suggestedNodeSet common.Set,
+	costModel *preemptionCostModel,
+	scope *allocScope) *PhysicalCell {
+
+	return buddyAllocAtLevel(freeList, level, level, suggestedNodeSet, costModel, scope)
+}
+
+// buddyAllocAtLevel allocates a free cell at a certain level for buddy alloc at the target level
+// (the cell is to be split if it is higher than the target level).
+func buddyAllocAtLevel(
+	freeList ChainCellList,
+	level CellLevel,
+	targetLevel CellLevel,
+	suggestedNodeSet common.Set,
+	costModel *preemptionCostModel,
+	scope *allocScope) *PhysicalCell {
+
+	split := level > targetLevel
+	if len(filterCellsInNodes(filterCordonedCells(scope.filter(freeList[level]), split), suggestedNodeSet)) == 0 &&
+		level < CellLevel(len(freeList)) {
+		higherCell := buddyAllocAtLevel(freeList, level+1, targetLevel, suggestedNodeSet, costModel, scope)
 		if higherCell != nil {
 			freeList[level] = append(freeList[level], higherCell.GetChildren()...)
 		}
 	}
-	if len(freeList[level]) == 0 {
+	candidates := filterCellsInNodes(filterCordonedCells(scope.filter(freeList[level]), split), suggestedNodeSet)
+	if len(candidates) == 0 {
 		return nil
 	}
-	return getFewestOpporPhysicalCell(freeList[level], suggestedNodeSet)
+	return getLowestCostPhysicalCell(candidates, costModel)
 }
 
-// getFewestOpporPhysicalCell selects a physical cell with the minimum number of opportunistic pods from a cell list.
-func getFewestOpporPhysicalCell(cl CellList, suggestedNodeSet common.Set) *PhysicalCell {
+// filterCellsInNodes returns the cells in a list which have any node in the node set, i.e., the cells
+// which can hold the pods that must be placed within the suggested nodes.
+func filterCellsInNodes(cl CellList, nodeSet common.Set) CellList {
+	var filtered CellList
+	for _, c := range cl {
+		nodes, _ := c.(*PhysicalCell).GetPhysicalPlacement()
+		for _, n := range nodes {
+			if nodeSet.Contains(n) {
+				filtered = append(filtered, c)
+				break
+			}
+		}
+	}
+	return filtered
+}
+
+// allocScope restricts the physical cells that buddy alloc can allocate: a cell must be within
+// the cell "within" (if not nil), and not within any of the "excluded" cells. Besides, the allocated cell
+// should not contain cells pre-bound to the other preassigned cells of the group.
+type allocScope struct {
+	level    CellLevel // level of the cell to allocate
+	within   *PhysicalCell
+	excluded CellList
+}
+
+// filter returns the cells in a list that can be allocated (or split to allocate lower-level cells)
+// within the scope. A nil scope allows any cell.
+func (s *allocScope) filter(cl CellList) CellList {
+	if s == nil {
+		return cl
+	}
+	filtered := CellList{}
+	for _, c := range cl {
+		if s.within != nil && !isAncestorOrSelf(s.within, c) && !isAncestorOrSelf(c, s.within) {
+			continue
+		}
+		if c.GetLevel() == s.level && hasPreBoundDescendant(c.(*PhysicalCell)) {
+			continue
+		}
+		excluded := false
+		for _, e := range s.excluded {
+			if isAncestorOrSelf(e, c) {
+				excluded = true
+				break
+			}
+		}
+		if !excluded {
+			filtered = append(filtered, c)
+		}
+	}
+	return filtered
+}
+
+// preassignedCellScopes tracks where the preassigned cells of an affinity group with a topology constraint
+// are placed in the physical cluster, so that buddy alloc places the preassigned cells lower than the
+// constraint levels accordingly: within the same cell at the max level, and within distinct cells at the
+// anti-affinity level (each of such preassigned cells holds a single pod of the group).
+type preassignedCellScopes struct {
+	constraint topologyConstraint
+	// physical cell at the max level containing the preassigned cells lower than that level
+	within *PhysicalCell
+	// preassigned cell name -> physical cell at the anti-affinity level containing it
+	used map[string]*PhysicalCell
+}
+
+// newPreassignedCellScopes collects the scopes of the bound preassigned cells in a virtual placement.
+// Nil is returned if the group has no topology constraint.
+func newPreassignedCellScopes(
+	virtualPlacement map[int32][]CellList,
+	constraint topologyConstraint) *preassignedCellScopes {
+
+	if constraint.maxLevel == 0 && constraint.antiAffinityLevel == 0 {
+		return nil
+	}
+	s := &preassignedCellScopes{constraint: constraint, used: map[string]*PhysicalCell{}}
+	for _, podPlacements := range virtualPlacement {
+		for _, podGpus := range podPlacements {
+			for _, gpu := range podGpus {
+				pac := gpu.(*VirtualCell).GetPreAssignedCell()
+				if pc := pac.GetPhysicalCell(); pc != nil {
+					s.add(pac, pc)
+				}
+			}
+		}
+	}
+	return s
+}
+
+// add records the physical cell where a preassigned cell is placed.
+func (s *preassignedCellScopes) add(pac *VirtualCell, pc *PhysicalCell) {
+	if s == nil {
+		return
+	}
+	if pac.GetLevel() < s.constraint.maxLevel && s.within == nil {
+		s.within = getConstraintScope(pc, s.constraint.maxLevel).(*PhysicalCell)
+	}
+	if pac.GetLevel() < s.constraint.antiAffinityLevel {
+		s.used[pac.GetName()] = getConstraintScope(pc, s.constraint.antiAffinityLevel).(*PhysicalCell)
+	}
+}
+
+// getAllocScope returns the scope where buddy alloc can allocate a physical cell for a preassigned cell.
+// If the group has no topology constraint, the scope only excludes the cells containing the cells
+// pre-bound to the other preassigned cells of the group.
+func (s *preassignedCellScopes) getAllocScope(pac *VirtualCell) *allocScope {
+	scope := &allocScope{level: pac.GetLevel()}
+	if s == nil {
+		return scope
+	}
+	if pac.GetLevel() < s.constraint.maxLevel {
+		scope.within = s.within
+	}
+	if pac.GetLevel() < s.constraint.antiAffinityLevel {
+		for name, c := range s.used {
+			if name != pac.GetName() {
+				scope.excluded = append(scope.excluded, c)
+			}
+		}
+	}
+	return scope
+}
+
+// isAncestorOrSelf checks if a cell is another cell or an ancestor of it.
+func isAncestorOrSelf(ancestor Cell, c Cell) bool {
+	for c != nil && c.GetLevel() < ancestor.GetLevel() {
+		c = c.GetParent()
+	}
+	return c != nil && CellEqual(ancestor, c)
+}
+
+// getLowestCostPhysicalCell selects a physical cell with the minimum cost of preempting the opportunistic pods
+// in it from a cell list. Among the cells with the same cost, the one with the fewest opportunistic pods is selected.
+func getLowestCostPhysicalCell(cl CellList, costModel *preemptionCostModel) *PhysicalCell {
 	fewestOpporNum := int32(math.MaxInt32)
-	fewestOpporNumSuggested := int32(math.MaxInt32)
+	lowestCost := math.MaxFloat64
 	var fewestOpporCell *PhysicalCell
-	var fewestOpporSuggested *PhysicalCell
 	for _, c := range cl {
 		if pc := c.(*PhysicalCell); pc.GetVirtualCell() == nil && pc.GetPreBoundVirtualCell() == nil {
 			numOppor := pc.GetUsedGpuNumAtPriorities()[opportunisticPriority]
-			if numOppor < fewestOpporNum {
+			cost := costModel.cellCost(pc, minGuaranteedPriority)
+			if cost < lowestCost || (cost == lowestCost && numOppor < fewestOpporNum) {
+				lowestCost = cost
 				fewestOpporNum = numOppor
 				fewestOpporCell = pc
 			}
-			allNodesInSuggested := true
-			nodes, _ := pc.GetPhysicalPlacement()
-			for _, n := range nodes {
-				if !suggestedNodeSet.Contains(n) {
-					allNodesInSuggested = false
-					break
-				}
-			}
-			if allNodesInSuggested && numOppor < fewestOpporNumSuggested {
-				fewestOpporNumSuggested = numOppor
-				fewestOpporSuggested = pc
-			}
 		}
 	}
-	if fewestOpporSuggested == nil {
-		return fewestOpporCell
-	} else {
-		return fewestOpporSuggested
-	}
+	return fewestOpporCell
 }
 
 // mapNonPreassignedCellToPhysical maps a virtual cell (possibly inside a preassigned one) to the
 // physical cell of the preassigned cell. This operation keeps the inner-cell topology equivalent,
-// by recursively binding the cells inside the preassigned one.
-func mapNonPreassignedCellToPhysical(c *VirtualCell, suggestedNodeSet common.Set) *PhysicalCell {
+// by recursively binding the cells inside the preassigned one. Nil is returned if the cell cannot be
+// mapped within the suggested nodes.
+func mapNonPreassignedCellToPhysical(
+	c *VirtualCell,
+	suggestedNodeSet common.Set,
+	costModel *preemptionCostModel) *PhysicalCell {
+
 	if c.GetPhysicalCell() != nil {
 		return c.GetPhysicalCell()
 	} else if c.GetPreBoundPhysicalCell() != nil {
 		return c.GetPreBoundPhysicalCell()
 	} else {
-		parentPhysical := mapNonPreassignedCellToPhysical(c.GetParent().(*VirtualCell), suggestedNodeSet)
-		pc := getFewestOpporPhysicalCell(parentPhysical.GetChildren(), suggestedNodeSet)
+		parentPhysical := mapNonPreassignedCellToPhysical(c.GetParent().(*VirtualCell), suggestedNodeSet, costModel)
+		if parentPhysical == nil {
+			return nil
+		}
+		pc := getLowestCostPhysicalCell(filterCellsInNodes(parentPhysical.GetChildren(), suggestedNodeSet), costModel)
+		if pc == nil && getLowestCostPhysicalCell(parentPhysical.GetChildren(), costModel) != nil {
+			return nil
+		}
 		if pc == nil || pc.GetPriority() > opportunisticPriority {
 			panic(fmt.Sprintf("VC Safety Broken: Cannot find physical cell for %v", c.GetName()))
 		}
@@ -1138,12 +2228,13 @@ func mapNonPreassignedCellToVirtual(
 	c *PhysicalCell,
 	ccl ChainCellList,
 	preassignedLevel CellLevel,
-	p CellPriority) (*VirtualCell, string) {
+	p CellPriority,
+	costModel *preemptionCostModel) (*VirtualCell, string) {
 
 	if c.GetVirtualCell() != nil {
 		return c.GetVirtualCell(), ""
 	} else if c.GetLevel() == preassignedLevel {
-		if preassignedVirtual := getLowestPriorityCell(ccl[preassignedLevel], p); preassignedVirtual == nil {
+		if preassignedVirtual := getLowestCostCell(ccl[preassignedLevel], p, costModel); preassignedVirtual == nil {
 			return nil, fmt.Sprintf("insufficient quota in the VC at the preassigned level (%v)", preassignedLevel)
 		} else {
 			return preassignedVirtual.(*VirtualCell), ""
@@ -1153,30 +2244,117 @@ func mapNonPreassignedCellToVirtual(
 			"physical and virtual cell hierarchies not match (cannot reach the preassigned level %v in physical)",
 			preassignedLevel)
 	} else {
-		parentVirtual, message := mapNonPreassignedCellToVirtual(c.GetParent().(*PhysicalCell), ccl, preassignedLevel, p)
+		parentVirtual, message := mapNonPreassignedCellToVirtual(
+			c.GetParent().(*PhysicalCell), ccl, preassignedLevel, p, costModel)
 		if parentVirtual == nil {
 			return nil, message
 		} else {
-			return getLowestPriorityCell(parentVirtual.GetChildren(), p).(*VirtualCell), ""
+			return getLowestCostCell(parentVirtual.GetChildren(), p, costModel).(*VirtualCell), ""
+		}
+	}
+}
+
+// mapPhysicalCellToFreeVirtual maps a physical cell to a free virtual cell in a VC (given by ccl),
+// by pre-binding the cell (and its ancestors if necessary) to virtual cells of the same topology.
+// Different from mapNonPreassignedCellToVirtual, it never maps the cell to a virtual cell being used,
+// and only binds a new preassigned cell to a physical cell which is free in the buddy alloc sense.
+// The virtual cells pre-bound are appended to preBound. Nil is returned if no such virtual cell exists.
+func mapPhysicalCellToFreeVirtual(c *PhysicalCell, ccl ChainCellList, preBound *[]*VirtualCell) *VirtualCell {
+	if vc := c.GetVirtualCell(); vc != nil {
+		if !cellListContains(ccl[vc.GetLevel()], vc) {
+			return nil
+		}
+		return vc
+	} else if vc := c.GetPreBoundVirtualCell(); vc != nil {
+		return vc
+	}
+	var vc *VirtualCell
+	if !hasBoundAncestor(c) && !c.IsSplit() && !hasPreBoundDescendant(c) {
+		for _, cc := range ccl[c.GetLevel()] {
+			v := cc.(*VirtualCell)
+			if CellEqual(v.GetPreAssignedCell(), v) && !v.IsInactive() &&
+				v.GetPhysicalCell() == nil && v.GetPreBoundPhysicalCell() == nil {
+				vc = v
+				break
+			}
+		}
+	}
+	if vc == nil {
+		if c.GetParent() == nil {
+			return nil
+		}
+		parentVirtual := mapPhysicalCellToFreeVirtual(c.GetParent().(*PhysicalCell), ccl, preBound)
+		if parentVirtual == nil {
+			return nil
+		}
+		for _, cc := range parentVirtual.GetChildren() {
+			v := cc.(*VirtualCell)
+			if v.GetPriority() == freePriority && v.GetPhysicalCell() == nil && v.GetPreBoundPhysicalCell() == nil {
+				vc = v
+				break
+			}
+		}
+		if vc == nil {
+			return nil
 		}
 	}
+	vc.SetPreBoundPhysicalCell(c)
+	c.SetPreBoundVirtualCell(vc)
+	*preBound = append(*preBound, vc)
+	return vc
 }
 
-// getLowestPriorityCell returns a cell with the lowest priority among the cells
-// whose priorities are lower than the given priority (p).
-func getLowestPriorityCell(cl CellList, p CellPriority) Cell {
+// hasBoundAncestor checks if any ancestor of a physical cell is bound (or pre-bound) to a virtual cell.
+func hasBoundAncestor(c *PhysicalCell) bool {
+	for p := c.GetParent(); p != nil; p = p.GetParent() {
+		if pp := p.(*PhysicalCell); pp.GetVirtualCell() != nil || pp.GetPreBoundVirtualCell() != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// hasPreBoundDescendant checks if any descendant of a physical cell is pre-bound to a virtual cell.
+func hasPreBoundDescendant(c *PhysicalCell) bool {
+	for _, cc := range c.GetChildren() {
+		if child := cc.(*PhysicalCell); child.GetPreBoundVirtualCell() != nil || hasPreBoundDescendant(child) {
+			return true
+		}
+	}
+	return false
+}
+
+// cellListContains checks if a cell is in a cell list.
+func cellListContains(cl CellList, c Cell) bool {
+	for _, cc := range cl {
+		if CellEqual(cc, c) {
+			return true
+		}
+	}
+	return false
+}
+
+// getLowestCostCell returns a cell with the lowest preemption cost among the cells
+// whose priorities are lower than the given priority (p). Among the cells with the same cost,
+// the one with the lowest priority is returned. A free cell is always returned first.
+func getLowestCostCell(cl CellList, p CellPriority, costModel *preemptionCostModel) Cell {
 	lowestPriority := maxGuaranteedPriority
-	var lowestPriorityCell Cell
+	lowestCost := math.MaxFloat64
+	var lowestCostCell Cell
 	for _, c := range cl {
 		pp := c.GetPriority()
 		if pp == freePriority {
 			return c
-		} else if pp < p && pp < lowestPriority {
-			lowestPriority = pp
-			lowestPriorityCell = c
+		} else if pp < p {
+			cost := costModel.cellCost(c, p)
+			if cost < lowestCost || (cost == lowestCost && pp < lowestPriority) {
+				lowestCost = cost
+				lowestPriority = pp
+				lowestCostCell = c
+			}
 		}
 	}
-	return lowestPriorityCell
+	return lowestCostCell
 }
 
 // clearPreBindings clears the temporary bindings created during scheduling.
@@ -27,12 +27,17 @@ import (
 	"github.com/microsoft/hivedscheduler/pkg/api"
 	"github.com/microsoft/hivedscheduler/pkg/common"
 	"github.com/microsoft/hivedscheduler/pkg/internal"
+	"io/ioutil"
 	core "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
 	"net/http"
-	"sort"
+	"os"
+	"path/filepath"
+	"reflect"
 	"testing"
+	"time"
 )
 
 var allPods = map[string]*core.Pod{}
@@ -52,16 +57,6 @@ func init() {
 	}
 }
 
-var allNodes []string
-
-func initNodes(h *HivedAlgorithm) {
-	for _, ccl := range h.fullCellList {
-		for _, c := range ccl[CellLevel(len(ccl))] {
-			allNodes = append(allNodes, c.(*PhysicalCell).nodes...)
-		}
-	}
-}
-
 var group1, group2, group3, group4, group5, group6, group7, group8, group9, group10, group11, group12, group13, group14, group15, group16, group17 = &api.AffinityGroupSpec{
 	Name:    "group1",
 	Members: []api.AffinityGroupMemberSpec{{PodNumber: 1, GpuNumber: 1}},
@@ -372,7 +367,7 @@ var expectedPreemptInfos = map[string]common.Set{
 var allocatedPods []*core.Pod
 
 func TestHivedAlgorithm(t *testing.T) {
-	configFilePath := "../../example/config/design/hivedscheduler.yaml"
+	configFilePath := testConfigFilePath
 	sConfig := api.NewConfig(api.InitRawConfig(&configFilePath))
 	h := NewHivedAlgorithm(sConfig)
 	initNodes(h)
@@ -387,17 +382,6 @@ func TestHivedAlgorithm(t *testing.T) {
 	testInvalidInitialAssignment(t, sConfig)
 }
 
-func sortChains(chains []CellChain) {
-	var chainsTemp []string
-	for _, c := range chains {
-		chainsTemp = append(chainsTemp, string(c))
-	}
-	sort.Strings(chainsTemp)
-	for i := range chains {
-		chains[i] = CellChain(chainsTemp[len(chainsTemp)-i-1])
-	}
-}
-
 func printConfig(t *testing.T, h *HivedAlgorithm) {
 	for chain, ccl := range h.fullCellList {
 		t.Logf("%v", chain)
@@ -579,3 +563,775 @@ func compareSchedulingResult(t *testing.T, pod *core.Pod, psr internal.PodSchedu
 			internal.Key(pod), expected.node, expected.gpuIsolation, psr.PodBindInfo.Node, psr.PodBindInfo.GpuIsolation)
 	}
 }
+
+func TestUpdateAffinityGroupPriority(t *testing.T) {
+	sConfig := newTestConfig()
+	vcSpec := (*sConfig.VirtualClusters)["VC2"]
+	vcSpec.UserQuota = &api.UserQuotaSpec{Users: map[string][]api.PriorityGpuLimitSpec{
+		api.DefaultUserName: {{MinPriority: 10, MaxPriority: 20, GpuNumber: 1}},
+	}}
+	(*sConfig.VirtualClusters)["VC2"] = vcSpec
+	h := newTestAlgorithm(sConfig)
+	pod := allPods["pod24"]
+	pod.Annotations[api.AnnotationKeyPodSchedulingSpec] = common.ToYaml(pss[pod.UID])
+	scheduleAndAllocate(t, h, pod)
+
+	ag := h.UpdateAffinityGroupPriority(group15.Name, 5)
+	if ag.Status.Priority != 5 {
+		t.Errorf("Expected priority 5 in the affinity group status, but got %v", ag.Status.Priority)
+	}
+	g := h.allocatedAffinityGroups[group15.Name]
+	for i, gpu := range g.physicalGpuPlacement[2][0] {
+		vGpu := g.virtualGpuPlacement[2][0][i]
+		if gpu.GetPriority() != 5 || vGpu.GetPriority() != 5 {
+			t.Errorf("Expected priority 5 of cells %v and %v, but got %v and %v",
+				gpu.GetName(), vGpu.GetName(), gpu.GetPriority(), vGpu.GetPriority())
+		}
+		if top := vGpu.(*VirtualCell).GetPreAssignedCell(); top.GetPriority() != 5 || top.GetUsedGpuNumAtPriorities()[5] != 2 {
+			t.Errorf("Expected 2 GPUs used at priority 5 in cell %v, but got %v",
+				top.GetName(), top.GetUsedGpuNumAtPriorities())
+		}
+	}
+
+	for _, p := range []int32{api.OpportunisticPriority, api.MaxGuaranteedPriority + 1, 15} {
+		expectBadRequest(t, fmt.Sprintf("updating priority to %v", p), func() {
+			h.UpdateAffinityGroupPriority(group15.Name, p)
+		})
+	}
+
+	// the priority is recorded in the bind info, so the group is recovered with it
+	changedPods := h.TakeChangedAllocatedPods()
+	if len(changedPods) != 1 {
+		t.Fatalf("Expected 1 changed pod, but got %v", len(changedPods))
+	}
+	recovered := newTestAlgorithm(sConfig)
+	recovered.AddAllocatedPod(changedPods[0])
+	if g := recovered.allocatedAffinityGroups[group15.Name]; g.priority != 5 || g.virtualGpuPlacement == nil {
+		t.Errorf("Expected group %v recovered with priority 5, but got %v", group15.Name, g.priority)
+	}
+	h.DeleteAllocatedPod(changedPods[0])
+}
+
+func TestPreemptingAffinityGroup(t *testing.T) {
+	h := newTestAlgorithm(newTestConfig())
+	now := time.Now()
+	h.now = func() time.Time { return now }
+	newPod := func(group string, index int, priority int32, podNumber int32) *core.Pod {
+		return newTestPod(fmt.Sprintf("%v-%v", group, index), api.PodSchedulingSpec{
+			VirtualCluster: "VC2",
+			Priority:       priority,
+			GpuType:        "DGX1-P100",
+			GpuNumber:      8,
+			AffinityGroup: &api.AffinityGroupSpec{
+				Name:    "test/" + group,
+				Members: []api.AffinityGroupMemberSpec{{PodNumber: podNumber, GpuNumber: 8}},
+			},
+		})
+	}
+	var victims []*core.Pod
+	for i := 0; i < 3; i++ {
+		victims = append(victims, scheduleAndAllocate(t, h, newPod("o", i, api.OpportunisticPriority, 3)))
+	}
+	preemptor := newPod("g", 0, 1, 2)
+	schedulePreemptor := func() {
+		if psr := h.Schedule(preemptor, allNodes); psr.PodPreemptInfo == nil {
+			t.Fatalf("Expected to preempt, but got %v", common.ToJson(psr))
+		}
+		if g := h.GetAffinityGroup("test/g"); g.Status.PreemptionStatus == nil {
+			t.Errorf("Expected test/g preempting, but got %v", g)
+		}
+	}
+
+	// the preemption is canceled once the preempting pod is deleted
+	schedulePreemptor()
+	h.DeleteUnallocatedPod(preemptor)
+	expectBadRequest(t, "getting a group whose preempting pod is deleted", func() { h.GetAffinityGroup("test/g") })
+
+	// the preemption expires if it is not retried
+	schedulePreemptor()
+	now = now.Add(preemptingAffinityGroupTimeout / 2)
+	h.Reconcile()
+	h.GetAffinityGroup("test/g")
+	now = now.Add(preemptingAffinityGroupTimeout)
+	h.Reconcile()
+	expectBadRequest(t, "getting a group whose preemption expired", func() { h.GetAffinityGroup("test/g") })
+
+	for _, pod := range victims {
+		h.DeleteAllocatedPod(pod)
+	}
+}
+
+func TestGpuTypePreference(t *testing.T) {
+	h := newTestAlgorithm(newTestConfig())
+	now := time.Now()
+	h.now = func() time.Time { return now }
+	newPod := func(name string, gpuTypes []string, fallbackWaitSec int64) *core.Pod {
+		pod := newTestPod(name, api.PodSchedulingSpec{
+			VirtualCluster:         "VC2",
+			Priority:               1,
+			GpuTypes:               gpuTypes,
+			GpuTypeFallbackWaitSec: fallbackWaitSec,
+			GpuNumber:              2,
+			AffinityGroup: &api.AffinityGroupSpec{
+				Name:    name,
+				Members: []api.AffinityGroupMemberSpec{{PodNumber: 1, GpuNumber: 2}},
+			},
+		})
+		pod.CreationTimestamp = meta.NewTime(now)
+		return pod
+	}
+	cases := []struct {
+		name            string
+		gpuTypes        []string
+		fallbackWaitSec int64
+		expectedGpuType string // empty means the pod should wait
+	}{
+		{"prefer-p100", []string{"DGX1-P100", "CT1"}, 0, "DGX1-P100"},
+		{"prefer-ct1", []string{"CT1", "DGX1-P100"}, 0, "CT1"},
+		{"wait-for-ct1", []string{"CT1", "DGX1-P100"}, api.UnlimitedValue, ""},
+		{"wait-before-fallback", []string{"CT1", "DGX1-P100"}, 60, ""},
+		{"fallback-to-p100", []string{"CT1", "DGX1-P100"}, 0, "DGX1-P100"},
+	}
+	for _, c := range cases {
+		pod := newPod(c.name, c.gpuTypes, c.fallbackWaitSec)
+		psr := h.Schedule(pod, allNodes)
+		if c.expectedGpuType == "" {
+			if psr.PodWaitInfo == nil {
+				t.Errorf("[%v]: expected to wait, but got %v", internal.Key(pod), common.ToJson(psr))
+			}
+			continue
+		}
+		if psr.PodBindInfo == nil || psr.PodBindInfo.GpuType != c.expectedGpuType {
+			t.Errorf("[%v]: expected to bind to GPU type %v, but got %v",
+				internal.Key(pod), c.expectedGpuType, common.ToJson(psr))
+			continue
+		}
+		allocatedPod := internal.NewBindingPod(pod, psr.PodBindInfo)
+		if gpuType := allocatedPod.Annotations[api.AnnotationKeyPodGpuType]; gpuType != c.expectedGpuType {
+			t.Errorf("[%v]: expected GPU type annotation %v, but got %v", internal.Key(pod), c.expectedGpuType, gpuType)
+		}
+		h.AddAllocatedPod(allocatedPod)
+	}
+
+	// the pod falls back only after it has waited for the fallback time
+	pod := newPod("fallback-after-wait", []string{"CT1", "DGX1-P100"}, 60)
+	now = now.Add(30 * time.Second)
+	if psr := h.Schedule(pod, allNodes); psr.PodWaitInfo == nil {
+		t.Errorf("[%v]: expected to wait before the fallback time, but got %v", internal.Key(pod), common.ToJson(psr))
+	}
+	now = now.Add(30 * time.Second)
+	if psr := h.Schedule(pod, allNodes); psr.PodBindInfo == nil || psr.PodBindInfo.GpuType != "DGX1-P100" {
+		t.Errorf("[%v]: expected to fall back to DGX1-P100, but got %v", internal.Key(pod), common.ToJson(psr))
+	}
+}
+
+func TestHeterogeneousAffinityGroup(t *testing.T) {
+	sConfig := newTestConfig()
+	h := newTestAlgorithm(sConfig)
+	newPod := func(name string, groupName string, gpuNumber int32, members []api.AffinityGroupMemberSpec) *core.Pod {
+		return newTestPod(name, api.PodSchedulingSpec{
+			VirtualCluster: "VC2",
+			Priority:       1,
+			GpuNumber:      gpuNumber,
+			AffinityGroup:  &api.AffinityGroupSpec{Name: groupName, Members: members},
+		})
+	}
+
+	// the CT1 member cannot fit into the VC, so the whole group should wait
+	members := []api.AffinityGroupMemberSpec{
+		{PodNumber: 1, GpuNumber: 4, GpuType: "CT1"},
+		{PodNumber: 1, GpuNumber: 1, GpuType: "DGX1-P100"},
+	}
+	if psr := h.Schedule(newPod("hetero-wait", "hetero-wait", 1, members), allNodes); psr.PodWaitInfo == nil {
+		t.Errorf("Group hetero-wait is expected to wait, but got %v", common.ToJson(psr))
+	}
+
+	members = []api.AffinityGroupMemberSpec{
+		{PodNumber: 1, GpuNumber: 2, GpuType: "CT1"},
+		{PodNumber: 2, GpuNumber: 4, GpuType: "DGX1-P100"},
+	}
+	pods := []*core.Pod{
+		newPod("hetero-ct1-0", "hetero", 2, members),
+		newPod("hetero-p100-0", "hetero", 4, members),
+		newPod("hetero-p100-1", "hetero", 4, members),
+	}
+	expectedGpuTypes := map[int32]string{2: "CT1", 4: "DGX1-P100"}
+	var allocated []*core.Pod
+	for _, pod := range pods {
+		gpuNumber := internal.ExtractPodSchedulingSpec(pod).GpuNumber
+		psr := h.Schedule(pod, allNodes)
+		if psr.PodBindInfo == nil || psr.PodBindInfo.GpuType != expectedGpuTypes[gpuNumber] {
+			t.Fatalf("[%v]: expected to bind to GPU type %v, but got %v",
+				internal.Key(pod), expectedGpuTypes[gpuNumber], common.ToJson(psr))
+		}
+		for _, mbi := range psr.PodBindInfo.AffinityGroupBindInfo {
+			memberGpuNumber := int32(len(mbi.PodPlacements[0].PhysicalGpuIndices))
+			if gpuType := string(h.cellTypes[CellChain(mbi.CellChain)][lowestLevel]); gpuType != expectedGpuTypes[memberGpuNumber] {
+				t.Errorf("[%v]: expected member with %v GPUs in chain of %v, but got %v",
+					internal.Key(pod), memberGpuNumber, expectedGpuTypes[memberGpuNumber], mbi.CellChain)
+			}
+		}
+		allocatedPod := internal.NewBindingPod(pod, psr.PodBindInfo)
+		h.AddAllocatedPod(allocatedPod)
+		allocated = append(allocated, allocatedPod)
+	}
+
+	// the per-member chains should be recovered after restarting
+	h = NewHivedAlgorithm(sConfig)
+	for _, pod := range allocated {
+		h.AddAllocatedPod(pod)
+	}
+	g := h.allocatedAffinityGroups["hetero"]
+	for gpuNum, podPlacements := range g.physicalGpuPlacement {
+		for podIndex, podPlacement := range podPlacements {
+			if g.allocatedPods[gpuNum][podIndex] == nil {
+				t.Errorf("Pod %v with %v GPUs in group hetero is expected to be recovered, but not", podIndex, gpuNum)
+			}
+			for _, gpu := range podPlacement {
+				if gpu == nil || string(h.cellTypes[gpu.GetChain()][lowestLevel]) != expectedGpuTypes[gpuNum] ||
+					gpu.(*PhysicalCell).GetVirtualCell() == nil {
+					t.Errorf("Pod %v with %v GPUs in group hetero is expected to be recovered to %v in VC, but got %v",
+						podIndex, gpuNum, expectedGpuTypes[gpuNum], gpu)
+				}
+			}
+		}
+	}
+
+	// the members with the same GPU number can use different GPU types
+	h = newTestAlgorithm(sConfig)
+	members = []api.AffinityGroupMemberSpec{
+		{PodNumber: 1, GpuNumber: 1, GpuType: "DGX1-P100"},
+		{PodNumber: 1, GpuNumber: 1, GpuType: "CT1"},
+	}
+	expectBadRequest(t, "the pod does not specify the GPU type of its member", func() {
+		h.Schedule(newPod("mixed-untyped", "mixed", 1, members), allNodes)
+	})
+	allocated = nil
+	for _, gpuType := range []string{"CT1", "DGX1-P100"} {
+		pod := newTestPod("mixed-"+gpuType, api.PodSchedulingSpec{
+			VirtualCluster: "VC2",
+			Priority:       1,
+			GpuType:        gpuType,
+			GpuNumber:      1,
+			AffinityGroup:  &api.AffinityGroupSpec{Name: "mixed", Members: members},
+		})
+		allocatedPod := scheduleAndAllocate(t, h, pod)
+		if info := internal.ExtractPodBindInfo(allocatedPod); info.GpuType != gpuType {
+			t.Errorf("[%v]: expected to bind to GPU type %v, but got %v", internal.Key(pod), gpuType, info.GpuType)
+		}
+		allocated = append(allocated, allocatedPod)
+	}
+	h = newTestAlgorithm(sConfig)
+	for _, pod := range allocated {
+		h.AddAllocatedPod(pod)
+	}
+	g = h.allocatedAffinityGroups["mixed"]
+	for podIndex, gpuType := range []string{"DGX1-P100", "CT1"} {
+		gpu := g.physicalGpuPlacement[1][podIndex][0]
+		if g.allocatedPods[1][podIndex] == nil || gpu == nil ||
+			string(h.cellTypes[gpu.GetChain()][lowestLevel]) != gpuType {
+			t.Errorf("Pod %v in group mixed is expected to be recovered to %v, but got %v", podIndex, gpuType, gpu)
+		}
+	}
+
+	// no group is lazy preempted if the group cannot be scheduled as a whole
+	h = newTestAlgorithm(sConfig)
+	lazyPod := allPods["pod24"]
+	lazyPod.Annotations[api.AnnotationKeyPodSchedulingSpec] = common.ToYaml(pss[lazyPod.UID])
+	scheduleAndAllocate(t, h, lazyPod)
+	members = []api.AffinityGroupMemberSpec{
+		{PodNumber: 1, GpuNumber: 2, GpuType: "CT1"},
+		{PodNumber: 4, GpuNumber: 8, GpuType: "DGX1-P100"},
+	}
+	if psr := h.Schedule(newPod("hetero-fail", "hetero-fail", 2, members), allNodes); psr.PodWaitInfo == nil {
+		t.Errorf("Group hetero-fail is expected to wait, but got %v", common.ToJson(psr))
+	}
+	if g = h.allocatedAffinityGroups[group15.Name]; g.virtualGpuPlacement == nil || g.lazyPreemptionStatus != nil {
+		t.Errorf("Group %v is expected not to be lazy preempted, but got %v", g.name, g.lazyPreemptionStatus)
+	}
+}
+
+func TestZeroGpuPods(t *testing.T) {
+	sConfig := newTestConfig()
+	vcSpec := (*sConfig.VirtualClusters)["VC2"]
+	vcSpec.CpuQuota = "2"
+	(*sConfig.VirtualClusters)["VC2"] = vcSpec
+	h := newTestAlgorithm(sConfig)
+	newPod := func(name string, gpuNumber int32, cpu string, group *api.AffinityGroupSpec) *core.Pod {
+		pod := newTestPod(name, api.PodSchedulingSpec{
+			VirtualCluster: "VC2",
+			Priority:       1,
+			GpuNumber:      gpuNumber,
+			AffinityGroup:  group,
+		})
+		pod.Spec.Containers = []core.Container{{Resources: core.ResourceRequirements{
+			Requests: core.ResourceList{core.ResourceCPU: resource.MustParse(cpu)},
+		}}}
+		return pod
+	}
+	group := &api.AffinityGroupSpec{
+		Name:    "cpu-helper",
+		Members: []api.AffinityGroupMemberSpec{{PodNumber: 1, GpuNumber: 2}, {PodNumber: 2, GpuNumber: 0}},
+	}
+	helper0 := newPod("cpu-helper-0", 0, "1", group)
+	helper1 := newPod("cpu-helper-1", 0, "1.5", group)
+	worker := newPod("cpu-helper-worker", 2, "1", group)
+
+	// the zero-GPU pod comes first, which schedules the whole group
+	psr := h.Schedule(helper0, allNodes)
+	if psr.PodBindInfo == nil || len(psr.PodBindInfo.GpuIsolation) != 0 {
+		t.Fatalf("[%v]: expected to bind with no GPU, but got %v", internal.Key(helper0), common.ToJson(psr))
+	}
+	helperNode := psr.PodBindInfo.Node
+	allocatedHelper0 := internal.NewBindingPod(helper0, psr.PodBindInfo)
+	h.AddAllocatedPod(allocatedHelper0)
+	if allocatedWorker := scheduleAndAllocate(t, h, worker); allocatedWorker.Spec.NodeName != helperNode {
+		t.Fatalf("[%v]: expected to bind to node %v, but got %v", internal.Key(worker), helperNode, allocatedWorker.Spec.NodeName)
+	}
+
+	// the CPU quota of the VC is exceeded
+	if psr = h.Schedule(helper1, allNodes); psr.PodWaitInfo == nil {
+		t.Errorf("[%v]: expected to wait for CPU quota, but got %v", internal.Key(helper1), common.ToJson(psr))
+	}
+	h.DeleteAllocatedPod(allocatedHelper0)
+	if psr = h.Schedule(helper1, allNodes); psr.PodBindInfo == nil || psr.PodBindInfo.Node != helperNode {
+		t.Errorf("[%v]: expected to bind to node %v, but got %v", internal.Key(helper1), helperNode, common.ToJson(psr))
+	}
+	h.AddAllocatedPod(internal.NewBindingPod(helper1, psr.PodBindInfo))
+	if g := h.allocatedAffinityGroups[group.Name]; g.allocatedPods[0][0] == nil {
+		t.Errorf("Pod %v is expected to be allocated in group %v, but not", internal.Key(helper1), group.Name)
+	}
+
+	// a standalone zero-GPU pod can be placed on any node of the VC
+	standalone := newPod("cpu-standalone", 0, "0.5", nil)
+	vcNodes := common.NewSet()
+	for _, n := range h.getVcNodes("VC2", "") {
+		vcNodes.Add(n)
+	}
+	if psr = h.Schedule(standalone, allNodes); psr.PodBindInfo == nil || !vcNodes.Contains(psr.PodBindInfo.Node) {
+		t.Errorf("[%v]: expected to bind to a node of VC2, but got %v", internal.Key(standalone), common.ToJson(psr))
+	}
+
+	// an opportunistic pod is not counted in the usage, even if it is deleted after its group is upgraded
+	opportunistic := newPod("cpu-opportunistic", 0, "0.5", nil)
+	opportunistic.Annotations[api.AnnotationKeyPodSchedulingSpec] = common.ToYaml(api.PodSchedulingSpec{
+		VirtualCluster: "VC2",
+		Priority:       api.OpportunisticPriority,
+	})
+	allocatedOpportunistic := scheduleAndAllocate(t, h, opportunistic)
+	upgradedPriority := int32(1)
+	h.allocatedAffinityGroups["test/cpu-opportunistic"].priority = CellPriority(upgradedPriority)
+	info := internal.ExtractPodBindInfo(allocatedOpportunistic)
+	info.AffinityGroupPriority = &upgradedPriority
+	h.DeleteAllocatedPod(internal.NewBindingPod(allocatedOpportunistic, info))
+	if cpu := h.vcResourceUsages["VC2"][core.ResourceCPU]; cpu.Cmp(resource.MustParse("1.5")) != 0 {
+		t.Errorf("Expected 1.5 CPU used in VC2, but got %v", cpu.String())
+	}
+}
+
+func TestNonGpuDevice(t *testing.T) {
+	rawConfig := newTestRawConfig()
+	rawConfig.PhysicalCluster.CellTypes["FPGA"] = api.CellTypeSpec{
+		DeviceResourceName:        "xilinx.com/fpga",
+		DeviceIsolationAnnotation: "xilinx.com/pod-fpga-isolation",
+		DeviceIsolationEnv:        "XILINX_VISIBLE_DEVICES",
+	}
+	rawConfig.PhysicalCluster.CellTypes["FPGA-NODE"] = api.CellTypeSpec{
+		ChildCellType:   "FPGA",
+		ChildCellNumber: 2,
+		IsNodeLevel:     true,
+	}
+	rawConfig.PhysicalCluster.PhysicalCells = append(rawConfig.PhysicalCluster.PhysicalCells,
+		api.PhysicalCellSpec{CellType: "FPGA-NODE", CellAddress: "fpga-0"})
+	vcSpec := (*rawConfig.VirtualClusters)["VC2"]
+	vcSpec.VirtualCells = append(vcSpec.VirtualCells, api.VirtualCellSpec{CellType: "FPGA-NODE", CellNumber: 1})
+	(*rawConfig.VirtualClusters)["VC2"] = vcSpec
+	h := newTestAlgorithm(api.NewConfig(rawConfig))
+
+	pod := newTestPod("fpga", api.PodSchedulingSpec{
+		VirtualCluster: "VC2",
+		Priority:       1,
+		GpuType:        "FPGA",
+		GpuNumber:      2,
+	})
+	h.ValidatePod(pod)
+	psr := h.Schedule(pod, append(allNodes, "fpga-0"))
+	if psr.PodBindInfo == nil || psr.PodBindInfo.Node != "fpga-0" {
+		t.Fatalf("[%v]: expected to bind to FPGAs on node fpga-0, but got %v", internal.Key(pod), common.ToJson(psr))
+	}
+	annotations := internal.ExtractPodBindAnnotations(internal.NewBindingPod(pod, psr.PodBindInfo))
+	if isolation := annotations["xilinx.com/pod-fpga-isolation"]; isolation != "0,1" {
+		t.Errorf("[%v]: expected FPGA isolation 0,1, but got %v", internal.Key(pod), isolation)
+	}
+	if _, ok := annotations[api.AnnotationKeyPodGpuIsolation]; ok {
+		t.Errorf("[%v]: expected no GPU isolation, but got %v", internal.Key(pod), annotations)
+	}
+
+	// the FPGAs are allocated by the scheduler, not through the device plugin
+	pod.Spec.Containers = []core.Container{{Resources: core.ResourceRequirements{
+		Limits: core.ResourceList{"xilinx.com/fpga": resource.MustParse("2")},
+	}}}
+	expectBadRequest(t, "the pod requests the device resource", func() {
+		h.ValidatePod(pod)
+	})
+}
+
+func TestCpuIsolation(t *testing.T) {
+	rawConfig := newTestRawConfig()
+	socketSpec := rawConfig.PhysicalCluster.CellTypes["DGX1-P100-CPU-SOCKET"]
+	socketSpec.CpuSet = []string{"0-19", "20-39"}
+	rawConfig.PhysicalCluster.CellTypes["DGX1-P100-CPU-SOCKET"] = socketSpec
+	h := newTestAlgorithm(api.NewConfig(rawConfig))
+	for _, c := range []struct {
+		name            string
+		gpuNumber       int32
+		expectedCpuSets []string
+	}{
+		{"cpu-isolation-socket", 4, []string{"0-19", "20-39"}},
+		{"cpu-isolation-node", 8, []string{"0-39"}},
+	} {
+		pod := scheduleAndAllocate(t, h, newTestPod(c.name, api.PodSchedulingSpec{
+			VirtualCluster: "VC2",
+			Priority:       1,
+			GpuType:        "DGX1-P100",
+			GpuNumber:      c.gpuNumber,
+		}))
+		if cpuSet := pod.Annotations[api.AnnotationKeyPodCpuIsolation]; !common.StringsContains(c.expectedCpuSets, cpuSet) {
+			t.Errorf("[%v]: expected CPU isolation in %v, but got %v", internal.Key(pod), c.expectedCpuSets, cpuSet)
+		}
+	}
+}
+
+func TestNicIsolation(t *testing.T) {
+	rawConfig := newTestRawConfig()
+	switchSpec := rawConfig.PhysicalCluster.CellTypes["DGX1-P100-PCI-SWITCH"]
+	switchSpec.Nics = []string{"mlx5_0", "mlx5_1"}
+	rawConfig.PhysicalCluster.CellTypes["DGX1-P100-PCI-SWITCH"] = switchSpec
+	h := newTestAlgorithm(api.NewConfig(rawConfig))
+	for _, c := range []struct {
+		name         string
+		gpuNumber    int32
+		expectedNics []string
+	}{
+		{"nic-isolation-switch", 2, []string{"mlx5_0", "mlx5_1"}},
+		{"nic-isolation-socket", 4, []string{"mlx5_0,mlx5_1"}},
+	} {
+		pod := scheduleAndAllocate(t, h, newTestPod(c.name, api.PodSchedulingSpec{
+			VirtualCluster: "VC2",
+			Priority:       1,
+			GpuType:        "DGX1-P100",
+			GpuNumber:      c.gpuNumber,
+		}))
+		if nics := pod.Annotations[api.AnnotationKeyPodNicIsolation]; !common.StringsContains(c.expectedNics, nics) {
+			t.Errorf("[%v]: expected NIC isolation in %v, but got %v", internal.Key(pod), c.expectedNics, nics)
+		}
+	}
+}
+
+// getChainNodes returns the nodes of all the chains of the GPU type.
+func getChainNodes(h *HivedAlgorithm, gpuType string) []string {
+	var nodes []string
+	for _, chain := range h.chains[gpuType] {
+		ccl := h.fullCellList[chain]
+		for _, c := range ccl[CellLevel(len(ccl))] {
+			n, _ := c.(*PhysicalCell).GetPhysicalPlacement()
+			nodes = append(nodes, n...)
+		}
+	}
+	return nodes
+}
+
+func TestSuggestedNodesForGuaranteedPods(t *testing.T) {
+	h := newTestAlgorithm(newTestConfig())
+	p100Nodes := getChainNodes(h, "DGX1-P100")
+	group := &api.AffinityGroupSpec{
+		Name:    "suggested",
+		Members: []api.AffinityGroupMemberSpec{{PodNumber: 2, GpuNumber: 1}},
+	}
+	newPod := func(name string) *core.Pod {
+		return newTestPod(name, api.PodSchedulingSpec{
+			VirtualCluster: "VC2",
+			Priority:       1,
+			GpuNumber:      1,
+			AffinityGroup:  group,
+		})
+	}
+
+	// CT1 is tried first, but skipped since its nodes are not suggested
+	pod := newPod("suggested-0")
+	psr := h.Schedule(pod, p100Nodes)
+	if psr.PodBindInfo == nil || psr.PodBindInfo.GpuType != "DGX1-P100" {
+		t.Fatalf("[%v]: expected to bind to DGX1-P100, but got %v", internal.Key(pod), common.ToJson(psr))
+	}
+	h.AddAllocatedPod(internal.NewBindingPod(pod, psr.PodBindInfo))
+
+	// the pod of the allocated group waits if its node is not suggested
+	pod = newPod("suggested-1")
+	psr = h.Schedule(pod, []string{})
+	if psr.PodWaitInfo == nil {
+		t.Errorf("[%v]: expected to wait, but got %v", internal.Key(pod), common.ToJson(psr))
+	}
+	if psr = h.Schedule(pod, p100Nodes); psr.PodBindInfo == nil {
+		t.Errorf("[%v]: expected to bind, but got %v", internal.Key(pod), common.ToJson(psr))
+	}
+
+	// all the pods of a new group are placed within the suggested nodes, or the group waits
+	for _, priority := range []int32{1, api.OpportunisticPriority} {
+		h = newTestAlgorithm(newTestConfig())
+		for _, c := range []struct {
+			podNumber  int32
+			gpuNumber  int32
+			expectBind bool
+		}{{2, 4, true}, {2, 8, false}} {
+			name := fmt.Sprintf("suggested-%v-%v-%v", priority, c.podNumber, c.gpuNumber)
+			pod = newTestPod(name, api.PodSchedulingSpec{
+				VirtualCluster: "VC2",
+				Priority:       priority,
+				GpuType:        "DGX1-P100",
+				GpuNumber:      c.gpuNumber,
+				AffinityGroup: &api.AffinityGroupSpec{
+					Name:    name,
+					Members: []api.AffinityGroupMemberSpec{{PodNumber: c.podNumber, GpuNumber: c.gpuNumber}},
+				},
+			})
+			psr = h.Schedule(pod, p100Nodes[:1])
+			if !c.expectBind {
+				if psr.PodBindInfo != nil {
+					t.Errorf("[%v]: expected to wait, but got %v", internal.Key(pod), common.ToJson(psr))
+				}
+				continue
+			}
+			if psr.PodBindInfo == nil {
+				t.Fatalf("[%v]: expected to bind, but got %v", internal.Key(pod), common.ToJson(psr))
+			}
+			for _, placement := range psr.PodBindInfo.AffinityGroupBindInfo[0].PodPlacements {
+				if placement.PhysicalNode != p100Nodes[0] {
+					t.Errorf("[%v]: expected all the pods on node %v, but got %v",
+						internal.Key(pod), p100Nodes[0], common.ToJson(psr.PodBindInfo))
+				}
+			}
+		}
+	}
+}
+
+func TestTopologyConstraint(t *testing.T) {
+	sConfig := newTestConfig()
+	h := newTestAlgorithm(sConfig)
+	p100Nodes := getChainNodes(h, "DGX1-P100")
+	newPod := func(name string, priority int32, gpuNumber int32, group *api.AffinityGroupSpec) *core.Pod {
+		return newTestPod(name, api.PodSchedulingSpec{
+			VirtualCluster: "VC2",
+			Priority:       priority,
+			GpuType:        "DGX1-P100",
+			GpuNumber:      gpuNumber,
+			AffinityGroup:  group,
+		})
+	}
+	scheduleGroup := func(h *HivedAlgorithm, priority int32, group *api.AffinityGroupSpec) []*api.PodBindInfo {
+		var bindInfos []*api.PodBindInfo
+		for _, m := range group.Members {
+			for i := int32(0); i < m.PodNumber; i++ {
+				pod := newPod(fmt.Sprintf("%v-%v-%v", group.Name, m.GpuNumber, i), priority, m.GpuNumber, group)
+				psr := h.Schedule(pod, p100Nodes)
+				if psr.PodBindInfo == nil {
+					return nil
+				}
+				h.AddAllocatedPod(internal.NewBindingPod(pod, psr.PodBindInfo))
+				bindInfos = append(bindInfos, psr.PodBindInfo)
+			}
+		}
+		return bindInfos
+	}
+
+	// each pod is placed on a distinct node, including the one in a preassigned cell lower than node
+	group := &api.AffinityGroupSpec{
+		Name:         "anti-affinity",
+		Members:      []api.AffinityGroupMemberSpec{{PodNumber: 3, GpuNumber: 2}},
+		AntiAffinity: api.AntiAffinityNode,
+	}
+	nodes := common.NewSet()
+	for _, info := range scheduleGroup(h, 1, group) {
+		if nodes.Contains(info.Node) {
+			t.Errorf("Pods in group %v are expected to be on distinct nodes, but got %v twice", group.Name, info.Node)
+		}
+		nodes.Add(info.Node)
+	}
+	if len(nodes.Items()) != 3 {
+		t.Errorf("Pods in group %v are expected to be on 3 nodes, but got %v", group.Name, nodes)
+	}
+
+	// the pods are placed within one cell of the max cell type
+	h = newTestAlgorithm(sConfig)
+	group = &api.AffinityGroupSpec{
+		Name:        "max-cell-type",
+		Members:     []api.AffinityGroupMemberSpec{{PodNumber: 2, GpuNumber: 2}},
+		MaxCellType: "DGX1-P100-CPU-SOCKET",
+	}
+	scheduleGroup(h, api.OpportunisticPriority, group)
+	var affinity Cell
+	for _, podPlacements := range h.allocatedAffinityGroups[group.Name].physicalGpuPlacement {
+		for _, podGpus := range podPlacements {
+			for _, gpu := range podGpus {
+				if affinity == nil {
+					affinity = gpu
+				} else {
+					affinity = findLCA(gpu, affinity)
+				}
+			}
+		}
+	}
+	if affinity == nil || affinity.GetLevel() > 3 {
+		t.Errorf("Pods in group %v are expected to be within a CPU socket, but got affinity %v", group.Name, affinity)
+	}
+
+	// buddy alloc places the preassigned cells lower than node according to the constraints
+	h = newTestAlgorithm(sConfig)
+	for i := 0; i < 2; i++ {
+		scheduleGroup(h, 1, &api.AffinityGroupSpec{
+			Name:    fmt.Sprintf("full-node-%v", i),
+			Members: []api.AffinityGroupMemberSpec{{PodNumber: 1, GpuNumber: 8}},
+		})
+	}
+	group = &api.AffinityGroupSpec{
+		Name:         "anti-affinity-socket",
+		Members:      []api.AffinityGroupMemberSpec{{PodNumber: 2, GpuNumber: 4}},
+		AntiAffinity: api.AntiAffinityNode,
+	}
+	if bindInfos := scheduleGroup(h, 1, group); bindInfos != nil {
+		t.Errorf("Group %v is expected to wait since only one node is free, but got %v", group.Name, common.ToJson(bindInfos))
+	}
+	group = &api.AffinityGroupSpec{
+		Name:        "max-cell-type-socket",
+		Members:     []api.AffinityGroupMemberSpec{{PodNumber: 2, GpuNumber: 4}},
+		MaxCellType: "DGX1-P100-NODE",
+	}
+	if bindInfos := scheduleGroup(h, 1, group); len(bindInfos) != 2 || bindInfos[0].Node != bindInfos[1].Node {
+		t.Errorf("Pods in group %v are expected to be on the same node, but got %v", group.Name, common.ToJson(bindInfos))
+	}
+
+	// a pod waits if the constraints cannot be satisfied, or is rejected if they are illegal
+	group = &api.AffinityGroupSpec{
+		Name:         "unsatisfiable",
+		Members:      []api.AffinityGroupMemberSpec{{PodNumber: 2, GpuNumber: 1}},
+		MaxCellType:  "DGX1-P100-CPU-SOCKET",
+		AntiAffinity: api.AntiAffinityNode,
+	}
+	if psr := h.Schedule(newPod("unsatisfiable", 1, 1, group), p100Nodes); psr.PodWaitInfo == nil {
+		t.Errorf("Group %v is expected to wait, but got %v", group.Name, common.ToJson(psr))
+	}
+	for _, group = range []*api.AffinityGroupSpec{
+		{Name: "illegal-0", Members: group.Members, MaxCellType: "NON-EXISTENT"},
+		{Name: "illegal-1", Members: group.Members, AntiAffinity: "DGX1-P100-PCI-SWITCH"},
+		{Name: "illegal-2", Members: group.Members, MaxCellType: "DGX1-P100-NODE", MaxCellLevel: 2},
+	} {
+		expectBadRequest(t, "scheduling group "+group.Name, func() {
+			h.Schedule(newPod(group.Name, 1, 1, group), p100Nodes)
+		})
+	}
+}
+
+func TestValidatePod(t *testing.T) {
+	h := newTestAlgorithm(newTestConfig())
+	groupSpec := func(podNumber int32) *api.AffinityGroupSpec {
+		return &api.AffinityGroupSpec{
+			Name:    "test/group",
+			Members: []api.AffinityGroupMemberSpec{{PodNumber: podNumber, GpuNumber: 1}},
+		}
+	}
+
+	pod := newTestPod("pod", api.PodSchedulingSpec{
+		VirtualCluster: "VC2", Priority: 1, GpuType: "CT1", GpuNumber: 1, AffinityGroup: groupSpec(2)})
+	h.ValidatePod(pod)
+	scheduleAndAllocate(t, h, pod)
+	h.ValidatePod(newTestPod("pod-2", api.PodSchedulingSpec{
+		VirtualCluster: "VC2", Priority: 1, GpuType: "CT1", GpuNumber: 1, AffinityGroup: groupSpec(2)}))
+	// opportunistic pods can use the GPU types not in their VCs
+	h.ValidatePod(newTestPod("opportunistic-pod", api.PodSchedulingSpec{
+		VirtualCluster: "VC2", Priority: api.OpportunisticPriority, GpuType: "DGX2-V100", GpuNumber: 1}))
+
+	for _, c := range []struct {
+		desc string
+		spec api.PodSchedulingSpec
+	}{
+		{"malformed spec", api.PodSchedulingSpec{VirtualCluster: "VC2", Priority: 1, GpuNumber: -1}},
+		{"non-existent VC", api.PodSchedulingSpec{VirtualCluster: "VC3", Priority: 1, GpuNumber: 1}},
+		{"non-existent GPU type", api.PodSchedulingSpec{
+			VirtualCluster: "VC2", Priority: 1, GpuType: "K80", GpuNumber: 1}},
+		{"GPU type not in the VC", api.PodSchedulingSpec{
+			VirtualCluster: "VC2", Priority: 1, GpuType: "DGX2-V100", GpuNumber: 1}},
+		{"reservation of another VC", api.PodSchedulingSpec{
+			VirtualCluster: "VC2", Priority: 1, ReservationId: "VC1-YQW-CT1", GpuNumber: 1}},
+		{"group in another VC", api.PodSchedulingSpec{
+			VirtualCluster: "VC1", Priority: 1, GpuType: "CT1", GpuNumber: 1, AffinityGroup: groupSpec(2)}},
+		{"group with different members", api.PodSchedulingSpec{
+			VirtualCluster: "VC2", Priority: 1, GpuType: "CT1", GpuNumber: 1, AffinityGroup: groupSpec(3)}},
+	} {
+		expectBadRequest(t, "validating "+c.desc, func() { h.ValidatePod(newTestPod("invalid-pod", c.spec)) })
+	}
+}
+
+func TestGpuHourLedger(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ledger")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sConfig := newTestConfig()
+	ledgerFilePath := filepath.Join(dir, "ledger.jsonl")
+	sConfig.LedgerFilePath = &ledgerFilePath
+	// rotate on every record
+	sConfig.LedgerMaxFileBytes = common.PtrInt64(1)
+	h := newTestAlgorithm(sConfig)
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	now := start
+	h.now = func() time.Time { return now }
+	newPod := func(name string, user string, priority int32, gpuNumber int32) *core.Pod {
+		pod := newTestPod(name, api.PodSchedulingSpec{
+			VirtualCluster: "VC2",
+			Priority:       priority,
+			GpuType:        "DGX1-P100",
+			GpuNumber:      gpuNumber,
+		})
+		pod.Labels = map[string]string{api.LabelKeyUser: user}
+		return pod
+	}
+
+	alicePod := scheduleAndAllocate(t, h, newPod("alice-0", "alice", 1, 2))
+	scheduleAndAllocate(t, h, newPod("bob-0", "bob", api.OpportunisticPriority, 1))
+	now = start.Add(time.Hour)
+	h.DeleteAllocatedPod(alicePod)
+	now = start.Add(2 * time.Hour)
+	if _, err := os.Stat(ledgerFilePath + ".2"); err != nil {
+		t.Errorf("Expected ledger rotated, but got %v", err)
+	}
+
+	expectedHours := func(items ...api.GpuHours) api.GpuHoursList {
+		return api.GpuHoursList{Items: items}
+	}
+	for _, c := range []struct {
+		start    time.Time
+		vc, user string
+		expected api.GpuHoursList
+	}{
+		{time.Time{}, "", "", expectedHours(
+			api.GpuHours{VirtualCluster: "VC2", User: "alice", GpuType: "DGX1-P100", Guaranteed: true, GpuHours: 2},
+			api.GpuHours{VirtualCluster: "VC2", User: "bob", GpuType: "DGX1-P100", Guaranteed: false, GpuHours: 2})},
+		{start.Add(30 * time.Minute), "VC2", "alice", expectedHours(
+			api.GpuHours{VirtualCluster: "VC2", User: "alice", GpuType: "DGX1-P100", Guaranteed: true, GpuHours: 1})},
+		{time.Time{}, "VC1", "", expectedHours()},
+	} {
+		list := h.GetGpuHours(c.start, time.Time{}, c.vc, c.user)
+		if !list.EndTime.Equal(&meta.Time{Time: now}) {
+			t.Errorf("Expected end time %v, but got %v", now, list.EndTime)
+		}
+		if len(list.Items) != len(c.expected.Items) || (len(list.Items) > 0 && !reflect.DeepEqual(list.Items, c.expected.Items)) {
+			t.Errorf("Expected GPU-hours %v in VC %v of user %v, but got %v",
+				common.ToJson(c.expected.Items), c.vc, c.user, common.ToJson(list.Items))
+		}
+	}
+
+	// the ledger is disabled by default
+	sConfig.LedgerFilePath = common.PtrString("")
+	h = NewHivedAlgorithm(sConfig)
+	expectBadRequest(t, "the ledger is disabled", func() { h.GetGpuHours(time.Time{}, time.Time{}, "", "") })
+}
@@ -36,8 +36,16 @@ type intraVCScheduler interface {
 	getNonReservedCellList() map[CellChain]ChainCellList
 	getReservedCellList() map[api.ReservationId]ChainCellList
 
-	// Scheduling an affinity group inside a VC. We use topologyAwareScheduler by default.
-	schedule(schedulingRequest) map[int32][]CellList
+	// Scheduling an affinity group inside a VC (within the suggested nodes if the virtual
+	// cells are bound). We use topologyAwareScheduler by default.
+	schedule(schedulingRequest, common.Set) map[int32][]CellList
+
+	// Adding or removing the cells of a reservation created or deleted at runtime.
+	addReservation(rid api.ReservationId, ccl ChainCellList)
+	removeReservation(rid api.ReservationId)
+
+	// Updating the schedulers after the preassigned cells are activated or deactivated by their time windows.
+	updateActiveCells()
 }
 
 type defaultIntraVCScheduler struct {
@@ -49,26 +57,33 @@ type defaultIntraVCScheduler struct {
 	// TODO: Support an affinity group can relax to be allocated across multiple chains.
 	nonReservedSchedulers map[CellChain]*topologyAwareScheduler
 	reservedSchedulers    map[api.ReservationId]*topologyAwareScheduler
+	// used to create the schedulers for the reservations created at runtime
+	gpuNums   map[CellChain]map[CellLevel]int32
+	costModel *preemptionCostModel
 }
 
 func newDefaultIntraVCScheduler(
 	nonReservedVcl map[CellChain]ChainCellList,
 	reservedVcl map[api.ReservationId]ChainCellList,
-	gpuNums map[CellChain]map[CellLevel]int32) *defaultIntraVCScheduler {
+	gpuNums map[CellChain]map[CellLevel]int32,
+	costModel *preemptionCostModel) *defaultIntraVCScheduler {
 
 	snr := map[CellChain]*topologyAwareScheduler{}
 	sr := map[api.ReservationId]*topologyAwareScheduler{}
 	for chain, ccl := range nonReservedVcl {
-		snr[chain] = NewTopologyAwareScheduler(ccl, gpuNums[chain], true, false)
+		snr[chain] = NewTopologyAwareScheduler(ccl, gpuNums[chain], true, false, costModel)
 	}
 	for rid, ccl := range reservedVcl {
-		sr[rid] = NewTopologyAwareScheduler(ccl, gpuNums[ccl[CellLevel(1)][0].GetChain()], true, false)
+		sr[rid] = NewTopologyAwareScheduler(
+			ccl, gpuNums[ccl[CellLevel(1)][0].GetChain()], true, false, costModel)
 	}
 	return &defaultIntraVCScheduler{
 		virtualNonReservedCellList: nonReservedVcl,
 		virtualReservedCellList:    reservedVcl,
 		nonReservedSchedulers:      snr,
 		reservedSchedulers:         sr,
+		gpuNums:                    gpuNums,
+		costModel:                  costModel,
 	}
 }
 
@@ -80,7 +95,63 @@ func (s *defaultIntraVCScheduler) getReservedCellList() map[api.ReservationId]Ch
 	return s.virtualReservedCellList
 }
 
-func (s *defaultIntraVCScheduler) schedule(sr schedulingRequest) map[int32][]CellList {
+func (s *defaultIntraVCScheduler) addReservation(rid api.ReservationId, ccl ChainCellList) {
+	s.virtualReservedCellList[rid] = ccl
+	s.reservedSchedulers[rid] = NewTopologyAwareScheduler(
+		ccl, s.gpuNums[ccl[CellLevel(1)][0].GetChain()], true, false, s.costModel)
+}
+
+func (s *defaultIntraVCScheduler) removeReservation(rid api.ReservationId) {
+	delete(s.virtualReservedCellList, rid)
+	delete(s.reservedSchedulers, rid)
+}
+
+func (s *defaultIntraVCScheduler) updateActiveCells() {
+	for chain, ccl := range s.virtualNonReservedCellList {
+		if activeCcl := getActiveCellList(ccl); activeCcl == nil {
+			delete(s.nonReservedSchedulers, chain)
+		} else {
+			s.nonReservedSchedulers[chain] = NewTopologyAwareScheduler(
+				activeCcl, s.gpuNums[chain], true, false, s.costModel)
+		}
+	}
+	for rid, ccl := range s.virtualReservedCellList {
+		if ccl[CellLevel(len(ccl))][0].(*VirtualCell).IsInactive() {
+			delete(s.reservedSchedulers, rid)
+		} else if s.reservedSchedulers[rid] == nil {
+			s.reservedSchedulers[rid] = NewTopologyAwareScheduler(
+				ccl, s.gpuNums[ccl[CellLevel(1)][0].GetChain()], true, false, s.costModel)
+		}
+	}
+}
+
+// getActiveCellList returns the cells in a ChainCellList whose preassigned cells are active,
+// or nil if there is no such cell.
+func getActiveCellList(ccl ChainCellList) ChainCellList {
+	top := CellLevel(0)
+	for l := CellLevel(len(ccl)); l >= lowestLevel && top == 0; l-- {
+		for _, c := range ccl[l] {
+			if !c.(*VirtualCell).GetPreAssignedCell().IsInactive() {
+				top = l
+				break
+			}
+		}
+	}
+	if top == 0 {
+		return nil
+	}
+	activeCcl := NewChainCellList(top)
+	for l := lowestLevel; l <= top; l++ {
+		for _, c := range ccl[l] {
+			if !c.(*VirtualCell).GetPreAssignedCell().IsInactive() {
+				activeCcl[l] = append(activeCcl[l], c)
+			}
+		}
+	}
+	return activeCcl
+}
+
+func (s *defaultIntraVCScheduler) schedule(sr schedulingRequest, suggestedNodeSet common.Set) map[int32][]CellList {
 	var scheduler *topologyAwareScheduler
 	var str string
 	if sr.reservationId != "" {
@@ -92,7 +163,7 @@ func (s *defaultIntraVCScheduler) schedule(sr schedulingRequest) map[int32][]Cel
 	}
 	var placement map[int32][]CellList
 	if scheduler != nil {
-		placement = scheduler.Schedule(sr.affinityGroupPodNums, sr.priority, common.NewSet())
+		placement = scheduler.Schedule(sr.affinityGroupPodNums, sr.priority, suggestedNodeSet, sr.topologyConstraint)
 	}
 	if placement == nil {
 		klog.Infof("Insufficient quota in VC %v for scheduling request: %v, GPU numbers %v, priority %v",
@@ -0,0 +1,112 @@
+// MIT License
+//
+// Copyright (c) Microsoft Corporation. All rights reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE
+
+package algorithm
+
+import (
+	"github.com/microsoft/hivedscheduler/pkg/api"
+	"sort"
+	"time"
+)
+
+// preemptionCostModel evaluates the cost of preempting a set of affinity groups, so that preemption
+// victims can be selected by minimizing the cost, instead of purely by cell priority.
+// See api.PreemptionCostWeights for the definition of the cost.
+type preemptionCostModel struct {
+	weights api.PreemptionCostWeights
+	now     func() time.Time // current time to calculate the runtime of the victims
+}
+
+func newPreemptionCostModel(weights *api.PreemptionCostWeights) *preemptionCostModel {
+	m := &preemptionCostModel{now: time.Now}
+	if weights != nil {
+		m.weights = *weights
+	}
+	return m
+}
+
+// victimSetCost calculates the cost of preempting a set of affinity groups to get a number of GPUs.
+func (m *preemptionCostModel) victimSetCost(victims map[string]*AlgoAffinityGroup, neededGpuNum int32) float64 {
+	if m == nil || len(victims) == 0 {
+		return 0
+	}
+	now := m.now()
+	freedGpuNum := int32(0)
+	cost := m.weights.AffinityGroup * float64(len(victims))
+	for _, g := range victims {
+		freedGpuNum += g.getTotalGpuNum()
+		cost += m.weights.RuntimeMinute * now.Sub(g.startTime).Minutes()
+		cost += m.weights.Annotation * float64(g.preemptionCost)
+	}
+	if freedGpuNum > neededGpuNum {
+		cost += m.weights.ExtraGpu * float64(freedGpuNum-neededGpuNum)
+	}
+	return cost
+}
+
+// cellCost calculates the cost of preempting the affinity groups inside a cell for a given priority,
+// in order to get all the GPUs of the cell.
+func (m *preemptionCostModel) cellCost(c Cell, p CellPriority) float64 {
+	victims := map[string]*AlgoAffinityGroup{}
+	collectCellVictims(c, p, victims)
+	return m.victimSetCost(victims, c.GetTotalGpuNum())
+}
+
+// sortGpusByCost stably sorts a list of preemptible GPUs so that GPUs cheaper to preempt are used first.
+func (m *preemptionCostModel) sortGpusByCost(gpus CellList, p CellPriority) {
+	if m == nil || len(gpus) < 2 {
+		return
+	}
+	costs := map[string]float64{}
+	for _, gpu := range gpus {
+		costs[gpu.GetName()] = m.cellCost(gpu, p)
+	}
+	sort.SliceStable(gpus, func(i, j int) bool {
+		return costs[gpus[i].GetName()] < costs[gpus[j].GetName()]
+	})
+}
+
+// collectCellVictims collects the affinity groups running on a cell (physical or virtual)
+// that will be preempted by a given priority.
+func collectCellVictims(c Cell, p CellPriority, victims map[string]*AlgoAffinityGroup) {
+	if c.GetPriority() == freePriority || c.GetPriority() >= p {
+		return
+	}
+	if c.GetLevel() > lowestLevel {
+		for _, cc := range c.GetChildren() {
+			collectCellVictims(cc, p, victims)
+		}
+		return
+	}
+	var pGpu *PhysicalCell
+	switch gpu := c.(type) {
+	case *PhysicalCell:
+		pGpu = gpu
+	case *VirtualCell:
+		pGpu = gpu.GetPhysicalCell()
+	}
+	if pGpu != nil {
+		if g := pGpu.GetAffinityGroup(); g != nil {
+			victims[g.name] = g
+		}
+	}
+}
@@ -0,0 +1,85 @@
+// MIT License
+//
+// Copyright (c) Microsoft Corporation. All rights reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE
+
+package algorithm
+
+import (
+	"github.com/microsoft/hivedscheduler/pkg/api"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestPreemptionCost(t *testing.T) {
+	large := newAlgoAffinityGroup(&api.PodSchedulingSpec{AffinityGroup: &api.AffinityGroupSpec{
+		Name:    "large",
+		Members: []api.AffinityGroupMemberSpec{{PodNumber: 8, GpuNumber: 8}},
+	}}, time.Now())
+	small := newAlgoAffinityGroup(&api.PodSchedulingSpec{AffinityGroup: &api.AffinityGroupSpec{
+		Name:    "small",
+		Members: []api.AffinityGroupMemberSpec{{PodNumber: 1, GpuNumber: 1}},
+	}}, time.Now())
+	c1 := NewPhysicalCell("chain", lowestLevel, false, 1)
+	c1.SetPhysicalResources([]string{"node"}, []int32{0})
+	c1.SetPriority(0)
+	c1.AddAffinityGroup(large)
+	c2 := NewPhysicalCell("chain", lowestLevel, false, 1)
+	c2.SetPhysicalResources([]string{"node"}, []int32{1})
+	c2.SetPriority(1)
+	c2.AddAffinityGroup(small)
+
+	m := newPreemptionCostModel(&api.PreemptionCostWeights{AffinityGroup: 1, ExtraGpu: 0.5})
+	if cost := m.cellCost(c1, 2); cost != 32.5 {
+		t.Errorf("Wrong preemption cost of cell %v: expected 32.5, but got %v", c1.GetName(), cost)
+	}
+	if c := getLowestCostCell(CellList{c1, c2}, 2, m); !CellEqual(c, c2) {
+		t.Errorf("Expected cell %v to be selected as the cheapest victim, but got %v", c2.GetName(), c)
+	}
+	// with zero weights, victims are selected by priority
+	if c := getLowestCostCell(CellList{c1, c2}, 2, newPreemptionCostModel(nil)); !CellEqual(c, c1) {
+		t.Errorf("Expected cell %v to be selected as the lowest priority victim, but got %v", c1.GetName(), c)
+	}
+	if c := getLowestCostCell(CellList{c1, c2}, 1, m); !CellEqual(c, c1) {
+		t.Errorf("Expected cell %v to be the only preemptible victim, but got %v", c1.GetName(), c)
+	}
+}
+
+func TestClusterViewPreemptionCostOrder(t *testing.T) {
+	packed := &node{inSuggested: true, usedGpuNumSamePriority: 6, preemptionCost: 3}
+	cheap := &node{inSuggested: true, usedGpuNumSamePriority: 2, preemptionCost: 1}
+	free := &node{inSuggested: true}
+	unsuggested := &node{usedGpuNumSamePriority: 7}
+	cv := clusterView{unsuggested, packed, cheap, free}
+	sort.Stable(cv)
+	// nodes cheaper to preempt are preferred over the packing
+	if cv[0] != free || cv[1] != cheap || cv[2] != packed || cv[3] != unsuggested {
+		t.Errorf("Wrong node order: %v", cv)
+	}
+	// without preemption costs, the nodes are packed
+	for _, n := range cv {
+		n.preemptionCost = 0
+	}
+	sort.Stable(cv)
+	if cv[0] != packed || cv[1] != cheap || cv[2] != free || cv[3] != unsuggested {
+		t.Errorf("Wrong node order: %v", cv)
+	}
+}
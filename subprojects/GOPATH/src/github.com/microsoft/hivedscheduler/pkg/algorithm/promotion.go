@@ -0,0 +1,201 @@
+// MIT License
+//
+// Copyright (c) Microsoft Corporation. All rights reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE
+
+package algorithm
+
+import (
+	"fmt"
+	"github.com/microsoft/hivedscheduler/pkg/api"
+	"github.com/microsoft/hivedscheduler/pkg/common"
+	"github.com/microsoft/hivedscheduler/pkg/internal"
+	core "k8s.io/api/core/v1"
+	"k8s.io/klog"
+	"sort"
+)
+
+// promoteAffinityGroups tries to restore the lazy preempted affinity groups back to their VCs,
+// and upgrade the opportunistic groups which enabled upgrade to guaranteed (from the highest priority
+// to the lowest), if the VCs have enough free quota to hold them at their current physical placements.
+// A group will never be promoted by preempting others.
+func (h *HivedAlgorithm) promoteAffinityGroups() {
+	var groups []*AlgoAffinityGroup
+	for _, g := range h.allocatedAffinityGroups {
+		if g.virtualGpuPlacement != nil {
+			continue
+		}
+		if (g.lazyPreemptionStatus != nil && g.priority >= minGuaranteedPriority) ||
+			(g.upgradeEnable && g.priority == opportunisticPriority) {
+			groups = append(groups, g)
+		}
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		if groups[i].priority != groups[j].priority {
+			return groups[i].priority > groups[j].priority
+		}
+		return groups[i].name < groups[j].name
+	})
+	for _, g := range groups {
+		priority := g.priority
+		if priority < minGuaranteedPriority {
+			priority = g.upgradePriority
+		}
+		if r := h.getExceededUserQuota(g.vc, g.user, priority, g.getTotalGpuNum(), nil); r != "" {
+			klog.Infof("Affinity group %v cannot be restored to VC %v: %v", g.name, g.vc, r)
+			continue
+		}
+		if virtualPlacement, message := h.mapAffinityGroupToFreeVirtual(g); virtualPlacement == nil {
+			klog.Infof("Affinity group %v cannot be restored to VC %v: %v", g.name, g.vc, message)
+		} else {
+			h.restoreAffinityGroup(g, virtualPlacement)
+		}
+	}
+}
+
+// mapAffinityGroupToFreeVirtual maps the physical placement of an affinity group to free virtual
+// cells in its VC. It returns nil (and the reason) if the VC has no enough free quota.
+func (h *HivedAlgorithm) mapAffinityGroupToFreeVirtual(g *AlgoAffinityGroup) (map[int32][]CellList, string) {
+	vcs := h.vcSchedulers[g.vc]
+	if vcs == nil {
+		return nil, fmt.Sprintf("VC %v not found", g.vc)
+	}
+	var preBound []*VirtualCell
+	defer func() {
+		for _, vc := range preBound {
+			vc.GetPreBoundPhysicalCell().SetPreBoundVirtualCell(nil)
+			vc.SetPreBoundPhysicalCell(nil)
+		}
+	}()
+	virtualPlacement := map[int32][]CellList{}
+	for gpuNum, podPlacements := range g.physicalGpuPlacement {
+		virtualPlacement[gpuNum] = make([]CellList, len(podPlacements))
+		for podIndex, podPlacement := range podPlacements {
+			virtualPlacement[gpuNum][podIndex] = make(CellList, len(podPlacement))
+			for gpuIndex, gpu := range podPlacement {
+				if gpu == nil {
+					continue
+				}
+				pGpu := gpu.(*PhysicalCell)
+				vccl := vcs.getNonReservedCellList()[pGpu.GetChain()]
+				if g.reservationId != "" {
+					vccl = vcs.getReservedCellList()[g.reservationId]
+				}
+				if vccl == nil {
+					return nil, fmt.Sprintf("VC %v has no cell for GPU %v", g.vc, pGpu.GetName())
+				}
+				vGpu := mapPhysicalCellToFreeVirtual(pGpu, vccl, &preBound)
+				if vGpu == nil {
+					return nil, fmt.Sprintf("insufficient free quota in the VC for GPU %v", pGpu.GetName())
+				}
+				virtualPlacement[gpuNum][podIndex][gpuIndex] = vGpu
+			}
+		}
+	}
+	return virtualPlacement, ""
+}
+
+// restoreAffinityGroup moves an affinity group from the opportunistic priority back to its VC,
+// using the virtual placement found by mapAffinityGroupToFreeVirtual. An opportunistic group
+// is upgraded to its upgrade priority, and the upgrade is recorded in the bind info of its pods.
+func (h *HivedAlgorithm) restoreAffinityGroup(g *AlgoAffinityGroup, virtualPlacement map[int32][]CellList) {
+	if g.priority < minGuaranteedPriority {
+		klog.Infof("Affinity group %v is upgraded from opportunistic to priority %v", g.name, g.upgradePriority)
+		g.priority = g.upgradePriority
+		g.bindInfoChanged = true
+	}
+	for gpuNum, podPlacements := range g.physicalGpuPlacement {
+		for podIndex, podPlacement := range podPlacements {
+			for gpuIndex, gpu := range podPlacement {
+				if gpu != nil {
+					pGpu := gpu.(*PhysicalCell)
+					vGpu := virtualPlacement[gpuNum][podIndex][gpuIndex].(*VirtualCell)
+					h.confirmReleasedGpu(pGpu, g)
+					h.confirmAllocatedGpu(pGpu, vGpu, g.priority, g)
+				}
+			}
+		}
+	}
+	g.virtualGpuPlacement = virtualPlacement
+	g.lazyPreemptionStatus = nil
+	h.recordLedger(g, api.LedgerAllocate)
+	klog.Infof("Affinity group %v is restored to VC %v with priority %v", g.name, g.vc, g.priority)
+}
+
+func (h *HivedAlgorithm) TakeChangedAllocatedPods() []*core.Pod {
+	h.algorithmLock.Lock()
+	defer h.algorithmLock.Unlock()
+
+	var names []string
+	for name, g := range h.allocatedAffinityGroups {
+		if g.bindInfoChanged {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	var changedPods []*core.Pod
+	for _, name := range names {
+		g := h.allocatedAffinityGroups[name]
+		g.bindInfoChanged = false
+		var gpuNums []int32
+		for gpuNum := range g.allocatedPods {
+			gpuNums = append(gpuNums, gpuNum)
+		}
+		common.SortInt32(gpuNums)
+		for _, gpuNum := range gpuNums {
+			for podIndex, pod := range g.allocatedPods[gpuNum] {
+				if pod == nil {
+					continue
+				}
+				info := internal.ExtractPodBindInfo(pod)
+				h.updatePodBindInfo(g, info)
+				changedPod := pod.DeepCopy()
+				changedPod.Annotations[api.AnnotationKeyPodBindInfo] = common.ToYaml(info)
+				g.allocatedPods[gpuNum][podIndex] = changedPod
+				changedPods = append(changedPods, changedPod)
+			}
+		}
+		klog.Infof("Bind info of affinity group %v changed: priority %v", g.name, g.priority)
+	}
+	return changedPods
+}
+
+// updatePodBindInfo records the current priority and virtual placement of an affinity group
+// in the bind info of a pod, so that the group is recovered with them.
+func (h *HivedAlgorithm) updatePodBindInfo(g *AlgoAffinityGroup, info *api.PodBindInfo) {
+	info.AffinityGroupPriority = common.PtrInt32(int32(g.priority))
+	if g.virtualGpuPlacement == nil {
+		return
+	}
+	for _, gms := range info.AffinityGroupBindInfo {
+		gpuNum := int32(len(gms.PodPlacements[0].PhysicalGpuIndices))
+		for podIndex := range gms.PodPlacements {
+			if gms.PodPlacements[podIndex].PreassignedCellTypes == nil {
+				gms.PodPlacements[podIndex].PreassignedCellTypes = make([]api.CellType, gpuNum)
+			}
+			for gpuIndex := range gms.PodPlacements[podIndex].PreassignedCellTypes {
+				if vGpu, ok := g.virtualGpuPlacement[gpuNum][podIndex][gpuIndex].(*VirtualCell); ok {
+					gms.PodPlacements[podIndex].PreassignedCellTypes[gpuIndex] =
+						h.cellTypes[vGpu.GetChain()][vGpu.GetPreAssignedCell().GetLevel()]
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,127 @@
+// MIT License
+//
+// Copyright (c) Microsoft Corporation. All rights reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE
+
+package algorithm
+
+import (
+	"github.com/microsoft/hivedscheduler/pkg/api"
+	"github.com/microsoft/hivedscheduler/pkg/common"
+	"github.com/microsoft/hivedscheduler/pkg/internal"
+	core "k8s.io/api/core/v1"
+	"testing"
+)
+
+func TestRestoreLazyPreemptedAffinityGroup(t *testing.T) {
+	h := newTestAlgorithm(newTestConfig())
+	var pods []*core.Pod
+	for _, podName := range []string{"pod24", "pod25"} {
+		pod := allPods[podName]
+		pod.Annotations[api.AnnotationKeyPodSchedulingSpec] = common.ToYaml(pss[pod.UID])
+		pods = append(pods, scheduleAndAllocate(t, h, pod))
+	}
+	g := h.allocatedAffinityGroups[group15.Name]
+	if g.virtualGpuPlacement != nil || g.lazyPreemptionStatus == nil {
+		t.Fatalf("Group %v is expected to be lazy preempted, but not", g.name)
+	}
+	// no free quota in the VC yet
+	h.Reconcile()
+	if g.virtualGpuPlacement != nil {
+		t.Errorf("Group %v is expected to stay lazy preempted, but restored", g.name)
+	}
+	h.DeleteAllocatedPod(pods[1])
+	if g.virtualGpuPlacement == nil || g.lazyPreemptionStatus != nil {
+		t.Fatalf("Group %v is expected to be restored, but not", g.name)
+	}
+	for _, gpu := range g.physicalGpuPlacement[2][0] {
+		pGpu := gpu.(*PhysicalCell)
+		if pGpu.GetPriority() != CellPriority(pss["pod24"].Priority) || pGpu.GetVirtualCell() == nil ||
+			pGpu.GetVirtualCell().vc != "VC2" {
+			t.Errorf("GPU %v is expected to be bound to VC2 with priority %v, but got %v with priority %v",
+				pGpu.GetName(), pss["pod24"].Priority, pGpu.GetVirtualCell(), pGpu.GetPriority())
+		}
+	}
+	h.DeleteAllocatedPod(pods[0])
+	for _, gpu := range g.physicalGpuPlacement[2][0] {
+		if pGpu := gpu.(*PhysicalCell); pGpu.GetPriority() != freePriority || pGpu.GetVirtualCell() != nil {
+			t.Errorf("GPU %v is expected to be released, but not", pGpu.GetName())
+		}
+	}
+}
+
+func TestUpgradeOpportunisticAffinityGroup(t *testing.T) {
+	h := newTestAlgorithm(newTestConfig())
+	guaranteedPod := allPods["pod24"]
+	guaranteedPod.Annotations[api.AnnotationKeyPodSchedulingSpec] = common.ToYaml(pss[guaranteedPod.UID])
+	opportunisticPod := newTestPod("upgrade", api.PodSchedulingSpec{
+		VirtualCluster:  "VC2",
+		Priority:        api.OpportunisticPriority,
+		GpuType:         "CT1",
+		GpuNumber:       2,
+		UpgradeEnable:   true,
+		UpgradePriority: 2,
+		AffinityGroup: &api.AffinityGroupSpec{
+			Name:    "upgrade",
+			Members: []api.AffinityGroupMemberSpec{{PodNumber: 1, GpuNumber: 2}},
+		},
+	})
+	var pods []*core.Pod
+	for _, pod := range []*core.Pod{guaranteedPod, opportunisticPod} {
+		pods = append(pods, scheduleAndAllocate(t, h, pod))
+	}
+	g := h.allocatedAffinityGroups["upgrade"]
+	// no free quota in the VC yet
+	h.Reconcile()
+	if g.virtualGpuPlacement != nil || g.priority != opportunisticPriority {
+		t.Fatalf("Group %v is expected to stay opportunistic, but upgraded", g.name)
+	}
+	h.DeleteAllocatedPod(pods[0])
+	if g.virtualGpuPlacement == nil || g.priority != 2 {
+		t.Fatalf("Group %v is expected to be upgraded to priority 2, but got %v", g.name, g.priority)
+	}
+	for _, gpu := range g.physicalGpuPlacement[2][0] {
+		pGpu := gpu.(*PhysicalCell)
+		if pGpu.GetPriority() != 2 || pGpu.GetVirtualCell() == nil || pGpu.GetVirtualCell().vc != "VC2" {
+			t.Errorf("GPU %v is expected to be bound to VC2 with priority 2, but got %v with priority %v",
+				pGpu.GetName(), pGpu.GetVirtualCell(), pGpu.GetPriority())
+		}
+	}
+
+	// the upgrade is recorded in the bind info, so the group is recovered as upgraded
+	changedPods := h.TakeChangedAllocatedPods()
+	if len(changedPods) != 1 || len(h.TakeChangedAllocatedPods()) != 0 {
+		t.Fatalf("Expected the pod of group %v changed once, but got %v", g.name, changedPods)
+	}
+	info := internal.ExtractPodBindInfo(changedPods[0])
+	if p := info.AffinityGroupPriority; p == nil || *p != 2 ||
+		info.AffinityGroupBindInfo[0].PodPlacements[0].PreassignedCellTypes[0] == "" {
+		t.Errorf("Expected the upgrade recorded in the bind info, but got %v", common.ToYaml(info))
+	}
+	recovered := newTestAlgorithm(newTestConfig())
+	recovered.AddAllocatedPod(changedPods[0])
+	if rg := recovered.allocatedAffinityGroups["upgrade"]; rg.virtualGpuPlacement == nil || rg.priority != 2 {
+		t.Errorf("Group %v is expected to be recovered as upgraded, but got priority %v", g.name, rg.priority)
+	}
+	h.DeleteAllocatedPod(changedPods[0])
+	if _, ok := h.allocatedAffinityGroups["upgrade"]; ok {
+		t.Errorf("Group %v is expected to be deleted, but not", g.name)
+	}
+}
@@ -0,0 +1,134 @@
+// MIT License
+//
+// Copyright (c) Microsoft Corporation. All rights reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE
+
+package algorithm
+
+import (
+	"fmt"
+	"github.com/microsoft/hivedscheduler/pkg/api"
+	"github.com/microsoft/hivedscheduler/pkg/internal"
+	core "k8s.io/api/core/v1"
+)
+
+// getExceededVcResource returns the name of the resource whose VC quota will be exceeded
+// if the requests are allocated, or empty if the VC has enough quota.
+func (h *HivedAlgorithm) getExceededVcResource(vc api.VirtualClusterName, requests core.ResourceList) string {
+	for name, quota := range h.vcResourceQuotas[vc] {
+		used := h.vcResourceUsages[vc][name]
+		used.Add(requests[name])
+		if used.Cmp(quota) > 0 {
+			return string(name)
+		}
+	}
+	return ""
+}
+
+// getQuotaUser returns the user of a pod in its VC, whose quota the pod uses, by the label of
+// the user quota of the VC (or the default label if the VC has no user quota).
+func (h *HivedAlgorithm) getQuotaUser(vc api.VirtualClusterName, pod *core.Pod) string {
+	if q := h.userQuotas[vc]; q != nil {
+		return pod.Labels[q.LabelKey]
+	}
+	return pod.Labels[api.LabelKeyUser]
+}
+
+// getExceededUserQuota returns the reason if the GPU quota of a user in a VC will be exceeded when
+// a guaranteed group requesting the GPUs at the priority is allocated, or empty if the user has enough quota.
+// Only the groups using their VC quota (i.e., not lazy preempted) are counted, except the given group
+// (if not nil) whose priority is to be updated.
+func (h *HivedAlgorithm) getExceededUserQuota(
+	vc api.VirtualClusterName, user string, priority CellPriority, gpuNum int32, except *AlgoAffinityGroup) string {
+
+	q := h.userQuotas[vc]
+	if q == nil || priority < minGuaranteedPriority || gpuNum == 0 {
+		return ""
+	}
+	limits, ok := q.Users[user]
+	if !ok {
+		limits = q.Users[api.DefaultUserName]
+	}
+	for _, l := range limits {
+		minPriority, maxPriority := CellPriority(l.MinPriority), CellPriority(l.MaxPriority)
+		if priority < minPriority || priority > maxPriority {
+			continue
+		}
+		used := int32(0)
+		for _, g := range h.allocatedAffinityGroups {
+			if g != except && g.vc == vc && g.user == user && g.virtualGpuPlacement != nil &&
+				g.priority >= minPriority && g.priority <= maxPriority {
+				used += g.getTotalGpuNum()
+			}
+		}
+		if used+gpuNum > l.GpuNumber {
+			return fmt.Sprintf("insufficient GPU quota of user %q in VC %v for priority [%v, %v]: "+
+				"%v GPUs used, %v GPUs requested, %v GPUs limited",
+				user, vc, minPriority, maxPriority, used, gpuNum, l.GpuNumber)
+		}
+	}
+	return ""
+}
+
+// getRequestedGpuNum returns the number of GPUs requested by all the pods of the group of a pod.
+func getRequestedGpuNum(s *api.PodSchedulingSpec) int32 {
+	n := int32(0)
+	for _, m := range s.AffinityGroup.Members {
+		n += m.GpuNumber * m.PodNumber
+	}
+	return n
+}
+
+// countVcResourceUsage counts the CPU and memory of a pod requesting zero GPU in the usage of its VC
+// if its group is guaranteed, and records the requests counted, so that exactly the same requests are
+// uncounted when the pod is deleted, even if the priority of the group is changed since.
+func (h *HivedAlgorithm) countVcResourceUsage(g *AlgoAffinityGroup, podIndex int32, pod *core.Pod) {
+	h.uncountVcResourceUsage(g, podIndex)
+	if g.priority >= minGuaranteedPriority {
+		requests := internal.GetPodResourceRequests(pod)
+		h.updateVcResourceUsage(g.vc, requests, true)
+		g.vcResourceRequests[podIndex] = requests
+	}
+}
+
+// uncountVcResourceUsage removes the CPU and memory counted for a pod requesting zero GPU from the usage
+// of its VC.
+func (h *HivedAlgorithm) uncountVcResourceUsage(g *AlgoAffinityGroup, podIndex int32) {
+	if requests, ok := g.vcResourceRequests[podIndex]; ok {
+		h.updateVcResourceUsage(g.vc, requests, false)
+		delete(g.vcResourceRequests, podIndex)
+	}
+}
+
+// updateVcResourceUsage updates the CPU and memory used by the guaranteed pods requesting zero GPU in a VC.
+func (h *HivedAlgorithm) updateVcResourceUsage(vc api.VirtualClusterName, requests core.ResourceList, increase bool) {
+	if h.vcResourceUsages[vc] == nil {
+		h.vcResourceUsages[vc] = core.ResourceList{}
+	}
+	for name, q := range requests {
+		used := h.vcResourceUsages[vc][name]
+		if increase {
+			used.Add(q)
+		} else {
+			used.Sub(q)
+		}
+		h.vcResourceUsages[vc][name] = used
+	}
+}
@@ -0,0 +1,96 @@
+// MIT License
+//
+// Copyright (c) Microsoft Corporation. All rights reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE
+
+package algorithm
+
+import (
+	"github.com/microsoft/hivedscheduler/pkg/api"
+	"github.com/microsoft/hivedscheduler/pkg/common"
+	"github.com/microsoft/hivedscheduler/pkg/internal"
+	core "k8s.io/api/core/v1"
+	"testing"
+)
+
+func TestUserQuota(t *testing.T) {
+	sConfig := newTestConfig()
+	vcSpec := (*sConfig.VirtualClusters)["VC2"]
+	vcSpec.UserQuota = &api.UserQuotaSpec{Users: map[string][]api.PriorityGpuLimitSpec{
+		"alice":             {{MinPriority: 0, MaxPriority: 1000, GpuNumber: 3}, {MinPriority: 10, MaxPriority: 1000, GpuNumber: 1}},
+		api.DefaultUserName: {{MinPriority: 0, MaxPriority: 1000, GpuNumber: 1}},
+	}}
+	(*sConfig.VirtualClusters)["VC2"] = vcSpec
+	newPod := func(name string, user string, priority int32, gpuNumber int32) *core.Pod {
+		pod := newTestPod(name, api.PodSchedulingSpec{
+			VirtualCluster: "VC2",
+			Priority:       priority,
+			GpuType:        "DGX1-P100",
+			GpuNumber:      gpuNumber,
+		})
+		pod.Labels = map[string]string{api.LabelKeyUser: user}
+		return pod
+	}
+	h := newTestAlgorithm(sConfig)
+	expectWait := func(pod *core.Pod) {
+		if psr := h.Schedule(pod, allNodes); psr.PodWaitInfo == nil {
+			t.Errorf("[%v]: expected to wait for user quota, but got %v", internal.Key(pod), common.ToJson(psr))
+		}
+	}
+
+	scheduleAndAllocate(t, h, newPod("alice-0", "alice", 1, 2))
+	scheduleAndAllocate(t, h, newPod("alice-1", "alice", 20, 1))
+	// the band [10, 1000] of alice is used up
+	expectWait(newPod("alice-2", "alice", 20, 1))
+	// the band [0, 1000] of alice is used up
+	expectWait(newPod("alice-3", "alice", 1, 1))
+	// the opportunistic pods are not limited
+	scheduleAndAllocate(t, h, newPod("alice-4", "alice", api.OpportunisticPriority, 1))
+	// the other users use the default quota
+	scheduleAndAllocate(t, h, newPod("bob-0", "bob", 1, 1))
+	expectWait(newPod("bob-1", "bob", 1, 1))
+	scheduleAndAllocate(t, h, newPod("unlabeled-0", "", 1, 1))
+
+	// downgrade the over quota groups to opportunistic
+	vcSpec.UserQuota.DowngradeToOpportunistic = true
+	h = newTestAlgorithm(sConfig)
+	allocatedPods := []*core.Pod{
+		scheduleAndAllocate(t, h, newPod("alice-0", "alice", 1, 2)),
+		scheduleAndAllocate(t, h, newPod("alice-1", "alice", 1, 2)),
+	}
+	if info := internal.ExtractPodBindInfo(allocatedPods[1]); !info.Downgraded {
+		t.Errorf("Expected pod %v downgraded, but got %v", allocatedPods[1].Name, common.ToJson(info))
+	}
+	if g := h.allocatedAffinityGroups["test/alice-1"]; g.priority != opportunisticPriority {
+		t.Errorf("Expected group %v opportunistic, but got priority %v", g.name, g.priority)
+	}
+
+	// the downgraded group is recovered as opportunistic
+	h = newTestAlgorithm(sConfig)
+	for _, pod := range allocatedPods {
+		h.AddAllocatedPod(pod)
+	}
+	if g := h.allocatedAffinityGroups["test/alice-1"]; g.priority != opportunisticPriority || g.virtualGpuPlacement != nil {
+		t.Errorf("Expected group %v recovered as opportunistic, but got priority %v", g.name, g.priority)
+	}
+	if g := h.allocatedAffinityGroups["test/alice-0"]; g.priority != 1 || g.virtualGpuPlacement == nil {
+		t.Errorf("Expected group %v recovered as guaranteed, but got priority %v", g.name, g.priority)
+	}
+}
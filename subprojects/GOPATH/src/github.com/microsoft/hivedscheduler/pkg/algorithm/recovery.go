@@ -0,0 +1,312 @@
+// MIT License
+//
+// Copyright (c) Microsoft Corporation. All rights reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE
+
+package algorithm
+
+import (
+	"fmt"
+	"github.com/microsoft/hivedscheduler/pkg/api"
+	"github.com/microsoft/hivedscheduler/pkg/internal"
+	core "k8s.io/api/core/v1"
+	"k8s.io/klog"
+	"sort"
+)
+
+// checkAllocatedPod checks if an allocated pod being added (e.g., a bound pod recovered after a config change)
+// is consistent with the config and with the other allocated pods, without changing the scheduling state.
+// The inconsistencies are recorded in the recovery report. It returns true if the pod should be quarantined
+// (in degraded mode), i.e., tracked but not accounted, instead of being added inconsistently.
+func (h *HivedAlgorithm) checkAllocatedPod(pod *core.Pod, s *api.PodSchedulingSpec, info *api.PodBindInfo) bool {
+	inconsistencies := h.getAllocatedPodInconsistencies(s, info)
+	if len(inconsistencies) == 0 {
+		return false
+	}
+	for _, i := range inconsistencies {
+		klog.Errorf("[%v]: allocated pod inconsistent: %v: %v", internal.Key(pod), i.Kind, i.Message)
+	}
+	h.inconsistentPods[pod.UID] = &api.RecoveredPod{
+		Pod:             pod.Namespace + "/" + pod.Name,
+		UID:             pod.UID,
+		Node:            info.Node,
+		AffinityGroup:   s.AffinityGroup.Name,
+		VirtualCluster:  s.VirtualCluster,
+		Quarantined:     h.degradedModeEnable,
+		Inconsistencies: inconsistencies,
+	}
+	if h.degradedModeEnable {
+		klog.Warningf("[%v]: allocated pod quarantined in degraded mode: its resources are not accounted",
+			internal.Key(pod))
+	}
+	return h.degradedModeEnable
+}
+
+// quarantineFailedPod is deferred when an allocated pod is added in degraded mode, and quarantines the pod if
+// adding it panics on an inconsistency not found by checkAllocatedPod, instead of crashing the Scheduler again
+// whenever the pod is recovered. If the pod is creating its group, the GPUs taken by the group are released,
+// otherwise the partial allocation of the pod in its group is rolled back.
+func (h *HivedAlgorithm) quarantineFailedPod(
+	pod *core.Pod,
+	s *api.PodSchedulingSpec,
+	info *api.PodBindInfo,
+	creatingGroup bool,
+	reallocatedGpus *[]*PhysicalCell) {
+
+	r := recover()
+	if r == nil {
+		return
+	}
+	klog.Errorf("[%v]: failed to add allocated pod: %v", internal.Key(pod), r)
+	if creatingGroup {
+		h.releaseFailedAffinityGroup(s.AffinityGroup.Name)
+	} else if g := h.allocatedAffinityGroups[s.AffinityGroup.Name]; g != nil {
+		h.rollBackFailedPod(g, pod, *reallocatedGpus)
+	}
+	h.inconsistentPods[pod.UID] = &api.RecoveredPod{
+		Pod:            pod.Namespace + "/" + pod.Name,
+		UID:            pod.UID,
+		Node:           info.Node,
+		AffinityGroup:  s.AffinityGroup.Name,
+		VirtualCluster: s.VirtualCluster,
+		Quarantined:    true,
+		Inconsistencies: []api.RecoveryInconsistency{{
+			Kind:    api.RecoveryInvalidPlacement,
+			Message: fmt.Sprintf("failed to add the pod: %v", r),
+		}},
+	}
+	klog.Warningf("[%v]: allocated pod quarantined in degraded mode: its resources are not accounted",
+		internal.Key(pod))
+}
+
+// releaseFailedAffinityGroup releases the GPUs taken by a group whose creation failed, and removes the group
+// if it has been created.
+func (h *HivedAlgorithm) releaseFailedAffinityGroup(name string) {
+	if g := h.allocatedAffinityGroups[name]; g != nil {
+		delete(h.allocatedAffinityGroups, name)
+		h.recordLedger(g, api.LedgerRelease)
+	}
+	for _, chain := range getSortedCellListChains(h.fullCellList) {
+		for _, c := range h.fullCellList[chain][lowestLevel] {
+			if pGpu := c.(*PhysicalCell); pGpu.GetAffinityGroup() != nil && pGpu.GetAffinityGroup().name == name {
+				h.confirmReleasedGpu(pGpu, pGpu.GetAffinityGroup())
+			}
+		}
+	}
+	klog.Infof("Affinity group %v failed to be created and released", name)
+}
+
+// rollBackFailedPod releases the GPUs reallocated to a pod failing to be added to an allocated group, and
+// removes the pod from the group if it has been added. The groups lazy preempted for the reallocation are
+// left to be restored by promoteAffinityGroups.
+func (h *HivedAlgorithm) rollBackFailedPod(g *AlgoAffinityGroup, pod *core.Pod, reallocatedGpus []*PhysicalCell) {
+	for _, pGpu := range reallocatedGpus {
+		if pGpu.GetAffinityGroup() == g {
+			h.confirmReleasedGpu(pGpu, g)
+		}
+	}
+	if len(reallocatedGpus) > 0 {
+		h.recordLedger(g, api.LedgerAllocate)
+	}
+	for gpuNumber, pods := range g.allocatedPods {
+		for i, p := range pods {
+			if p != nil && p.UID == pod.UID {
+				pods[i] = nil
+				if gpuNumber == 0 {
+					h.uncountVcResourceUsage(g, int32(i))
+				}
+			}
+		}
+	}
+	klog.Infof("[%v]: allocation in affinity group %v rolled back", internal.Key(pod), g.name)
+}
+
+// getAllocatedPodInconsistencies checks the placement of an allocated pod in the PodBindInfo, or the placements
+// of all the pods of its group if the group is not allocated yet (i.e., the group will be created from them).
+func (h *HivedAlgorithm) getAllocatedPodInconsistencies(
+	s *api.PodSchedulingSpec,
+	info *api.PodBindInfo) (inconsistencies []api.RecoveryInconsistency) {
+
+	add := func(kind api.RecoveryInconsistencyKind, format string, args ...interface{}) {
+		inconsistencies = append(inconsistencies, api.RecoveryInconsistency{
+			Kind: kind, Message: fmt.Sprintf(format, args...)})
+	}
+	group := h.allocatedAffinityGroups[s.AffinityGroup.Name]
+	totalPodNums := map[int32]int32{}
+	if group == nil {
+		for _, m := range s.AffinityGroup.Members {
+			totalPodNums[m.GpuNumber] += m.PodNumber
+		}
+	} else {
+		totalPodNums = group.totalPodNums
+	}
+	if totalPodNums[s.GpuNumber] == 0 {
+		add(api.RecoveryInvalidPlacement, "no member of group %v requests %v GPUs",
+			s.AffinityGroup.Name, s.GpuNumber)
+		return inconsistencies
+	}
+
+	placementFound := s.GpuNumber == 0
+	for _, gms := range info.AffinityGroupBindInfo {
+		if len(gms.PodPlacements) == 0 {
+			add(api.RecoveryInvalidPlacement, "no pod placement in a member of group %v", s.AffinityGroup.Name)
+			continue
+		}
+		gpuNumber := int32(len(gms.PodPlacements[0].PhysicalGpuIndices))
+		placementFound = placementFound || gpuNumber == s.GpuNumber
+		if group == nil {
+			if podNum := int32(len(gms.PodPlacements)); podNum > totalPodNums[gpuNumber] {
+				add(api.RecoveryInvalidPlacement, "%v pods requesting %v GPUs placed, but group %v has %v",
+					podNum, gpuNumber, s.AffinityGroup.Name, totalPodNums[gpuNumber])
+				continue
+			}
+			for _, placement := range gms.PodPlacements {
+				h.checkAllocatedPodPlacement(gms, placement, info, nil, add)
+			}
+		} else if s.GpuNumber > 0 && gpuNumber == s.GpuNumber {
+			// only the placement of this pod is (re)allocated in an allocated group
+			if len(info.GpuIsolation) == 0 {
+				add(api.RecoveryInvalidPlacement, "no GPU isolation in the PodBindInfo")
+			} else if podIndex := getPodIndex(gms.PodPlacements, info.Node, info.GpuIsolation[0]); podIndex == -1 {
+				add(api.RecoveryInvalidPlacement, "placement not found in group %v: node %v, GPUs %v",
+					s.AffinityGroup.Name, info.Node, info.GpuIsolation)
+			} else if podIndex >= totalPodNums[gpuNumber] {
+				add(api.RecoveryInvalidPlacement, "pod %v requesting %v GPUs placed, but group %v has %v",
+					podIndex, gpuNumber, s.AffinityGroup.Name, totalPodNums[gpuNumber])
+			} else {
+				h.checkAllocatedPodPlacement(gms, gms.PodPlacements[podIndex], info, group, add)
+			}
+		}
+	}
+	if !placementFound {
+		add(api.RecoveryInvalidPlacement, "no placement of pods requesting %v GPUs in the PodBindInfo", s.GpuNumber)
+	}
+	if group == nil && CellPriority(s.Priority) >= minGuaranteedPriority && len(inconsistencies) == 0 {
+		h.checkVcAllocation(s, info, add)
+	}
+	return inconsistencies
+}
+
+// checkAllocatedPodPlacement checks if the GPUs of a pod placement exist and are not used by another group.
+func (h *HivedAlgorithm) checkAllocatedPodPlacement(
+	gms api.AffinityGroupMemberBindInfo,
+	placement api.PodPlacementInfo,
+	info *api.PodBindInfo,
+	group *AlgoAffinityGroup,
+	add func(kind api.RecoveryInconsistencyKind, format string, args ...interface{})) {
+
+	gpuNumber := int32(len(gms.PodPlacements[0].PhysicalGpuIndices))
+	if int32(len(placement.PhysicalGpuIndices)) != gpuNumber {
+		add(api.RecoveryInvalidPlacement, "%v GPUs placed on node %v, but the pod requests %v",
+			len(placement.PhysicalGpuIndices), placement.PhysicalNode, gpuNumber)
+		return
+	}
+	if placement.PreassignedCellTypes != nil && len(placement.PreassignedCellTypes) != len(placement.PhysicalGpuIndices) {
+		add(api.RecoveryInvalidPlacement, "%v preassigned cell types for %v GPUs on node %v",
+			len(placement.PreassignedCellTypes), len(placement.PhysicalGpuIndices), placement.PhysicalNode)
+		return
+	}
+	for _, gpuIndex := range placement.PhysicalGpuIndices {
+		pGpu := h.findPhysicalGpu(getPodCellChain(info, gms, placement), placement.PhysicalNode, gpuIndex)
+		if pGpu == nil {
+			add(api.RecoveryMissingCell, "GPU %v on node %v not found in the physical cluster",
+				gpuIndex, placement.PhysicalNode)
+		} else if g := pGpu.GetAffinityGroup(); g != nil && g != group {
+			add(api.RecoveryConflictingGroups, "GPU %v on node %v (cell %v) is used by group %v",
+				gpuIndex, placement.PhysicalNode, pGpu.GetName(), g.name)
+		}
+	}
+}
+
+// checkVcAllocation checks if the VC (or the lender VC) of a guaranteed group being created still has enough
+// virtual GPUs for the GPUs of the group placed in each chain (or reservation), i.e., the GPUs not used at
+// the priority of the group or higher.
+func (h *HivedAlgorithm) checkVcAllocation(
+	s *api.PodSchedulingSpec,
+	info *api.PodBindInfo,
+	add func(kind api.RecoveryInconsistencyKind, format string, args ...interface{})) {
+
+	vc := s.VirtualCluster
+	if info.LenderVirtualCluster != "" {
+		vc = info.LenderVirtualCluster
+	}
+	vcs := h.vcSchedulers[vc]
+	if vcs == nil {
+		add(api.RecoveryVcOverAllocation, "VC %v not found", vc)
+		return
+	}
+	// the GPUs requested in each chain (or in the reservation)
+	requested := map[string]int32{}
+	for _, gms := range info.AffinityGroupBindInfo {
+		for _, placement := range gms.PodPlacements {
+			for i, gpuIndex := range placement.PhysicalGpuIndices {
+				// a GPU without a preassigned cell type is allocated without a virtual GPU
+				if placement.PreassignedCellTypes != nil && placement.PreassignedCellTypes[i] != "" {
+					if s.ReservationId != "" {
+						requested[string(s.ReservationId)]++
+					} else {
+						pGpu := h.findPhysicalGpu(getPodCellChain(info, gms, placement), placement.PhysicalNode, gpuIndex)
+						requested[string(pGpu.GetChain())]++
+					}
+				}
+			}
+		}
+	}
+	var keys []string
+	for k := range requested {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		vccl := vcs.getNonReservedCellList()[CellChain(k)]
+		if s.ReservationId != "" {
+			vccl = vcs.getReservedCellList()[s.ReservationId]
+		}
+		if vccl == nil {
+			add(api.RecoveryVcOverAllocation, "VC %v has no cell for %v", vc, k)
+			continue
+		}
+		available := int32(0)
+		for _, c := range vccl[1] {
+			if vGpu := c.(*VirtualCell); !vGpu.GetPreAssignedCell().IsInactive() &&
+				vGpu.GetPriority() < CellPriority(s.Priority) {
+				available++
+			}
+		}
+		if requested[k] > available {
+			add(api.RecoveryVcOverAllocation, "%v GPUs of the group placed in %v, but VC %v has only %v left",
+				requested[k], k, vc, available)
+		}
+	}
+}
+
+func (h *HivedAlgorithm) GetRecoveryReport() api.RecoveryReport {
+	h.algorithmLock.RLock()
+	defer h.algorithmLock.RUnlock()
+
+	report := api.RecoveryReport{DegradedModeEnable: h.degradedModeEnable, Pods: []api.RecoveredPod{}}
+	for _, p := range h.inconsistentPods {
+		report.Pods = append(report.Pods, *p)
+	}
+	sort.Slice(report.Pods, func(i, j int) bool {
+		return report.Pods[i].Pod < report.Pods[j].Pod
+	})
+	return report
+}
@@ -0,0 +1,184 @@
+// MIT License
+//
+// Copyright (c) Microsoft Corporation. All rights reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE
+
+package algorithm
+
+import (
+	"github.com/microsoft/hivedscheduler/pkg/api"
+	"github.com/microsoft/hivedscheduler/pkg/common"
+	"github.com/microsoft/hivedscheduler/pkg/internal"
+	core "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"strings"
+	"testing"
+)
+
+func TestRecoveryDegradedMode(t *testing.T) {
+	sConfig := newTestConfig()
+	h := newTestAlgorithm(sConfig)
+	bound := map[string]*core.Pod{}
+	for _, name := range []string{"g1", "g2"} {
+		bound[name] = scheduleAndAllocate(t, h, newTestPod(name, api.PodSchedulingSpec{
+			VirtualCluster: "VC2",
+			Priority:       1,
+			GpuType:        "DGX1-P100",
+			GpuNumber:      8,
+		}))
+	}
+	// a copy of g1 in another group, placed on the same GPUs or on a removed node
+	copyPod := func(name string, node string) *core.Pod {
+		pod := bound["g1"].DeepCopy()
+		pod.Name, pod.UID = name, types.UID(name)
+		s := api.PodSchedulingSpec{}
+		common.FromYaml(pod.Annotations[api.AnnotationKeyPodSchedulingSpec], &s)
+		s.AffinityGroup = &api.AffinityGroupSpec{
+			Name:    "test/" + name,
+			Members: []api.AffinityGroupMemberSpec{{PodNumber: 1, GpuNumber: 8}},
+		}
+		info := internal.ExtractPodBindInfo(pod)
+		info.Node = node
+		for _, gms := range info.AffinityGroupBindInfo {
+			for i := range gms.PodPlacements {
+				gms.PodPlacements[i].PhysicalNode = node
+			}
+		}
+		pod.Annotations[api.AnnotationKeyPodSchedulingSpec] = common.ToYaml(s)
+		pod.Annotations[api.AnnotationKeyPodBindInfo] = common.ToYaml(info)
+		return pod
+	}
+	node := internal.ExtractPodBindInfo(bound["g1"]).Node
+	conflicting, missing := copyPod("c", node), copyPod("m", "removed-node")
+
+	// after the config change, VC2 has only 1 DGX1-P100-NODE, so g2 over-allocates it
+	degradedConfig := newTestConfig()
+	degradedConfig.RecoveryDegradedModeEnable = common.PtrBool(true)
+	vc2 := (*degradedConfig.VirtualClusters)["VC2"]
+	vc2.VirtualCells = []api.VirtualCellSpec{
+		{CellType: "3-DGX1-P100-NODE.DGX1-P100-NODE", CellNumber: 1},
+		{CellType: "CT1-NODE", CellNumber: 1},
+	}
+	(*degradedConfig.VirtualClusters)["VC2"] = vc2
+	h = NewHivedAlgorithm(degradedConfig)
+	for _, pod := range []*core.Pod{bound["g1"], conflicting, missing, bound["g2"]} {
+		h.AddAllocatedPod(pod)
+	}
+	report := h.GetRecoveryReport()
+	expectedKinds := map[string]api.RecoveryInconsistencyKind{
+		"test/c":  api.RecoveryConflictingGroups,
+		"test/g2": api.RecoveryVcOverAllocation,
+		"test/m":  api.RecoveryMissingCell,
+	}
+	if !report.DegradedModeEnable || len(report.Pods) != len(expectedKinds) {
+		t.Fatalf("Expected %v quarantined pods, but got %v", len(expectedKinds), common.ToJson(report))
+	}
+	for _, p := range report.Pods {
+		if !p.Quarantined || len(p.Inconsistencies) == 0 || p.Inconsistencies[0].Kind != expectedKinds[p.Pod] {
+			t.Errorf("Expected %v quarantined for %v, but got %v", p.Pod, expectedKinds[p.Pod], common.ToJson(p))
+		}
+	}
+	// the quarantined pods are not accounted
+	g1 := h.allocatedAffinityGroups["test/g1"]
+	if g1 == nil || len(h.allocatedAffinityGroups) != 1 {
+		t.Fatalf("Expected only test/g1 allocated, but got %v", len(h.allocatedAffinityGroups))
+	}
+	for _, podPlacements := range g1.physicalGpuPlacement {
+		for _, gpus := range podPlacements {
+			for _, gpu := range gpus {
+				if g := gpu.(*PhysicalCell).GetAffinityGroup(); g != g1 {
+					t.Errorf("Expected GPU %v used by test/g1, but got %v", gpu.GetName(), g)
+				}
+			}
+		}
+	}
+	h.DeleteAllocatedPod(conflicting)
+	if len(h.GetRecoveryReport().Pods) != 2 || h.allocatedAffinityGroups["test/g1"].allocatedPods[8][0] == nil {
+		t.Errorf("Expected the quarantined pod deleted without releasing test/g1")
+	}
+
+	// a pod failing to be added on an inconsistency not checked (no GPU isolation when creating its group)
+	// is quarantined, and the GPUs taken by its group are released
+	failingNode := internal.ExtractPodBindInfo(bound["g2"]).Node
+	failing := internal.NewBindingPod(newTestPod("f", api.PodSchedulingSpec{
+		VirtualCluster: "VC2",
+		Priority:       api.OpportunisticPriority,
+		GpuType:        "DGX1-P100",
+		GpuNumber:      2,
+	}), &api.PodBindInfo{
+		Node:      failingNode,
+		CellChain: "3-DGX1-P100-NODE",
+		AffinityGroupBindInfo: []api.AffinityGroupMemberBindInfo{{PodPlacements: []api.PodPlacementInfo{{
+			PhysicalNode:         failingNode,
+			PhysicalGpuIndices:   []int32{0, 1},
+			PreassignedCellTypes: []api.CellType{"", ""},
+		}}}},
+	})
+	h.AddAllocatedPod(failing)
+	if p := h.inconsistentPods[failing.UID]; p == nil || !p.Quarantined || h.allocatedAffinityGroups["test/f"] != nil ||
+		!strings.HasPrefix(p.Inconsistencies[0].Message, "failed to add the pod") {
+		t.Errorf("Expected test/f quarantined, but got %v", common.ToJson(p))
+	}
+	if pGpu := h.findPhysicalGpu("3-DGX1-P100-NODE", failingNode, 0); pGpu.GetAffinityGroup() != nil ||
+		pGpu.GetPriority() != freePriority {
+		t.Errorf("Expected GPU 0 on node %v released, but got %v", failingNode, pGpu.GetAffinityGroup())
+	}
+
+	// a pod failing to be re-added to an allocated group after its GPU is reallocated (on a group
+	// corrupted to have no slot for the pod) is quarantined, and its GPU is released again
+	rollback := &api.AffinityGroupSpec{
+		Name:    "test/r",
+		Members: []api.AffinityGroupMemberSpec{{PodNumber: 2, GpuNumber: 1}},
+	}
+	var rollbackPods []*core.Pod
+	for _, name := range []string{"r0", "r1"} {
+		rollbackPods = append(rollbackPods, scheduleAndAllocate(t, h, newTestPod(name, api.PodSchedulingSpec{
+			VirtualCluster: "VC2",
+			Priority:       1,
+			GpuType:        "CT1",
+			GpuNumber:      1,
+			AffinityGroup:  rollback,
+		})))
+	}
+	h.DeleteAllocatedPod(rollbackPods[1])
+	r := h.allocatedAffinityGroups["test/r"]
+	r.allocatedPods[1] = r.allocatedPods[1][:1]
+	h.AddAllocatedPod(rollbackPods[1])
+	info := internal.ExtractPodBindInfo(rollbackPods[1])
+	if p := h.inconsistentPods[rollbackPods[1].UID]; p == nil || !p.Quarantined ||
+		!strings.HasPrefix(p.Inconsistencies[0].Message, "failed to add the pod") {
+		t.Errorf("Expected %v quarantined, but got %v", rollbackPods[1].Name, common.ToJson(p))
+	}
+	if pGpu := h.findPhysicalGpu(CellChain(info.CellChain), info.Node, info.GpuIsolation[0]); pGpu.GetAffinityGroup() != nil ||
+		pGpu.GetPriority() != freePriority {
+		t.Errorf("Expected GPU %v on node %v released, but got %v", info.GpuIsolation[0], info.Node, pGpu.GetAffinityGroup())
+	}
+	if h.allocatedAffinityGroups["test/r"] != r || r.allocatedPods[1][0] == nil {
+		t.Errorf("Expected test/r still allocated with %v", rollbackPods[0].Name)
+	}
+
+	// without degraded mode, the inconsistent pods are still reported but recovered
+	h = NewHivedAlgorithm(sConfig)
+	h.AddAllocatedPod(missing)
+	if report := h.GetRecoveryReport(); report.DegradedModeEnable || len(report.Pods) != 1 ||
+		report.Pods[0].Quarantined || h.allocatedAffinityGroups["test/m"] == nil {
+		t.Errorf("Expected test/m reported and recovered, but got %v", common.ToJson(report))
+	}
+}
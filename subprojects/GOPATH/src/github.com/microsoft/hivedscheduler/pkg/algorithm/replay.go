@@ -0,0 +1,207 @@
+// MIT License
+//
+// Copyright (c) Microsoft Corporation. All rights reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE
+
+package algorithm
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"github.com/microsoft/hivedscheduler/pkg/api"
+	"github.com/microsoft/hivedscheduler/pkg/common"
+	"github.com/microsoft/hivedscheduler/pkg/internal"
+	core "k8s.io/api/core/v1"
+	"k8s.io/klog"
+	"time"
+)
+
+// Replayer rebuilds a HivedAlgorithm from the config, and replays the calls recorded in an audit log
+// in order, at the recorded time and with the recorded seed of the random decisions. So a scheduling
+// decision can be reproduced by stepping through the calls, and the algorithm is deterministic if
+// each replayed call returns the recorded result.
+type Replayer struct {
+	// the replayed algorithm, which can be inspected between the steps
+	Algorithm *HivedAlgorithm
+	records   []internal.AuditRecord
+	next      int
+	now       time.Time
+}
+
+// NewReplayer creates a Replayer for the records of an audit log, which start with the Init record.
+// The config should be the one the audit log is recorded with, which is checked by its hash in the
+// Init record. The replayed algorithm does not write the audit log or the ledger of the Scheduler.
+func NewReplayer(sConfig *api.Config, records []internal.AuditRecord) *Replayer {
+	if len(records) == 0 || records[0].Call != internal.AuditInit || len(records[0].Args) != 2 {
+		panic(fmt.Sprintf("Audit log does not start with an %v record", internal.AuditInit))
+	}
+	var seed int64
+	var configHash string
+	common.FromJsonBytes(records[0].Args[0], &seed)
+	common.FromJsonBytes(records[0].Args[1], &configHash)
+	if h := getConfigHash(sConfig); h != configHash {
+		panic(fmt.Sprintf("Audit log is recorded with config hash %v, but the config to replay it has hash %v",
+			configHash, h))
+	}
+	c := *sConfig
+	c.AuditLogFilePath = common.PtrString("")
+	c.LedgerFilePath = common.PtrString("")
+
+	r := &Replayer{records: records, next: 1, now: records[0].Time}
+	r.Algorithm = newHivedAlgorithm(&c, func() time.Time { return r.now }, seed)
+	return r
+}
+
+// Step replays the next call, and returns its record and the mismatch between the replayed and the
+// recorded result (empty if they are the same), or a nil record if all the calls have been replayed.
+func (r *Replayer) Step() (record *internal.AuditRecord, mismatch string) {
+	if r.next >= len(r.records) {
+		return nil, ""
+	}
+	record = &r.records[r.next]
+	r.next++
+	r.now = record.Time
+	result, err := r.replay(record)
+	if err != record.Error {
+		return record, fmt.Sprintf("expected error %q, but got %q", record.Error, err)
+	}
+	if !bytes.Equal(result, record.Result) {
+		return record, fmt.Sprintf("expected result %s, but got %s", record.Result, result)
+	}
+	return record, ""
+}
+
+// Replay replays all the remaining calls, and returns the mismatches prefixed by their records.
+func (r *Replayer) Replay() []string {
+	var mismatches []string
+	for {
+		i := r.next
+		record, mismatch := r.Step()
+		if record == nil {
+			return mismatches
+		}
+		if mismatch != "" {
+			mismatches = append(mismatches, fmt.Sprintf("record %v (%v at %v): %v",
+				i, record.Call, record.Time.Format(time.RFC3339Nano), mismatch))
+		}
+	}
+}
+
+// getConfigHash returns the hash of the parts of a config used by the algorithm, which is recorded in
+// the Init record of the audit log.
+func getConfigHash(sConfig *api.Config) string {
+	c := api.Config{
+		PreemptionCostWeights:      sConfig.PreemptionCostWeights,
+		RecoveryDegradedModeEnable: sConfig.RecoveryDegradedModeEnable,
+		PhysicalCluster:            sConfig.PhysicalCluster,
+		VirtualClusters:            sConfig.VirtualClusters,
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(common.ToJsonBytes(c)))
+}
+
+// ReplayAuditLog replays all the calls in an audit log file (from the Init record of the run, which may be
+// in an older rotated file), and logs and returns the mismatches.
+func ReplayAuditLog(sConfig *api.Config, filePath string) []string {
+	records := internal.ReadAuditLogRun(filePath)
+	mismatches := NewReplayer(sConfig, records).Replay()
+	for _, m := range mismatches {
+		klog.Errorf("Replay mismatch at %v", m)
+	}
+	if len(mismatches) > 0 {
+		klog.Errorf("Replayed %v records of audit log %v with %v mismatches", len(records), filePath, len(mismatches))
+	} else {
+		klog.Infof("Replayed %v records of audit log %v deterministically", len(records), filePath)
+	}
+	return mismatches
+}
+
+// replay executes a recorded call on the algorithm, and returns its result recorded in the same way as
+// the audit log, or its panic.
+func (r *Replayer) replay(record *internal.AuditRecord) (result json.RawMessage, err string) {
+	defer func() {
+		if e := recover(); e != nil {
+			result, err = nil, fmt.Sprint(e)
+		}
+	}()
+	h := r.Algorithm
+	arg := func(i int, objAddr interface{}) {
+		if i >= len(record.Args) {
+			panic(fmt.Sprintf("Audit record of %v has only %v arguments", record.Call, len(record.Args)))
+		}
+		common.FromJsonBytes(record.Args[i], objAddr)
+	}
+	var name string
+	switch record.Call {
+	case internal.AuditSchedule:
+		pod, suggestedNodes := &core.Pod{}, []string{}
+		arg(0, pod)
+		arg(1, &suggestedNodes)
+		return internal.NewAuditResult(h.Schedule(pod, suggestedNodes)), ""
+	case internal.AuditAddAllocatedPod:
+		pod := &core.Pod{}
+		arg(0, pod)
+		h.AddAllocatedPod(pod)
+	case internal.AuditDeleteAllocatedPod:
+		pod := &core.Pod{}
+		arg(0, pod)
+		h.DeleteAllocatedPod(pod)
+	case internal.AuditDeleteUnallocatedPod:
+		pod := &core.Pod{}
+		arg(0, pod)
+		h.DeleteUnallocatedPod(pod)
+	case internal.AuditReconcile:
+		h.Reconcile()
+	case internal.AuditDefragment:
+		var maxMoves int32
+		var minRuntime time.Duration
+		arg(0, &maxMoves)
+		arg(1, &minRuntime)
+		return internal.NewAuditResult(h.Defragment(maxMoves, minRuntime)), ""
+	case internal.AuditUpdateAffinityGroupPriority:
+		var priority int32
+		arg(0, &name)
+		arg(1, &priority)
+		return internal.NewAuditResult(h.UpdateAffinityGroupPriority(name, priority)), ""
+	case internal.AuditCreateReservation:
+		var reservation api.Reservation
+		arg(0, &reservation)
+		return internal.NewAuditResult(h.CreateReservation(reservation)), ""
+	case internal.AuditMoveReservation:
+		var spec api.ReservationSpec
+		arg(0, &name)
+		arg(1, &spec)
+		return internal.NewAuditResult(h.MoveReservation(name, spec)), ""
+	case internal.AuditDeleteReservation:
+		arg(0, &name)
+		return internal.NewAuditResult(h.DeleteReservation(name)), ""
+	case internal.AuditCreateCellCordon:
+		var cordon api.CellCordon
+		arg(0, &cordon)
+		return internal.NewAuditResult(h.CreateCellCordon(cordon)), ""
+	case internal.AuditDeleteCellCordon:
+		arg(0, &name)
+		return internal.NewAuditResult(h.DeleteCellCordon(name)), ""
+	default:
+		panic(fmt.Sprintf("Unknown call %v in audit log", record.Call))
+	}
+	return nil, ""
+}
@@ -0,0 +1,110 @@
+// MIT License
+//
+// Copyright (c) Microsoft Corporation. All rights reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE
+
+package algorithm
+
+import (
+	"fmt"
+	"github.com/microsoft/hivedscheduler/pkg/api"
+	"github.com/microsoft/hivedscheduler/pkg/common"
+	"github.com/microsoft/hivedscheduler/pkg/internal"
+	"io/ioutil"
+	core "k8s.io/api/core/v1"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAuditLogReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sConfig := newTestConfig()
+	auditLogFilePath := filepath.Join(dir, "audit.jsonl")
+	sConfig.AuditLogFilePath = &auditLogFilePath
+	// the chains are not sorted, as the replay rebuilds the algorithm from the config
+	h := NewHivedAlgorithm(sConfig)
+	initNodes(h)
+	newPod := func(group string, index int, vc api.VirtualClusterName, priority int32, podNumber int32) *core.Pod {
+		return newTestPod(fmt.Sprintf("%v-%v", group, index), api.PodSchedulingSpec{
+			VirtualCluster: vc,
+			Priority:       priority,
+			GpuType:        "DGX1-P100",
+			GpuNumber:      8,
+			AffinityGroup: &api.AffinityGroupSpec{
+				Name:    "test/" + group,
+				Members: []api.AffinityGroupMemberSpec{{PodNumber: podNumber, GpuNumber: 8}},
+			},
+		})
+	}
+
+	// the opportunistic group fills the nodes, and the guaranteed group preempts it on a random node
+	var victims []*core.Pod
+	for i := 0; i < 3; i++ {
+		victims = append(victims, scheduleAndAllocate(t, h, newPod("o", i, "VC2", api.OpportunisticPriority, 3)))
+	}
+	preemptor := newPod("g", 0, "VC2", 1, 2)
+	if psr := h.Schedule(preemptor, allNodes); psr.PodPreemptInfo == nil {
+		t.Fatalf("Expected to preempt, but got %v", common.ToJson(psr))
+	}
+	expectBadRequest(t, "scheduling to a non-existent VC", func() {
+		h.Schedule(newPod("x", 0, "VC-NOT-EXIST", 1, 1), allNodes)
+	})
+	h.Reconcile()
+	for _, pod := range victims {
+		h.DeleteAllocatedPod(pod)
+	}
+	scheduleAndAllocate(t, h, preemptor)
+
+	// the replayed calls return the recorded results
+	if mismatches := ReplayAuditLog(sConfig, auditLogFilePath); len(mismatches) != 0 {
+		t.Errorf("Expected deterministic replay, but got mismatches %v", mismatches)
+	}
+
+	// the replay can be stepped through to the preemption decision
+	records := internal.ReadAuditLog(auditLogFilePath)
+	if len(records) != 15 {
+		t.Fatalf("Expected 15 records, but got %v", len(records))
+	}
+	r := NewReplayer(sConfig, records)
+	for i := 1; i <= 7; i++ {
+		if record, mismatch := r.Step(); record == nil || mismatch != "" {
+			t.Fatalf("Expected record %v to be replayed, but got mismatch %q", i, mismatch)
+		}
+	}
+	if _, ok := r.Algorithm.preemptingAffinityGroups["test/g"]; !ok {
+		t.Errorf("Expected test/g preempting after record 7 (%v)", records[7].Call)
+	}
+
+	// the audit log cannot be replayed with another config
+	otherConfig := newTestConfig()
+	otherConfig.RecoveryDegradedModeEnable = common.PtrBool(true)
+	expectPanic(t, "replaying with another config", func() { NewReplayer(otherConfig, records) })
+
+	// a different result is reported
+	records[len(records)-2].Result = internal.NewAuditResult(internal.PodScheduleResult{})
+	if mismatches := NewReplayer(sConfig, records).Replay(); len(mismatches) != 1 {
+		t.Errorf("Expected 1 mismatch, but got %v", mismatches)
+	}
+}
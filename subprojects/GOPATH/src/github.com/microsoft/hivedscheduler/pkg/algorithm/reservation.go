@@ -0,0 +1,385 @@
+// MIT License
+//
+// Copyright (c) Microsoft Corporation. All rights reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE
+
+package algorithm
+
+import (
+	"fmt"
+	"github.com/microsoft/hivedscheduler/pkg/api"
+	"github.com/microsoft/hivedscheduler/pkg/common"
+	"github.com/microsoft/hivedscheduler/pkg/internal"
+	"k8s.io/klog"
+	"sort"
+)
+
+func (h *HivedAlgorithm) GetReservations() api.ReservationList {
+	h.algorithmLock.RLock()
+	defer h.algorithmLock.RUnlock()
+
+	rs := api.ReservationList{}
+	for vc, vcReservation := range h.reservedCells {
+		for rid := range vcReservation {
+			rs.Items = append(rs.Items, h.toReservation(vc, rid))
+		}
+	}
+	sort.SliceStable(rs.Items, func(i, j int) bool {
+		return rs.Items[i].Name < rs.Items[j].Name
+	})
+	return rs
+}
+
+func (h *HivedAlgorithm) GetReservation(name string) api.Reservation {
+	h.algorithmLock.RLock()
+	defer h.algorithmLock.RUnlock()
+
+	vc := h.getReservationVc(api.ReservationId(name))
+	return h.toReservation(vc, api.ReservationId(name))
+}
+
+// CreateReservation reserves a free physical cell (the specified one, or one picked by buddy alloc)
+// for a VC, and binds it to the reserved virtual cell created for the reservation.
+func (h *HivedAlgorithm) CreateReservation(r api.Reservation) (result api.Reservation) {
+	h.algorithmLock.Lock()
+	defer h.algorithmLock.Unlock()
+	defer h.audit(internal.AuditCreateReservation, &result, r)()
+
+	rid := api.ReservationId(r.Name)
+	vc := r.Spec.VirtualCluster
+	if rid == "" {
+		panic(internal.NewBadRequestError("Reservation name is empty"))
+	}
+	for existingVc, vcs := range h.vcSchedulers {
+		if vcs.getReservedCellList()[rid] != nil {
+			panic(internal.NewBadRequestError(fmt.Sprintf(
+				"Reservation %v already exists in VC %v", rid, existingVc)))
+		}
+	}
+	if h.vcSchedulers[vc] == nil {
+		panic(internal.NewBadRequestError(fmt.Sprintf(
+			"VC %v does not exist", vc)))
+	}
+	chainLevels := h.getCellTypeChainLevels(r.Spec.CellType)
+	if len(chainLevels) == 0 {
+		panic(internal.NewBadRequestError(fmt.Sprintf(
+			"Cell type %v does not exist in the physical cluster", r.Spec.CellType)))
+	}
+
+	pc := h.allocateReservedCell(chainLevels, r.Spec)
+	pc.SetReserved(true)
+	virtualList := buildReservedVirtualCells(h.cellTypeSpecs, vc, rid, pc)
+	h.vcSchedulers[vc].addReservation(rid, virtualList)
+	if h.reservedCells[vc] == nil {
+		h.reservedCells[vc] = map[api.ReservationId]*PhysicalCell{}
+	}
+	h.reservedCells[vc][rid] = pc
+	bindReservedCell(virtualList[CellLevel(len(virtualList))][0].(*VirtualCell), pc)
+	klog.Infof("Reservation %v created in VC %v", rid, vc)
+	return h.toReservation(vc, rid)
+}
+
+// MoveReservation moves an idle reservation to another free physical cell of the same type
+// (the specified one, or one picked by buddy alloc).
+func (h *HivedAlgorithm) MoveReservation(name string, spec api.ReservationSpec) (result api.Reservation) {
+	h.algorithmLock.Lock()
+	defer h.algorithmLock.Unlock()
+	defer h.audit(internal.AuditMoveReservation, &result, name, spec)()
+
+	rid := api.ReservationId(name)
+	vc := h.getReservationVc(rid)
+	h.checkReservationWithoutTimeWindows(vc, rid)
+	original := h.reservedCells[vc][rid]
+	if spec.VirtualCluster != "" && spec.VirtualCluster != vc {
+		panic(internal.NewBadRequestError(fmt.Sprintf(
+			"Reservation %v cannot be moved from VC %v to VC %v", rid, vc, spec.VirtualCluster)))
+	}
+	cellType := h.cellTypes[original.GetChain()][original.GetLevel()]
+	if spec.CellType != "" && spec.CellType != cellType {
+		panic(internal.NewBadRequestError(fmt.Sprintf(
+			"Reservation %v cannot be moved from cell type %v to cell type %v", rid, cellType, spec.CellType)))
+	}
+
+	h.moveReservation(vc, rid, spec)
+	return h.toReservation(vc, rid)
+}
+
+// DeleteReservation deletes an idle reservation and returns its physical cell to the free list.
+func (h *HivedAlgorithm) DeleteReservation(name string) (result api.Reservation) {
+	h.algorithmLock.Lock()
+	defer h.algorithmLock.Unlock()
+	defer h.audit(internal.AuditDeleteReservation, &result, name)()
+
+	rid := api.ReservationId(name)
+	vc := h.getReservationVc(rid)
+	h.checkReservationWithoutTimeWindows(vc, rid)
+	r := h.toReservation(vc, rid)
+	h.unbindReservedCell(vc, rid)
+	h.vcSchedulers[vc].removeReservation(rid)
+	delete(h.reservedCells[vc], rid)
+	klog.Infof("Reservation %v deleted from VC %v", rid, vc)
+	return r
+}
+
+// initReservations creates static bindings for the reserved cells, and removes the
+// reserved physical cells from the free cell list.
+func (h *HivedAlgorithm) initReservations() {
+	for vc, vcReservation := range h.reservedCells {
+		for rid, physical := range vcReservation {
+			h.removeCellFromFreeList(physical)
+			virtualList := h.vcSchedulers[vc].getReservedCellList()[rid]
+			bindReservedCell(virtualList[CellLevel(len(virtualList))][0].(*VirtualCell), physical)
+		}
+	}
+}
+
+// moveReservation moves an idle reservation to another free physical cell of the same type.
+// The reservation is kept on the original cell if no cell can be found.
+func (h *HivedAlgorithm) moveReservation(vc api.VirtualClusterName, rid api.ReservationId, spec api.ReservationSpec) {
+	original := h.reservedCells[vc][rid]
+	virtual := h.unbindReservedCell(vc, rid)
+	var pc *PhysicalCell
+	func() {
+		defer func() {
+			if r := recover(); r != nil {
+				// restore the original reservation before reporting the error
+				h.removeCellFromFreeList(original)
+				bindReservedCell(virtual, original)
+				panic(r)
+			}
+		}()
+		pc = h.allocateReservedCell(map[CellChain]CellLevel{original.GetChain(): original.GetLevel()}, spec)
+	}()
+	h.reservedCells[vc][rid] = pc
+	bindReservedCell(virtual, pc)
+	klog.Infof("Reservation %v in VC %v moved from %v to %v", rid, vc, original.GetName(), pc.GetName())
+}
+
+// getReservationVc returns the VC of a reservation.
+func (h *HivedAlgorithm) getReservationVc(rid api.ReservationId) api.VirtualClusterName {
+	for vc, vcReservation := range h.reservedCells {
+		if vcReservation[rid] != nil {
+			return vc
+		}
+	}
+	panic(internal.NewBadRequestError(fmt.Sprintf(
+		"Reservation %v does not exist", rid)))
+}
+
+// toReservation returns the reservation exposed by the inspect API.
+func (h *HivedAlgorithm) toReservation(vc api.VirtualClusterName, rid api.ReservationId) api.Reservation {
+	pc := h.reservedCells[vc][rid]
+	nodes, gpuIndices := pc.GetPhysicalPlacement()
+	r := api.Reservation{}
+	r.Name = string(rid)
+	r.Spec.VirtualCluster = vc
+	r.Spec.CellType = h.cellTypes[pc.GetChain()][pc.GetLevel()]
+	r.Spec.Nodes = append([]string{}, nodes...)
+	if !pc.AtOrHigherThanNode() {
+		r.Spec.GpuIndices = append([]int32{}, gpuIndices...)
+	}
+	return r
+}
+
+// getCellTypeChainLevels returns the level of a cell type in each chain containing it.
+func (h *HivedAlgorithm) getCellTypeChainLevels(cellType api.CellType) map[CellChain]CellLevel {
+	chainLevels := map[CellChain]CellLevel{}
+	for chain, levelTypes := range h.cellTypes {
+		for l, t := range levelTypes {
+			if t == cellType {
+				chainLevels[chain] = l
+			}
+		}
+	}
+	return chainLevels
+}
+
+// allocateReservedCell finds a free physical cell for a reservation and removes it from the free list.
+// If the spec specifies the nodes, the cell on these nodes is used; otherwise the cell is selected
+// by buddy alloc. The cell is not used if reserving it makes the free cells insufficient for the VCs.
+func (h *HivedAlgorithm) allocateReservedCell(
+	chainLevels map[CellChain]CellLevel,
+	spec api.ReservationSpec) *PhysicalCell {
+
+	chains := getSortedChains(chainLevels)
+	if len(spec.Nodes) != 0 {
+		pc := h.findPhysicalCell(chainLevels, spec.CellType, spec.Nodes, spec.GpuIndices)
+		if isInCordonedCell(pc) || hasCordonedDescendant(pc) {
+			panic(internal.NewBadRequestError(fmt.Sprintf(
+				"Cell %v is cordoned", pc.GetName())))
+		}
+		if !h.isCellFree(pc) {
+			panic(internal.NewBadRequestError(fmt.Sprintf(
+				"Cell %v is not free", pc.GetName())))
+		}
+		h.removeCellFromFreeList(pc)
+		if !h.isFreeCellListSufficient(pc.GetChain()) {
+			h.addCellToFreeList(pc)
+			panic(internal.NewBadRequestError(fmt.Sprintf(
+				"Cell %v cannot be reserved since the free cells will be insufficient for the VCs",
+				pc.GetName())))
+		}
+		return pc
+	}
+	for _, chain := range chains {
+		pc := buddyAlloc(h.getTmpFreeCellList(chain), chainLevels[chain], h.getAllNodeSet(), h.costModel, nil)
+		if pc == nil {
+			continue
+		}
+		h.removeCellFromFreeList(pc)
+		if h.isFreeCellListSufficient(chain) {
+			return pc
+		}
+		h.addCellToFreeList(pc)
+	}
+	panic(internal.NewBadRequestError(fmt.Sprintf(
+		"No free cell of type %v can be reserved without making the free cells insufficient for the VCs",
+		spec.CellType)))
+}
+
+// getSortedChains returns the chains in a map sorted by name.
+func getSortedChains(chainLevels map[CellChain]CellLevel) []CellChain {
+	var chains []CellChain
+	for chain := range chainLevels {
+		chains = append(chains, chain)
+	}
+	sort.SliceStable(chains, func(i, j int) bool {
+		return chains[i] < chains[j]
+	})
+	return chains
+}
+
+// findPhysicalCell finds the physical cell at the level of each chain which is on the exact nodes
+// (and GPU indices, if specified). It panics if not exactly one cell is found.
+func (h *HivedAlgorithm) findPhysicalCell(
+	chainLevels map[CellChain]CellLevel,
+	cellType api.CellType,
+	nodes []string,
+	gpuIndices []int32) *PhysicalCell {
+
+	var pc *PhysicalCell
+	for _, chain := range getSortedChains(chainLevels) {
+		for _, c := range h.fullCellList[chain][chainLevels[chain]] {
+			if cc := c.(*PhysicalCell); isCellAtPlacement(cc, nodes, gpuIndices) {
+				if pc != nil {
+					panic(internal.NewBadRequestError(fmt.Sprintf(
+						"More than one cell of type %v found on nodes %v with GPU indices %v",
+						cellType, nodes, gpuIndices)))
+				}
+				pc = cc
+			}
+		}
+	}
+	if pc == nil {
+		panic(internal.NewBadRequestError(fmt.Sprintf(
+			"No cell of type %v found on nodes %v with GPU indices %v",
+			cellType, nodes, gpuIndices)))
+	}
+	return pc
+}
+
+// isCellAtPlacement checks if a physical cell is on the exact nodes (and GPU indices, if specified).
+func isCellAtPlacement(c *PhysicalCell, nodes []string, gpuIndices []int32) bool {
+	cNodes, cGpuIndices := c.GetPhysicalPlacement()
+	if len(cNodes) != len(nodes) {
+		return false
+	}
+	for _, n := range nodes {
+		if !common.StringsContains(cNodes, n) {
+			return false
+		}
+	}
+	if len(gpuIndices) == 0 {
+		return true
+	}
+	if len(cGpuIndices) != len(gpuIndices) {
+		return false
+	}
+	for _, i := range gpuIndices {
+		if !common.Int32SliceContains(cGpuIndices, i) {
+			return false
+		}
+	}
+	return true
+}
+
+// isCellFree checks if a physical cell is in the free cell list or within a free cell.
+func (h *HivedAlgorithm) isCellFree(c *PhysicalCell) bool {
+	for cc := Cell(c); cc != nil; cc = cc.GetParent() {
+		if cellListContains(h.freeCellList[c.GetChain()][cc.GetLevel()], cc) {
+			return true
+		}
+	}
+	return false
+}
+
+// isFreeCellListSufficient checks if the free cells in a chain can still be bound to
+// all the unbound preassigned cells of the VCs (i.e., the VC safety is kept).
+func (h *HivedAlgorithm) isFreeCellListSufficient(chain CellChain) bool {
+	needed := map[CellLevel]int32{}
+	for _, vcs := range h.vcSchedulers {
+		for l, cl := range vcs.getNonReservedCellList()[chain] {
+			for _, c := range cl {
+				if v := c.(*VirtualCell); v.GetParent() == nil && v.GetPhysicalCell() == nil && !v.IsInactive() {
+					needed[l]++
+				}
+			}
+		}
+	}
+	freeList := h.freeCellList[chain]
+	available := int32(0)
+	for l := CellLevel(len(freeList)); l >= lowestLevel; l-- {
+		available += int32(len(freeList[l]))
+		left := available - needed[l]
+		if left < 0 {
+			return false
+		}
+		if l > lowestLevel {
+			available = left * int32(len(h.fullCellList[chain][l][0].GetChildren()))
+		}
+	}
+	return true
+}
+
+// unbindReservedCell unbinds an idle reservation from its physical cell, and returns the top reserved
+// virtual cell. The physical cell is added back to the free list.
+func (h *HivedAlgorithm) unbindReservedCell(vc api.VirtualClusterName, rid api.ReservationId) *VirtualCell {
+	pc := h.reservedCells[vc][rid]
+	virtual := pc.GetVirtualCell()
+	if virtual.GetPriority() != freePriority {
+		panic(internal.NewBadRequestError(fmt.Sprintf(
+			"Reservation %v is in use by affinity groups", rid)))
+	}
+	virtual.SetPhysicalCell(nil)
+	pc.SetVirtualCell(nil)
+	pc.SetReserved(false)
+	klog.Infof("Cells unbound: %v and %v (reservation)", virtual.GetName(), pc.GetName())
+	h.addCellToFreeList(pc)
+	return virtual
+}
+
+// bindReservedCell binds the top reserved virtual cell to a physical cell which has been
+// removed from the free list.
+func bindReservedCell(virtual *VirtualCell, pc *PhysicalCell) {
+	virtual.SetPhysicalCell(pc)
+	pc.SetVirtualCell(virtual)
+	pc.SetReserved(true)
+	klog.Infof("Cells bound: %v and %v (reservation)", virtual.GetName(), pc.GetName())
+}
@@ -0,0 +1,135 @@
+// MIT License
+//
+// Copyright (c) Microsoft Corporation. All rights reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE
+
+package algorithm
+
+import (
+	"github.com/microsoft/hivedscheduler/pkg/api"
+	"github.com/microsoft/hivedscheduler/pkg/common"
+	"github.com/microsoft/hivedscheduler/pkg/internal"
+	"reflect"
+	"testing"
+)
+
+func TestRuntimeReservation(t *testing.T) {
+	h := newTestAlgorithm(newTestConfig())
+	reservationNum := len(h.GetReservations().Items)
+
+	// the CT1-NODE chain has two free nodes, and VC2 needs one of them
+	r0 := h.CreateReservation(api.Reservation{
+		ObjectMeta: api.ObjectMeta{Name: "VC1-CT1-NODE"},
+		Spec:       api.ReservationSpec{VirtualCluster: "VC1", CellType: "CT1-NODE"},
+	})
+	if len(r0.Spec.Nodes) != 1 || r0.Spec.Nodes[0] == "1.0.0.2" {
+		t.Errorf("Expected reservation %v on a free CT1-NODE, but got %v", r0.Name, r0.Spec.Nodes)
+	}
+	expectBadRequest(t, "reserving the last free CT1-NODE needed by VC2", func() {
+		h.CreateReservation(api.Reservation{
+			ObjectMeta: api.ObjectMeta{Name: "VC2-CT1-NODE"},
+			Spec:       api.ReservationSpec{VirtualCluster: "VC2", CellType: "CT1-NODE"},
+		})
+	})
+	r1 := api.Reservation{
+		ObjectMeta: api.ObjectMeta{Name: "VC2-CT1"},
+		Spec: api.ReservationSpec{
+			VirtualCluster: "VC2", CellType: "CT1", Nodes: []string{"1.0.0.2"}, GpuIndices: []int32{9}},
+	}
+	if r := h.CreateReservation(r1); !reflect.DeepEqual(r, r1) {
+		t.Errorf("Expected reservation %v, but got %v", r1, r)
+	}
+	expectBadRequest(t, "reserving an existing reservation", func() { h.CreateReservation(r1) })
+	expectBadRequest(t, "reserving a reserved cell", func() {
+		h.CreateReservation(api.Reservation{
+			ObjectMeta: api.ObjectMeta{Name: "VC2-CT1-8"},
+			Spec: api.ReservationSpec{
+				VirtualCluster: "VC2", CellType: "CT1", Nodes: []string{"1.0.0.2"}, GpuIndices: []int32{8}},
+		})
+	})
+	expectBadRequest(t, "reserving for a non-existing VC", func() {
+		h.CreateReservation(api.Reservation{
+			ObjectMeta: api.ObjectMeta{Name: "VC3-CT1"},
+			Spec:       api.ReservationSpec{VirtualCluster: "VC3", CellType: "CT1"},
+		})
+	})
+	if n := len(h.GetReservations().Items); n != reservationNum+2 {
+		t.Errorf("Expected %v reservations, but got %v", reservationNum+2, n)
+	}
+
+	// a reservation in use cannot be moved or deleted
+	allocatedPod := scheduleAndAllocate(t, h, newTestPod("reservation-pod", api.PodSchedulingSpec{
+		VirtualCluster: "VC2",
+		Priority:       1,
+		ReservationId:  "VC2-CT1",
+		GpuType:        "CT1",
+		GpuNumber:      1,
+	}))
+	if info := internal.ExtractPodBindInfo(allocatedPod); info.Node != "1.0.0.2" ||
+		!compareGpuIsolation(info.GpuIsolation, []int32{9}) {
+		t.Fatalf("Expected pod %v bound to GPU 9 of node 1.0.0.2, but got %v", allocatedPod.Name, common.ToJson(info))
+	}
+	expectBadRequest(t, "deleting a reservation in use", func() { h.DeleteReservation("VC2-CT1") })
+	expectBadRequest(t, "moving a reservation in use", func() { h.MoveReservation("VC2-CT1", api.ReservationSpec{}) })
+	h.DeleteAllocatedPod(allocatedPod)
+
+	// moving to the last free CT1-NODE breaks VC2, so the reservation stays on the original cell
+	var lastFreeGpu api.ReservationSpec
+	for _, c := range h.fullCellList["CT1-NODE"][1] {
+		if nodes, gpuIndices := c.(*PhysicalCell).GetPhysicalPlacement(); nodes[0] != "1.0.0.2" &&
+			nodes[0] != r0.Spec.Nodes[0] {
+			lastFreeGpu = api.ReservationSpec{Nodes: nodes, GpuIndices: gpuIndices}
+		}
+	}
+	expectBadRequest(t, "moving a reservation to the last free CT1-NODE", func() {
+		h.MoveReservation("VC2-CT1", lastFreeGpu)
+	})
+	if r := h.GetReservation("VC2-CT1"); !reflect.DeepEqual(r, r1) {
+		t.Errorf("Expected reservation %v, but got %v", r1, r)
+	}
+	if !h.isFreeCellListSufficient("CT1-NODE") {
+		t.Errorf("Expected sufficient free cells after the failed move")
+	}
+
+	h.DeleteReservation(r0.Name)
+	expectBadRequest(t, "getting a deleted reservation", func() { h.GetReservation(r0.Name) })
+	spec := api.ReservationSpec{Nodes: r0.Spec.Nodes, GpuIndices: []int32{0}}
+	for _, c := range h.fullCellList["CT1-NODE"][1] {
+		if nodes, gpuIndices := c.(*PhysicalCell).GetPhysicalPlacement(); nodes[0] == r0.Spec.Nodes[0] {
+			spec.GpuIndices = gpuIndices
+			break
+		}
+	}
+	if r := h.MoveReservation("VC2-CT1", spec); !reflect.DeepEqual(r.Spec.Nodes, spec.Nodes) ||
+		!reflect.DeepEqual(r.Spec.GpuIndices, spec.GpuIndices) {
+		t.Errorf("Expected reservation VC2-CT1 moved to %v, but got %v", spec, r.Spec)
+	}
+	for _, c := range h.fullCellList["CT1-NODE"][1] {
+		pc := c.(*PhysicalCell)
+		if nodes, gpuIndices := pc.GetPhysicalPlacement(); nodes[0] == "1.0.0.2" && gpuIndices[0] == 9 &&
+			(pc.IsReserved() || !h.isCellFree(pc)) {
+			t.Errorf("Expected cell %v to be free after the reservation moved", pc.GetName())
+		}
+	}
+	h.DeleteReservation("VC2-CT1")
+	if n := len(h.GetReservations().Items); n != reservationNum {
+		t.Errorf("Expected %v reservations, but got %v", reservationNum, n)
+	}
+}
@@ -0,0 +1,380 @@
+// MIT License
+//
+// Copyright (c) Microsoft Corporation. All rights reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE
+
+package algorithm
+
+import (
+	"fmt"
+	"github.com/microsoft/hivedscheduler/pkg/api"
+	"github.com/microsoft/hivedscheduler/pkg/common"
+	"github.com/microsoft/hivedscheduler/pkg/internal"
+	core "k8s.io/api/core/v1"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"reflect"
+	"sort"
+	"time"
+)
+
+// GetSnapshot returns the Snapshot of the scheduling state of the algorithm, i.e., without the Config
+// and the PodScheduleStatuses, which are filled by the Scheduler.
+func (h *HivedAlgorithm) GetSnapshot() api.Snapshot {
+	h.algorithmLock.RLock()
+	defer h.algorithmLock.RUnlock()
+
+	snapshot := api.Snapshot{
+		Version:                  api.SnapshotVersion,
+		Time:                     meta.NewTime(h.now()),
+		PhysicalCells:            []api.CellSnapshot{},
+		VirtualCells:             map[api.VirtualClusterName][]api.CellSnapshot{},
+		FreeCells:                map[string]map[int32][]string{},
+		AffinityGroups:           []api.AffinityGroupSnapshot{},
+		PreemptingAffinityGroups: []api.AffinityGroup{},
+		Reservations:             []api.Reservation{},
+		CellCordons:              []api.CellCordon{},
+	}
+	for _, chain := range getSortedCellListChains(h.fullCellList) {
+		for _, c := range getTopCells(h.fullCellList[chain]) {
+			snapshot.PhysicalCells = append(snapshot.PhysicalCells, h.toCellSnapshot(c))
+		}
+		freeCells := map[int32][]string{}
+		for l, cl := range h.freeCellList[chain] {
+			if len(cl) > 0 {
+				freeCells[int32(l)] = getSortedCellNames(cl)
+			}
+		}
+		snapshot.FreeCells[string(chain)] = freeCells
+	}
+	for vc, vcs := range h.vcSchedulers {
+		cells := []api.CellSnapshot{}
+		for _, chain := range getSortedCellListChains(vcs.getNonReservedCellList()) {
+			for _, c := range getTopCells(vcs.getNonReservedCellList()[chain]) {
+				cells = append(cells, h.toCellSnapshot(c))
+			}
+		}
+		var rids []api.ReservationId
+		for rid := range vcs.getReservedCellList() {
+			rids = append(rids, rid)
+		}
+		sort.Slice(rids, func(i, j int) bool { return rids[i] < rids[j] })
+		for _, rid := range rids {
+			for _, c := range getTopCells(vcs.getReservedCellList()[rid]) {
+				cells = append(cells, h.toCellSnapshot(c))
+			}
+		}
+		snapshot.VirtualCells[vc] = cells
+	}
+
+	var names []string
+	for name := range h.allocatedAffinityGroups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		snapshot.AffinityGroups = append(snapshot.AffinityGroups, toAffinityGroupSnapshot(h.allocatedAffinityGroups[name]))
+	}
+	names = nil
+	for name := range h.preemptingAffinityGroups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		ag := api.AffinityGroup{}
+		ag.Name = name
+		ag.Status.PreemptionStatus = h.preemptingAffinityGroups[name]
+		snapshot.PreemptingAffinityGroups = append(snapshot.PreemptingAffinityGroups, ag)
+	}
+	for vc, vcReservation := range h.reservedCells {
+		for rid := range vcReservation {
+			snapshot.Reservations = append(snapshot.Reservations, h.toReservation(vc, rid))
+		}
+	}
+	sort.SliceStable(snapshot.Reservations, func(i, j int) bool {
+		return snapshot.Reservations[i].Name < snapshot.Reservations[j].Name
+	})
+	names = nil
+	for name := range h.cellCordons {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		snapshot.CellCordons = append(snapshot.CellCordons, h.toCellCordon(name))
+	}
+	return snapshot
+}
+
+// toCellSnapshot returns the CellSnapshot of a physical or virtual cell with its children.
+func (h *HivedAlgorithm) toCellSnapshot(c Cell) api.CellSnapshot {
+	cs := api.CellSnapshot{
+		Name:      c.GetName(),
+		CellType:  h.cellTypes[c.GetChain()][c.GetLevel()],
+		CellChain: string(c.GetChain()),
+		Level:     int32(c.GetLevel()),
+		Priority:  int32(c.GetPriority()),
+	}
+	for p, n := range c.GetUsedGpuNumAtPriorities() {
+		if n != 0 {
+			if cs.UsedGpuNumbers == nil {
+				cs.UsedGpuNumbers = map[int32]int32{}
+			}
+			cs.UsedGpuNumbers[int32(p)] = n
+		}
+	}
+	switch cc := c.(type) {
+	case *PhysicalCell:
+		if vc := cc.GetVirtualCell(); vc != nil {
+			cs.BoundCell = vc.GetName()
+			cs.VirtualCluster = vc.vc
+			cs.ReservationId = vc.rid
+		}
+		cs.Reserved = cc.IsReserved()
+		cs.Cordoned = cc.IsCordoned()
+		if g := cc.GetAffinityGroup(); g != nil {
+			cs.AffinityGroup = g.name
+		}
+	case *VirtualCell:
+		if pc := cc.GetPhysicalCell(); pc != nil {
+			cs.BoundCell = pc.GetName()
+		}
+		cs.VirtualCluster = cc.vc
+		cs.ReservationId = cc.rid
+		cs.Inactive = cc.IsInactive()
+	}
+	for _, child := range c.GetChildren() {
+		cs.Children = append(cs.Children, h.toCellSnapshot(child))
+	}
+	return cs
+}
+
+// toAffinityGroupSnapshot returns the AffinityGroupSnapshot of an allocated affinity group,
+// with its allocated pods ordered by GPU number and pod index.
+func toAffinityGroupSnapshot(g *AlgoAffinityGroup) api.AffinityGroupSnapshot {
+	ags := api.AffinityGroupSnapshot{AffinityGroup: g.ToAffinityGroup(), User: g.user, Pods: []*core.Pod{}}
+	var gpuNums []int32
+	for gpuNum := range g.allocatedPods {
+		gpuNums = append(gpuNums, gpuNum)
+	}
+	sort.Slice(gpuNums, func(i, j int) bool { return gpuNums[i] < gpuNums[j] })
+	for _, gpuNum := range gpuNums {
+		for _, pod := range g.allocatedPods[gpuNum] {
+			if pod != nil {
+				ags.Pods = append(ags.Pods, internal.CompactPod(pod))
+			}
+		}
+	}
+	return ags
+}
+
+// getSortedCellListChains returns the chains of the ChainCellLists sorted by name.
+func getSortedCellListChains(ccls map[CellChain]ChainCellList) []CellChain {
+	var chains []CellChain
+	for chain := range ccls {
+		chains = append(chains, chain)
+	}
+	sort.Slice(chains, func(i, j int) bool { return chains[i] < chains[j] })
+	return chains
+}
+
+// getTopCells returns the cells without parent in a ChainCellList, from the highest level.
+func getTopCells(ccl ChainCellList) CellList {
+	var cells CellList
+	for l := CellLevel(len(ccl)); l >= lowestLevel; l-- {
+		for _, c := range ccl[l] {
+			if c.GetParent() == nil {
+				cells = append(cells, c)
+			}
+		}
+	}
+	return cells
+}
+
+func getSortedCellNames(cl CellList) []string {
+	names := make([]string, len(cl))
+	for i, c := range cl {
+		names[i] = c.GetName()
+	}
+	sort.Strings(names)
+	return names
+}
+
+// LoadSnapshot rebuilds a HivedAlgorithm offline from a Snapshot, e.g., captured from the Scheduler in
+// production: the algorithm is initialized from the Config in the Snapshot, its Reservations and
+// CellCordons are changed to the ones in the Snapshot, and then its affinity groups are recovered from
+// their allocated pods as if the Scheduler restarted, with their priorities and preemption statuses.
+// The bindings between the virtual and physical cells may depend on the history, so the rebuilt state
+// is compared with the Snapshot, and the differences (and the failures to recover) are returned.
+// The clock of the algorithm is fixed at the time of the Snapshot, and the ledger and the audit log
+// are disabled.
+func LoadSnapshot(snapshot api.Snapshot) (h *HivedAlgorithm, differences []string) {
+	if snapshot.Version != api.SnapshotVersion {
+		panic(fmt.Sprintf("Snapshot version %v is not supported, expected %v",
+			snapshot.Version, api.SnapshotVersion))
+	}
+	rawConfig := api.Config{}
+	common.FromYaml(snapshot.Config, &rawConfig)
+	sConfig := api.NewConfig(&rawConfig)
+	sConfig.LedgerFilePath = common.PtrString("")
+	sConfig.AuditLogFilePath = common.PtrString("")
+	now := snapshot.Time.Time
+	h = newHivedAlgorithm(sConfig, func() time.Time { return now }, now.UnixNano())
+
+	try := func(step string, f func()) {
+		defer func() {
+			if r := recover(); r != nil {
+				differences = append(differences, fmt.Sprintf("failed to %v: %v", step, r))
+			}
+		}()
+		f()
+	}
+	current := map[string]api.Reservation{}
+	for _, r := range h.GetReservations().Items {
+		current[r.Name] = r
+	}
+	for name := range current {
+		found := false
+		for _, r := range snapshot.Reservations {
+			found = found || r.Name == name
+		}
+		if !found {
+			try("delete reservation "+name, func() { h.DeleteReservation(name) })
+		}
+	}
+	for _, r := range snapshot.Reservations {
+		r := r
+		if c, ok := current[r.Name]; !ok {
+			try("create reservation "+r.Name, func() { h.CreateReservation(r) })
+		} else if !reflect.DeepEqual(c.Spec, r.Spec) {
+			try("move reservation "+r.Name, func() { h.MoveReservation(r.Name, r.Spec) })
+		}
+	}
+	for _, cc := range snapshot.CellCordons {
+		cordon := api.CellCordon{ObjectMeta: cc.ObjectMeta, Spec: cc.Spec}
+		try("create cell cordon "+cc.Name, func() { h.CreateCellCordon(cordon) })
+	}
+
+	for _, ags := range snapshot.AffinityGroups {
+		for _, pod := range ags.Pods {
+			try("add pod "+internal.Key(pod), func() { h.AddAllocatedPod(pod) })
+		}
+	}
+	for _, ags := range snapshot.AffinityGroups {
+		g := h.allocatedAffinityGroups[ags.Name]
+		if g == nil {
+			continue
+		}
+		if ags.Status.Priority != int32(g.priority) {
+			try("update priority of affinity group "+ags.Name, func() {
+				h.UpdateAffinityGroupPriority(ags.Name, ags.Status.Priority)
+			})
+		}
+		if ags.Status.LazyPreemptionStatus != nil && g.lazyPreemptionStatus == nil {
+			h.lazyPreemptAffinityGroup(g, ags.Status.LazyPreemptionStatus.Preemptor)
+		}
+		if g.lazyPreemptionStatus != nil && ags.Status.LazyPreemptionStatus != nil {
+			g.lazyPreemptionStatus = ags.Status.LazyPreemptionStatus
+		}
+		g.preemptionStatus = ags.Status.PreemptionStatus
+	}
+	for _, ag := range snapshot.PreemptingAffinityGroups {
+		h.preemptingAffinityGroups[ag.Name] = ag.Status.PreemptionStatus
+	}
+
+	return h, append(differences, compareSnapshots(snapshot, h.GetSnapshot())...)
+}
+
+// compareSnapshots returns the differences of the cells, the free cells, the affinity groups,
+// the Reservations and the CellCordons between two Snapshots.
+func compareSnapshots(expected, actual api.Snapshot) []string {
+	var differences []string
+	compare := func(kind string, expected, actual map[string]interface{}) {
+		var names []string
+		for name := range expected {
+			names = append(names, name)
+		}
+		for name := range actual {
+			if _, ok := expected[name]; !ok {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			e, a := common.ToJson(expected[name]), common.ToJson(actual[name])
+			if e != a {
+				differences = append(differences, fmt.Sprintf("%v %v: expected %v, but got %v", kind, name, e, a))
+			}
+		}
+	}
+	compare("cell", flattenCellSnapshots(expected), flattenCellSnapshots(actual))
+	compare("free cells of chain", toItemMap(expected.FreeCells), toItemMap(actual.FreeCells))
+	compare("affinity group", toItemMap(expected.AffinityGroups), toItemMap(actual.AffinityGroups))
+	compare("reservation", toItemMap(expected.Reservations), toItemMap(actual.Reservations))
+	compare("cell cordon", toItemMap(expected.CellCordons), toItemMap(actual.CellCordons))
+	return differences
+}
+
+// flattenCellSnapshots maps the name of each physical and virtual cell in a Snapshot to
+// its CellSnapshot without children.
+func flattenCellSnapshots(snapshot api.Snapshot) map[string]interface{} {
+	cells := map[string]interface{}{}
+	var add func(cs api.CellSnapshot)
+	add = func(cs api.CellSnapshot) {
+		for _, child := range cs.Children {
+			add(child)
+		}
+		cs.Children = nil
+		cells[cs.Name] = cs
+	}
+	for _, cs := range snapshot.PhysicalCells {
+		add(cs)
+	}
+	for _, vcCells := range snapshot.VirtualCells {
+		for _, cs := range vcCells {
+			add(cs)
+		}
+	}
+	return cells
+}
+
+// toItemMap maps the name of each item in a Snapshot field to the item, ignoring the pods of
+// the affinity groups (which are used to rebuild them).
+func toItemMap(items interface{}) map[string]interface{} {
+	m := map[string]interface{}{}
+	switch list := items.(type) {
+	case map[string]map[int32][]string:
+		for chain, freeCells := range list {
+			m[chain] = freeCells
+		}
+	case []api.AffinityGroupSnapshot:
+		for _, ags := range list {
+			ags.Pods = nil
+			m[ags.Name] = ags
+		}
+	case []api.Reservation:
+		for _, r := range list {
+			m[r.Name] = r
+		}
+	case []api.CellCordon:
+		for _, cc := range list {
+			m[cc.Name] = cc
+		}
+	}
+	return m
+}
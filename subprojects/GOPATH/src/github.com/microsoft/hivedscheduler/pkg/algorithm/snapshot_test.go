@@ -0,0 +1,79 @@
+// MIT License
+//
+// Copyright (c) Microsoft Corporation. All rights reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE
+
+package algorithm
+
+import (
+	"github.com/microsoft/hivedscheduler/pkg/api"
+	"github.com/microsoft/hivedscheduler/pkg/common"
+	"testing"
+)
+
+func TestSnapshot(t *testing.T) {
+	sConfig := newTestConfig()
+	h := newTestAlgorithm(sConfig)
+	schedule := func(name string, priority int32, gpuNumber int32) {
+		scheduleAndAllocate(t, h, newTestPod(name, api.PodSchedulingSpec{
+			VirtualCluster: "VC2",
+			Priority:       priority,
+			GpuType:        "DGX1-P100",
+			GpuNumber:      gpuNumber,
+		}))
+	}
+	schedule("g", 1, 8)
+	schedule("o", api.OpportunisticPriority, 4)
+	h.UpdateAffinityGroupPriority("test/g", 2)
+	h.CreateCellCordon(api.CellCordon{
+		ObjectMeta: api.ObjectMeta{Name: "0.0.0.1"},
+		Spec:       api.CellCordonSpec{Nodes: []string{"0.0.0.1"}},
+	})
+
+	// the Snapshot document is loaded to rebuild the same state
+	snapshot := h.GetSnapshot()
+	snapshot.Config = common.ToYaml(sConfig)
+	loaded := api.Snapshot{}
+	common.FromJson(common.ToJson(snapshot), &loaded)
+	if len(loaded.PhysicalCells) == 0 || len(loaded.VirtualCells["VC2"]) == 0 || len(loaded.AffinityGroups) != 2 {
+		t.Fatalf("Expected the cells and the affinity groups in the snapshot, but got %v", common.ToJson(loaded))
+	}
+	rebuilt, differences := LoadSnapshot(loaded)
+	if len(differences) != 0 {
+		t.Errorf("Expected no difference, but got %v", differences)
+	}
+	if g := rebuilt.allocatedAffinityGroups["test/g"]; g == nil || g.priority != 2 || g.virtualGpuPlacement == nil {
+		t.Errorf("Expected test/g rebuilt as guaranteed at priority 2")
+	}
+	if g := rebuilt.allocatedAffinityGroups["test/o"]; g == nil || g.priority != opportunisticPriority {
+		t.Errorf("Expected test/o rebuilt as opportunistic")
+	}
+	if cc := rebuilt.GetCellCordon("0.0.0.1"); len(cc.Status.Cells) == 0 {
+		t.Errorf("Expected cell cordon 0.0.0.1 rebuilt, but got %v", cc)
+	}
+
+	// a changed document is reported
+	loaded.AffinityGroups[0].Status.Priority = 3
+	if _, differences := LoadSnapshot(loaded); len(differences) == 0 {
+		t.Errorf("Expected differences for the changed priority")
+	}
+	loaded.Version = "v0"
+	expectPanic(t, "loading an unsupported version", func() { LoadSnapshot(loaded) })
+}
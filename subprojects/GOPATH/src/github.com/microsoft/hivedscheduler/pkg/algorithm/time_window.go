@@ -0,0 +1,533 @@
+// MIT License
+//
+// Copyright (c) Microsoft Corporation. All rights reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE
+
+package algorithm
+
+import (
+	"fmt"
+	"github.com/microsoft/hivedscheduler/pkg/api"
+	"github.com/microsoft/hivedscheduler/pkg/internal"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxCronSearchDuration bounds the search for the next (or previous) time matching a cron expression,
+// so that an expression which never matches (e.g., Feb 30) does not loop forever.
+const maxCronSearchDuration = 5 * 366 * 24 * time.Hour
+
+// timeWindow is a time window in which a cell is in its VC, either a fixed [start, end) range,
+// or the windows opened at each time matching a cron expression and lasting for a duration.
+type timeWindow struct {
+	start    time.Time
+	end      time.Time
+	cron     *cronSchedule
+	duration time.Duration
+}
+
+// timeWindows is a set of time windows. A cell with time windows is in its VC when any of the windows is open.
+type timeWindows []*timeWindow
+
+// parseTimeWindows parses the time windows of a cell spec in a VC.
+func parseTimeWindows(vc api.VirtualClusterName, specs []api.TimeWindowSpec) timeWindows {
+	var windows timeWindows
+	for _, spec := range specs {
+		w, err := parseTimeWindow(spec)
+		if err != nil {
+			panic(fmt.Sprintf("invalid time window %+v of VC %v: %v", spec, vc, err))
+		}
+		windows = append(windows, w)
+	}
+	return windows
+}
+
+func parseTimeWindow(spec api.TimeWindowSpec) (*timeWindow, error) {
+	if spec.Cron != "" {
+		if spec.Start != "" || spec.End != "" {
+			return nil, fmt.Errorf("cron cannot be specified together with start and end")
+		}
+		if spec.DurationMinutes <= 0 {
+			return nil, fmt.Errorf("durationMinutes must be positive for cron")
+		}
+		cron, err := parseCronSchedule(spec.Cron)
+		if err != nil {
+			return nil, err
+		}
+		return &timeWindow{cron: cron, duration: time.Duration(spec.DurationMinutes) * time.Minute}, nil
+	}
+	if spec.Start == "" || spec.End == "" {
+		return nil, fmt.Errorf("either cron or both start and end must be specified")
+	}
+	start, err := time.Parse(time.RFC3339, spec.Start)
+	if err != nil {
+		return nil, err
+	}
+	end, err := time.Parse(time.RFC3339, spec.End)
+	if err != nil {
+		return nil, err
+	}
+	if !end.After(start) {
+		return nil, fmt.Errorf("end must be after start")
+	}
+	return &timeWindow{start: start, end: end}, nil
+}
+
+// isOpen checks if the window is open at a time.
+func (w *timeWindow) isOpen(t time.Time) bool {
+	if w.cron == nil {
+		return !t.Before(w.start) && t.Before(w.end)
+	}
+	return !w.cron.prev(t, t.Add(-w.duration+time.Nanosecond)).IsZero()
+}
+
+// currentEnd returns the end of the window open at a time.
+func (w *timeWindow) currentEnd(t time.Time) time.Time {
+	if w.cron == nil {
+		return w.end
+	}
+	return w.cron.prev(t, t.Add(-w.duration+time.Nanosecond)).Add(w.duration)
+}
+
+// nextStart returns the first start of the window not earlier than a time (zero if none).
+func (w *timeWindow) nextStart(t time.Time) time.Time {
+	if w.cron == nil {
+		if w.start.Before(t) {
+			return time.Time{}
+		}
+		return w.start
+	}
+	return w.cron.next(t)
+}
+
+// isOpen checks if any of the windows is open at a time.
+func (ws timeWindows) isOpen(t time.Time) bool {
+	for _, w := range ws {
+		if w.isOpen(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// nextClose returns the time when the windows open at a time all close (zero if they are not open),
+// taking the overlapping windows into account.
+func (ws timeWindows) nextClose(t time.Time) time.Time {
+	var end time.Time
+	for i := 0; i < 1000 && ws.isOpen(t); i++ {
+		for _, w := range ws {
+			if w.isOpen(t) {
+				if e := w.currentEnd(t); e.After(end) {
+					end = e
+				}
+			}
+		}
+		t = end
+	}
+	return end
+}
+
+// nextOpen returns the time when any of the windows opens next after a time (zero if none).
+// If the windows are open at the time, the next opening after they close is returned.
+func (ws timeWindows) nextOpen(t time.Time) time.Time {
+	if ws.isOpen(t) {
+		t = ws.nextClose(t)
+		if t.IsZero() {
+			return t
+		}
+	}
+	var start time.Time
+	for _, w := range ws {
+		if s := w.nextStart(t); !s.IsZero() && (start.IsZero() || s.Before(start)) {
+			start = s
+		}
+	}
+	return start
+}
+
+// cronSchedule is a parsed cron expression of 5 fields: minute, hour, day of month, month and day of week.
+// Each field supports *, a value, a range a-b, a step */n or a-b/n, and a comma separated list of them.
+// Like cron, if both day of month and day of week are restricted, a day matching either of them matches.
+// The schedule is in UTC, so that a wall clock time is never skipped or repeated by the daylight saving time.
+type cronSchedule struct {
+	minute     uint64
+	hour       uint64
+	dayOfMonth uint64
+	month      uint64
+	dayOfWeek  uint64
+	anyDom     bool
+	anyDow     bool
+}
+
+func parseCronSchedule(expr string) (*cronSchedule, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron %q does not have 5 fields", expr)
+	}
+	s := &cronSchedule{anyDom: fields[2] == "*", anyDow: fields[4] == "*"}
+	for i, f := range []struct {
+		bits     *uint64
+		min, max int
+	}{
+		{&s.minute, 0, 59},
+		{&s.hour, 0, 23},
+		{&s.dayOfMonth, 1, 31},
+		{&s.month, 1, 12},
+		{&s.dayOfWeek, 0, 7},
+	} {
+		bits, err := parseCronField(fields[i], f.min, f.max)
+		if err != nil {
+			return nil, fmt.Errorf("cron %q: %v", expr, err)
+		}
+		*f.bits = bits
+	}
+	// both 0 and 7 are Sunday
+	if s.dayOfWeek&(1<<7) != 0 {
+		s.dayOfWeek |= 1
+	}
+	return s, nil
+}
+
+func parseCronField(field string, min int, max int) (uint64, error) {
+	var bits uint64
+	for _, item := range strings.Split(field, ",") {
+		rangeStr, step := item, 1
+		if i := strings.Index(item, "/"); i >= 0 {
+			n, err := strconv.Atoi(item[i+1:])
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("invalid step in %q", item)
+			}
+			rangeStr, step = item[:i], n
+		}
+		low, high := min, max
+		if rangeStr != "*" {
+			bounds := strings.SplitN(rangeStr, "-", 2)
+			var err error
+			if low, err = strconv.Atoi(bounds[0]); err != nil {
+				return 0, fmt.Errorf("invalid value in %q", item)
+			}
+			high = low
+			if len(bounds) == 2 {
+				if high, err = strconv.Atoi(bounds[1]); err != nil {
+					return 0, fmt.Errorf("invalid value in %q", item)
+				}
+			} else if step > 1 {
+				high = max
+			}
+		}
+		if low < min || high > max || low > high {
+			return 0, fmt.Errorf("%q is out of range [%v, %v]", item, min, max)
+		}
+		for v := low; v <= high; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+func (s *cronSchedule) matchDay(t time.Time) bool {
+	dom := s.dayOfMonth&(1<<uint(t.Day())) != 0
+	dow := s.dayOfWeek&(1<<uint(t.Weekday())) != 0
+	if s.anyDom || s.anyDow {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// next returns the first time matching the schedule not earlier than a time (zero if none).
+func (s *cronSchedule) next(t time.Time) time.Time {
+	t = t.UTC()
+	m := t.Truncate(time.Minute)
+	if m.Before(t) {
+		m = m.Add(time.Minute)
+	}
+	limit := t.Add(maxCronSearchDuration)
+	for m.Before(limit) {
+		y, mon, d := m.Date()
+		switch {
+		case s.month&(1<<uint(mon)) == 0:
+			m = time.Date(y, mon+1, 1, 0, 0, 0, 0, m.Location())
+		case !s.matchDay(m):
+			m = time.Date(y, mon, d+1, 0, 0, 0, 0, m.Location())
+		case s.hour&(1<<uint(m.Hour())) == 0:
+			m = time.Date(y, mon, d, m.Hour()+1, 0, 0, 0, m.Location())
+		case s.minute&(1<<uint(m.Minute())) == 0:
+			m = m.Add(time.Minute)
+		default:
+			return m
+		}
+	}
+	return time.Time{}
+}
+
+// prev returns the last time matching the schedule not later than a time and
+// not earlier than another (zero if none).
+func (s *cronSchedule) prev(t time.Time, earliest time.Time) time.Time {
+	m := t.UTC().Truncate(time.Minute)
+	for !m.Before(earliest) {
+		y, mon, d := m.Date()
+		switch {
+		case s.month&(1<<uint(mon)) == 0:
+			m = time.Date(y, mon, 1, 0, 0, 0, 0, m.Location()).Add(-time.Minute)
+		case !s.matchDay(m):
+			m = time.Date(y, mon, d, 0, 0, 0, 0, m.Location()).Add(-time.Minute)
+		case s.hour&(1<<uint(m.Hour())) == 0:
+			m = time.Date(y, mon, d, m.Hour(), 0, 0, 0, m.Location()).Add(-time.Minute)
+		case s.minute&(1<<uint(m.Minute())) == 0:
+			m = m.Add(-time.Minute)
+		default:
+			return m
+		}
+	}
+	return time.Time{}
+}
+
+// GetTimeWindowSchedules returns the time window schedules of the cells with time windows
+// in a VC, or in all VCs if the VC is empty.
+func (h *HivedAlgorithm) GetTimeWindowSchedules(vc string) api.TimeWindowScheduleList {
+	h.algorithmLock.RLock()
+	defer h.algorithmLock.RUnlock()
+
+	if vc != "" && h.vcSchedulers[api.VirtualClusterName(vc)] == nil {
+		panic(internal.NewBadRequestError(fmt.Sprintf(
+			"VC %v does not exist", vc)))
+	}
+	now := h.now()
+	schedules := api.TimeWindowScheduleList{Items: []api.TimeWindowSchedule{}}
+	for _, twc := range h.timeWindowCells {
+		if vc != "" && twc.vc != api.VirtualClusterName(vc) {
+			continue
+		}
+		v := twc.virtual
+		windows := v.GetTimeWindows()
+		s := api.TimeWindowSchedule{
+			VirtualCluster: twc.vc,
+			CellType:       h.cellTypes[v.GetChain()][v.GetLevel()],
+			Cell:           v.GetName(),
+			ReservationId:  twc.rid,
+			State:          api.TimeWindowActive,
+		}
+		if v.IsInactive() {
+			if windows.isOpen(now) {
+				s.State = api.TimeWindowPending
+			} else {
+				s.State = api.TimeWindowInactive
+			}
+		}
+		if t := windows.nextOpen(now); !t.IsZero() {
+			s.NextOpenTime = &meta.Time{Time: t}
+		}
+		if t := windows.nextClose(now); !t.IsZero() {
+			s.NextCloseTime = &meta.Time{Time: t}
+		}
+		schedules.Items = append(schedules.Items, s)
+	}
+	return schedules
+}
+
+// initTimeWindows collects the cells with time windows. They are initially out of their VCs
+// (and the physical cells of the reservations are not reserved) until their windows are found open.
+func (h *HivedAlgorithm) initTimeWindows() {
+	for vc, vcs := range h.vcSchedulers {
+		for _, ccl := range vcs.getNonReservedCellList() {
+			for _, cl := range ccl {
+				for _, c := range cl {
+					if v := c.(*VirtualCell); v.GetParent() == nil && v.GetTimeWindows() != nil {
+						v.SetInactive(true)
+						h.timeWindowCells = append(h.timeWindowCells, &timeWindowCell{vc: vc, virtual: v})
+					}
+				}
+			}
+		}
+		for rid, ccl := range vcs.getReservedCellList() {
+			if v := ccl[CellLevel(len(ccl))][0].(*VirtualCell); v.GetTimeWindows() != nil {
+				v.SetInactive(true)
+				pc := h.reservedCells[vc][rid]
+				pc.SetReserved(false)
+				delete(h.reservedCells[vc], rid)
+				h.timeWindowCells = append(h.timeWindowCells,
+					&timeWindowCell{vc: vc, rid: rid, virtual: v, reservedCell: pc})
+			}
+		}
+		vcs.updateActiveCells()
+	}
+	sort.SliceStable(h.timeWindowCells, func(i, j int) bool {
+		if h.timeWindowCells[i].vc != h.timeWindowCells[j].vc {
+			return h.timeWindowCells[i].vc < h.timeWindowCells[j].vc
+		}
+		return h.timeWindowCells[i].virtual.GetName() < h.timeWindowCells[j].virtual.GetName()
+	})
+}
+
+// updateTimeWindows moves the cells whose time windows have closed out of their VCs, and then moves
+// the cells whose windows are open into their VCs, if the free cells are sufficient for them.
+// Otherwise the cells are pending until the free cells become sufficient.
+func (h *HivedAlgorithm) updateTimeWindows() {
+	now := h.now()
+	updatedVcs := map[api.VirtualClusterName]bool{}
+	for _, twc := range h.timeWindowCells {
+		if !twc.virtual.IsInactive() && !twc.virtual.GetTimeWindows().isOpen(now) {
+			h.deactivateTimeWindowCell(twc)
+			updatedVcs[twc.vc] = true
+		}
+	}
+	for _, twc := range h.timeWindowCells {
+		if twc.virtual.IsInactive() && twc.virtual.GetTimeWindows().isOpen(now) && h.activateTimeWindowCell(twc) {
+			updatedVcs[twc.vc] = true
+		}
+	}
+	for vc := range updatedVcs {
+		h.vcSchedulers[vc].updateActiveCells()
+	}
+}
+
+// deactivateTimeWindowCell moves a cell out of its VC. The affinity groups using the cell are
+// lazy preempted, hence the cell is released and they can be preempted by the other VCs.
+func (h *HivedAlgorithm) deactivateTimeWindowCell(twc *timeWindowCell) {
+	groups := map[string]*AlgoAffinityGroup{}
+	collectAffinityGroupsInVirtualCell(twc.virtual, groups)
+	var names []string
+	for name := range groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		h.lazyPreemptAffinityGroup(groups[name], fmt.Sprintf("closed time windows of %v", twc.virtual.GetName()))
+	}
+	if twc.rid != "" {
+		twc.reservedCell = h.reservedCells[twc.vc][twc.rid]
+		h.unbindReservedCell(twc.vc, twc.rid)
+		delete(h.reservedCells[twc.vc], twc.rid)
+	}
+	twc.virtual.SetInactive(true)
+	klog.Infof("Cell %v moved out of VC %v since its time windows are closed", twc.virtual.GetName(), twc.vc)
+}
+
+// activateTimeWindowCell moves a cell into its VC, and returns false if the free cells are insufficient.
+// A reservation is bound to its last physical cell if it is free, otherwise to another free cell.
+func (h *HivedAlgorithm) activateTimeWindowCell(twc *timeWindowCell) bool {
+	twc.virtual.SetInactive(false)
+	if twc.rid == "" {
+		if !h.isFreeCellListSufficient(twc.virtual.GetChain()) {
+			twc.virtual.SetInactive(true)
+			klog.Infof("Cell %v pending to be moved into VC %v due to insufficient free cells",
+				twc.virtual.GetName(), twc.vc)
+			return false
+		}
+	} else {
+		chainLevels := map[CellChain]CellLevel{twc.reservedCell.GetChain(): twc.reservedCell.GetLevel()}
+		spec := api.ReservationSpec{CellType: h.cellTypes[twc.reservedCell.GetChain()][twc.reservedCell.GetLevel()]}
+		preferredSpec := spec
+		preferredSpec.Nodes, preferredSpec.GpuIndices = twc.reservedCell.GetPhysicalPlacement()
+		if twc.reservedCell.AtOrHigherThanNode() {
+			preferredSpec.GpuIndices = nil
+		}
+		pc := h.tryAllocateReservedCell(chainLevels, preferredSpec)
+		if pc == nil {
+			pc = h.tryAllocateReservedCell(chainLevels, spec)
+		}
+		if pc == nil {
+			twc.virtual.SetInactive(true)
+			klog.Infof("Reservation %v pending to be moved into VC %v due to insufficient free cells",
+				twc.rid, twc.vc)
+			return false
+		}
+		if h.reservedCells[twc.vc] == nil {
+			h.reservedCells[twc.vc] = map[api.ReservationId]*PhysicalCell{}
+		}
+		h.reservedCells[twc.vc][twc.rid] = pc
+		bindReservedCell(twc.virtual, pc)
+	}
+	klog.Infof("Cell %v moved into VC %v since its time windows are open", twc.virtual.GetName(), twc.vc)
+	return true
+}
+
+// rebindTimeWindowReservation rebinds an idle reservation with time windows to the physical cell of a group
+// being recovered in it. When the windows opened, the reservation may have been bound to another cell than
+// its last one (see activateTimeWindowCell), which is only persisted in the PodBindInfo of its groups, while
+// it is bound to the cell in the config again when the windows are found open before the pods are recovered.
+func (h *HivedAlgorithm) rebindTimeWindowReservation(s *api.PodSchedulingSpec, info *api.PodBindInfo) {
+	if s.ReservationId == "" || CellPriority(s.Priority) < minGuaranteedPriority || len(info.GpuIsolation) == 0 {
+		return
+	}
+	pc := h.reservedCells[s.VirtualCluster][s.ReservationId]
+	if pc == nil || pc.GetVirtualCell().GetTimeWindows() == nil || pc.GetVirtualCell().GetPriority() != freePriority {
+		return
+	}
+	pGpu := h.findPhysicalGpu(CellChain(info.CellChain), info.Node, info.GpuIsolation[0])
+	if pGpu == nil || pGpu.GetChain() != pc.GetChain() {
+		return
+	}
+	var c Cell = pGpu
+	for c.GetParent() != nil && c.GetLevel() < pc.GetLevel() {
+		c = c.GetParent()
+	}
+	target := c.(*PhysicalCell)
+	if target.GetLevel() != pc.GetLevel() || CellEqual(target, pc) || !h.isCellFree(target) {
+		return
+	}
+	virtual := h.unbindReservedCell(s.VirtualCluster, s.ReservationId)
+	h.removeCellFromFreeList(target)
+	h.reservedCells[s.VirtualCluster][s.ReservationId] = target
+	bindReservedCell(virtual, target)
+	klog.Infof("Reservation %v in VC %v rebound from %v to %v, where its groups are placed",
+		s.ReservationId, s.VirtualCluster, pc.GetName(), target.GetName())
+}
+
+// tryAllocateReservedCell allocates a physical cell for a reservation like allocateReservedCell,
+// but returns nil instead of panicking if no cell can be allocated.
+func (h *HivedAlgorithm) tryAllocateReservedCell(
+	chainLevels map[CellChain]CellLevel,
+	spec api.ReservationSpec) (pc *PhysicalCell) {
+
+	defer func() {
+		if r := recover(); r != nil {
+			klog.Infof("Cell of type %v not allocated for reservation: %v", spec.CellType, r)
+			pc = nil
+		}
+	}()
+	return h.allocateReservedCell(chainLevels, spec)
+}
+
+// checkReservationWithoutTimeWindows makes sure that a reservation to be changed at runtime
+// is not the one with time windows, which is managed by its windows.
+func (h *HivedAlgorithm) checkReservationWithoutTimeWindows(vc api.VirtualClusterName, rid api.ReservationId) {
+	if h.reservedCells[vc][rid].GetVirtualCell().GetTimeWindows() != nil {
+		panic(internal.NewBadRequestError(fmt.Sprintf(
+			"Reservation %v has time windows and cannot be changed at runtime", rid)))
+	}
+}
+
+// collectAffinityGroupsInVirtualCell collects the guaranteed affinity groups using the GPUs in a virtual cell.
+func collectAffinityGroupsInVirtualCell(c *VirtualCell, groups map[string]*AlgoAffinityGroup) {
+	if c.GetLevel() > lowestLevel {
+		for _, cc := range c.GetChildren() {
+			collectAffinityGroupsInVirtualCell(cc.(*VirtualCell), groups)
+		}
+	} else if pGpu := c.GetPhysicalCell(); pGpu != nil {
+		if g := pGpu.GetAffinityGroup(); g != nil && g.virtualGpuPlacement != nil {
+			groups[g.name] = g
+		}
+	}
+}
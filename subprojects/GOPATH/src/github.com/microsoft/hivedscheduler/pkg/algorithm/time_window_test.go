@@ -0,0 +1,248 @@
+// MIT License
+//
+// Copyright (c) Microsoft Corporation. All rights reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE
+
+package algorithm
+
+import (
+	"github.com/microsoft/hivedscheduler/pkg/api"
+	core "k8s.io/api/core/v1"
+	"testing"
+	"time"
+)
+
+func TestTimeWindow(t *testing.T) {
+	sConfig := newTestConfig()
+	vcs := *sConfig.VirtualClusters
+	vc1, vc2 := vcs["VC1"], vcs["VC2"]
+	// the VC2 cell is in the day, and the VC1 cells and the reservation of the VC1 CT1 GPU are in the night
+	vc2.VirtualCells = append(vc2.VirtualCells, api.VirtualCellSpec{
+		CellType:    "CT1-NODE",
+		CellNumber:  1,
+		TimeWindows: []api.TimeWindowSpec{{Start: "2020-06-01T08:00:00Z", End: "2020-06-01T20:00:00Z"}},
+	})
+	vc1.VirtualCells = append(vc1.VirtualCells, api.VirtualCellSpec{
+		CellType:    "CT1-NODE",
+		CellNumber:  3,
+		TimeWindows: []api.TimeWindowSpec{{Cron: "0 20 * * *", DurationMinutes: 720}},
+	})
+	vc1.ReservedCells = append([]api.ReservedCellSpec{}, vc1.ReservedCells...)
+	for i := range vc1.ReservedCells {
+		if vc1.ReservedCells[i].ReservationId == "VC1-YQW-CT1" {
+			vc1.ReservedCells[i].TimeWindows = []api.TimeWindowSpec{{Cron: "0 8 * * *", DurationMinutes: 720}}
+		}
+	}
+	vcs["VC1"], vcs["VC2"] = vc1, vc2
+	h := newTestAlgorithm(sConfig)
+	newPod := func(name string, vc api.VirtualClusterName, gpuNumber int32) *core.Pod {
+		return newTestPod(name, api.PodSchedulingSpec{
+			VirtualCluster: vc,
+			Priority:       1,
+			GpuType:        "CT1",
+			GpuNumber:      gpuNumber,
+		})
+	}
+	setTime := func(value string) {
+		now, _ := time.Parse(time.RFC3339, value)
+		h.now = func() time.Time { return now }
+		h.Reconcile()
+	}
+	countStates := func(vc string) map[api.TimeWindowState]int {
+		states := map[api.TimeWindowState]int{}
+		for _, s := range h.GetTimeWindowSchedules(vc).Items {
+			if s.CellType == "CT1-NODE" {
+				states[s.State]++
+			}
+		}
+		return states
+	}
+
+	// in the day, only the VC2 cell is in its VC
+	setTime("2020-06-01T12:00:00Z")
+	if states := countStates("VC1"); states[api.TimeWindowInactive] != 3 {
+		t.Errorf("Expected 3 inactive VC1 cells, but got %v", states)
+	}
+	if s := h.GetTimeWindowSchedules("VC2").Items; len(s) != 1 || s[0].State != api.TimeWindowActive ||
+		s[0].NextCloseTime == nil || s[0].NextCloseTime.Format(time.RFC3339) != "2020-06-01T20:00:00Z" ||
+		s[0].NextOpenTime != nil {
+		t.Errorf("Expected the VC2 cell active until 2020-06-01T20:00:00Z, but got %v", s)
+	}
+	for _, s := range h.GetTimeWindowSchedules("VC1").Items {
+		if s.ReservationId != "" {
+			if s.State != api.TimeWindowActive {
+				t.Errorf("Expected reservation %v active, but got %v", s.ReservationId, s.State)
+			}
+		} else if s.NextOpenTime == nil || s.NextOpenTime.Format(time.RFC3339) != "2020-06-01T20:00:00Z" {
+			t.Errorf("Expected cell %v to open at 2020-06-01T20:00:00Z, but got %v", s.Cell, s.NextOpenTime)
+		}
+	}
+	expectBadRequest(t, "moving a reservation with time windows", func() {
+		h.MoveReservation("VC1-YQW-CT1", api.ReservationSpec{})
+	})
+	allocatedPods := []*core.Pod{
+		scheduleAndAllocate(t, h, newPod("vc2-pod-1", "VC2", 2)),
+		scheduleAndAllocate(t, h, newPod("vc2-pod-2", "VC2", 2)),
+	}
+	if psr := h.Schedule(newPod("vc1-pod", "VC1", 2), allNodes); psr.PodBindInfo != nil || psr.PodPreemptInfo != nil {
+		t.Errorf("Expected pod vc1-pod waiting, but got %v", psr)
+	}
+
+	// in the night, the VC2 group in the closed cell is lazy preempted, and the VC1 cells are moved in
+	// as far as the free cells (including the one released by the reservation) are sufficient
+	setTime("2020-06-01T21:00:00Z")
+	preempted := 0
+	for _, g := range h.GetAffinityGroups().Items {
+		if g.Status.LazyPreemptionStatus != nil {
+			preempted++
+		}
+	}
+	if preempted != 1 {
+		t.Errorf("Expected 1 lazy preempted affinity group, but got %v", preempted)
+	}
+	if states := countStates("VC1"); states[api.TimeWindowActive] != 2 || states[api.TimeWindowPending] != 1 {
+		t.Errorf("Expected 2 active and 1 pending VC1 cells, but got %v", states)
+	}
+	if s := h.GetTimeWindowSchedules("VC2").Items; s[0].State != api.TimeWindowInactive ||
+		s[0].NextOpenTime != nil || s[0].NextCloseTime != nil {
+		t.Errorf("Expected the VC2 cell inactive forever, but got %v", s)
+	}
+	expectBadRequest(t, "getting a reservation out of its time windows", func() { h.GetReservation("VC1-YQW-CT1") })
+	expectBadRequest(t, "creating a reservation with the ID of one out of its time windows", func() {
+		h.CreateReservation(api.Reservation{
+			ObjectMeta: api.ObjectMeta{Name: "VC1-YQW-CT1"},
+			Spec:       api.ReservationSpec{VirtualCluster: "VC2", CellType: "CT1"},
+		})
+	})
+	if psr := h.Schedule(newPod("vc1-pod", "VC1", 2), allNodes); psr.PodBindInfo == nil && psr.PodPreemptInfo == nil {
+		t.Errorf("Expected pod vc1-pod scheduled, but got %v", psr)
+	}
+	reservedPod := newTestPod("vc1-reserved-pod", api.PodSchedulingSpec{
+		VirtualCluster: "VC1",
+		Priority:       1,
+		ReservationId:  "VC1-YQW-CT1",
+		GpuNumber:      1,
+	})
+	if psr := h.Schedule(reservedPod, allNodes); psr.PodBindInfo != nil || psr.PodPreemptInfo != nil {
+		t.Errorf("Expected pod %v waiting, but got %v", reservedPod.Name, psr)
+	}
+
+	// in the next morning, the reservation is back to its GPU
+	setTime("2020-06-02T08:00:00Z")
+	if states := countStates("VC1"); states[api.TimeWindowInactive] != 3 {
+		t.Errorf("Expected 3 inactive VC1 cells, but got %v", states)
+	}
+	if r := h.GetReservation("VC1-YQW-CT1"); r.Spec.Nodes[0] != "1.0.0.2" || r.Spec.GpuIndices[0] != 8 {
+		t.Errorf("Expected reservation %v on node 1.0.0.2 GPU 8, but got %v", r.Name, r.Spec)
+	}
+	for _, pod := range allocatedPods {
+		h.DeleteAllocatedPod(pod)
+	}
+
+	// the reservation bound to another GPU when its windows opened is rebound to the GPU of its group recovered
+	// after the restart, although it is bound to the GPU in the config again when its windows are found open
+	h.moveReservation("VC1", "VC1-YQW-CT1", api.ReservationSpec{
+		CellType: "CT1", Nodes: []string{"1.0.0.2"}, GpuIndices: []int32{9}})
+	allocatedReservedPod := scheduleAndAllocate(t, h, reservedPod)
+	now := h.now
+	h = newTestAlgorithm(sConfig)
+	h.now = now
+	h.Reconcile()
+	if r := h.GetReservation("VC1-YQW-CT1"); r.Spec.Nodes[0] != "1.0.0.2" || r.Spec.GpuIndices[0] != 8 {
+		t.Errorf("Expected reservation %v on node 1.0.0.2 GPU 8, but got %v", r.Name, r.Spec)
+	}
+	h.AddAllocatedPod(allocatedReservedPod)
+	if r := h.GetReservation("VC1-YQW-CT1"); r.Spec.Nodes[0] != "1.0.0.2" || r.Spec.GpuIndices[0] != 9 {
+		t.Errorf("Expected reservation %v rebound to node 1.0.0.2 GPU 9, but got %v", r.Name, r.Spec)
+	}
+	if g := h.allocatedAffinityGroups["test/vc1-reserved-pod"]; g == nil || g.virtualGpuPlacement == nil ||
+		len(h.GetRecoveryReport().Pods) != 0 {
+		t.Errorf("Expected group test/vc1-reserved-pod recovered in the reservation, but got %v",
+			h.GetRecoveryReport())
+	}
+
+	expectPanic(t, "parsing an invalid cron", func() {
+		parseTimeWindows("VC1", []api.TimeWindowSpec{{Cron: "60 * * * *", DurationMinutes: 10}})
+	})
+}
+
+func TestCronSchedule(t *testing.T) {
+	parseTime := func(value string) time.Time {
+		tm, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tm
+	}
+	checkNext := func(cron string, from string, expected ...string) {
+		s, err := parseCronSchedule(cron)
+		if err != nil {
+			t.Fatalf("Failed to parse cron %q: %v", cron, err)
+		}
+		tm := parseTime(from)
+		for _, e := range expected {
+			if tm = s.next(tm); !tm.Equal(parseTime(e)) {
+				t.Errorf("Expected cron %q next at %v, but got %v", cron, e, tm)
+				return
+			}
+			if p := s.prev(tm.Add(time.Minute-time.Nanosecond), tm); !p.Equal(tm) {
+				t.Errorf("Expected cron %q previously at %v, but got %v", cron, tm, p)
+			}
+			tm = tm.Add(time.Minute)
+		}
+	}
+
+	// day of month or day of week if both are restricted (2020-06-01 is Monday, and 2020-06-13 is Saturday)
+	checkNext("0 0 13 * 5", "2020-06-01T00:00:00Z",
+		"2020-06-05T00:00:00Z", "2020-06-12T00:00:00Z", "2020-06-13T00:00:00Z", "2020-06-19T00:00:00Z")
+	// day of month and day of week if either is *
+	checkNext("0 0 13 * *", "2020-06-01T00:00:00Z", "2020-06-13T00:00:00Z", "2020-07-13T00:00:00Z")
+	checkNext("0 0 * * 5", "2020-06-01T00:00:00Z", "2020-06-05T00:00:00Z", "2020-06-12T00:00:00Z")
+	checkNext("0 0 */10 6 0,7", "2020-06-01T00:00:00Z",
+		"2020-06-01T00:00:00Z", "2020-06-07T00:00:00Z", "2020-06-11T00:00:00Z")
+
+	// the schedule is in UTC, so that the daylight saving time neither skips nor repeats a time
+	// (2020-03-08 02:00 and 2020-11-01 02:00 in New York are the changes)
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, _ := parseCronSchedule("30 6 * * *")
+	tm := time.Date(2020, 3, 7, 0, 0, 0, 0, loc)
+	for _, e := range []string{
+		"2020-03-07T06:30:00Z", "2020-03-08T06:30:00Z", "2020-03-09T06:30:00Z",
+	} {
+		if tm = s.next(tm); !tm.Equal(parseTime(e)) {
+			t.Errorf("Expected next at %v, but got %v", e, tm)
+		}
+		tm = tm.Add(time.Minute).In(loc)
+	}
+	tm = time.Date(2020, 11, 1, 0, 0, 0, 0, loc)
+	for _, e := range []string{"2020-11-01T06:30:00Z", "2020-11-02T06:30:00Z"} {
+		if tm = s.next(tm); !tm.Equal(parseTime(e)) {
+			t.Errorf("Expected next at %v, but got %v", e, tm)
+		}
+		tm = tm.Add(time.Minute).In(loc)
+	}
+	w := &timeWindow{cron: s, duration: time.Hour}
+	if !w.isOpen(time.Date(2020, 11, 1, 2, 15, 0, 0, loc)) || w.isOpen(time.Date(2020, 11, 1, 2, 45, 0, 0, loc)) {
+		t.Errorf("Expected the window open from 06:30 to 07:30 UTC, i.e. 01:30 to 02:30 EST")
+	}
+}
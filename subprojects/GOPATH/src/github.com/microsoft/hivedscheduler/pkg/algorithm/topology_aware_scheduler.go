@@ -44,9 +44,12 @@ type topologyAwareScheduler struct {
 	// because guaranteed pods can avoid preempting opportunistic pods only among buddy cells (this is decided
 	// by the buddy cell allocation algorithm).
 	crossPriorityPack bool
-	// whether or not the scheduler should avoid using nodes that are not suggested by K8s.
-	// should be true when the scheduler is used for scheduling physical GPUs (i.e., for opportunistic pods)
+	// whether or not the nodes are physical cells, whose nodes are checked against the suggested nodes.
+	// should be true when the scheduler is used for scheduling physical GPUs (i.e., for opportunistic pods).
+	// otherwise only the virtual nodes bound to physical nodes are checked
 	considerSuggestedNodes bool
+	// cost model used to select preemption victims when preemption is needed
+	costModel *preemptionCostModel
 }
 
 // NewTopologyAwareScheduler initializes the scheduler by extracting node-level cells
@@ -54,13 +57,15 @@ type topologyAwareScheduler struct {
 func NewTopologyAwareScheduler(ccl ChainCellList,
 	levelGpuNum map[CellLevel]int32,
 	crossPriorityPack bool,
-	considerSuggestedNodes bool) *topologyAwareScheduler {
+	considerSuggestedNodes bool,
+	costModel *preemptionCostModel) *topologyAwareScheduler {
 
 	return &topologyAwareScheduler{
 		cv:                     newClusterView(ccl),
 		levelGpuNum:            levelGpuNum,
 		crossPriorityPack:      crossPriorityPack,
-		considerSuggestedNodes: considerSuggestedNodes}
+		considerSuggestedNodes: considerSuggestedNodes,
+		costModel:              costModel}
 }
 
 // ancestorNoHigherThanNode finds an ancestor at a level no higher than node level for a cell.
@@ -76,7 +81,8 @@ func ancestorNoHigherThanNode(c Cell) Cell {
 func (t *topologyAwareScheduler) Schedule(
 	podGpuNumbers map[int32]int32,
 	p CellPriority,
-	suggestedNodeSet common.Set) map[int32][]CellList {
+	suggestedNodeSet common.Set,
+	constraint topologyConstraint) map[int32][]CellList {
 
 	// GPU numbers of the pods to schedule
 	var sortedPodGpuNumbers []int32
@@ -91,12 +97,57 @@ func (t *topologyAwareScheduler) Schedule(
 	priority := opportunisticPriority
 	t.updateClusterView(priority, suggestedNodeSet)
 	// try to fit the pods to a set of nodes
-	selectedNodeIndices := findNodesForPods(t.cv, sortedPodGpuNumbers, priority)
+	podPlacements := t.findPodPlacements(sortedPodGpuNumbers, priority, suggestedNodeSet, constraint)
 	// enable preemption if scheduling failed
-	if selectedNodeIndices == nil && p > opportunisticPriority {
+	if podPlacements == nil && p > opportunisticPriority {
 		priority = p
 		t.updateClusterView(priority, suggestedNodeSet)
-		selectedNodeIndices = findNodesForPods(t.cv, sortedPodGpuNumbers, priority)
+		podPlacements = t.findPodPlacements(sortedPodGpuNumbers, priority, suggestedNodeSet, constraint)
+	}
+	return podPlacements
+}
+
+// findPodPlacements finds the GPUs for the pods. If the pods must be within one cell at a max level,
+// the nodes (or the cells at the max level inside the nodes) within each such cell are tried in turn.
+func (t *topologyAwareScheduler) findPodPlacements(
+	sortedPodGpuNumbers []int32,
+	p CellPriority,
+	suggestedNodeSet common.Set,
+	constraint topologyConstraint) map[int32][]CellList {
+
+	if constraint.maxLevel == 0 {
+		return t.findPodPlacementsInView(t.cv, sortedPodGpuNumbers, p, constraint.antiAffinityLevel)
+	}
+	totalGpuNum := int32(0)
+	for _, gpuNum := range sortedPodGpuNumbers {
+		totalGpuNum += gpuNum
+	}
+	if totalGpuNum > t.levelGpuNum[constraint.maxLevel] {
+		return nil
+	}
+	// sort the nodes so that the scopes are tried in the order of their most preferred nodes
+	sort.Stable(t.cv)
+	for _, view := range t.splitClusterView(constraint.maxLevel, p, suggestedNodeSet) {
+		if podPlacements := t.findPodPlacementsInView(
+			view, sortedPodGpuNumbers, p, constraint.antiAffinityLevel); podPlacements != nil {
+			return podPlacements
+		}
+	}
+	return nil
+}
+
+// findPodPlacementsInView finds the nodes in a cluster view for the pods, and then the GPUs inside the nodes.
+func (t *topologyAwareScheduler) findPodPlacementsInView(
+	cv clusterView,
+	sortedPodGpuNumbers []int32,
+	p CellPriority,
+	antiAffinityLevel CellLevel) map[int32][]CellList {
+
+	var selectedNodeIndices []int32
+	if antiAffinityLevel > 0 {
+		selectedNodeIndices = findDistinctNodesForPods(cv, sortedPodGpuNumbers, antiAffinityLevel)
+	} else {
+		selectedNodeIndices = findNodesForPods(cv, sortedPodGpuNumbers, p)
 	}
 	if selectedNodeIndices == nil {
 		return nil
@@ -104,7 +155,7 @@ func (t *topologyAwareScheduler) Schedule(
 	// find GPUs inside the selected node for each pod
 	selectedNodes := make(CellList, len(sortedPodGpuNumbers))
 	for i := 0; i < len(selectedNodeIndices); i++ {
-		selectedNodes[i] = t.cv[selectedNodeIndices[i]].c
+		selectedNodes[i] = cv[selectedNodeIndices[i]].c
 	}
 	selectedGpus := CellList{}
 	nodeAvailableGpus := map[Cell]CellList{}
@@ -114,7 +165,8 @@ func (t *topologyAwareScheduler) Schedule(
 		n := selectedNodes[podIndex]
 		// TODO: Optimize findNodesForPods and findGpusInNode together to get a better placement,
 		//  such as also aware intra node topology when findNodesForPods.
-		selectedGpus, nodeAvailableGpus[n] = findGpusInNode(n, gpuNumber, priority, nodeAvailableGpus[n], t.levelGpuNum)
+		selectedGpus, nodeAvailableGpus[n] = findGpusInNode(
+			n, gpuNumber, p, nodeAvailableGpus[n], t.levelGpuNum, t.costModel)
 		if podPlacements[gpuNumber] == nil {
 			podPlacements[gpuNumber] = []CellList{}
 		}
@@ -124,10 +176,12 @@ func (t *topologyAwareScheduler) Schedule(
 }
 
 type node struct {
-	c                        Cell  // a cell at node level (or lower than node level if no node level in the chain)
-	freeGpuNumAtPriority     int32 // free GPU number at the priority of the pod to be scheduled (lower priority considered as free)
-	usedGpuNumSamePriority   int32 // GPU number used by the same priority as that of the pod to be scheduled
-	usedGpuNumHigherPriority int32 // GPU number used by higher priorities than that of the pod to be scheduled
+	c                        Cell    // a cell at node level (or lower than node level if no node level in the chain)
+	freeGpuNumAtPriority     int32   // free GPU number at the priority of the pod to be scheduled (lower priority considered as free)
+	usedGpuNumSamePriority   int32   // GPU number used by the same priority as that of the pod to be scheduled
+	usedGpuNumHigherPriority int32   // GPU number used by higher priorities than that of the pod to be scheduled
+	preemptionCost           float64 // cost of preempting all the preemptible groups in the node
+	inSuggested              bool    // whether the node is in the suggested nodes
 }
 
 // When cross-priority packing is not enabled, we count the GPU numbers used by the current
@@ -202,8 +256,15 @@ func (cv clusterView) Len() int {
 	return len(cv)
 }
 
+// Nodes in the suggested nodes are always preferred. Then, when preemption is enabled, nodes cheaper to preempt
+// are preferred, so that the preemption victims are selected by the cost. Nodes with the same cost (e.g., nodes
+// without preemptible groups, or all the nodes if preemption is disabled) are sorted by the used GPU numbers.
 func (cv clusterView) Less(i int, j int) bool {
-	if cv[i].usedGpuNumSamePriority > cv[j].usedGpuNumSamePriority {
+	if cv[i].inSuggested != cv[j].inSuggested {
+		return cv[i].inSuggested
+	} else if cv[i].preemptionCost != cv[j].preemptionCost {
+		return cv[i].preemptionCost < cv[j].preemptionCost
+	} else if cv[i].usedGpuNumSamePriority > cv[j].usedGpuNumSamePriority {
 		return true
 	} else if cv[i].usedGpuNumSamePriority < cv[j].usedGpuNumSamePriority {
 		return false
@@ -221,13 +282,107 @@ func (cv clusterView) Swap(i int, j int) {
 // updateClusterView updates the GPU numbers of the nodes for the sorting.
 func (t *topologyAwareScheduler) updateClusterView(p CellPriority, suggestedNodeSet common.Set) {
 	for _, n := range t.cv {
-		inSuggested := true
-		if t.considerSuggestedNodes {
-			nodeNames, _ := n.c.(*PhysicalCell).GetPhysicalPlacement()
-			inSuggested = suggestedNodeSet.Contains(nodeNames[0])
+		t.updateNode(n, p, suggestedNodeSet)
+	}
+}
+
+// updateNode updates the GPU numbers and the preemption cost of a node for the sorting.
+// A node outside the suggested nodes has no free GPU, as the pods must be placed within the suggested nodes.
+func (t *topologyAwareScheduler) updateNode(n *node, p CellPriority, suggestedNodeSet common.Set) {
+	inSuggested := true
+	if t.considerSuggestedNodes {
+		nodeNames, _ := n.c.(*PhysicalCell).GetPhysicalPlacement()
+		inSuggested = suggestedNodeSet.Contains(nodeNames[0])
+	} else if pn := n.c.(*VirtualCell).GetPhysicalCell(); pn != nil {
+		// an unbound virtual node will be mapped to a physical node within the suggested nodes
+		nodeNames, _ := pn.GetPhysicalPlacement()
+		inSuggested = suggestedNodeSet.Contains(nodeNames[0])
+	}
+	n.inSuggested = inSuggested
+	n.UpdateUsedGpuNumForPriority(p, t.crossPriorityPack, inSuggested)
+	n.freeGpuNumAtPriority -= getCordonedGpuNum(n.c, p)
+	if !inSuggested {
+		n.freeGpuNumAtPriority = 0
+	}
+	n.preemptionCost = 0
+	if p > opportunisticPriority && t.costModel != nil {
+		n.preemptionCost = t.costModel.cellCost(n.c, p)
+	}
+}
+
+// splitClusterView splits the (sorted) nodes into the views of the scopes at a max level, i.e., the nodes
+// in each view are within one cell at that level. If the max level is lower than a node, the node is split
+// into its cells at the max level, each of which is a view treated as a single node.
+// A virtual node whose preassigned cell is lower than the max level and not bound yet does not have a scope
+// until buddy alloc. Such nodes are added to each view of a physical scope, and also make up a view of their own.
+func (t *topologyAwareScheduler) splitClusterView(
+	maxLevel CellLevel,
+	p CellPriority,
+	suggestedNodeSet common.Set) []clusterView {
+
+	var views []clusterView
+	var scopes CellList
+	nodeScopes := make(CellList, len(t.cv))
+	var unscopedNodes clusterView
+	for i, n := range t.cv {
+		if n.c.GetLevel() >= maxLevel {
+			for _, c := range getDescendantsAtLevel(n.c, maxLevel) {
+				cellNode := &node{c: c}
+				t.updateNode(cellNode, p, suggestedNodeSet)
+				views = append(views, clusterView{cellNode})
+			}
+		} else if nodeScopes[i] = getConstraintScope(n.c, maxLevel); nodeScopes[i] == nil {
+			unscopedNodes = append(unscopedNodes, n)
+		} else if !cellListContains(scopes, nodeScopes[i]) {
+			scopes = append(scopes, nodeScopes[i])
+		}
+	}
+	for _, s := range scopes {
+		_, isPhysical := s.(*PhysicalCell)
+		view := clusterView{}
+		for i, n := range t.cv {
+			if CellEqual(nodeScopes[i], s) || (isPhysical && nodeScopes[i] == nil && n.c.GetLevel() < maxLevel) {
+				view = append(view, n)
+			}
 		}
-		n.UpdateUsedGpuNumForPriority(p, t.crossPriorityPack, inSuggested)
+		views = append(views, view)
 	}
+	if len(unscopedNodes) > 0 {
+		views = append(views, unscopedNodes)
+	}
+	return views
+}
+
+// getConstraintScope returns the cell at a certain level containing a cell (or the cell itself if it is
+// not lower than that level), i.e., the scope of the cell for a topology constraint at that level.
+// For a virtual cell whose preassigned cell is lower than the level, the scope is the physical cell
+// containing its bound preassigned cell, or nil if the preassigned cell is not bound.
+func getConstraintScope(c Cell, l CellLevel) Cell {
+	for c.GetLevel() < l && c.GetParent() != nil {
+		c = c.GetParent()
+	}
+	if c.GetLevel() >= l {
+		return c
+	}
+	if vc, ok := c.(*VirtualCell); ok {
+		if pc := vc.GetPhysicalCell(); pc != nil {
+			return getConstraintScope(pc, l)
+		}
+	}
+	return nil
+}
+
+// getDescendantsAtLevel returns the descendants of a cell at a certain level (or the cell itself if it is
+// at or lower than that level).
+func getDescendantsAtLevel(c Cell, l CellLevel) CellList {
+	if c.GetLevel() <= l {
+		return CellList{c}
+	}
+	var descendants CellList
+	for _, cc := range c.GetChildren() {
+		descendants = append(descendants, getDescendantsAtLevel(cc, l)...)
+	}
+	return descendants
 }
 
 // findNodesForPods finds a set of nodes that can accommodate the GPU requirements of the pods.
@@ -262,13 +417,47 @@ func findNodesForPods(cv clusterView, gpuNums []int32, p CellPriority) []int32 {
 	return nil
 }
 
+// findDistinctNodesForPods finds a distinct node for each pod, such that no two pods are within the same cell
+// at the anti-affinity level (which is not lower than node). Pods with more GPUs pick their nodes first.
+func findDistinctNodesForPods(cv clusterView, gpuNums []int32, antiAffinityLevel CellLevel) []int32 {
+	sort.Stable(cv)
+	selectedNodeIndices := make([]int32, len(gpuNums))
+	selected := make([]bool, len(cv))
+	var usedScopes CellList
+	for podIndex := len(gpuNums) - 1; podIndex >= 0; podIndex-- {
+		found := false
+		for nodeIndex, n := range cv {
+			if selected[nodeIndex] || n.freeGpuNumAtPriority < gpuNums[podIndex] {
+				continue
+			}
+			// a node without scope (i.e., not bound yet) will be placed in a distinct cell by buddy alloc
+			scope := getConstraintScope(n.c, antiAffinityLevel)
+			if scope != nil && cellListContains(usedScopes, scope) {
+				continue
+			}
+			if scope != nil {
+				usedScopes = append(usedScopes, scope)
+			}
+			selected[nodeIndex] = true
+			selectedNodeIndices[podIndex] = int32(nodeIndex)
+			found = true
+			break
+		}
+		if !found {
+			return nil
+		}
+	}
+	return selectedNodeIndices
+}
+
 // findGpusInNode finds a set of GPUs with the best affinity in a node for a pod.
 func findGpusInNode(
 	n Cell,
 	gpuNum int32,
 	p CellPriority,
 	availableGpus CellList,
-	levelGpuNum map[CellLevel]int32) (CellList, CellList) {
+	levelGpuNum map[CellLevel]int32,
+	costModel *preemptionCostModel) (CellList, CellList) {
 
 	// indices of the currently picked GPUs
 	currentGpuIndices := make([]int32, gpuNum)
@@ -288,6 +477,8 @@ func findGpusInNode(
 		availableGpus = CellList{}
 		preemptibleGpus := CellList{}
 		availableGpus, preemptibleGpus = getGpusFromNode(n, p, availableGpus, preemptibleGpus)
+		// preemptible GPUs cheaper to preempt will be used first
+		costModel.sortGpusByCost(preemptibleGpus, p)
 		// free GPUs will be used first (before preemptible GPUs)
 		availableGpus = append(availableGpus, preemptibleGpus...)
 	}
@@ -415,12 +606,34 @@ func findLCA(lower Cell, higher Cell) Cell {
 	return lower.GetParent()
 }
 
+// getCordonedGpuNum counts the GPUs in a physical cell that are cordoned and not used at or above a priority
+// (i.e., the GPUs that would have been free or preemptible if not cordoned).
+func getCordonedGpuNum(c Cell, p CellPriority) int32 {
+	pc, ok := c.(*PhysicalCell)
+	if !ok {
+		return 0
+	}
+	if c.GetLevel() > 1 {
+		num := int32(0)
+		for _, cc := range c.GetChildren() {
+			num += getCordonedGpuNum(cc, p)
+		}
+		return num
+	} else if c.GetPriority() < p && isInCordonedCell(pc) {
+		return 1
+	}
+	return 0
+}
+
 // getGpusFromNode collects free GPUs and preemptible GPUs according to the priority.
+// Cordoned physical GPUs are not collected.
 func getGpusFromNode(c Cell, p CellPriority, freeGpus CellList, preemptibleGpus CellList) (CellList, CellList) {
 	if c.GetLevel() > 1 {
 		for _, cc := range c.GetChildren() {
 			freeGpus, preemptibleGpus = getGpusFromNode(cc, p, freeGpus, preemptibleGpus)
 		}
+	} else if pc, ok := c.(*PhysicalCell); ok && isInCordonedCell(pc) {
+		return freeGpus, preemptibleGpus
 	} else if c.GetPriority() == freePriority {
 		freeGpus = append(freeGpus, c)
 	} else if c.GetPriority() < p {
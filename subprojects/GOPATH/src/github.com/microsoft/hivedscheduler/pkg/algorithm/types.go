@@ -28,6 +28,7 @@ import (
 	core "k8s.io/api/core/v1"
 	"k8s.io/klog"
 	"strings"
+	"time"
 )
 
 type (
@@ -43,6 +44,34 @@ type schedulingRequest struct {
 	affinityGroupName    string
 	affinityGroupPodNums map[int32]int32 // gpu number -> pod number
 	priority             CellPriority
+	maxCellType          api.CellType       // all the pods must be within one cell of this type
+	maxCellLevel         CellLevel          // or within one cell at this level
+	antiAffinity         string             // each pod must be within a distinct node or cell of this type
+	topologyConstraint   topologyConstraint // the above constraints resolved to the levels in the chain
+	dryRun               bool               // do not lazy preempt any group (when inspecting the capacity)
+}
+
+// topologyConstraint constrains the placement of the pods of an affinity group in a chain.
+type topologyConstraint struct {
+	maxLevel          CellLevel // all the pods must be within one cell at this level (0 if not constrained)
+	antiAffinityLevel CellLevel // each pod must be within a distinct cell at this level (0 if not constrained)
+}
+
+// cellCordon is a set of physical cells cordoned (and drained if specified) for maintenance,
+// i.e., a cell specified by its address, or all the cells of a node specified by its name.
+type cellCordon struct {
+	spec  api.CellCordonSpec
+	cells []*PhysicalCell
+}
+
+// timeWindowCell is a preassigned cell (or the top cell of a reservation) which is only in its VC
+// when its time windows are open.
+type timeWindowCell struct {
+	vc      api.VirtualClusterName
+	rid     api.ReservationId
+	virtual *VirtualCell
+	// the physical cell last bound to the reservation, preferred when its windows open again
+	reservedCell *PhysicalCell
 }
 
 // CellList is a list of cells at a certain level of a chain.
@@ -105,28 +134,49 @@ func (ccl ChainCellList) remove(c Cell, l CellLevel) {
 // AlgoAffinityGroup is the algorithm-internal representation of an affinity group.
 type AlgoAffinityGroup struct {
 	name                 string
+	vc                   api.VirtualClusterName
+	reservationId        api.ReservationId
+	user                 string                 // user of the group in its VC, whose quota the group uses
+	lender               api.VirtualClusterName // sibling VC whose idle quota the group borrows
+	priority             CellPriority           // priority of the group, kept even if lazy preempted
 	gangReleaseEnable    bool
 	lazyPreemptionEnable bool
+	upgradeEnable        bool
+	upgradePriority      CellPriority          // guaranteed priority which the group is upgraded to
+	bindInfoChanged      bool                  // changed at runtime, but not patched to the bind info of the pods yet
 	totalPodNums         map[int32]int32       // GpuNum -> PodNum
 	allocatedPods        map[int32][]*core.Pod // GpuNum -> a list of allocated pods and node addresses
 	physicalGpuPlacement map[int32][]CellList  // GpuNum -> a list of pods -> a list of physical GPUs of each pod
 	virtualGpuPlacement  map[int32][]CellList  // GpuNum -> a list of pods -> a list of virtual GPUs of each pod
+	// pod index -> the CPU and memory of each pod requesting zero GPU counted in the VC usage
+	vcResourceRequests   map[int32]core.ResourceList
 	lazyPreemptionStatus *api.LazyPreemptionStatus
+	preemptionStatus     *api.PreemptionStatus
+	startTime            time.Time // earliest start time of the pods, used in preemption cost
+	preemptionCost       int32     // max preemption cost specified by the pods
+	defragmentationTime  time.Time // last time the group was selected to be moved by the defragmentation
 }
 
-func newAlgoAffinityGroup(g *api.AffinityGroupSpec, gangReleaseEnable bool, lazyPreemptionEnable bool) *AlgoAffinityGroup {
+func newAlgoAffinityGroup(s *api.PodSchedulingSpec, now time.Time) *AlgoAffinityGroup {
 	podNums := make(map[int32]int32)
-	for _, m := range g.Members {
+	for _, m := range s.AffinityGroup.Members {
 		podNums[m.GpuNumber] += m.PodNumber
 	}
 	group := &AlgoAffinityGroup{
-		name:                 g.Name,
-		gangReleaseEnable:    gangReleaseEnable,
-		lazyPreemptionEnable: lazyPreemptionEnable,
+		name:                 s.AffinityGroup.Name,
+		vc:                   s.VirtualCluster,
+		reservationId:        s.ReservationId,
+		priority:             CellPriority(s.Priority),
+		gangReleaseEnable:    s.GangReleaseEnable,
+		lazyPreemptionEnable: s.LazyPreemptionEnable,
+		upgradeEnable:        s.UpgradeEnable,
+		upgradePriority:      CellPriority(s.UpgradePriority),
 		totalPodNums:         podNums,
 		allocatedPods:        map[int32][]*core.Pod{},
 		physicalGpuPlacement: map[int32][]CellList{},
 		virtualGpuPlacement:  map[int32][]CellList{},
+		vcResourceRequests:   map[int32]core.ResourceList{},
+		startTime:            now,
 	}
 	for gpuNum, podNum := range podNums {
 		group.physicalGpuPlacement[gpuNum] = make([]CellList, podNum)
@@ -143,6 +193,29 @@ func newAlgoAffinityGroup(g *api.AffinityGroupSpec, gangReleaseEnable bool, lazy
 func (aag *AlgoAffinityGroup) ToAffinityGroup() api.AffinityGroup {
 	ag := api.AffinityGroup{}
 	ag.Name = aag.name
+	ag.Status.VirtualCluster = aag.vc
+	ag.Status.Priority = int32(aag.priority)
 	ag.Status.LazyPreemptionStatus = aag.lazyPreemptionStatus
+	ag.Status.PreemptionStatus = aag.preemptionStatus
+	ag.Status.LenderVirtualCluster = aag.lender
 	return ag
 }
+
+// getTotalGpuNum returns the number of GPUs requested by all the pods of the group.
+func (aag *AlgoAffinityGroup) getTotalGpuNum() int32 {
+	n := int32(0)
+	for gpuNum, podNum := range aag.totalPodNums {
+		n += gpuNum * podNum
+	}
+	return n
+}
+
+// updatePodInfo updates the start time and the preemption cost of the group from an allocated pod.
+func (aag *AlgoAffinityGroup) updatePodInfo(pod *core.Pod, preemptionCost int32) {
+	if pod.Status.StartTime != nil && pod.Status.StartTime.Time.Before(aag.startTime) {
+		aag.startTime = pod.Status.StartTime.Time
+	}
+	if preemptionCost > aag.preemptionCost {
+		aag.preemptionCost = preemptionCost
+	}
+}
@@ -0,0 +1,121 @@
+// MIT License
+//
+// Copyright (c) Microsoft Corporation. All rights reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE
+
+package algorithm
+
+import (
+	"github.com/microsoft/hivedscheduler/pkg/api"
+	"github.com/microsoft/hivedscheduler/pkg/common"
+	"github.com/microsoft/hivedscheduler/pkg/internal"
+	core "k8s.io/api/core/v1"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"net/http"
+	"sort"
+	"testing"
+)
+
+const testConfigFilePath = "../../example/config/design/hivedscheduler.yaml"
+
+var allNodes []string
+
+func initNodes(h *HivedAlgorithm) {
+	if allNodes != nil {
+		return
+	}
+	for _, ccl := range h.fullCellList {
+		for _, c := range ccl[CellLevel(len(ccl))] {
+			allNodes = append(allNodes, c.(*PhysicalCell).nodes...)
+		}
+	}
+}
+
+func sortChains(chains []CellChain) {
+	var chainsTemp []string
+	for _, c := range chains {
+		chainsTemp = append(chainsTemp, string(c))
+	}
+	sort.Strings(chainsTemp)
+	for i := range chains {
+		chains[i] = CellChain(chainsTemp[len(chainsTemp)-i-1])
+	}
+}
+
+// newTestRawConfig returns the raw config of the design example, to be changed by the test before NewConfig.
+func newTestRawConfig() *api.Config {
+	configFilePath := testConfigFilePath
+	return api.InitRawConfig(&configFilePath)
+}
+
+func newTestConfig() *api.Config {
+	return api.NewConfig(newTestRawConfig())
+}
+
+// newTestAlgorithm creates the algorithm with the chains of each GPU type sorted for stability of the test.
+func newTestAlgorithm(sConfig *api.Config) *HivedAlgorithm {
+	h := NewHivedAlgorithm(sConfig)
+	for _, chains := range h.chains {
+		sortChains(chains)
+	}
+	initNodes(h)
+	return h
+}
+
+func newTestPod(name string, s api.PodSchedulingSpec) *core.Pod {
+	return &core.Pod{
+		ObjectMeta: meta.ObjectMeta{
+			Name:        name,
+			Namespace:   "test",
+			UID:         types.UID(name),
+			Annotations: map[string]string{api.AnnotationKeyPodSchedulingSpec: common.ToYaml(s)},
+		},
+	}
+}
+
+// scheduleAndAllocate schedules the pod to all the nodes, and allocates it if it is bound.
+func scheduleAndAllocate(t *testing.T, h *HivedAlgorithm, pod *core.Pod) *core.Pod {
+	psr := h.Schedule(pod, allNodes)
+	if psr.PodBindInfo == nil {
+		t.Fatalf("[%v]: expected to bind, but got %v", internal.Key(pod), common.ToJson(psr))
+	}
+	bindingPod := internal.NewBindingPod(pod, psr.PodBindInfo)
+	h.AddAllocatedPod(bindingPod)
+	return bindingPod
+}
+
+func expectBadRequest(t *testing.T, desc string, f func()) {
+	defer func() {
+		if err, ok := recover().(*api.WebServerError); !ok || err.Code != http.StatusBadRequest {
+			t.Errorf("Expected User Error Panic when %v, but got %v", desc, err)
+		}
+	}()
+	f()
+}
+
+func expectPanic(t *testing.T, desc string, f func()) {
+	defer func() {
+		if r := recover(); r == nil {
+			t.Errorf("Expected panic when %v", desc)
+		}
+	}()
+	f()
+}
@@ -0,0 +1,236 @@
+// MIT License
+//
+// Copyright (c) Microsoft Corporation. All rights reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE
+
+package algorithm
+
+import (
+	"fmt"
+	"github.com/microsoft/hivedscheduler/pkg/api"
+	"github.com/microsoft/hivedscheduler/pkg/common"
+	"github.com/microsoft/hivedscheduler/pkg/internal"
+	core "k8s.io/api/core/v1"
+	"k8s.io/klog"
+	"sort"
+)
+
+// GetVirtualClusters returns all the VCs with their hierarchy.
+func (h *HivedAlgorithm) GetVirtualClusters() api.VirtualClusterList {
+	h.algorithmLock.RLock()
+	defer h.algorithmLock.RUnlock()
+
+	var vcs []api.VirtualClusterName
+	for vc := range h.vcSchedulers {
+		vcs = append(vcs, vc)
+	}
+	sort.Slice(vcs, func(i, j int) bool { return vcs[i] < vcs[j] })
+	list := api.VirtualClusterList{Items: []api.VirtualCluster{}}
+	for _, vc := range vcs {
+		list.Items = append(list.Items, h.toVirtualCluster(vc))
+	}
+	return list
+}
+
+func (h *HivedAlgorithm) GetVirtualCluster(name string) api.VirtualCluster {
+	h.algorithmLock.RLock()
+	defer h.algorithmLock.RUnlock()
+
+	vc := api.VirtualClusterName(name)
+	if h.vcSchedulers[vc] == nil {
+		panic(internal.NewBadRequestError(fmt.Sprintf(
+			"VC %v does not exist", name)))
+	}
+	return h.toVirtualCluster(vc)
+}
+
+// toVirtualCluster returns the VC exposed by the inspect API.
+func (h *HivedAlgorithm) toVirtualCluster(vc api.VirtualClusterName) api.VirtualCluster {
+	v := api.VirtualCluster{Name: vc, Parent: h.vcParents[vc], Cells: []api.VirtualClusterCell{}}
+	for child, parent := range h.vcParents {
+		if parent == vc {
+			v.Children = append(v.Children, child)
+		}
+	}
+	sort.Slice(v.Children, func(i, j int) bool { return v.Children[i] < v.Children[j] })
+
+	// count the preassigned cells (i.e., the top level ones) of each cell type
+	addCells := func(chain CellChain, rid api.ReservationId, ccl ChainCellList) {
+		for l := CellLevel(len(ccl)); l >= lowestLevel; l-- {
+			n := int32(0)
+			for _, c := range ccl[l] {
+				if virtual := c.(*VirtualCell); virtual.GetPreAssignedCell() == virtual {
+					n++
+				}
+			}
+			if n > 0 {
+				v.Cells = append(v.Cells, api.VirtualClusterCell{
+					CellChain:     string(chain),
+					CellType:      h.cellTypes[chain][l],
+					ReservationId: rid,
+					CellNumber:    n,
+				})
+			}
+		}
+	}
+	vcs := h.vcSchedulers[vc]
+	var chains []CellChain
+	for chain := range vcs.getNonReservedCellList() {
+		chains = append(chains, chain)
+	}
+	sort.Slice(chains, func(i, j int) bool { return chains[i] < chains[j] })
+	for _, chain := range chains {
+		addCells(chain, "", vcs.getNonReservedCellList()[chain])
+	}
+	var rids []api.ReservationId
+	for rid := range vcs.getReservedCellList() {
+		rids = append(rids, rid)
+	}
+	sort.Slice(rids, func(i, j int) bool { return rids[i] < rids[j] })
+	for _, rid := range rids {
+		ccl := vcs.getReservedCellList()[rid]
+		addCells(ccl[CellLevel(len(ccl))][0].GetChain(), rid, ccl)
+	}
+
+	for _, g := range h.allocatedAffinityGroups {
+		if g.lender == vc {
+			v.LentAffinityGroups = append(v.LentAffinityGroups, g.name)
+		}
+	}
+	sort.Strings(v.LentAffinityGroups)
+	return v
+}
+
+// scheduleAffinityGroupWithLentCells schedules a guaranteed group of a child VC which the free quota
+// of the VC cannot hold. The quota of the VC lent to its siblings is reclaimed first (by lazy preempting
+// the groups borrowing it), then the idle quota of the siblings is borrowed, i.e., the group can only use
+// their free virtual cells, without preempting any group in them.
+func (h *HivedAlgorithm) scheduleAffinityGroupWithLentCells(
+	sr schedulingRequest,
+	typedMembers []api.AffinityGroupMemberSpec,
+	pod *core.Pod,
+	s *api.PodSchedulingSpec,
+	suggestedNodeSet common.Set) (map[int32][]CellList, map[int32][]CellList, api.VirtualClusterName) {
+
+	if h.vcParents[sr.vc] == "" {
+		return nil, nil, ""
+	}
+	if borrowers := h.getReclaimedBorrowers(sr, typedMembers, pod, s, suggestedNodeSet); len(borrowers) != 0 {
+		for _, g := range borrowers {
+			klog.Infof("Reclaiming the quota of VC %v lent to affinity group %v", sr.vc, g.name)
+			h.lazyPreemptAffinityGroup(g, sr.affinityGroupName)
+		}
+		physicalPlacement, virtualPlacement := h.scheduleAffinityGroupInVc(
+			sr, typedMembers, pod, s, suggestedNodeSet)
+		if physicalPlacement != nil {
+			return physicalPlacement, virtualPlacement, ""
+		}
+		klog.Warningf("Affinity group %v cannot be scheduled after reclaiming the quota of VC %v",
+			sr.affinityGroupName, sr.vc)
+	}
+	for _, sibling := range h.getSiblingVcs(sr.vc) {
+		lsr := sr
+		lsr.vc = sibling
+		lsr.priority = minGuaranteedPriority
+		if h.validateGpuTypes(lsr, s.GpuTypes, typedMembers) != "" {
+			continue
+		}
+		physicalPlacement, virtualPlacement := h.scheduleAffinityGroupInVc(
+			lsr, typedMembers, pod, s, suggestedNodeSet)
+		if physicalPlacement != nil {
+			klog.Infof("Affinity group %v borrows the idle quota of VC %v", sr.affinityGroupName, sibling)
+			return physicalPlacement, virtualPlacement, sibling
+		}
+	}
+	return nil, nil, ""
+}
+
+// getReclaimedBorrowers finds the groups borrowing the quota of a VC which should be lazy preempted
+// to schedule a group in the VC, sorted by name. The group is dry run scheduled at a priority higher than
+// all the borrowers, and only the borrowers in that placement are returned. Nil is returned if the group
+// cannot be scheduled even if the quota is reclaimed, or the placement preempts a group of the VC
+// which the group cannot preempt at its own priority.
+func (h *HivedAlgorithm) getReclaimedBorrowers(
+	sr schedulingRequest,
+	typedMembers []api.AffinityGroupMemberSpec,
+	pod *core.Pod,
+	s *api.PodSchedulingSpec,
+	suggestedNodeSet common.Set) []*AlgoAffinityGroup {
+
+	dsr := sr
+	dsr.dryRun = true
+	borrowers := map[string]*AlgoAffinityGroup{}
+	for _, g := range h.allocatedAffinityGroups {
+		if g.lender == sr.vc && g.virtualGpuPlacement != nil {
+			borrowers[g.name] = g
+			if g.priority >= dsr.priority {
+				dsr.priority = g.priority + 1
+			}
+		}
+	}
+	if len(borrowers) == 0 {
+		return nil
+	}
+	_, virtualPlacement := h.scheduleAffinityGroupInVc(dsr, typedMembers, pod, s, suggestedNodeSet)
+	if virtualPlacement == nil {
+		return nil
+	}
+	reclaimed := map[string]*AlgoAffinityGroup{}
+	for _, podPlacements := range virtualPlacement {
+		for _, podPlacement := range podPlacements {
+			for _, gpu := range podPlacement {
+				vGpu := gpu.(*VirtualCell)
+				if vGpu.GetPriority() < sr.priority {
+					continue
+				}
+				var g *AlgoAffinityGroup
+				if pGpu := vGpu.GetPhysicalCell(); pGpu != nil {
+					g = pGpu.GetAffinityGroup()
+				}
+				if g == nil || borrowers[g.name] != g {
+					return nil
+				}
+				reclaimed[g.name] = g
+			}
+		}
+	}
+	var names []string
+	for name := range reclaimed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var groups []*AlgoAffinityGroup
+	for _, name := range names {
+		groups = append(groups, reclaimed[name])
+	}
+	return groups
+}
+
+// getSiblingVcs returns the sorted VCs which have the same parent as a child VC.
+func (h *HivedAlgorithm) getSiblingVcs(vc api.VirtualClusterName) []api.VirtualClusterName {
+	var siblings []api.VirtualClusterName
+	for sibling, parent := range h.vcParents {
+		if sibling != vc && parent == h.vcParents[vc] {
+			siblings = append(siblings, sibling)
+		}
+	}
+	sort.Slice(siblings, func(i, j int) bool { return siblings[i] < siblings[j] })
+	return siblings
+}
@@ -0,0 +1,139 @@
+// MIT License
+//
+// Copyright (c) Microsoft Corporation. All rights reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE
+
+package algorithm
+
+import (
+	"github.com/microsoft/hivedscheduler/pkg/api"
+	"github.com/microsoft/hivedscheduler/pkg/common"
+	"github.com/microsoft/hivedscheduler/pkg/internal"
+	core "k8s.io/api/core/v1"
+	"reflect"
+	"testing"
+)
+
+func TestHierarchicalVirtualClusters(t *testing.T) {
+	sConfig := newTestConfig()
+	vcs := *sConfig.VirtualClusters
+	vcs["VC2-A"] = api.VirtualClusterSpec{Parent: "VC2", VirtualCells: []api.VirtualCellSpec{
+		{CellType: "3-DGX1-P100-NODE.DGX1-P100-NODE.DGX1-P100-CPU-SOCKET", CellNumber: 1},
+	}}
+	vcs["VC2-B"] = api.VirtualClusterSpec{Parent: "VC2", VirtualCells: []api.VirtualCellSpec{
+		{CellType: "3-DGX1-P100-NODE.DGX1-P100-NODE", CellNumber: 1},
+		{CellType: "3-DGX1-P100-NODE.DGX1-P100-NODE.DGX1-P100-CPU-SOCKET.DGX1-P100-PCI-SWITCH", CellNumber: 1},
+	}}
+	h := newTestAlgorithm(sConfig)
+
+	// the cells of the children are carved out of the parent
+	expectedVc2 := api.VirtualCluster{
+		Name:     "VC2",
+		Children: []api.VirtualClusterName{"VC2-A", "VC2-B"},
+		Cells: []api.VirtualClusterCell{
+			{CellChain: "3-DGX1-P100-NODE", CellType: "DGX1-P100-NODE", CellNumber: 1},
+			{CellChain: "3-DGX1-P100-NODE", CellType: "DGX1-P100-PCI-SWITCH", CellNumber: 1},
+			{CellChain: "CT1-NODE", CellType: "CT1-NODE", CellNumber: 1},
+		},
+	}
+	if vc := h.GetVirtualCluster("VC2"); !reflect.DeepEqual(vc, expectedVc2) {
+		t.Errorf("Expected VC %v, but got %v", common.ToJson(expectedVc2), common.ToJson(vc))
+	}
+	if vc := h.GetVirtualCluster("VC2-A"); vc.Parent != "VC2" || len(vc.Cells) != 1 ||
+		vc.Cells[0].CellType != "DGX1-P100-CPU-SOCKET" {
+		t.Errorf("Expected VC VC2-A with a DGX1-P100-CPU-SOCKET from VC2, but got %v", common.ToJson(vc))
+	}
+
+	newPod := func(name string, vc api.VirtualClusterName, gpuNumber int32) *core.Pod {
+		return newTestPod(name, api.PodSchedulingSpec{
+			VirtualCluster: vc,
+			Priority:       1,
+			GpuType:        "DGX1-P100",
+			GpuNumber:      gpuNumber,
+		})
+	}
+	allocatedPods := []*core.Pod{
+		scheduleAndAllocate(t, h, newPod("a-0", "VC2-A", 4)),
+		scheduleAndAllocate(t, h, newPod("a-1", "VC2-A", 4)),
+	}
+	// the second group borrows the idle quota of the sibling
+	if g := h.GetAffinityGroup("test/a-1"); g.Status.LenderVirtualCluster != "VC2-B" {
+		t.Errorf("Expected group test/a-1 to borrow from VC2-B, but got %v", common.ToJson(g.Status))
+	}
+	if vc := h.GetVirtualCluster("VC2-B"); !reflect.DeepEqual(vc.LentAffinityGroups, []string{"test/a-1"}) {
+		t.Errorf("Expected VC2-B to lend to test/a-1, but got %v", vc.LentAffinityGroups)
+	}
+
+	// the borrowed group is recovered in the lender
+	recovered := newTestAlgorithm(sConfig)
+	for _, pod := range allocatedPods {
+		recovered.AddAllocatedPod(pod)
+	}
+	if g := recovered.allocatedAffinityGroups["test/a-1"]; g.lender != "VC2-B" || g.virtualGpuPlacement == nil {
+		t.Errorf("Expected group test/a-1 recovered to borrow from VC2-B, but got lender %v", g.lender)
+	}
+
+	allocatedPods = append(allocatedPods, scheduleAndAllocate(t, h, newPod("a-2", "VC2-A", 2)))
+	if vc := h.GetVirtualCluster("VC2-B"); !reflect.DeepEqual(
+		vc.LentAffinityGroups, []string{"test/a-1", "test/a-2"}) {
+		t.Errorf("Expected VC2-B to lend to test/a-1 and test/a-2, but got %v", vc.LentAffinityGroups)
+	}
+
+	// the quota is not reclaimed if the group cannot be scheduled even after reclaiming it
+	pod := newTestPod("b-1", api.PodSchedulingSpec{
+		VirtualCluster: "VC2-B",
+		Priority:       1,
+		GpuType:        "DGX1-P100",
+		GpuNumber:      8,
+		AffinityGroup: &api.AffinityGroupSpec{
+			Name:    "test/b-1",
+			Members: []api.AffinityGroupMemberSpec{{PodNumber: 2, GpuNumber: 8}},
+		},
+	})
+	if psr := h.Schedule(pod, allNodes); psr.PodBindInfo != nil {
+		t.Errorf("[%v]: expected not to bind, but got %v", internal.Key(pod), common.ToJson(psr))
+	}
+	for _, name := range []string{"test/a-1", "test/a-2"} {
+		if g := h.GetAffinityGroup(name); g.Status.LazyPreemptionStatus != nil || g.Status.LenderVirtualCluster != "VC2-B" {
+			t.Errorf("Expected group %v not lazy preempted, but got %v", name, common.ToJson(g.Status))
+		}
+	}
+
+	// the lender reclaims only the quota it needs: a-1 and a-2 use different sockets of the lent node
+	pod = newPod("b-0", "VC2-B", 4)
+	if psr := h.Schedule(pod, allNodes); psr.PodBindInfo == nil && psr.PodPreemptInfo == nil {
+		t.Errorf("[%v]: expected to bind or preempt, but got %v", internal.Key(pod), common.ToJson(psr))
+	}
+	reclaimed := 0
+	for _, name := range []string{"test/a-1", "test/a-2"} {
+		if g := h.GetAffinityGroup(name); g.Status.LazyPreemptionStatus != nil {
+			reclaimed++
+		}
+	}
+	if reclaimed != 1 {
+		t.Errorf("Expected one of test/a-1 and test/a-2 lazy preempted, but got %v", reclaimed)
+	}
+
+	// the children cannot exceed the parent
+	vcs["VC2-C"] = api.VirtualClusterSpec{Parent: "VC2", VirtualCells: []api.VirtualCellSpec{
+		{CellType: "3-DGX1-P100-NODE.DGX1-P100-NODE", CellNumber: 2},
+	}}
+	expectPanic(t, "the children exceed the parent", func() { NewHivedAlgorithm(sConfig) })
+}
@@ -58,6 +58,16 @@ type Config struct {
 	// WebServer
 	// Default to :9096
 	WebServerAddress *string `yaml:"webServerAddress"`
+	// Specify the TLS certificate and key files to serve the WebServer in HTTPS,
+	// which is required to serve the K8S Admission Webhooks.
+	// Default to empty, i.e. serve in HTTP.
+	WebServerCertFilePath *string `yaml:"webServerCertFilePath"`
+	WebServerKeyFilePath  *string `yaml:"webServerKeyFilePath"`
+
+	// Specify the schedulerName injected into the Pods by the K8S Mutating
+	// Admission Webhook, i.e. the K8S Default Scheduler extended by this scheduler.
+	// Default to hivedscheduler.
+	SchedulerName *string `yaml:"schedulerName"`
 
 	// Specify a threshold for PodBindAttempts, that after it is exceeded, an extra
 	// Pod binding will be executed forcefully.
@@ -71,6 +81,100 @@ type Config struct {
 	// K8S Default Scheduler.
 	WaitingPodSchedulingBlockMilliSec *int64 `yaml:"waitingPodSchedulingBlockMilliSec"`
 
+	// Specify the weights of the cost function which is minimized when selecting
+	// preemption victims, both inside a VC and in the physical cluster.
+	// Default to all zero weights, i.e. victims are selected purely by cell
+	// priority.
+	PreemptionCostWeights *PreemptionCostWeights `yaml:"preemptionCostWeights"`
+
+	// Specify the interval to periodically reconcile the scheduling view, such as
+	// to restore the lazy preempted AffinityGroups back to their VCs and to
+	// upgrade the opportunistic AffinityGroups with UpgradeEnable, once their VCs
+	// have enough free quota.
+	// The reconciliation is also triggered whenever an allocated Pod is deleted.
+	// Default to 60. Non-positive value disables the periodic reconciliation.
+	ReconcileIntervalSec *int64 `yaml:"reconcileIntervalSec"`
+
+	// Specify the bearer tokens of the cluster admins, who are permitted to modify
+	// the AffinityGroups in all VCs and the cluster, and to inspect the Capacity,
+	// through the Scheduler Inspect API.
+	// The VC admins are specified by VirtualClusterSpec.AdminTokens.
+	// Default to empty, i.e. only the VC admins are permitted.
+	ClusterAdminTokens *[]string `yaml:"clusterAdminTokens"`
+
+	// Specify the file to persist the Reservations created, moved or deleted at
+	// runtime (through the Scheduler Inspect API or by the scheduling), so that
+	// they survive the Scheduler restart. Only the changes are persisted, and they
+	// are replayed on top of the Reservations in the config, i.e. a change is
+	// dropped if the Reservation is changed in the config since.
+	// It should be on a persistent volume.
+	// Default to empty, i.e. the Reservations changed at runtime are lost on the
+	// restart.
+	ReservationFilePath *string `yaml:"reservationFilePath"`
+
+	// Specify the ledger file to append the records of the GPUs held by the
+	// AffinityGroups in JSON Lines format, for the GPU-hour accounting.
+	// It is rotated to LedgerFilePath.1, LedgerFilePath.2, ... (from the newest
+	// to the oldest) once it exceeds LedgerMaxFileBytes, and at most
+	// LedgerMaxBackups rotated files are kept. It should be on a persistent volume.
+	// Default to empty, i.e. the ledger is disabled.
+	LedgerFilePath *string `yaml:"ledgerFilePath"`
+	// Default to 104857600, i.e. 100MiB.
+	LedgerMaxFileBytes *int64 `yaml:"ledgerMaxFileBytes"`
+	// Default to 10.
+	LedgerMaxBackups *int32 `yaml:"ledgerMaxBackups"`
+
+	// Specify the interval to periodically defragment the opportunistic
+	// AffinityGroups, i.e., to evict the ones whose Pods opt in by annotation
+	// AnnotationKeyPodDefragmentationEnable, if they can be rescheduled more
+	// compactly to free some nodes.
+	// Default to 0, i.e. the defragmentation is disabled.
+	DefragmentationIntervalSec *int64 `yaml:"defragmentationIntervalSec"`
+	// Specify the disruption budget of the defragmentation: at most
+	// DefragmentationMaxEvictionsPerRound AffinityGroups are evicted in each
+	// round, and at most DefragmentationMaxEvictionsPerHour in any hour.
+	// The Pods are evicted through the K8S Eviction API, so their
+	// PodDisruptionBudgets are also respected.
+	// Default to 1 and 10.
+	DefragmentationMaxEvictionsPerRound *int32 `yaml:"defragmentationMaxEvictionsPerRound"`
+	DefragmentationMaxEvictionsPerHour  *int32 `yaml:"defragmentationMaxEvictionsPerHour"`
+	// Specify the min time an AffinityGroup runs before it is evicted by the
+	// defragmentation, which is also the min interval between its evictions.
+	// Default to 600.
+	DefragmentationMinRuntimeSec *int64 `yaml:"defragmentationMinRuntimeSec"`
+	// Specify the file to append the audit log of the defragmentation moves in
+	// JSON Lines format.
+	// Default to ./defragmentation.jsonl. Empty value disables the audit file,
+	// and the moves are only logged by the Scheduler.
+	DefragmentationAuditFilePath *string `yaml:"defragmentationAuditFilePath"`
+
+	// Specify the file to append the audit log of the scheduling calls in
+	// JSON Lines format, i.e. every Schedule, AddAllocatedPod, DeleteAllocatedPod,
+	// Reconcile and Defragment call, and every change through the Scheduler
+	// Inspect API, with its arguments and result. It can be replayed by
+	// "hivedscheduler replay" to reproduce the scheduling decisions.
+	// It is rotated to AuditLogFilePath.1, AuditLogFilePath.2, ... (from the
+	// newest to the oldest) when the Scheduler starts and once it exceeds
+	// AuditLogMaxFileBytes, and at most AuditLogMaxBackups rotated files are
+	// kept. A run can be replayed as long as its first file is kept.
+	// Default to empty, i.e. the audit log is disabled.
+	AuditLogFilePath *string `yaml:"auditLogFilePath"`
+	// Default to 104857600, i.e. 100MiB.
+	AuditLogMaxFileBytes *int64 `yaml:"auditLogMaxFileBytes"`
+	// Default to 10.
+	AuditLogMaxBackups *int32 `yaml:"auditLogMaxBackups"`
+
+	// Specify whether the Scheduler keeps running in degraded mode if the bound
+	// Pods recovered (e.g. when it restarts after a config change) are
+	// inconsistent with the config or with each other, i.e. their cells no
+	// longer exist, their VC is over-allocated, or their cells are used by
+	// another AffinityGroup. In degraded mode, such Pods are quarantined: they
+	// are tracked but their resources are not accounted by the scheduling.
+	// The inconsistencies are always exposed by the Scheduler Inspect API.
+	// Default to false, i.e. the inconsistent Pods are still recovered and
+	// accounted as far as possible, which may crash the Scheduler.
+	RecoveryDegradedModeEnable *bool `yaml:"recoveryDegradedModeEnable"`
+
 	// Specify the whole physical cluster
 	// TODO: Automatically construct it based on node info from GPU and Network Device Plugins
 	PhysicalCluster *PhysicalClusterSpec `yaml:"physicalCluster"`
@@ -79,6 +183,23 @@ type Config struct {
 	VirtualClusters *map[VirtualClusterName]VirtualClusterSpec `yaml:"virtualClusters"`
 }
 
+// The cost of preempting a set of AffinityGroups is the weighted sum of below
+// terms. Among the candidate victim sets with the same cost, the one with the
+// lowest priority is preferred.
+type PreemptionCostWeights struct {
+	// Weight of the number of the preempted AffinityGroups.
+	AffinityGroup float64 `yaml:"affinityGroup"`
+	// Weight of the number of GPUs freed by the preemption in excess of the GPUs
+	// needed.
+	ExtraGpu float64 `yaml:"extraGpu"`
+	// Weight of the runtime in minutes of each preempted AffinityGroup, counted
+	// from its earliest Pod start time.
+	RuntimeMinute float64 `yaml:"runtimeMinute"`
+	// Weight of the preemption cost of each preempted AffinityGroup, specified by
+	// its Pods in annotation AnnotationKeyPodPreemptionCost.
+	Annotation float64 `yaml:"annotation"`
+}
+
 func NewConfig(rawConfig *Config) *Config {
 	c := rawConfig
 
@@ -92,12 +213,69 @@ func NewConfig(rawConfig *Config) *Config {
 	if c.WebServerAddress == nil {
 		c.WebServerAddress = common.PtrString(":9096")
 	}
+	if c.WebServerCertFilePath == nil {
+		c.WebServerCertFilePath = common.PtrString("")
+	}
+	if c.WebServerKeyFilePath == nil {
+		c.WebServerKeyFilePath = common.PtrString("")
+	}
+	if c.SchedulerName == nil {
+		c.SchedulerName = common.PtrString(ComponentName)
+	}
 	if c.ForcePodBindThreshold == nil {
 		c.ForcePodBindThreshold = common.PtrInt32(3)
 	}
 	if c.WaitingPodSchedulingBlockMilliSec == nil {
 		c.WaitingPodSchedulingBlockMilliSec = common.PtrInt64(0)
 	}
+	if c.PreemptionCostWeights == nil {
+		c.PreemptionCostWeights = &PreemptionCostWeights{}
+	}
+	if c.ReconcileIntervalSec == nil {
+		c.ReconcileIntervalSec = common.PtrInt64(60)
+	}
+	if c.ClusterAdminTokens == nil {
+		c.ClusterAdminTokens = &[]string{}
+	}
+	if c.ReservationFilePath == nil {
+		c.ReservationFilePath = common.PtrString("")
+	}
+	if c.LedgerFilePath == nil {
+		c.LedgerFilePath = common.PtrString("")
+	}
+	if c.LedgerMaxFileBytes == nil {
+		c.LedgerMaxFileBytes = common.PtrInt64(100 << 20)
+	}
+	if c.LedgerMaxBackups == nil {
+		c.LedgerMaxBackups = common.PtrInt32(10)
+	}
+	if c.DefragmentationIntervalSec == nil {
+		c.DefragmentationIntervalSec = common.PtrInt64(0)
+	}
+	if c.DefragmentationMaxEvictionsPerRound == nil {
+		c.DefragmentationMaxEvictionsPerRound = common.PtrInt32(1)
+	}
+	if c.DefragmentationMaxEvictionsPerHour == nil {
+		c.DefragmentationMaxEvictionsPerHour = common.PtrInt32(10)
+	}
+	if c.DefragmentationMinRuntimeSec == nil {
+		c.DefragmentationMinRuntimeSec = common.PtrInt64(600)
+	}
+	if c.DefragmentationAuditFilePath == nil {
+		c.DefragmentationAuditFilePath = common.PtrString("./defragmentation.jsonl")
+	}
+	if c.AuditLogFilePath == nil {
+		c.AuditLogFilePath = common.PtrString("")
+	}
+	if c.AuditLogMaxFileBytes == nil {
+		c.AuditLogMaxFileBytes = common.PtrInt64(100 << 20)
+	}
+	if c.AuditLogMaxBackups == nil {
+		c.AuditLogMaxBackups = common.PtrInt32(10)
+	}
+	if c.RecoveryDegradedModeEnable == nil {
+		c.RecoveryDegradedModeEnable = common.PtrBool(false)
+	}
 	if c.PhysicalCluster == nil {
 		c.PhysicalCluster = defaultPhysicalCluster()
 	}
@@ -108,6 +286,28 @@ func NewConfig(rawConfig *Config) *Config {
 	defaultingPhysicalCells(c.PhysicalCluster)
 	// Validation
 	// TODO: Validate VirtualClusters against PhysicalCluster
+	if (*c.WebServerCertFilePath == "") != (*c.WebServerKeyFilePath == "") {
+		panic("webServerCertFilePath and webServerKeyFilePath should be both specified or both empty")
+	}
+	if *c.LedgerMaxFileBytes <= 0 || *c.LedgerMaxBackups < 0 {
+		panic(fmt.Sprintf("invalid ledgerMaxFileBytes %v or ledgerMaxBackups %v",
+			*c.LedgerMaxFileBytes, *c.LedgerMaxBackups))
+	}
+	if *c.AuditLogMaxFileBytes <= 0 || *c.AuditLogMaxBackups < 0 {
+		panic(fmt.Sprintf("invalid auditLogMaxFileBytes %v or auditLogMaxBackups %v",
+			*c.AuditLogMaxFileBytes, *c.AuditLogMaxBackups))
+	}
+	if *c.DefragmentationMaxEvictionsPerRound < 0 || *c.DefragmentationMaxEvictionsPerHour < 0 {
+		panic(fmt.Sprintf("invalid defragmentationMaxEvictionsPerRound %v or defragmentationMaxEvictionsPerHour %v",
+			*c.DefragmentationMaxEvictionsPerRound, *c.DefragmentationMaxEvictionsPerHour))
+	}
+	for ct, spec := range c.PhysicalCluster.CellTypes {
+		for _, cpuSet := range spec.CpuSet {
+			if len(common.FromCpuSetString(cpuSet)) == 0 {
+				panic(fmt.Sprintf("cellType %v has empty cpuSet", ct))
+			}
+		}
+	}
 
 	return c
 }
@@ -36,6 +36,14 @@ const (
 	DefaultConfigFilePath = "./hivedscheduler.yaml"
 	UnlimitedValue        = -1
 
+	// The version of the Snapshot document, which should be changed once the
+	// document is changed incompatibly.
+	SnapshotVersion = "v1"
+
+	// The AffinityGroupSpec.AntiAffinity to place each Pod of the group on a
+	// distinct node, whatever the node-level cell type of the chain is.
+	AntiAffinityNode = "node"
+
 	// To leverage this scheduler, at least one container in the Pod should contain
 	// below resource limit with any positive int16 value.
 	ResourceNamePodSchedulingEnable = GroupName + "/pod-scheduling-enable"
@@ -59,13 +67,54 @@ const (
 	// 2. If multiple containers in the Pod contain the env, the allocated GPUs are
 	//    all visible to them, so it is these containers' freedom to control how
 	//    to share these GPUs.
+	// 3. For a leaf cell type declaring a non-GPU device, the isolation is delivered
+	//    through its CellTypeSpec.DeviceIsolationAnnotation and DeviceIsolationEnv
+	//    in the same way.
 	EnvNameNvidiaVisibleDevices  = "NVIDIA_VISIBLE_DEVICES"
 	AnnotationKeyPodGpuIsolation = GroupName + "/pod-gpu-isolation"
 
+	// The CPUs local to the GPUs allocated to the Pod, in Linux cpuset format, if the
+	// CellTypeSpec.CpuSet is specified for the cells of the GPUs. It can be referred
+	// by a container env in the same way as AnnotationKeyPodGpuIsolation:
+	//   fieldPath: metadata.annotations['hivedscheduler.microsoft.com/pod-cpu-isolation']
+	// The annotation will be populated by scheduler when bind the pod.
+	AnnotationKeyPodCpuIsolation = GroupName + "/pod-cpu-isolation"
+
+	// The NICs under the lowest common ancestor cell of the GPUs allocated to the Pod,
+	// separated by commas, if the CellTypeSpec.Nics is specified for the cells.
+	// It can be referred by a container env in the same way as the above annotations.
+	AnnotationKeyPodNicIsolation = GroupName + "/pod-nic-isolation"
+
+	// The GPU type selected for the Pod (see PodSchedulingSpec.GpuTypes), so that
+	// the job can adapt to it, such as to tune its batch size. It can be referred
+	// by a container env in the same way as AnnotationKeyPodGpuIsolation:
+	//   fieldPath: metadata.annotations['hivedscheduler.microsoft.com/pod-gpu-type']
+	// The annotation will be populated by scheduler when bind the pod.
+	AnnotationKeyPodGpuType = GroupName + "/pod-gpu-type"
+
+	// Optionally, the Pod can contain below annotation with a non-negative integer
+	// value to tell the scheduler how costly it is to preempt the Pod.
+	// The preemption cost of an AffinityGroup is the max of all its Pods, and it is
+	// weighted by PreemptionCostWeights.Annotation when selecting preemption victims.
+	AnnotationKeyPodPreemptionCost = GroupName + "/pod-preemption-cost"
+
+	// Optionally, the opportunistic Pod can contain below annotation with value
+	// "true" to opt in to the defragmentation (see DefragmentationIntervalSec),
+	// i.e., the scheduler may evict it, so that it is rescheduled more compactly.
+	// An AffinityGroup is evicted only if all its Pods opt in, so the Pods should
+	// be recreated by their controller after the eviction.
+	AnnotationKeyPodDefragmentationEnable = GroupName + "/pod-defragmentation-enable"
+
 	// Populated by this scheduler, used to track and recover allocated placement.
 	// It is in PodBindInfo YAML format.
 	AnnotationKeyPodBindInfo = GroupName + "/pod-bind-info"
 
+	// Default label of the Pod whose value is the user (or group) name, which the
+	// UserQuotaSpec of its VC is applied to.
+	LabelKeyUser = GroupName + "/user"
+	// The user name in UserQuotaSpec.Users applied to the users not specified.
+	DefaultUserName = "*"
+
 	// Priority Range of Guaranteed Pod.
 	MaxGuaranteedPriority = int32(1000)
 	MinGuaranteedPriority = int32(0)
@@ -91,10 +140,51 @@ const (
 	BindPath     = ExtenderPath + "/bind"
 	PreemptPath  = ExtenderPath + "/preempt"
 
+	// K8S Admission Webhook API: API with K8S ApiServer
+	// Notes:
+	// 1. K8S ApiServer only calls the webhooks in HTTPS, see
+	//    Config.WebServerCertFilePath.
+	AdmissionPath = VersionPath + "/admission"
+	// ValidatingAdmissionWebhook for the Pods: reject the Pod creation if its
+	// PodSchedulingSpec is invalid.
+	ValidatePodPath = AdmissionPath + "/validate"
+	// MutatingAdmissionWebhook for the Pods: inject the plumbing to be scheduled
+	// by this scheduler into the Pod with PodSchedulingSpec, see MutatePod.
+	MutatePodPath = AdmissionPath + "/mutate"
+
 	// Scheduler Inspect API: API to inspect current scheduling status
 	// Notes:
 	// 1. Both Binding and Bound AffinityGroups/Pods are considered as Allocated.
 	InspectPath = VersionPath + "/inspect"
 	// Inspect current allocated AffinityGroup(s)
 	AffinityGroupsPath = InspectPath + "/affinitygroups/"
+	// Update the priority of an allocated AffinityGroup by
+	// PUT AffinityGroupsPath + {name} + AffinityGroupPrioritySubPath
+	AffinityGroupPrioritySubPath = "/priority"
+	// Inspect current Reservation(s), and create (POST), move (PUT + {name})
+	// or delete (DELETE + {name}) a Reservation at runtime
+	ReservationsPath = InspectPath + "/reservations/"
+	// Inspect current CellCordon(s), and cordon (POST) or uncordon
+	// (DELETE + {name}) a physical cell at runtime
+	CellCordonsPath = InspectPath + "/cordons/"
+	// Inspect the TimeWindowSchedule(s) of the cells with time windows, of all
+	// VCs or of a VC (GET + {vc})
+	TimeWindowsPath = InspectPath + "/timewindows/"
+	// Inspect the VirtualCluster(s) and their hierarchy
+	VirtualClustersPath = InspectPath + "/virtualclusters/"
+	// Inspect the GpuHours aggregated from the ledger, optionally in the time
+	// range [startTime, endTime) (in RFC3339 format, default to the whole ledger
+	// until now) and of a VC or a user, by GET + ?startTime=&endTime=&vc=&user=
+	GpuHoursPath = InspectPath + "/gpuhours"
+	// Inspect the Capacity that can be scheduled immediately in each VC, and the
+	// fragmentation of each physical cell chain, by GET + ?priority= (the priority
+	// of the dry run preempting others, default to MinGuaranteedPriority).
+	// Only the cluster admins are permitted, since the dry runs block the scheduling.
+	CapacityPath = InspectPath + "/capacity"
+	// Inspect the Snapshot of the whole scheduling state, which can be loaded
+	// offline to rebuild the scheduling algorithm for debugging
+	SnapshotPath = InspectPath + "/snapshot"
+	// Inspect the RecoveryReport of the bound Pods inconsistent with the config
+	// or with each other when they were recovered, and whether they are quarantined
+	RecoveryPath = InspectPath + "/recovery"
 )
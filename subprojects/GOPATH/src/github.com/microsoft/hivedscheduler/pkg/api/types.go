@@ -24,7 +24,9 @@ package api
 
 import (
 	"fmt"
+	core "k8s.io/api/core/v1"
 	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
 )
 
 ///////////////////////////////////////////////////////////////////////////////////////
@@ -46,6 +48,26 @@ type CellTypeSpec struct {
 	ChildCellType   CellType `yaml:"childCellType"`
 	ChildCellNumber int32    `yaml:"childCellNumber"`
 	IsNodeLevel     bool     `yaml:"isNodeLevel"`
+	// Below fields only apply to a leaf cell type (i.e., without ChildCellType),
+	// to declare the device of the leaf cells. By default, the device is a GPU.
+	// The resource name of the device, such as xilinx.com/fpga. The devices are
+	// allocated by the Scheduler, so a Pod requesting the resource is rejected.
+	DeviceResourceName string `yaml:"deviceResourceName"`
+	// The annotation populated with the indices of the devices allocated to the
+	// Pod when it is bound. Default is AnnotationKeyPodGpuIsolation.
+	DeviceIsolationAnnotation string `yaml:"deviceIsolationAnnotation"`
+	// The env through which the device runtime receives the isolation, such as
+	// XILINX_VISIBLE_DEVICES. The Pod should populate it from the isolation
+	// annotation. Default is EnvNameNvidiaVisibleDevices.
+	DeviceIsolationEnv string `yaml:"deviceIsolationEnv"`
+	// Optional CPUs local to the cells of this type, in Linux cpuset format, such
+	// as 0-23. If multiple items are given, the i-th item is for the cells which
+	// are the i-th child of their parents, e.g. [0-23, 24-47] for 2 sockets.
+	CpuSet []string `yaml:"cpuSet"`
+	// Optional names of the NICs (e.g. InfiniBand HCAs) attached to the cells of
+	// this type, separated by commas. Multiple items are for the cells in the same
+	// way as CpuSet, e.g. [mlx5_0, mlx5_1] for 2 PCIe switches.
+	Nics []string `yaml:"nics"`
 }
 
 // Specify physical Cell instances.
@@ -62,36 +84,128 @@ type VirtualClusterName string
 type VirtualClusterSpec struct {
 	VirtualCells  []VirtualCellSpec  `yaml:"virtualCells"`
 	ReservedCells []ReservedCellSpec `yaml:"reservedCells,omitempty"`
+	// Optional parent VC of this VC. The VirtualCells (without time windows) of
+	// a child VC are carved out of the VirtualCells (without time windows) of
+	// its parent, so the parent only keeps the rest of them. The ReservedCells
+	// are not carved.
+	// A child VC can borrow the idle quota of its sibling VCs (the children of
+	// the same parent) when its own quota is insufficient, and the borrowing
+	// AffinityGroups are lazy preempted when the sibling needs the quota back.
+	Parent VirtualClusterName `yaml:"parent,omitempty"`
+	// Bearer tokens of the VC admins, who are permitted to modify the
+	// AffinityGroups in this VC through the Scheduler Inspect API.
+	AdminTokens []string `yaml:"adminTokens,omitempty"`
+	// Optional CPU and memory quota (in K8s quantity format, e.g. "16" and "64Gi")
+	// shared by the guaranteed Pods requesting zero GPU in this VC.
+	// Empty means unlimited.
+	CpuQuota    string `yaml:"cpuQuota,omitempty"`
+	MemoryQuota string `yaml:"memoryQuota,omitempty"`
+	// Optional GPU quota of each user (or group) in this VC, so that a single
+	// user cannot use up the VC quota. Nil means unlimited.
+	UserQuota *UserQuotaSpec `yaml:"userQuota,omitempty"`
+}
+
+type UserQuotaSpec struct {
+	// Label of the Pod whose value is the user name. Default is LabelKeyUser.
+	// A Pod without the label is of the user "".
+	LabelKey string `yaml:"labelKey,omitempty"`
+	// GPU limits of each user name. The user not found uses the limits of
+	// DefaultUserName if specified, otherwise it is unlimited.
+	Users map[string][]PriorityGpuLimitSpec `yaml:"users"`
+	// If true, a guaranteed AffinityGroup exceeding the quota is scheduled as
+	// opportunistic, otherwise it waits until the quota is enough.
+	DowngradeToOpportunistic bool `yaml:"downgradeToOpportunistic,omitempty"`
+}
+
+// The guaranteed AffinityGroups of a user with priority in [MinPriority,
+// MaxPriority] can use at most GpuNumber GPUs in total.
+type PriorityGpuLimitSpec struct {
+	MinPriority int32 `yaml:"minPriority"`
+	MaxPriority int32 `yaml:"maxPriority"`
+	GpuNumber   int32 `yaml:"gpuNumber"`
 }
 
 type VirtualCellSpec struct {
 	CellNumber int32    `yaml:"cellNumber"`
 	CellType   CellType `yaml:"cellType"`
+	// Optional time windows in which the cells are in the VC. Empty means the
+	// cells are always in the VC.
+	TimeWindows []TimeWindowSpec `yaml:"timeWindows,omitempty"`
 }
 
 type ReservedCellSpec struct {
 	ReservationId ReservationId `yaml:"reservationId"`
+	// Optional time windows in which the reserved cell is in the VC. Empty means
+	// the cell is always in the VC.
+	TimeWindows []TimeWindowSpec `yaml:"timeWindows,omitempty"`
+}
+
+// A time window is specified either by Start and End (in RFC3339 format, such
+// as 2020-06-01T08:00:00Z), or by a Cron expression (minute, hour, day of
+// month, month and day of week, such as "0 20 * * 1-5" for 20:00 on weekdays,
+// in UTC so that the windows are not shifted by the daylight saving time) with
+// the DurationMinutes it lasts. Like cron, if both day of month and day of week
+// are restricted, a day matching either of them matches.
+// When the last window of a cell closes, the AffinityGroups using the cell are
+// lazy preempted from the VC, and the cell is released to the VCs whose
+// windows open. When a window opens, the cell is added back to the VC only if
+// the free cells are sufficient for it, otherwise it is pending until they are.
+type TimeWindowSpec struct {
+	Start           string `yaml:"start,omitempty"`
+	End             string `yaml:"end,omitempty"`
+	Cron            string `yaml:"cron,omitempty"`
+	DurationMinutes int32  `yaml:"durationMinutes,omitempty"`
 }
 
 type PodSchedulingSpec struct {
-	VirtualCluster       VirtualClusterName `yaml:"virtualCluster"`
-	Priority             int32              `yaml:"priority"`
-	ReservationId        ReservationId      `yaml:"reservationId"`
-	GpuType              string             `yaml:"gpuType"`
-	GpuNumber            int32              `yaml:"gpuNumber"`
-	GangReleaseEnable    bool               `yaml:"gangReleaseEnable"`
-	LazyPreemptionEnable bool               `yaml:"lazyPreemptionEnable"`
-	AffinityGroup        *AffinityGroupSpec `yaml:"affinityGroup"`
+	VirtualCluster VirtualClusterName `yaml:"virtualCluster"`
+	Priority       int32              `yaml:"priority"`
+	ReservationId  ReservationId      `yaml:"reservationId"`
+	// Deprecated: equivalent to GpuTypes with a single item.
+	GpuType string `yaml:"gpuType"`
+	// The GPU types acceptable by the Pod, ordered by preference. The most
+	// preferred GPU type is tried first. Empty means any GPU type is acceptable.
+	GpuTypes []string `yaml:"gpuTypes"`
+	// How long the Pod waits for the most preferred GPU type (counted from the
+	// Pod creation) before falling back to the less preferred ones.
+	// 0 means falling back right away, UnlimitedValue means never falling back.
+	GpuTypeFallbackWaitSec int64 `yaml:"gpuTypeFallbackWaitSec"`
+	GpuNumber              int32 `yaml:"gpuNumber"`
+	GangReleaseEnable      bool  `yaml:"gangReleaseEnable"`
+	LazyPreemptionEnable   bool  `yaml:"lazyPreemptionEnable"`
+	// Only for opportunistic Pods: if enabled, the whole AffinityGroup will be
+	// upgraded to the UpgradePriority inside its VC, once its VC has enough
+	// free quota to hold the AffinityGroup at its current placement.
+	UpgradeEnable bool `yaml:"upgradeEnable"`
+	// The guaranteed priority which the AffinityGroup is upgraded to, i.e., the
+	// MinGuaranteedPriority by default.
+	UpgradePriority int32              `yaml:"upgradePriority"`
+	AffinityGroup   *AffinityGroupSpec `yaml:"affinityGroup"`
 }
 
 type AffinityGroupSpec struct {
 	Name    string                    `yaml:"name"`
 	Members []AffinityGroupMemberSpec `yaml:"members"`
+	// The cell type that the whole group must fit under, i.e., all the Pods of
+	// the group are placed within one cell of this type (e.g., a rack).
+	MaxCellType CellType `yaml:"maxCellType"`
+	// Same as MaxCellType, but given by the cell level (1 for the leaf cells),
+	// so that it applies to any chain. Cannot be specified with MaxCellType.
+	MaxCellLevel int32 `yaml:"maxCellLevel"`
+	// If not empty, the Pods of the group are spread: each Pod is placed within
+	// a distinct cell of this cell type, which should not be lower than the
+	// node level. AntiAffinityNode means each Pod is placed on a distinct node.
+	AntiAffinity string `yaml:"antiAffinity"`
 }
 
 type AffinityGroupMemberSpec struct {
 	PodNumber int32 `yaml:"podNumber"`
 	GpuNumber int32 `yaml:"gpuNumber"`
+	// The GPU type of the member, so that the members of a group can use different
+	// GPU types. If specified, it must be specified for all the members. A Pod of
+	// the group specifies the GpuType of its member if the members with its
+	// GpuNumber have different GpuTypes.
+	GpuType string `yaml:"gpuType"`
 }
 
 // Used to recover scheduler allocated resource
@@ -99,11 +213,26 @@ type PodBindInfo struct {
 	Node                  string                        `yaml:"node"`         // node to bind
 	GpuIsolation          []int32                       `yaml:"gpuIsolation"` // GPUs to bind
 	CellChain             string                        `yaml:"cellChain"`    // cell chain selected
+	GpuType               string                        `yaml:"gpuType"`      // GPU type selected
 	AffinityGroupBindInfo []AffinityGroupMemberBindInfo `yaml:"affinityGroupBindInfo"`
+	// Device declared by the leaf cell type selected, empty means GPU.
+	DeviceIsolationAnnotation string `yaml:"deviceIsolationAnnotation,omitempty"`
+	CpuIsolation              string `yaml:"cpuIsolation,omitempty"` // CPUs local to the GPUs to bind
+	NicIsolation              string `yaml:"nicIsolation,omitempty"` // NICs local to the GPUs to bind
+	// The guaranteed AffinityGroup is downgraded to opportunistic as it exceeds
+	// its user quota, so it is recovered as opportunistic.
+	Downgraded bool `yaml:"downgraded,omitempty"`
+	// The sibling VC whose idle quota is borrowed by the AffinityGroup.
+	LenderVirtualCluster VirtualClusterName `yaml:"lenderVirtualCluster,omitempty"`
+	// The priority of the AffinityGroup changed at runtime, i.e., upgraded from
+	// opportunistic or updated by the API, so it is recovered with this priority
+	// instead of the one in its PodSchedulingSpec.
+	AffinityGroupPriority *int32 `yaml:"affinityGroupPriority,omitempty"`
 }
 
 type AffinityGroupMemberBindInfo struct {
 	PodPlacements []PodPlacementInfo `yaml:"podPlacements"`
+	CellChain     string             `yaml:"cellChain"` // cell chain selected for the member
 }
 
 type PodPlacementInfo struct {
@@ -112,6 +241,9 @@ type PodPlacementInfo struct {
 	// preassigned cell types used by the pods. used to locate the virtual cells
 	// when adding an allocated pod
 	PreassignedCellTypes []CellType `yaml:"preassignedCellTypes"`
+	// cell chain of the pod if it is different from that of its member, i.e.,
+	// members with the same GPU number use different GPU types
+	CellChain string `yaml:"cellChain,omitempty"`
 }
 
 type WebServerPaths struct {
@@ -134,6 +266,33 @@ func (err *WebServerError) Error() string {
 	return fmt.Sprintf("Code: %v, Message: %v", err.Code, err.Message)
 }
 
+// K8S Admission Webhook Objects: Align with the AdmissionReview of K8S
+// admission.k8s.io/v1beta1 and v1, only with the fields used by the Scheduler.
+type AdmissionReview struct {
+	APIVersion string             `json:"apiVersion,omitempty"`
+	Kind       string             `json:"kind,omitempty"`
+	Request    *AdmissionRequest  `json:"request,omitempty"`
+	Response   *AdmissionResponse `json:"response,omitempty"`
+}
+
+type AdmissionRequest struct {
+	UID       types.UID `json:"uid"`
+	Operation string    `json:"operation"`
+	Namespace string    `json:"namespace,omitempty"`
+	Name      string    `json:"name,omitempty"`
+	// Only Pod objects are admitted by the Scheduler.
+	Object *core.Pod `json:"object,omitempty"`
+}
+
+type AdmissionResponse struct {
+	UID     types.UID    `json:"uid"`
+	Allowed bool         `json:"allowed"`
+	Result  *meta.Status `json:"status,omitempty"`
+	// The JSONPatch to mutate the object, only for a MutatingAdmissionWebhook.
+	Patch     []byte  `json:"patch,omitempty"`
+	PatchType *string `json:"patchType,omitempty"`
+}
+
 // WebServer Exposed Objects: Align with K8S Objects
 type ObjectMeta struct {
 	Name string `json:"name"`
@@ -149,7 +308,228 @@ type AffinityGroup struct {
 }
 
 type AffinityGroupStatus struct {
+	VirtualCluster       VirtualClusterName    `json:"virtualCluster"`
+	Priority             int32                 `json:"priority"`
 	LazyPreemptionStatus *LazyPreemptionStatus `json:"lazyPreemptionStatus"`
+	PreemptionStatus     *PreemptionStatus     `json:"preemptionStatus"`
+	// The sibling VC whose idle quota is borrowed by the AffinityGroup.
+	LenderVirtualCluster VirtualClusterName `json:"lenderVirtualCluster,omitempty"`
+}
+
+// Request body to update the priority of an allocated AffinityGroup.
+type AffinityGroupPriority struct {
+	Priority int32 `json:"priority"`
+}
+
+type ReservationList struct {
+	Items []Reservation `json:"items"`
+}
+
+// The Name of a Reservation is its ReservationId.
+type Reservation struct {
+	ObjectMeta `json:"metadata"`
+	Spec       ReservationSpec `json:"spec"`
+}
+
+type ReservationSpec struct {
+	VirtualCluster VirtualClusterName `json:"virtualCluster"`
+	CellType       CellType           `json:"cellType"`
+	// The physical cell to reserve, specified by its nodes and its GPU indices
+	// (only for a cell lower than node level).
+	// Empty Nodes means any free physical cell of the CellType.
+	Nodes      []string `json:"nodes,omitempty"`
+	GpuIndices []int32  `json:"gpuIndices,omitempty"`
+}
+
+type CellCordonList struct {
+	Items []CellCordon `json:"items"`
+}
+
+// The Name of a CellCordon is given by the cluster admin to refer to it.
+type CellCordon struct {
+	ObjectMeta `json:"metadata"`
+	Spec       CellCordonSpec   `json:"spec"`
+	Status     CellCordonStatus `json:"status"`
+}
+
+type CellCordonSpec struct {
+	// The physical cell to cordon, specified by a node name in Nodes (to cordon
+	// the node), or by its CellType and its nodes (and its GPU indices, only for
+	// a cell lower than node level).
+	// No new AffinityGroup will be placed in a cordoned cell.
+	CellType   CellType `json:"cellType,omitempty"`
+	Nodes      []string `json:"nodes,omitempty"`
+	GpuIndices []int32  `json:"gpuIndices,omitempty"`
+	// Whether to also drain the cell, i.e. move the VC bindings in the cell
+	// elsewhere once they become idle.
+	Drain bool `json:"drain"`
+}
+
+type CellCordonStatus struct {
+	// Names of the cordoned physical cells (a node with multiple GPU types has
+	// a cell in each of the corresponding cell chains).
+	Cells []string `json:"cells"`
+	// The cell is drained if it is not bound to any VC and not used by any
+	// AffinityGroup.
+	Drained bool `json:"drained"`
+	// The running AffinityGroups which block the drain.
+	BlockingAffinityGroups []string `json:"blockingAffinityGroups"`
+	// The idle Reservations in the cell which cannot be moved elsewhere, due to
+	// insufficient free cells.
+	BlockingReservations []string `json:"blockingReservations"`
+}
+
+type TimeWindowScheduleList struct {
+	Items []TimeWindowSchedule `json:"items"`
+}
+
+// The time window schedule of a cell with time windows in a VC.
+type TimeWindowSchedule struct {
+	VirtualCluster VirtualClusterName `json:"virtualCluster"`
+	CellType       CellType           `json:"cellType"`
+	// Name of the (top level) virtual cell.
+	Cell          string          `json:"cell"`
+	ReservationId ReservationId   `json:"reservationId,omitempty"`
+	State         TimeWindowState `json:"state"`
+	// The next time when the cell enters or leaves the VC, empty if the windows
+	// will never open or close again.
+	NextOpenTime  *meta.Time `json:"nextOpenTime,omitempty"`
+	NextCloseTime *meta.Time `json:"nextCloseTime,omitempty"`
+}
+
+type TimeWindowState string
+
+const (
+	// The cell is in the VC.
+	TimeWindowActive TimeWindowState = "Active"
+	// A window of the cell is open, but the cell is not in the VC yet, since the
+	// free cells are insufficient (e.g. a cell of another VC whose window has
+	// closed is still in use).
+	TimeWindowPending TimeWindowState = "Pending"
+	// All the windows of the cell are closed.
+	TimeWindowInactive TimeWindowState = "Inactive"
+)
+
+type VirtualClusterList struct {
+	Items []VirtualCluster `json:"items"`
+}
+
+type VirtualCluster struct {
+	Name     VirtualClusterName   `json:"name"`
+	Parent   VirtualClusterName   `json:"parent,omitempty"`
+	Children []VirtualClusterName `json:"children,omitempty"`
+	// The preassigned virtual cells of the VC, i.e., the VirtualCells left after
+	// its children carved out theirs, and the ReservedCells.
+	Cells []VirtualClusterCell `json:"cells"`
+	// The AffinityGroups of the sibling VCs which borrow the idle quota of the VC.
+	LentAffinityGroups []string `json:"lentAffinityGroups,omitempty"`
+}
+
+type VirtualClusterCell struct {
+	CellChain     string        `json:"cellChain"`
+	CellType      CellType      `json:"cellType"`
+	ReservationId ReservationId `json:"reservationId,omitempty"`
+	CellNumber    int32         `json:"cellNumber"`
+}
+
+// A record of the GPUs held by an AffinityGroup, appended to the ledger whenever
+// they change.
+type LedgerRecord struct {
+	Time           meta.Time          `json:"time"`
+	Event          LedgerEvent        `json:"event"`
+	AffinityGroup  string             `json:"affinityGroup"`
+	VirtualCluster VirtualClusterName `json:"virtualCluster"`
+	User           string             `json:"user,omitempty"`
+	Guaranteed     bool               `json:"guaranteed"`
+	// GPU type -> number of the GPUs held by the AffinityGroup since the Time.
+	GpuNumbers map[string]int32 `json:"gpuNumbers,omitempty"`
+}
+
+type LedgerEvent string
+
+const (
+	// The AffinityGroup holds the GPUs in the record, in place of the ones in
+	// its previous record.
+	LedgerAllocate LedgerEvent = "Allocate"
+	// The AffinityGroup releases all its GPUs.
+	LedgerRelease LedgerEvent = "Release"
+	// The AffinityGroup still holds the GPUs in its last allocation record, which
+	// is copied to the new ledger file when the ledger is rotated (with the Time
+	// of the original record).
+	LedgerCheckpoint LedgerEvent = "Checkpoint"
+)
+
+type GpuHoursList struct {
+	StartTime meta.Time  `json:"startTime"`
+	EndTime   meta.Time  `json:"endTime"`
+	Items     []GpuHours `json:"items"`
+}
+
+// The GPU-hours used in the time range, aggregated by VC, user, GPU type and
+// whether the AffinityGroups are guaranteed or opportunistic.
+type GpuHours struct {
+	VirtualCluster VirtualClusterName `json:"virtualCluster"`
+	User           string             `json:"user"`
+	GpuType        string             `json:"gpuType"`
+	Guaranteed     bool               `json:"guaranteed"`
+	GpuHours       float64            `json:"gpuHours"`
+}
+
+type Capacity struct {
+	// The priority of the dry run scheduling with preemption.
+	Priority        int32                    `json:"priority"`
+	VirtualClusters []VirtualClusterCapacity `json:"virtualClusters"`
+	Chains          []ChainFragmentation     `json:"chains"`
+}
+
+// The largest pod and AffinityGroup of a GPU type that can be scheduled
+// immediately in a VC (dry run in the current scheduling state, without
+// using the Reservations or the quota lent by the sibling VCs).
+type VirtualClusterCapacity struct {
+	VirtualCluster    VirtualClusterName `json:"virtualCluster"`
+	GpuType           string             `json:"gpuType"`
+	WithoutPreemption PlaceableCapacity  `json:"withoutPreemption"`
+	WithPreemption    PlaceableCapacity  `json:"withPreemption"`
+}
+
+type PlaceableCapacity struct {
+	// The GpuNumber of the largest single pod, 0 if no pod can be scheduled.
+	MaxPodGpuNumber int32 `json:"maxPodGpuNumber"`
+	// The AffinityGroup of identical pods with the most GPUs in total (PodNumber
+	// pods x GpuNumber GPUs), preferring the larger pods on ties.
+	MaxAffinityGroupPodNumber int32 `json:"maxAffinityGroupPodNumber"`
+	MaxAffinityGroupGpuNumber int32 `json:"maxAffinityGroupGpuNumber"`
+}
+
+// The fragmentation of the free cells (not used by any VC) of a physical cell
+// chain, i.e., the cells that buddy alloc can allocate to the VCs.
+type ChainFragmentation struct {
+	CellChain            string `json:"cellChain"`
+	FreeGpuNumber        int32  `json:"freeGpuNumber"`
+	MaxFreeCellGpuNumber int32  `json:"maxFreeCellGpuNumber"`
+	// 1 - MaxFreeCellGpuNumber / FreeGpuNumber (0 if no free GPU), i.e., 0 if
+	// all the free GPUs are in one free cell, and closer to 1 if they are
+	// scattered in more smaller cells.
+	FragmentationIndex float64 `json:"fragmentationIndex"`
+}
+
+// A move of an opportunistic AffinityGroup by the defragmentation: its Pods are
+// evicted, so that they are rescheduled more compactly.
+type DefragmentationMove struct {
+	Time           meta.Time          `json:"time"`
+	AffinityGroup  string             `json:"affinityGroup"`
+	VirtualCluster VirtualClusterName `json:"virtualCluster"`
+	// The Pods to evict, in namespace/name format.
+	Pods []string `json:"pods"`
+	// The nodes where the AffinityGroup is placed, and the nodes where it is
+	// expected to be rescheduled.
+	FromNodes []string `json:"fromNodes"`
+	ToNodes   []string `json:"toNodes"`
+	// The number of nodes expected to be freed by the move.
+	FreedNodeNumber int32 `json:"freedNodeNumber"`
+	// The errors of the Pod evictions, such as being blocked by a
+	// PodDisruptionBudget.
+	EvictionErrors []string `json:"evictionErrors,omitempty"`
 }
 
 type LazyPreemptionStatus struct {
@@ -158,3 +538,118 @@ type LazyPreemptionStatus struct {
 	// It was lazy preempted at PreemptionTime.
 	PreemptionTime meta.Time `json:"preemptionTime"`
 }
+
+type PreemptionStatus struct {
+	// The AffinityGroups selected to be preempted by it.
+	Victims []string `json:"victims"`
+	// The cost of preempting the Victims, see PreemptionCostWeights.
+	Cost float64 `json:"cost"`
+	// The Victims were selected at PreemptionTime.
+	PreemptionTime meta.Time `json:"preemptionTime"`
+}
+
+// A Snapshot of the whole scheduling state, which can be loaded offline by
+// algorithm.LoadSnapshot to rebuild the scheduling algorithm for debugging.
+type Snapshot struct {
+	// The SnapshotVersion of the document.
+	Version string    `json:"version"`
+	Time    meta.Time `json:"time"`
+	// The Config of the Scheduler in YAML format, without the admin tokens.
+	Config string `json:"config"`
+	// The physical cell trees of all the cell chains.
+	PhysicalCells []CellSnapshot `json:"physicalCells"`
+	// The virtual cell trees of each VC, i.e., its preassigned cells and the
+	// top cells of its Reservations.
+	VirtualCells map[VirtualClusterName][]CellSnapshot `json:"virtualCells"`
+	// The free physical cells of each cell chain at each level, i.e., the cells
+	// that buddy alloc can allocate to the VCs.
+	FreeCells map[string]map[int32][]string `json:"freeCells"`
+	// The allocated AffinityGroups, and the ones preempting others but not
+	// allocated yet.
+	AffinityGroups           []AffinityGroupSnapshot `json:"affinityGroups"`
+	PreemptingAffinityGroups []AffinityGroup         `json:"preemptingAffinityGroups"`
+	Reservations             []Reservation           `json:"reservations"`
+	CellCordons              []CellCordon            `json:"cellCordons"`
+	// The PodScheduleStatuses tracked by the Scheduler, of all the live Pods.
+	PodScheduleStatuses []PodScheduleStatusSnapshot `json:"podScheduleStatuses"`
+}
+
+type CellSnapshot struct {
+	Name      string   `json:"name"`
+	CellType  CellType `json:"cellType"`
+	CellChain string   `json:"cellChain"`
+	Level     int32    `json:"level"`
+	Priority  int32    `json:"priority"`
+	// The virtual cell bound to the physical cell, or the physical cell bound
+	// to the virtual cell.
+	BoundCell      string             `json:"boundCell,omitempty"`
+	VirtualCluster VirtualClusterName `json:"virtualCluster,omitempty"`
+	ReservationId  ReservationId      `json:"reservationId,omitempty"`
+	// Only for a physical cell.
+	Reserved bool `json:"reserved,omitempty"`
+	Cordoned bool `json:"cordoned,omitempty"`
+	// Only for a preassigned virtual cell: whether it is out of its VC, e.g.,
+	// its time windows are closed.
+	Inactive bool `json:"inactive,omitempty"`
+	// The number of GPUs in the cell used at each priority.
+	UsedGpuNumbers map[int32]int32 `json:"usedGpuNumbers,omitempty"`
+	// Only for a physical GPU: the AffinityGroup using it.
+	AffinityGroup string         `json:"affinityGroup,omitempty"`
+	Children      []CellSnapshot `json:"children,omitempty"`
+}
+
+type AffinityGroupSnapshot struct {
+	AffinityGroup
+	// The user of the AffinityGroup in its VC, whose quota the group uses.
+	User string `json:"user,omitempty"`
+	// The allocated Pods of the AffinityGroup with their PodBindInfo, from which
+	// the AffinityGroup is recovered as if the Scheduler restarted.
+	Pods []*core.Pod `json:"pods"`
+}
+
+type PodScheduleStatusSnapshot struct {
+	// The Pod in namespace/name format.
+	Pod             string    `json:"pod"`
+	UID             types.UID `json:"uid"`
+	PodState        string    `json:"podState"`
+	Node            string    `json:"node,omitempty"`
+	PodBindAttempts int32     `json:"podBindAttempts"`
+}
+
+type RecoveryInconsistencyKind string
+
+const (
+	// A cell of the Pod placement no longer exists in the physical cluster.
+	RecoveryMissingCell RecoveryInconsistencyKind = "MissingCell"
+	// The VC has not enough cells left for the guaranteed AffinityGroup.
+	RecoveryVcOverAllocation RecoveryInconsistencyKind = "VcOverAllocation"
+	// A GPU of the Pod placement is used by another AffinityGroup.
+	RecoveryConflictingGroups RecoveryInconsistencyKind = "ConflictingGroups"
+	// The PodBindInfo does not match the PodSchedulingSpec or the AffinityGroup.
+	RecoveryInvalidPlacement RecoveryInconsistencyKind = "InvalidPlacement"
+)
+
+// A RecoveryReport of the bound Pods inconsistent with the config or with each
+// other when they were recovered, e.g., after a config change.
+type RecoveryReport struct {
+	DegradedModeEnable bool           `json:"degradedModeEnable"`
+	Pods               []RecoveredPod `json:"pods"`
+}
+
+type RecoveredPod struct {
+	// The Pod in namespace/name format.
+	Pod            string             `json:"pod"`
+	UID            types.UID          `json:"uid"`
+	Node           string             `json:"node"`
+	AffinityGroup  string             `json:"affinityGroup"`
+	VirtualCluster VirtualClusterName `json:"virtualCluster"`
+	// Whether the Pod is tracked without its resources accounted (in degraded
+	// mode), or is recovered as far as possible.
+	Quarantined     bool                    `json:"quarantined"`
+	Inconsistencies []RecoveryInconsistency `json:"inconsistencies"`
+}
+
+type RecoveryInconsistency struct {
+	Kind    RecoveryInconsistencyKind `json:"kind"`
+	Message string                    `json:"message"`
+}
@@ -223,6 +223,50 @@ func ToIndicesString(indices []int32) string {
 	return indicesStr
 }
 
+// FromCpuSetString parses a Linux cpuset string, such as "0-3,8,10-11", to CPU indices.
+func FromCpuSetString(cpuSet string) []int32 {
+	cpus := []int32{}
+	if cpuSet == "" {
+		return cpus
+	}
+	for _, r := range strings.Split(cpuSet, ",") {
+		bounds := strings.Split(strings.TrimSpace(r), "-")
+		if len(bounds) > 2 {
+			panic(fmt.Sprintf("invalid cpuset: %v", cpuSet))
+		}
+		first := StringToInt32(bounds[0])
+		last := StringToInt32(bounds[len(bounds)-1])
+		if first < 0 || first > last {
+			panic(fmt.Sprintf("invalid cpuset: %v", cpuSet))
+		}
+		for i := first; i <= last; i++ {
+			cpus = append(cpus, i)
+		}
+	}
+	return cpus
+}
+
+// ToCpuSetString formats CPU indices to a Linux cpuset string, merging the consecutive indices into ranges.
+func ToCpuSetString(cpus []int32) string {
+	sorted := make([]int32, len(cpus))
+	copy(sorted, cpus)
+	SortInt32(sorted)
+	ranges := []string{}
+	for i := 0; i < len(sorted); {
+		j := i
+		for j+1 < len(sorted) && sorted[j+1] <= sorted[j]+1 {
+			j++
+		}
+		if sorted[i] == sorted[j] {
+			ranges = append(ranges, fmt.Sprint(sorted[i]))
+		} else {
+			ranges = append(ranges, fmt.Sprintf("%v-%v", sorted[i], sorted[j]))
+		}
+		i = j + 1
+	}
+	return strings.Join(ranges, ",")
+}
+
 func StringsContains(s []string, e string) bool {
 	for _, te := range s {
 		if te == e {
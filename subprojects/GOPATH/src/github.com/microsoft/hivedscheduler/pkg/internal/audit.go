@@ -0,0 +1,265 @@
+// MIT License
+//
+// Copyright (c) Microsoft Corporation. All rights reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE
+
+package internal
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/microsoft/hivedscheduler/pkg/common"
+	core "k8s.io/api/core/v1"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AuditCall is a SchedulerAlgorithm call recorded in the audit log.
+type AuditCall string
+
+const (
+	// The first record of a Scheduler run in the audit log, with the seed of the
+	// random decisions and the hash of the config.
+	AuditInit                        AuditCall = "Init"
+	AuditSchedule                    AuditCall = "Schedule"
+	AuditAddAllocatedPod             AuditCall = "AddAllocatedPod"
+	AuditDeleteAllocatedPod          AuditCall = "DeleteAllocatedPod"
+	AuditDeleteUnallocatedPod        AuditCall = "DeleteUnallocatedPod"
+	AuditReconcile                   AuditCall = "Reconcile"
+	AuditDefragment                  AuditCall = "Defragment"
+	AuditUpdateAffinityGroupPriority AuditCall = "UpdateAffinityGroupPriority"
+	AuditCreateReservation           AuditCall = "CreateReservation"
+	AuditMoveReservation             AuditCall = "MoveReservation"
+	AuditDeleteReservation           AuditCall = "DeleteReservation"
+	AuditCreateCellCordon            AuditCall = "CreateCellCordon"
+	AuditDeleteCellCordon            AuditCall = "DeleteCellCordon"
+)
+
+// AuditRecord is a call changing the scheduling state, with its arguments and its
+// result (or the panic of the call), so that the calls can be replayed in order.
+type AuditRecord struct {
+	Time   time.Time         `json:"time"`
+	Call   AuditCall         `json:"call"`
+	Args   []json.RawMessage `json:"args,omitempty"`
+	Result json.RawMessage   `json:"result,omitempty"`
+	Error  string            `json:"error,omitempty"`
+}
+
+// NewAuditRecord records the arguments of a call, keeping only the fields of the Pods
+// used by the scheduling.
+func NewAuditRecord(t time.Time, call AuditCall, args ...interface{}) AuditRecord {
+	r := AuditRecord{Time: t, Call: call}
+	for _, arg := range args {
+		r.Args = append(r.Args, common.ToJsonBytes(compactAuditObject(arg)))
+	}
+	return r
+}
+
+// NewAuditResult records the result of a call in the same way as the arguments,
+// so that the results of a replayed call can be compared with the recorded ones.
+func NewAuditResult(result interface{}) json.RawMessage {
+	return common.ToJsonBytes(compactAuditObject(result))
+}
+
+func compactAuditObject(obj interface{}) interface{} {
+	switch o := obj.(type) {
+	case *core.Pod:
+		return CompactPod(o)
+	case *PodScheduleResult:
+		return compactAuditObject(*o)
+	case PodScheduleResult:
+		if o.PodPreemptInfo != nil {
+			victims := make([]*core.Pod, len(o.PodPreemptInfo.VictimPods))
+			for i, v := range o.PodPreemptInfo.VictimPods {
+				victims[i] = CompactPod(v)
+			}
+			// the victims are collected from a set
+			sort.Slice(victims, func(i, j int) bool {
+				return Key(victims[i]) < Key(victims[j])
+			})
+			o.PodPreemptInfo = &PodPreemptInfo{VictimPods: victims}
+		}
+		return o
+	}
+	return obj
+}
+
+// CompactPod copies the fields of a Pod used by the scheduling.
+func CompactPod(pod *core.Pod) *core.Pod {
+	compact := &core.Pod{
+		ObjectMeta: meta.ObjectMeta{
+			Name:              pod.Name,
+			Namespace:         pod.Namespace,
+			UID:               pod.UID,
+			Labels:            pod.Labels,
+			Annotations:       map[string]string{},
+			CreationTimestamp: pod.CreationTimestamp,
+			DeletionTimestamp: pod.DeletionTimestamp,
+		},
+		Spec: core.PodSpec{NodeName: pod.Spec.NodeName},
+		Status: core.PodStatus{
+			Phase:     pod.Status.Phase,
+			StartTime: pod.Status.StartTime,
+		},
+	}
+	for k, v := range pod.Annotations {
+		if k != core.LastAppliedConfigAnnotation {
+			compact.Annotations[k] = v
+		}
+	}
+	for _, c := range pod.Spec.Containers {
+		compact.Spec.Containers = append(compact.Spec.Containers,
+			core.Container{Name: c.Name, Resources: c.Resources})
+	}
+	for _, c := range pod.Spec.InitContainers {
+		compact.Spec.InitContainers = append(compact.Spec.InitContainers,
+			core.Container{Name: c.Name, Resources: c.Resources})
+	}
+	return compact
+}
+
+// AuditLog appends the AuditRecords to a JSON Lines file which is kept open. The file is rotated
+// when the Scheduler starts and once it exceeds the max size, in the same way as the Ledger, so each
+// Scheduler run starts a new file with its Init record, and can be replayed from it as long as the
+// rotated files of the run are still kept.
+type AuditLog struct {
+	filePath     string
+	maxFileBytes int64
+	maxBackups   int32
+	file         *os.File
+	// size of the open file
+	fileBytes int64
+	lock      sync.Mutex
+}
+
+func NewAuditLog(filePath string, maxFileBytes int64, maxBackups int32) *AuditLog {
+	l := &AuditLog{
+		filePath:     filePath,
+		maxFileBytes: maxFileBytes,
+		maxBackups:   maxBackups,
+	}
+	l.rotate()
+	return l
+}
+
+// Append appends a record to the audit log file, and rotates the file once it exceeds the max size.
+// A failure is only logged, so that the auditing never blocks the scheduling.
+func (l *AuditLog) Append(r AuditRecord) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.file == nil {
+		l.open()
+		if l.file == nil {
+			return
+		}
+	}
+	n, err := l.file.Write(append(common.ToJsonBytes(r), '\n'))
+	l.fileBytes += int64(n)
+	if err != nil {
+		klog.Errorf("Failed to append record to audit log %v: %v", l.filePath, err)
+		return
+	}
+	if l.fileBytes >= l.maxFileBytes {
+		l.rotate()
+	}
+}
+
+// rotate closes the audit log file, shifts it and the rotated ones by one, and opens a new file.
+func (l *AuditLog) rotate() {
+	if l.file != nil {
+		if err := l.file.Close(); err != nil {
+			klog.Errorf("Failed to close audit log %v: %v", l.filePath, err)
+		}
+		l.file = nil
+	}
+	rotateFiles(l.filePath, l.maxBackups)
+	l.open()
+}
+
+// open opens the audit log file to append the records, leaving the file nil if it fails.
+func (l *AuditLog) open() {
+	f, err := os.OpenFile(l.filePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		klog.Errorf("Failed to open audit log %v: %v", l.filePath, err)
+		return
+	}
+	info, err := f.Stat()
+	if err != nil {
+		klog.Errorf("Failed to open audit log %v: %v", l.filePath, err)
+		f.Close()
+		return
+	}
+	l.file, l.fileBytes = f, info.Size()
+}
+
+// ReadAuditLogRun reads the records of the Scheduler run logged in an audit log file (or in one of its
+// rotated files), i.e. from the Init record of the run, which may be in an older rotated file.
+func ReadAuditLogRun(filePath string) []AuditRecord {
+	basePath, i := filePath, int32(0)
+	if dot := strings.LastIndex(filePath, "."); dot >= 0 {
+		if n, err := strconv.Atoi(filePath[dot+1:]); err == nil && n > 0 {
+			basePath, i = filePath[:dot], int32(n)
+		}
+	}
+	records := ReadAuditLog(filePath)
+	for len(records) == 0 || records[0].Call != AuditInit {
+		i++
+		olderPath := getBackupFilePath(basePath, i)
+		if _, err := os.Stat(olderPath); err != nil {
+			break
+		}
+		records = append(ReadAuditLog(olderPath), records...)
+	}
+	return records
+}
+
+// ReadAuditLog reads the records in an audit log file, stopping at the first malformed
+// line (e.g. the last line partially written when the Scheduler crashed).
+func ReadAuditLog(filePath string) []AuditRecord {
+	f, err := os.Open(filePath)
+	if err != nil {
+		panic(fmt.Errorf("Failed to read audit log %v: %v", filePath, err))
+	}
+	defer f.Close()
+
+	var records []AuditRecord
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var r AuditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			klog.Warningf("Stopped at malformed record %v in audit log %v: %v", len(records), filePath, err)
+			break
+		}
+		records = append(records, r)
+	}
+	if err := scanner.Err(); err != nil {
+		panic(fmt.Errorf("Failed to read audit log %v: %v", filePath, err))
+	}
+	return records
+}
@@ -0,0 +1,78 @@
+// MIT License
+//
+// Copyright (c) Microsoft Corporation. All rights reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE
+
+package internal
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAuditLogRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filePath := filepath.Join(dir, "audit.jsonl")
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	// the previous run is rotated when the log is created
+	previous := NewAuditLog(filePath, 1<<20, 3)
+	previous.Append(NewAuditRecord(now, AuditInit, int64(1), "hash"))
+	previous.Append(NewAuditRecord(now, AuditReconcile))
+	l := NewAuditLog(filePath, 1<<20, 3)
+	if records := ReadAuditLog(filePath + ".1"); len(records) != 2 || records[0].Call != AuditInit {
+		t.Errorf("Expected the previous run rotated, but got %v records", len(records))
+	}
+
+	// the log is rotated on every record, and the run is read back from its Init record
+	l.maxFileBytes = 1
+	l.Append(NewAuditRecord(now, AuditInit, int64(2), "hash"))
+	l.Append(NewAuditRecord(now, AuditReconcile))
+	l.Append(NewAuditRecord(now, AuditDefragment, int32(1), time.Minute))
+	if _, err := os.Stat(filePath + ".4"); !os.IsNotExist(err) {
+		t.Errorf("Expected at most 3 rotated audit log files, but got %v", err)
+	}
+	for _, path := range []string{filePath, filePath + ".1", filePath + ".2"} {
+		records := ReadAuditLogRun(path)
+		if len(records) == 0 || records[0].Call != AuditInit || string(records[0].Args[0]) != "2" {
+			t.Errorf("Expected the run read from its Init record through %v, but got %v", path, records)
+		}
+	}
+	if records := ReadAuditLogRun(filePath + ".1"); len(records) != 3 || records[2].Call != AuditDefragment {
+		t.Errorf("Expected 3 records of the run, but got %v", records)
+	}
+	if records := ReadAuditLogRun(filePath + ".2"); len(records) != 2 || records[1].Call != AuditReconcile {
+		t.Errorf("Expected 2 records of the run up to the file, but got %v", records)
+	}
+
+	// the records are appended to the file opened by the last rotation
+	l.maxFileBytes = 1 << 20
+	l.Append(NewAuditRecord(now, AuditReconcile))
+	if records := ReadAuditLog(filePath); len(records) != 1 {
+		t.Errorf("Expected 1 record in the current file, but got %v", len(records))
+	}
+}
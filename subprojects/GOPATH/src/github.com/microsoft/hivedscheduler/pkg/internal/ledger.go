@@ -0,0 +1,275 @@
+// MIT License
+//
+// Copyright (c) Microsoft Corporation. All rights reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE
+
+package internal
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	si "github.com/microsoft/hivedscheduler/pkg/api"
+	"github.com/microsoft/hivedscheduler/pkg/common"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Ledger appends the LedgerRecords to a JSON Lines file which is rotated by size,
+// and aggregates the GpuHours from them.
+// The records of the files kept are also held in memory, so that they are only parsed
+// once when the Ledger is created.
+type Ledger struct {
+	filePath     string
+	maxFileBytes int64
+	maxBackups   int32
+	// records of the current ledger file and the rotated ones, from the newest to the oldest
+	fileRecords [][]si.LedgerRecord
+	// AffinityGroup -> its last allocation record, for the groups still holding GPUs
+	allocated map[string]si.LedgerRecord
+	lock      sync.Mutex
+}
+
+func NewLedger(filePath string, maxFileBytes int64, maxBackups int32) *Ledger {
+	l := &Ledger{
+		filePath:     filePath,
+		maxFileBytes: maxFileBytes,
+		maxBackups:   maxBackups,
+		fileRecords:  make([][]si.LedgerRecord, maxBackups+1),
+		allocated:    map[string]si.LedgerRecord{},
+	}
+	for i := maxBackups; i >= 0; i-- {
+		l.fileRecords[i] = l.readRecords(getBackupFilePath(l.filePath, i))
+		for _, r := range l.fileRecords[i] {
+			l.index(r)
+		}
+	}
+	return l
+}
+
+// Append appends the records to the ledger file, and rotates the file once it exceeds
+// the max size. A failure is only logged, so that the accounting never blocks the scheduling.
+func (l *Ledger) Append(records ...si.LedgerRecord) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if size := l.write(records); size >= l.maxFileBytes {
+		l.rotate()
+	}
+}
+
+// write appends the records to the current ledger file and to the ones in memory,
+// and returns the size of the file (0 if the records failed to be written).
+func (l *Ledger) write(records []si.LedgerRecord) int64 {
+	var data []byte
+	for _, r := range records {
+		data = append(data, common.ToJsonBytes(r)...)
+		data = append(data, '\n')
+		l.fileRecords[0] = append(l.fileRecords[0], r)
+		l.index(r)
+	}
+	f, err := os.OpenFile(l.filePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		klog.Errorf("Failed to open ledger %v: %v", l.filePath, err)
+		return 0
+	}
+	defer f.Close()
+	if _, err := f.Write(data); err != nil {
+		klog.Errorf("Failed to append records to ledger %v: %v", l.filePath, err)
+		return 0
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
+
+// index tracks the last allocation record of each group still holding GPUs.
+func (l *Ledger) index(r si.LedgerRecord) {
+	switch r.Event {
+	case si.LedgerAllocate:
+		l.allocated[r.AffinityGroup] = r
+	case si.LedgerCheckpoint:
+		if _, ok := l.allocated[r.AffinityGroup]; !ok {
+			r.Event = si.LedgerAllocate
+			l.allocated[r.AffinityGroup] = r
+		}
+	case si.LedgerRelease:
+		delete(l.allocated, r.AffinityGroup)
+	}
+}
+
+// rotate shifts the ledger file and the rotated ones by one, and drops the oldest one.
+// The allocation records of the groups still holding GPUs are checkpointed to the new
+// ledger file, so that they are not dropped with the files they were appended to.
+func (l *Ledger) rotate() {
+	rotateFiles(l.filePath, l.maxBackups)
+	copy(l.fileRecords[1:], l.fileRecords[:l.maxBackups])
+	l.fileRecords[0] = nil
+
+	var groups []string
+	for g := range l.allocated {
+		groups = append(groups, g)
+	}
+	sort.Strings(groups)
+	var checkpoints []si.LedgerRecord
+	for _, g := range groups {
+		r := l.allocated[g]
+		r.Event = si.LedgerCheckpoint
+		checkpoints = append(checkpoints, r)
+	}
+	l.write(checkpoints)
+	klog.Infof("Ledger %v rotated with %v groups checkpointed", l.filePath, len(checkpoints))
+}
+
+// rotateFiles shifts a file and its rotated ones (suffixed by .1, .2, ... from the newest to the oldest)
+// by one, and drops the oldest one if there are already maxBackups rotated files.
+func rotateFiles(filePath string, maxBackups int32) {
+	if err := os.Remove(getBackupFilePath(filePath, maxBackups)); err != nil && !os.IsNotExist(err) {
+		klog.Errorf("Failed to remove the oldest rotated file of %v: %v", filePath, err)
+	}
+	for i := maxBackups - 1; i >= 0; i-- {
+		if err := os.Rename(getBackupFilePath(filePath, i), getBackupFilePath(filePath, i+1)); err != nil &&
+			!os.IsNotExist(err) {
+			klog.Errorf("Failed to rotate %v: %v", getBackupFilePath(filePath, i), err)
+		}
+	}
+}
+
+// getBackupFilePath returns the path of the i-th newest rotated file of a file, or of the
+// file itself if i is 0.
+func getBackupFilePath(filePath string, i int32) string {
+	if i == 0 {
+		return filePath
+	}
+	return fmt.Sprintf("%v.%v", filePath, i)
+}
+
+// GetGpuHours aggregates the GpuHours in the time range [start, end) from the records of the
+// ledger files (from the oldest to the newest), of a VC and of a user if they are not empty.
+// The GPUs still held are counted until now.
+func (l *Ledger) GetGpuHours(start, end, now time.Time, vc si.VirtualClusterName, user string) si.GpuHoursList {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if end.IsZero() || end.After(now) {
+		end = now
+	}
+	hours := map[si.GpuHours]float64{}
+	account := func(r si.LedgerRecord, until time.Time) {
+		from := r.Time.Time
+		if from.Before(start) {
+			from = start
+		}
+		if until.After(end) {
+			until = end
+		}
+		if !until.After(from) || (vc != "" && r.VirtualCluster != vc) || (user != "" && r.User != user) {
+			return
+		}
+		for gpuType, n := range r.GpuNumbers {
+			key := si.GpuHours{
+				VirtualCluster: r.VirtualCluster,
+				User:           r.User,
+				GpuType:        gpuType,
+				Guaranteed:     r.Guaranteed,
+			}
+			hours[key] += float64(n) * until.Sub(from).Hours()
+		}
+	}
+
+	// AffinityGroup -> its last allocation record
+	allocated := map[string]si.LedgerRecord{}
+	for i := l.maxBackups; i >= 0; i-- {
+		for _, r := range l.fileRecords[i] {
+			if r.Event == si.LedgerCheckpoint {
+				// the allocation record is still kept if the group is found allocated
+				if _, ok := allocated[r.AffinityGroup]; !ok {
+					r.Event = si.LedgerAllocate
+					allocated[r.AffinityGroup] = r
+				}
+				continue
+			}
+			if last, ok := allocated[r.AffinityGroup]; ok {
+				account(last, r.Time.Time)
+				delete(allocated, r.AffinityGroup)
+			}
+			if r.Event == si.LedgerAllocate {
+				allocated[r.AffinityGroup] = r
+			}
+		}
+	}
+	for _, r := range allocated {
+		account(r, now)
+	}
+
+	list := si.GpuHoursList{StartTime: meta.NewTime(start), EndTime: meta.NewTime(end), Items: []si.GpuHours{}}
+	for key, h := range hours {
+		key.GpuHours = h
+		list.Items = append(list.Items, key)
+	}
+	sort.Slice(list.Items, func(i, j int) bool {
+		a, b := list.Items[i], list.Items[j]
+		if a.VirtualCluster != b.VirtualCluster {
+			return a.VirtualCluster < b.VirtualCluster
+		}
+		if a.User != b.User {
+			return a.User < b.User
+		}
+		if a.GpuType != b.GpuType {
+			return a.GpuType < b.GpuType
+		}
+		return a.Guaranteed && !b.Guaranteed
+	})
+	return list
+}
+
+// readRecords reads the records in a ledger file, skipping the malformed lines (e.g. the
+// last line partially written when the Scheduler crashed).
+func (l *Ledger) readRecords(filePath string) []si.LedgerRecord {
+	f, err := os.Open(filePath)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		panic(fmt.Errorf("Failed to read ledger %v: %v", filePath, err))
+	}
+	defer f.Close()
+
+	var records []si.LedgerRecord
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var r si.LedgerRecord
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			klog.Warningf("Skipped malformed record in ledger %v: %v", filePath, err)
+			continue
+		}
+		records = append(records, r)
+	}
+	if err := scanner.Err(); err != nil {
+		panic(fmt.Errorf("Failed to read ledger %v: %v", filePath, err))
+	}
+	return records
+}
@@ -0,0 +1,95 @@
+// MIT License
+//
+// Copyright (c) Microsoft Corporation. All rights reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE
+
+package internal
+
+import (
+	si "github.com/microsoft/hivedscheduler/pkg/api"
+	"github.com/microsoft/hivedscheduler/pkg/common"
+	"io/ioutil"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLedgerRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ledger")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filePath := filepath.Join(dir, "ledger.jsonl")
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	newRecord := func(event si.LedgerEvent, group string, hours int, gpuNumber int32) si.LedgerRecord {
+		r := si.LedgerRecord{
+			Time:           meta.NewTime(start.Add(time.Duration(hours) * time.Hour)),
+			Event:          event,
+			AffinityGroup:  group,
+			VirtualCluster: "VC1",
+			User:           "alice",
+			Guaranteed:     true,
+		}
+		if event == si.LedgerAllocate {
+			r.GpuNumbers = map[string]int32{"DGX2-V100": gpuNumber}
+		}
+		return r
+	}
+
+	// rotate on every append, and keep only one rotated file, so the allocation record
+	// of a is dropped with its file and only kept by the checkpoints
+	l := NewLedger(filePath, 1, 1)
+	l.Append(newRecord(si.LedgerAllocate, "a", 0, 2))
+	l.Append(newRecord(si.LedgerAllocate, "b", 1, 1))
+	l.Append(newRecord(si.LedgerRelease, "b", 2, 0))
+	if _, err := os.Stat(filePath + ".2"); !os.IsNotExist(err) {
+		t.Errorf("Expected at most 1 rotated ledger file, but got %v", err)
+	}
+	if records := l.readRecords(filePath); len(records) != 1 ||
+		records[0].Event != si.LedgerCheckpoint || records[0].AffinityGroup != "a" {
+		t.Errorf("Expected the allocation of a checkpointed, but got %v", common.ToJson(records))
+	}
+
+	now := start.Add(3 * time.Hour)
+	expected := []si.GpuHours{{VirtualCluster: "VC1", User: "alice", GpuType: "DGX2-V100", Guaranteed: true, GpuHours: 7}}
+	if list := l.GetGpuHours(time.Time{}, time.Time{}, now, "", ""); !reflect.DeepEqual(list.Items, expected) {
+		t.Errorf("Expected GPU-hours %v, but got %v", common.ToJson(expected), common.ToJson(list.Items))
+	}
+	expected[0].GpuHours = 2
+	if list := l.GetGpuHours(start.Add(2*time.Hour), time.Time{}, now, "VC1", "alice"); !reflect.DeepEqual(
+		list.Items, expected) {
+		t.Errorf("Expected GPU-hours %v, but got %v", common.ToJson(expected), common.ToJson(list.Items))
+	}
+
+	// the records are recovered from the ledger files
+	l = NewLedger(filePath, 1, 1)
+	expected[0].GpuHours = 7
+	if list := l.GetGpuHours(time.Time{}, time.Time{}, now, "", ""); !reflect.DeepEqual(list.Items, expected) {
+		t.Errorf("Expected recovered GPU-hours %v, but got %v", common.ToJson(expected), common.ToJson(list.Items))
+	}
+	l.Append(newRecord(si.LedgerRelease, "a", 3, 0))
+	if records := l.readRecords(filePath); len(records) != 0 {
+		t.Errorf("Expected no allocation checkpointed, but got %v", common.ToJson(records))
+	}
+}
@@ -28,6 +28,7 @@ import (
 	core "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/types"
 	ei "k8s.io/kubernetes/pkg/scheduler/api"
+	"time"
 )
 
 ///////////////////////////////////////////////////////////////////////////////////////
@@ -45,9 +46,41 @@ type ExtenderHandlers struct {
 	PreemptHandler func(args ei.ExtenderPreemptionArgs) *ei.ExtenderPreemptionResult
 }
 
+type AdmissionHandlers struct {
+	// Panic with User Error if the Pod should be rejected.
+	ValidatePodHandler func(pod *core.Pod)
+	// Return the mutated copy of the Pod, or the Pod itself if it is not mutated.
+	MutatePodHandler func(pod *core.Pod) *core.Pod
+}
+
 type InspectHandlers struct {
 	GetAffinityGroupsHandler func() si.AffinityGroupList
 	GetAffinityGroupHandler  func(name string) si.AffinityGroup
+	// Permission should be checked before calling it.
+	UpdateAffinityGroupPriorityHandler func(name string, priority int32) si.AffinityGroup
+
+	GetReservationsHandler func() si.ReservationList
+	GetReservationHandler  func(name string) si.Reservation
+	// Permission should be checked before calling them.
+	CreateReservationHandler func(r si.Reservation) si.Reservation
+	MoveReservationHandler   func(name string, spec si.ReservationSpec) si.Reservation
+	DeleteReservationHandler func(name string) si.Reservation
+
+	GetCellCordonsHandler func() si.CellCordonList
+	GetCellCordonHandler  func(name string) si.CellCordon
+	// Permission should be checked before calling them.
+	CreateCellCordonHandler func(cc si.CellCordon) si.CellCordon
+	DeleteCellCordonHandler func(name string) si.CellCordon
+
+	GetTimeWindowSchedulesHandler func(vc string) si.TimeWindowScheduleList
+
+	GetVirtualClustersHandler func() si.VirtualClusterList
+	GetVirtualClusterHandler  func(name string) si.VirtualCluster
+
+	GetGpuHoursHandler       func(start, end time.Time, vc, user string) si.GpuHoursList
+	GetCapacityHandler       func(priority int32) si.Capacity
+	GetSnapshotHandler       func() si.Snapshot
+	GetRecoveryReportHandler func() si.RecoveryReport
 }
 
 // SchedulerAlgorithm is used to make the pod schedule decision based on its whole
@@ -83,9 +116,75 @@ type SchedulerAlgorithm interface {
 	AddAllocatedPod(pod *core.Pod)
 	DeleteAllocatedPod(pod *core.Pod)
 
+	// Track the deletion of the Pods which are not allocated yet, such as to
+	// cancel the preemption for them.
+	DeleteUnallocatedPod(pod *core.Pod)
+
+	// Take the allocated Pods whose PodBindInfo is changed at runtime, such as
+	// by the upgrade of their AffinityGroups, with the changed PodBindInfo
+	// annotation, so that it can be patched to the Pods to survive the Scheduler
+	// restart. Each change is taken only once.
+	TakeChangedAllocatedPods() []*core.Pod
+
+	// Periodically reconcile the scheduling view, such as to restore the lazy
+	// preempted AffinityGroups and to upgrade the opportunistic AffinityGroups.
+	Reconcile()
+
+	// Select at most maxMoves opportunistic AffinityGroups, which have run for
+	// minRuntime, to be evicted and rescheduled more compactly.
+	Defragment(maxMoves int32, minRuntime time.Duration) []si.DefragmentationMove
+
 	// Expose current scheduling status
 	GetAffinityGroups() si.AffinityGroupList
 	GetAffinityGroup(name string) si.AffinityGroup
+
+	// Update the priority of an allocated AffinityGroup at runtime.
+	UpdateAffinityGroupPriority(name string, priority int32) si.AffinityGroup
+
+	// Expose current Reservations, and create, move or delete a Reservation at
+	// runtime.
+	GetReservations() si.ReservationList
+	GetReservation(name string) si.Reservation
+	CreateReservation(r si.Reservation) si.Reservation
+	MoveReservation(name string, spec si.ReservationSpec) si.Reservation
+	DeleteReservation(name string) si.Reservation
+
+	// Expose current CellCordons, and cordon (and drain) or uncordon a physical
+	// cell at runtime.
+	GetCellCordons() si.CellCordonList
+	GetCellCordon(name string) si.CellCordon
+	CreateCellCordon(cc si.CellCordon) si.CellCordon
+	DeleteCellCordon(name string) si.CellCordon
+
+	// Expose the schedules of the cells with time windows, of all VCs or of a VC
+	// if it is not empty.
+	GetTimeWindowSchedules(vc string) si.TimeWindowScheduleList
+
+	// Expose the VCs with their hierarchy.
+	GetVirtualClusters() si.VirtualClusterList
+	GetVirtualCluster(name string) si.VirtualCluster
+
+	// Expose the GPU-hours aggregated from the ledger in the time range [start, end),
+	// of a VC and of a user if they are not empty.
+	GetGpuHours(start, end time.Time, vc, user string) si.GpuHoursList
+
+	// Expose the Capacity that can be scheduled immediately (dry run without
+	// changing the scheduling state), with preemption at the priority.
+	GetCapacity(priority int32) si.Capacity
+
+	// Expose the Snapshot of the whole scheduling state of the algorithm, i.e.
+	// without the Config and the PodScheduleStatuses.
+	GetSnapshot() si.Snapshot
+
+	// Expose the RecoveryReport of the allocated Pods which are inconsistent
+	// with the config or with each other when added, and are quarantined in
+	// degraded mode.
+	GetRecoveryReport() si.RecoveryReport
+
+	// Validate the PodSchedulingSpec of a Pod to be created against the current
+	// scheduling view, such as the VCs, GPU types, Reservations and allocated
+	// AffinityGroups.
+	ValidatePod(pod *core.Pod)
 }
 
 // Notes:
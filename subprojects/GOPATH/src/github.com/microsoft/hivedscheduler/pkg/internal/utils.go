@@ -27,12 +27,17 @@ import (
 	si "github.com/microsoft/hivedscheduler/pkg/api"
 	"github.com/microsoft/hivedscheduler/pkg/common"
 	core "k8s.io/api/core/v1"
+	policy "k8s.io/api/policy/v1beta1"
+	"k8s.io/apimachinery/pkg/api/resource"
 	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
 	kubeClient "k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/cache"
 	"k8s.io/klog"
 	"net/http"
+	"sort"
+	"strings"
 )
 
 func CreateClient(kConfig *rest.Config) kubeClient.Interface {
@@ -162,8 +167,15 @@ func NewBindingPod(pod *core.Pod, podBindInfo *si.PodBindInfo) *core.Pod {
 	if bindingPod.Annotations == nil {
 		bindingPod.Annotations = map[string]string{}
 	}
-	bindingPod.Annotations[si.AnnotationKeyPodGpuIsolation] =
+	bindingPod.Annotations[GetDeviceIsolationAnnotation(podBindInfo)] =
 		common.ToIndicesString(podBindInfo.GpuIsolation)
+	bindingPod.Annotations[si.AnnotationKeyPodGpuType] = podBindInfo.GpuType
+	if podBindInfo.CpuIsolation != "" {
+		bindingPod.Annotations[si.AnnotationKeyPodCpuIsolation] = podBindInfo.CpuIsolation
+	}
+	if podBindInfo.NicIsolation != "" {
+		bindingPod.Annotations[si.AnnotationKeyPodNicIsolation] = podBindInfo.NicIsolation
+	}
 	bindingPod.Annotations[si.AnnotationKeyPodBindInfo] =
 		common.ToYaml(podBindInfo)
 
@@ -186,10 +198,27 @@ func ExtractPodBindInfo(allocatedPod *core.Pod) *si.PodBindInfo {
 }
 
 func ExtractPodBindAnnotations(allocatedPod *core.Pod) map[string]string {
-	return map[string]string{
-		si.AnnotationKeyPodGpuIsolation: allocatedPod.Annotations[si.AnnotationKeyPodGpuIsolation],
-		si.AnnotationKeyPodBindInfo:     allocatedPod.Annotations[si.AnnotationKeyPodBindInfo],
+	annotations := map[string]string{}
+	for _, key := range []string{
+		GetDeviceIsolationAnnotation(ExtractPodBindInfo(allocatedPod)),
+		si.AnnotationKeyPodCpuIsolation,
+		si.AnnotationKeyPodNicIsolation,
+		si.AnnotationKeyPodGpuType,
+		si.AnnotationKeyPodBindInfo,
+	} {
+		if value, ok := allocatedPod.Annotations[key]; ok {
+			annotations[key] = value
+		}
 	}
+	return annotations
+}
+
+// GetDeviceIsolationAnnotation returns the annotation to deliver the device isolation of a Pod.
+func GetDeviceIsolationAnnotation(podBindInfo *si.PodBindInfo) string {
+	if podBindInfo.DeviceIsolationAnnotation != "" {
+		return podBindInfo.DeviceIsolationAnnotation
+	}
+	return si.AnnotationKeyPodGpuIsolation
 }
 
 // PodSchedulingSpec comes from external, so need more Defaulting and Validation
@@ -218,6 +247,12 @@ func ExtractPodSchedulingSpec(pod *core.Pod) *si.PodSchedulingSpec {
 			},
 		}
 	}
+	if podSchedulingSpec.GpuType != "" {
+		if len(podSchedulingSpec.GpuTypes) != 0 {
+			panic(fmt.Errorf(errPfx + "GpuType and GpuTypes cannot be both specified"))
+		}
+		podSchedulingSpec.GpuTypes = []string{podSchedulingSpec.GpuType}
+	}
 
 	// Validation
 	if podSchedulingSpec.VirtualCluster == "" {
@@ -229,32 +264,289 @@ func ExtractPodSchedulingSpec(pod *core.Pod) *si.PodSchedulingSpec {
 	if podSchedulingSpec.Priority > si.MaxGuaranteedPriority {
 		panic(fmt.Errorf(errPfx+"Priority is greater than %v", si.MaxGuaranteedPriority))
 	}
-	if podSchedulingSpec.GpuNumber <= 0 {
-		panic(fmt.Errorf(errPfx + "GpuNumber is non-positive"))
+	if podSchedulingSpec.UpgradePriority < si.MinGuaranteedPriority {
+		panic(fmt.Errorf(errPfx+"UpgradePriority is less than %v", si.MinGuaranteedPriority))
+	}
+	if podSchedulingSpec.UpgradePriority > si.MaxGuaranteedPriority {
+		panic(fmt.Errorf(errPfx+"UpgradePriority is greater than %v", si.MaxGuaranteedPriority))
+	}
+	for _, gpuType := range podSchedulingSpec.GpuTypes {
+		if gpuType == "" {
+			panic(fmt.Errorf(errPfx + "GpuTypes has empty item"))
+		}
+	}
+	if podSchedulingSpec.GpuTypeFallbackWaitSec < si.UnlimitedValue {
+		panic(fmt.Errorf(errPfx+"GpuTypeFallbackWaitSec is less than %v", si.UnlimitedValue))
+	}
+	if podSchedulingSpec.GpuNumber < 0 {
+		panic(fmt.Errorf(errPfx + "GpuNumber is negative"))
 	}
 	if podSchedulingSpec.AffinityGroup.Name == "" {
 		panic(fmt.Errorf(errPfx + "AffinityGroup.Name is empty"))
 	}
 
 	isPodInGroup := false
+	memberGpuTypes := map[int32][]string{}
 	for _, member := range podSchedulingSpec.AffinityGroup.Members {
 		if member.PodNumber <= 0 {
 			panic(fmt.Errorf(errPfx + "AffinityGroup.Members has non-positive PodNumber"))
 		}
-		if member.GpuNumber <= 0 {
-			panic(fmt.Errorf(errPfx + "AffinityGroup.Members has non-positive GpuNumber"))
+		if member.GpuNumber < 0 {
+			panic(fmt.Errorf(errPfx + "AffinityGroup.Members has negative GpuNumber"))
 		}
 		if member.GpuNumber == podSchedulingSpec.GpuNumber {
 			isPodInGroup = true
 		}
+		if (member.GpuType == "") != (podSchedulingSpec.AffinityGroup.Members[0].GpuType == "") {
+			panic(fmt.Errorf(errPfx + "AffinityGroup.Members should either all or none specify GpuType"))
+		}
+		if !common.StringsContains(memberGpuTypes[member.GpuNumber], member.GpuType) {
+			memberGpuTypes[member.GpuNumber] = append(memberGpuTypes[member.GpuNumber], member.GpuType)
+		}
 	}
 	if !isPodInGroup {
 		panic(fmt.Errorf(errPfx + "AffinityGroup.Members does not contains current Pod"))
 	}
+	if podSchedulingSpec.AffinityGroup.MaxCellLevel < 0 {
+		panic(fmt.Errorf(errPfx + "AffinityGroup.MaxCellLevel is negative"))
+	}
+	if podSchedulingSpec.AffinityGroup.MaxCellType != "" && podSchedulingSpec.AffinityGroup.MaxCellLevel != 0 {
+		panic(fmt.Errorf(errPfx + "AffinityGroup.MaxCellType and AffinityGroup.MaxCellLevel cannot be both specified"))
+	}
+	if podGpuTypes := memberGpuTypes[podSchedulingSpec.GpuNumber]; podGpuTypes[0] != "" {
+		if podSchedulingSpec.AffinityGroup.MaxCellType != "" || podSchedulingSpec.AffinityGroup.MaxCellLevel != 0 {
+			panic(fmt.Errorf(errPfx +
+				"AffinityGroup.MaxCellType and AffinityGroup.MaxCellLevel cannot be specified when AffinityGroup.Members specify GpuType"))
+		}
+		if len(podSchedulingSpec.GpuTypes) > 1 {
+			panic(fmt.Errorf(errPfx + "GpuTypes cannot be specified when AffinityGroup.Members specify GpuType"))
+		}
+		if len(podSchedulingSpec.GpuTypes) == 1 && !common.StringsContains(podGpuTypes, podSchedulingSpec.GpuTypes[0]) {
+			panic(fmt.Errorf(errPfx + "GpuType is not the GpuType of any AffinityGroup.Members with the same GpuNumber"))
+		}
+		if len(podSchedulingSpec.GpuTypes) == 0 && len(podGpuTypes) > 1 {
+			panic(fmt.Errorf(errPfx +
+				"GpuType should be specified when AffinityGroup.Members with the same GpuNumber have different GpuType"))
+		}
+		if podSchedulingSpec.ReservationId != "" {
+			panic(fmt.Errorf(errPfx + "ReservationId cannot be specified when AffinityGroup.Members specify GpuType"))
+		}
+	}
 
 	return &podSchedulingSpec
 }
 
+// PodPreemptionCost comes from external, so need Validation when deserialization.
+func ExtractPodPreemptionCost(pod *core.Pod) int32 {
+	// Consider all panics are BadRequestPanic.
+	defer AsBadRequestPanic()
+	errPfx := fmt.Sprintf("Pod annotation %v: ", si.AnnotationKeyPodPreemptionCost)
+
+	annotation := pod.Annotations[si.AnnotationKeyPodPreemptionCost]
+	if annotation == "" {
+		return 0
+	}
+
+	cost := common.StringToInt32(annotation)
+	if cost < 0 {
+		panic(fmt.Errorf(errPfx + "PreemptionCost is negative"))
+	}
+	return cost
+}
+
+// ValidatePodPreemptionCost validates the PodPreemptionCost of a Pod which is not allocated yet.
+func ValidatePodPreemptionCost(pod *core.Pod) {
+	ExtractPodPreemptionCost(pod)
+}
+
+// GetPodResourceRequests returns the CPU and memory requested by a Pod, i.e., the sum of
+// the requests of its containers, or the max request of its init containers if larger.
+func GetPodResourceRequests(pod *core.Pod) core.ResourceList {
+	requests := core.ResourceList{}
+	for _, name := range []core.ResourceName{core.ResourceCPU, core.ResourceMemory} {
+		total := resource.Quantity{}
+		for _, container := range pod.Spec.Containers {
+			if q, ok := container.Resources.Requests[name]; ok {
+				total.Add(q)
+			}
+		}
+		for _, container := range pod.Spec.InitContainers {
+			if q, ok := container.Resources.Requests[name]; ok && q.Cmp(total) > 0 {
+				total = q.DeepCopy()
+			}
+		}
+		requests[name] = total
+	}
+	return requests
+}
+
+// MutatePod returns a copy of a Pod with PodSchedulingSpec, injected with the plumbing
+// to be scheduled by this scheduler: the schedulerName if the Pod is for the default
+// scheduler, the ResourceNamePodSchedulingEnable limit if no container has it, and the
+// device isolation envs into the containers requesting it or a device if the Pod
+// requests any GPU.
+// The default AffinityGroup is not injected, since it is named after the Pod, whose
+// name may not be generated yet at the admission. It is defaulted at the scheduling
+// instead, see ExtractPodSchedulingSpec.
+func MutatePod(pod *core.Pod, schedulerName string, cellTypes map[si.CellType]si.CellTypeSpec) *core.Pod {
+	podSchedulingSpec := ExtractPodSchedulingSpec(pod)
+	mutatedPod := pod.DeepCopy()
+
+	if mutatedPod.Spec.SchedulerName == "" || mutatedPod.Spec.SchedulerName == core.DefaultSchedulerName {
+		mutatedPod.Spec.SchedulerName = schedulerName
+	}
+	if !IsHivedEnabled(mutatedPod) && len(mutatedPod.Spec.Containers) > 0 {
+		container := &mutatedPod.Spec.Containers[0]
+		if container.Resources.Limits == nil {
+			container.Resources.Limits = core.ResourceList{}
+		}
+		container.Resources.Limits[si.ResourceNamePodSchedulingEnable] = resource.MustParse("1")
+	}
+	if podSchedulingSpec.GpuNumber > 0 {
+		gpuTypes := append([]string{}, podSchedulingSpec.GpuTypes...)
+		for _, member := range podSchedulingSpec.AffinityGroup.Members {
+			if member.GpuType != "" {
+				gpuTypes = append(gpuTypes, member.GpuType)
+			}
+		}
+		isolationEnvs := GetDeviceIsolationEnvs(cellTypes, gpuTypes)
+		var envNames []string
+		for name := range isolationEnvs {
+			envNames = append(envNames, name)
+		}
+		sort.Strings(envNames)
+		for i := range mutatedPod.Spec.Containers {
+			container := &mutatedPod.Spec.Containers[i]
+			if !isDeviceContainer(container) {
+				continue
+			}
+			for _, name := range envNames {
+				if !containerHasEnv(container, name) {
+					container.Env = append(container.Env, core.EnvVar{
+						Name: name,
+						ValueFrom: &core.EnvVarSource{FieldRef: &core.ObjectFieldSelector{
+							FieldPath: fmt.Sprintf("metadata.annotations['%v']", isolationEnvs[name]),
+						}},
+					})
+				}
+			}
+		}
+	}
+
+	return mutatedPod
+}
+
+// isDeviceContainer checks whether the container requests the ResourceNamePodSchedulingEnable
+// or a device, i.e. an extended resource out of the kubernetes.io domain.
+func isDeviceContainer(container *core.Container) bool {
+	// No need to check Requests, since extended resource must set Limits.
+	for resourceName, resourceQuantity := range container.Resources.Limits {
+		if resourceQuantity.Sign() <= 0 {
+			continue
+		}
+		if resourceName == si.ResourceNamePodSchedulingEnable {
+			return true
+		}
+		if domain := strings.SplitN(string(resourceName), "/", 2); len(domain) == 2 &&
+			domain[0] != "kubernetes.io" && !strings.HasSuffix(domain[0], ".kubernetes.io") {
+			return true
+		}
+	}
+	return false
+}
+
+func containerHasEnv(container *core.Container, name string) bool {
+	for _, env := range container.Env {
+		if env.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// GetDeviceIsolationEnvs returns the envs (env name -> isolation annotation) through
+// which the devices of the GPU types are delivered, or of all the leaf cell types if
+// no GPU type is given.
+func GetDeviceIsolationEnvs(cellTypes map[si.CellType]si.CellTypeSpec, gpuTypes []string) map[string]string {
+	if len(gpuTypes) == 0 {
+		for _, spec := range cellTypes {
+			if childSpec, ok := cellTypes[spec.ChildCellType]; spec.ChildCellType != "" &&
+				(!ok || childSpec.ChildCellType == "") {
+				gpuTypes = append(gpuTypes, string(spec.ChildCellType))
+			}
+		}
+	}
+
+	isolationEnvs := map[string]string{}
+	for _, gpuType := range gpuTypes {
+		spec := cellTypes[si.CellType(gpuType)]
+		name, annotation := spec.DeviceIsolationEnv, spec.DeviceIsolationAnnotation
+		if name == "" {
+			name = si.EnvNameNvidiaVisibleDevices
+		}
+		if annotation == "" {
+			annotation = si.AnnotationKeyPodGpuIsolation
+		}
+		isolationEnvs[name] = annotation
+	}
+	if len(isolationEnvs) == 0 {
+		isolationEnvs[si.EnvNameNvidiaVisibleDevices] = si.AnnotationKeyPodGpuIsolation
+	}
+	return isolationEnvs
+}
+
+// GetRequestedDeviceResources returns the sorted device resources declared by the leaf cell types
+// which the containers of a Pod request directly, i.e., not through the Scheduler.
+func GetRequestedDeviceResources(pod *core.Pod, cellTypes map[si.CellType]si.CellTypeSpec) []string {
+	var resourceNames []string
+	for _, spec := range cellTypes {
+		name := spec.DeviceResourceName
+		if name == "" || common.StringsContains(resourceNames, name) {
+			continue
+		}
+		if isResourceLimitedForContainers(pod.Spec.InitContainers, name) ||
+			isResourceLimitedForContainers(pod.Spec.Containers, name) {
+			resourceNames = append(resourceNames, name)
+		}
+	}
+	sort.Strings(resourceNames)
+	return resourceNames
+}
+
+func isResourceLimitedForContainers(containers []core.Container, resourceName string) bool {
+	for _, container := range containers {
+		// No need to check Requests, since extended resource must set Limits.
+		if q, ok := container.Resources.Limits[core.ResourceName(resourceName)]; ok && q.Sign() > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// EvictPod evicts a Pod through the K8S Eviction API, which respects its PodDisruptionBudgets.
+// The error is returned instead of panic, since the eviction may be blocked by the budgets.
+func EvictPod(kClient kubeClient.Interface, namespace string, name string) error {
+	return kClient.CoreV1().Pods(namespace).Evict(&policy.Eviction{
+		ObjectMeta: meta.ObjectMeta{
+			Namespace: namespace,
+			Name:      name,
+		},
+	})
+}
+
+// PatchPodAnnotation patches an annotation of a Pod to its value in the given Pod.
+// The error is returned instead of panic, since the Pod may have been deleted.
+func PatchPodAnnotation(kClient kubeClient.Interface, pod *core.Pod, key string) error {
+	patch := map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{key: pod.Annotations[key]},
+		},
+	}
+	_, err := kClient.CoreV1().Pods(pod.Namespace).Patch(
+		pod.Name, types.MergePatchType, common.ToJsonBytes(patch))
+	return err
+}
+
 func BindPod(kClient kubeClient.Interface, bindingPod *core.Pod) {
 	// The K8S Bind is atomic and can only succeed at most once.
 	err := kClient.CoreV1().Pods(bindingPod.Namespace).Bind(&core.Binding{
@@ -277,7 +569,7 @@ func BindPod(kClient kubeClient.Interface, bindingPod *core.Pod) {
 	klog.Infof("[%v]: Succeeded to bind Pod on node %v, gpus %v",
 		Key(bindingPod),
 		bindingPod.Spec.NodeName,
-		bindingPod.Annotations[si.AnnotationKeyPodGpuIsolation])
+		bindingPod.Annotations[GetDeviceIsolationAnnotation(ExtractPodBindInfo(bindingPod))])
 }
 
 func NewBadRequestError(message string) *si.WebServerError {
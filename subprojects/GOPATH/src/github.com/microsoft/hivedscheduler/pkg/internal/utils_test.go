@@ -0,0 +1,106 @@
+// MIT License
+//
+// Copyright (c) Microsoft Corporation. All rights reserved.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE
+
+package internal
+
+import (
+	"fmt"
+	si "github.com/microsoft/hivedscheduler/pkg/api"
+	"github.com/microsoft/hivedscheduler/pkg/common"
+	core "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestMutatePod(t *testing.T) {
+	configFilePath := "../../example/config/design/hivedscheduler.yaml"
+	sConfig := si.NewConfig(si.InitRawConfig(&configFilePath))
+	cellTypes := sConfig.PhysicalCluster.CellTypes
+	newPod := func(name string, s si.PodSchedulingSpec) *core.Pod {
+		return &core.Pod{
+			ObjectMeta: meta.ObjectMeta{
+				Name:        name,
+				Namespace:   "test",
+				Annotations: map[string]string{si.AnnotationKeyPodSchedulingSpec: common.ToYaml(s)},
+			},
+			Spec: core.PodSpec{Containers: []core.Container{{Name: "c1"}, {Name: "c2", Resources: core.ResourceRequirements{
+				Limits: core.ResourceList{"example.com/device": resource.MustParse("1")},
+			}}, {Name: "c3"}}},
+		}
+	}
+
+	pod := newPod("pod", si.PodSchedulingSpec{
+		VirtualCluster: "VC2", Priority: 1, GpuType: "CT1", GpuNumber: 1})
+	mutatedPod := MutatePod(pod, "hivedscheduler", cellTypes)
+	if pod.Spec.SchedulerName != "" || pod.Spec.Containers[0].Resources.Limits != nil {
+		t.Errorf("Expected original pod not mutated, but got %v", common.ToYaml(pod))
+	}
+	if mutatedPod.Spec.SchedulerName != "hivedscheduler" {
+		t.Errorf("Expected schedulerName hivedscheduler, but got %v", mutatedPod.Spec.SchedulerName)
+	}
+	if !IsHivedEnabled(mutatedPod) {
+		t.Errorf("Expected pod enabled to be scheduled, but got %v", mutatedPod.Spec.Containers)
+	}
+	// the envs are injected only into the containers requesting the scheduling resource or a device
+	for _, c := range mutatedPod.Spec.Containers[:2] {
+		if len(c.Env) != 1 || c.Env[0].Name != si.EnvNameNvidiaVisibleDevices ||
+			c.Env[0].ValueFrom.FieldRef.FieldPath !=
+				fmt.Sprintf("metadata.annotations['%v']", si.AnnotationKeyPodGpuIsolation) {
+			t.Errorf("Expected GPU isolation env injected into container %v, but got %v", c.Name, c.Env)
+		}
+	}
+	if c := mutatedPod.Spec.Containers[2]; c.Env != nil {
+		t.Errorf("Expected no env injected into container %v, but got %v", c.Name, c.Env)
+	}
+	// the default affinity group is left to the scheduling, since the pod name may not be generated yet
+	if mutatedPod.Annotations[si.AnnotationKeyPodSchedulingSpec] != pod.Annotations[si.AnnotationKeyPodSchedulingSpec] {
+		t.Errorf("Expected pod scheduling spec not mutated, but got %v",
+			mutatedPod.Annotations[si.AnnotationKeyPodSchedulingSpec])
+	}
+	if remutatedPod := MutatePod(mutatedPod, "hivedscheduler", cellTypes); !reflect.DeepEqual(
+		remutatedPod, mutatedPod) {
+		t.Errorf("Expected mutated pod not mutated again, but got %v", common.ToYaml(remutatedPod))
+	}
+
+	// the pod without name yet and GPU does not get the affinity group and envs
+	pod = newPod("", si.PodSchedulingSpec{VirtualCluster: "VC2", Priority: 1, GpuNumber: 0})
+	pod.Spec.SchedulerName = "custom-scheduler"
+	mutatedPod = MutatePod(pod, "hivedscheduler", cellTypes)
+	if mutatedPod.Spec.SchedulerName != "custom-scheduler" ||
+		mutatedPod.Spec.Containers[0].Env != nil ||
+		mutatedPod.Annotations[si.AnnotationKeyPodSchedulingSpec] != pod.Annotations[si.AnnotationKeyPodSchedulingSpec] {
+		t.Errorf("Expected only scheduling enabled, but got %v", common.ToYaml(mutatedPod))
+	}
+
+	func() {
+		defer func() {
+			if err, ok := recover().(*si.WebServerError); !ok || err.Code != http.StatusBadRequest {
+				t.Errorf("Expected User Error Panic for malformed spec, but got %v", err)
+			}
+		}()
+		MutatePod(newPod("invalid-pod", si.PodSchedulingSpec{
+			VirtualCluster: "VC2", Priority: 1, GpuNumber: -1}), "hivedscheduler", cellTypes)
+	}()
+}
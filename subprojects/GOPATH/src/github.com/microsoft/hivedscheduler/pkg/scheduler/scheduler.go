@@ -29,9 +29,11 @@ import (
 	"github.com/microsoft/hivedscheduler/pkg/common"
 	"github.com/microsoft/hivedscheduler/pkg/internal"
 	"github.com/microsoft/hivedscheduler/pkg/webserver"
+	"io/ioutil"
 	core "k8s.io/api/core/v1"
 	apiErrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
 	kubeInformer "k8s.io/client-go/informers"
 	kubeClient "k8s.io/client-go/kubernetes"
 	coreLister "k8s.io/client-go/listers/core/v1"
@@ -39,6 +41,9 @@ import (
 	"k8s.io/client-go/tools/cache"
 	"k8s.io/klog"
 	ei "k8s.io/kubernetes/pkg/scheduler/api"
+	"os"
+	"reflect"
+	"sort"
 	"sync"
 	"time"
 )
@@ -117,13 +122,32 @@ type HivedScheduler struct {
 	// SchedulerAlgorithm is used to make the pod schedule decision based on the
 	// scheduling view.
 	schedulerAlgorithm internal.SchedulerAlgorithm
+
+	// The times of the AffinityGroup evictions by the defragmentation in the last
+	// hour, which are counted in DefragmentationMaxEvictionsPerHour.
+	defragmentationEvictions []time.Time
+
+	// The Reservations in the config, and the changes of the Reservations made at
+	// runtime (Reservation name -> change), which are persisted to the
+	// ReservationFilePath and replayed on top of the config after the restart.
+	configReservations map[string]si.Reservation
+	reservationChanges map[string]reservationChange
+}
+
+// reservationChange is a change of a Reservation made at runtime.
+type reservationChange struct {
+	// The Reservation created or moved at runtime, nil if it is deleted.
+	Reservation *si.Reservation `json:"reservation,omitempty"`
+	// The spec of the Reservation in the config when it was first changed, nil if
+	// it is created at runtime.
+	ConfigSpec *si.ReservationSpec `json:"configSpec,omitempty"`
 }
 
 func NewHivedScheduler() *HivedScheduler {
 	klog.Infof("Initializing " + si.ComponentName)
 
 	sConfig := si.NewConfig(si.InitRawConfig(nil))
-	klog.Infof("With Config: \n%v", common.ToYaml(sConfig))
+	klog.Infof("With Config: \n%v", common.ToYaml(getRedactedConfig(sConfig)))
 	kConfig := si.BuildKubeConfig(sConfig)
 
 	kClient := internal.CreateClient(kConfig)
@@ -180,11 +204,35 @@ func NewHivedScheduler() *HivedScheduler {
 			PreemptHandler: s.preemptRoutine,
 		},
 		internal.InspectHandlers{
-			GetAffinityGroupsHandler: s.getAffinityGroups,
-			GetAffinityGroupHandler:  s.getAffinityGroup,
+			GetAffinityGroupsHandler:           s.getAffinityGroups,
+			GetAffinityGroupHandler:            s.getAffinityGroup,
+			UpdateAffinityGroupPriorityHandler: s.updateAffinityGroupPriority,
+			GetReservationsHandler:             s.getReservations,
+			GetReservationHandler:              s.getReservation,
+			CreateReservationHandler:           s.createReservation,
+			MoveReservationHandler:             s.moveReservation,
+			DeleteReservationHandler:           s.deleteReservation,
+			GetCellCordonsHandler:              s.getCellCordons,
+			GetCellCordonHandler:               s.getCellCordon,
+			CreateCellCordonHandler:            s.createCellCordon,
+			DeleteCellCordonHandler:            s.deleteCellCordon,
+			GetTimeWindowSchedulesHandler:      s.getTimeWindowSchedules,
+			GetVirtualClustersHandler:          s.getVirtualClusters,
+			GetVirtualClusterHandler:           s.getVirtualCluster,
+			GetGpuHoursHandler:                 s.getGpuHours,
+			GetCapacityHandler:                 s.getCapacity,
+			GetSnapshotHandler:                 s.getSnapshot,
+			GetRecoveryReportHandler:           s.getRecoveryReport,
+		},
+		internal.AdmissionHandlers{
+			ValidatePodHandler: s.validatePod,
+			MutatePodHandler:   s.mutatePod,
 		},
 	)
 
+	// Restore the Reservations changed at runtime before any Pod is recovered.
+	s.restoreReservations()
+
 	return s
 }
 
@@ -205,11 +253,109 @@ func (s *HivedScheduler) Run(stopCh <-chan struct{}) {
 
 	// Previous bound pods recovery completed, start to accept scheduling request.
 	s.webServer.AsyncRun(stopCh)
+	if *s.sConfig.ReconcileIntervalSec > 0 {
+		go wait.Until(s.reconcile, time.Duration(*s.sConfig.ReconcileIntervalSec)*time.Second, stopCh)
+	}
+	if *s.sConfig.DefragmentationIntervalSec > 0 {
+		go wait.Until(s.defragment, time.Duration(*s.sConfig.DefragmentationIntervalSec)*time.Second, stopCh)
+	}
 	klog.Infof("Running " + si.ComponentName)
 
 	<-stopCh
 }
 
+func (s *HivedScheduler) reconcile() {
+	s.schedulerLock.Lock()
+	defer s.schedulerLock.Unlock()
+
+	logPfx := "reconcile: "
+	defer internal.HandleInformerPanic(logPfx, false)
+
+	// the Reservations may be moved by the drain of the cordoned cells, or by
+	// their time windows
+	reservations := s.schedulerAlgorithm.GetReservations()
+	s.schedulerAlgorithm.Reconcile()
+	s.persistReservationsIfChanged(reservations)
+	s.persistChangedAllocatedPods()
+}
+
+// persistChangedAllocatedPods patches the PodBindInfo changed at runtime to the allocated Pods,
+// so that their AffinityGroups are recovered with the changes after the Scheduler restart.
+// A failure is only logged, since the change has been made in the scheduling view.
+func (s *HivedScheduler) persistChangedAllocatedPods() {
+	for _, pod := range s.schedulerAlgorithm.TakeChangedAllocatedPods() {
+		if podStatus := s.podScheduleStatuses[pod.UID]; podStatus != nil {
+			podStatus.Pod = pod
+		}
+		if err := internal.PatchPodAnnotation(s.kClient, pod, si.AnnotationKeyPodBindInfo); err != nil {
+			klog.Errorf("[%v]: Failed to patch the changed PodBindInfo: %v", internal.Key(pod), err)
+		} else {
+			klog.Infof("[%v]: Patched the changed PodBindInfo", internal.Key(pod))
+		}
+	}
+}
+
+// defragment evicts the opportunistic AffinityGroups selected by the SchedulerAlgorithm within the
+// disruption budget, so that they are rescheduled more compactly, and appends the moves to the audit log.
+// The evicted Pods are deleted from the scheduling view later through the PodInformer.
+func (s *HivedScheduler) defragment() {
+	s.schedulerLock.Lock()
+	defer s.schedulerLock.Unlock()
+
+	logPfx := "defragment: "
+	defer internal.HandleInformerPanic(logPfx, false)
+
+	now := time.Now()
+	recentEvictions := []time.Time{}
+	for _, t := range s.defragmentationEvictions {
+		if now.Sub(t) < time.Hour {
+			recentEvictions = append(recentEvictions, t)
+		}
+	}
+	s.defragmentationEvictions = recentEvictions
+	maxMoves := *s.sConfig.DefragmentationMaxEvictionsPerHour - int32(len(recentEvictions))
+	if maxMoves > *s.sConfig.DefragmentationMaxEvictionsPerRound {
+		maxMoves = *s.sConfig.DefragmentationMaxEvictionsPerRound
+	}
+	if maxMoves <= 0 {
+		klog.Infof(logPfx+"Skipped since the disruption budget is used up: %v evictions in the last hour",
+			len(recentEvictions))
+		return
+	}
+
+	moves := s.schedulerAlgorithm.Defragment(
+		maxMoves, time.Duration(*s.sConfig.DefragmentationMinRuntimeSec)*time.Second)
+	for _, move := range moves {
+		for _, key := range move.Pods {
+			namespace, name, _ := cache.SplitMetaNamespaceKey(key)
+			if err := internal.EvictPod(s.kClient, namespace, name); err != nil {
+				move.EvictionErrors = append(move.EvictionErrors, fmt.Sprintf("%v: %v", key, err))
+			}
+		}
+		s.defragmentationEvictions = append(s.defragmentationEvictions, now)
+		klog.Infof(logPfx+"Moved AffinityGroup %v: %v", move.AffinityGroup, common.ToJson(move))
+		s.appendDefragmentationAudit(move)
+	}
+}
+
+// appendDefragmentationAudit appends a defragmentation move to the DefragmentationAuditFilePath if it
+// is not empty. A failure is only logged, since the move has been executed.
+func (s *HivedScheduler) appendDefragmentationAudit(move si.DefragmentationMove) {
+	filePath := *s.sConfig.DefragmentationAuditFilePath
+	if filePath == "" {
+		return
+	}
+	f, err := os.OpenFile(filePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		klog.Errorf("Failed to open defragmentation audit file %v: %v", filePath, err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Write(append(common.ToJsonBytes(move), '\n')); err != nil {
+		klog.Errorf("Failed to append to defragmentation audit file %v: %v", filePath, err)
+	}
+}
+
 func (s *HivedScheduler) addNode(obj interface{}) {
 	node := internal.ToNode(obj)
 	logPfx := fmt.Sprintf("[%v]: addNode: ", node.Name)
@@ -290,9 +436,13 @@ func (s *HivedScheduler) deletePod(obj interface{}) {
 	if podStatus != nil {
 		if internal.IsAllocated(podStatus.PodState) {
 			s.schedulerAlgorithm.DeleteAllocatedPod(podStatus.Pod)
+		} else {
+			s.schedulerAlgorithm.DeleteUnallocatedPod(podStatus.Pod)
 		}
 
 		delete(s.podScheduleStatuses, pod.UID)
+		// the deletion may restore or upgrade the other AffinityGroups
+		s.persistChangedAllocatedPods()
 	}
 }
 
@@ -621,6 +771,32 @@ func (s *HivedScheduler) bindRoutine(args ei.ExtenderBindingArgs) *ei.ExtenderBi
 		podStatus.PodState, bindingNode)))
 }
 
+func (s *HivedScheduler) validatePod(pod *core.Pod) {
+	logPfx := fmt.Sprintf("[%v]: validatePod: ", internal.Key(pod))
+	klog.Infof(logPfx + "Started")
+	defer internal.HandleRoutinePanic(logPfx)
+
+	// Only the Pods to be scheduled by the Scheduler are validated.
+	if !internal.IsInterested(pod) {
+		return
+	}
+	s.schedulerAlgorithm.ValidatePod(pod)
+}
+
+func (s *HivedScheduler) mutatePod(pod *core.Pod) *core.Pod {
+	logPfx := fmt.Sprintf("[%v]: mutatePod: ", internal.Key(pod))
+	klog.Infof(logPfx + "Started")
+	defer internal.HandleRoutinePanic(logPfx)
+
+	// Only the Pods with PodSchedulingSpec are mutated, no matter whether they
+	// have been enabled to be scheduled by the Scheduler.
+	if _, ok := pod.Annotations[si.AnnotationKeyPodSchedulingSpec]; !ok {
+		return pod
+	}
+	return internal.MutatePod(
+		pod, *s.sConfig.SchedulerName, s.sConfig.PhysicalCluster.CellTypes)
+}
+
 func (s *HivedScheduler) preemptRoutine(args ei.ExtenderPreemptionArgs) *ei.ExtenderPreemptionResult {
 	s.schedulerLock.RLock()
 	defer s.schedulerLock.RUnlock()
@@ -678,3 +854,308 @@ func (s *HivedScheduler) getAffinityGroups() si.AffinityGroupList {
 func (s *HivedScheduler) getAffinityGroup(name string) si.AffinityGroup {
 	return s.schedulerAlgorithm.GetAffinityGroup(name)
 }
+
+func (s *HivedScheduler) updateAffinityGroupPriority(name string, priority int32) si.AffinityGroup {
+	s.schedulerLock.Lock()
+	defer s.schedulerLock.Unlock()
+
+	ag := s.schedulerAlgorithm.UpdateAffinityGroupPriority(name, priority)
+	s.persistChangedAllocatedPods()
+	return ag
+}
+
+func (s *HivedScheduler) getReservations() si.ReservationList {
+	return s.schedulerAlgorithm.GetReservations()
+}
+
+func (s *HivedScheduler) getReservation(name string) si.Reservation {
+	return s.schedulerAlgorithm.GetReservation(name)
+}
+
+func (s *HivedScheduler) createReservation(r si.Reservation) si.Reservation {
+	s.schedulerLock.Lock()
+	defer s.schedulerLock.Unlock()
+
+	reservations := s.schedulerAlgorithm.GetReservations()
+	created := s.schedulerAlgorithm.CreateReservation(r)
+	s.persistReservations(reservations, func() { s.schedulerAlgorithm.DeleteReservation(r.Name) })
+	return created
+}
+
+func (s *HivedScheduler) moveReservation(name string, spec si.ReservationSpec) si.Reservation {
+	s.schedulerLock.Lock()
+	defer s.schedulerLock.Unlock()
+
+	reservations := s.schedulerAlgorithm.GetReservations()
+	original := s.schedulerAlgorithm.GetReservation(name)
+	moved := s.schedulerAlgorithm.MoveReservation(name, spec)
+	s.persistReservations(reservations, func() { s.schedulerAlgorithm.MoveReservation(name, original.Spec) })
+	return moved
+}
+
+func (s *HivedScheduler) deleteReservation(name string) si.Reservation {
+	s.schedulerLock.Lock()
+	defer s.schedulerLock.Unlock()
+
+	reservations := s.schedulerAlgorithm.GetReservations()
+	deleted := s.schedulerAlgorithm.DeleteReservation(name)
+	s.persistReservations(reservations, func() { s.schedulerAlgorithm.CreateReservation(deleted) })
+	return deleted
+}
+
+func (s *HivedScheduler) getCellCordons() si.CellCordonList {
+	return s.schedulerAlgorithm.GetCellCordons()
+}
+
+func (s *HivedScheduler) getCellCordon(name string) si.CellCordon {
+	return s.schedulerAlgorithm.GetCellCordon(name)
+}
+
+func (s *HivedScheduler) createCellCordon(cc si.CellCordon) si.CellCordon {
+	s.schedulerLock.Lock()
+	defer s.schedulerLock.Unlock()
+
+	// the Reservations may be moved by the drain
+	reservations := s.schedulerAlgorithm.GetReservations()
+	created := s.schedulerAlgorithm.CreateCellCordon(cc)
+	s.persistReservationsIfChanged(reservations)
+	return created
+}
+
+func (s *HivedScheduler) deleteCellCordon(name string) si.CellCordon {
+	s.schedulerLock.Lock()
+	defer s.schedulerLock.Unlock()
+
+	return s.schedulerAlgorithm.DeleteCellCordon(name)
+}
+
+func (s *HivedScheduler) getTimeWindowSchedules(vc string) si.TimeWindowScheduleList {
+	return s.schedulerAlgorithm.GetTimeWindowSchedules(vc)
+}
+
+func (s *HivedScheduler) getVirtualClusters() si.VirtualClusterList {
+	return s.schedulerAlgorithm.GetVirtualClusters()
+}
+
+func (s *HivedScheduler) getVirtualCluster(name string) si.VirtualCluster {
+	return s.schedulerAlgorithm.GetVirtualCluster(name)
+}
+
+func (s *HivedScheduler) getGpuHours(start, end time.Time, vc, user string) si.GpuHoursList {
+	return s.schedulerAlgorithm.GetGpuHours(start, end, vc, user)
+}
+
+func (s *HivedScheduler) getCapacity(priority int32) si.Capacity {
+	return s.schedulerAlgorithm.GetCapacity(priority)
+}
+
+// getRedactedConfig returns a copy of the Config without the admin tokens, so that
+// the tokens are not exposed when the Config is logged or returned.
+func getRedactedConfig(sConfig *si.Config) *si.Config {
+	config := si.Config{}
+	common.FromYaml(common.ToYaml(sConfig), &config)
+	config.ClusterAdminTokens = &[]string{}
+	for vc, spec := range *config.VirtualClusters {
+		spec.AdminTokens = nil
+		(*config.VirtualClusters)[vc] = spec
+	}
+	return &config
+}
+
+func (s *HivedScheduler) getSnapshot() si.Snapshot {
+	s.schedulerLock.RLock()
+	defer s.schedulerLock.RUnlock()
+
+	snapshot := s.schedulerAlgorithm.GetSnapshot()
+	snapshot.Config = common.ToYaml(getRedactedConfig(s.sConfig))
+
+	snapshot.PodScheduleStatuses = []si.PodScheduleStatusSnapshot{}
+	for uid, podStatus := range s.podScheduleStatuses {
+		snapshot.PodScheduleStatuses = append(snapshot.PodScheduleStatuses, si.PodScheduleStatusSnapshot{
+			Pod:             podStatus.Pod.Namespace + "/" + podStatus.Pod.Name,
+			UID:             uid,
+			PodState:        string(podStatus.PodState),
+			Node:            podStatus.Pod.Spec.NodeName,
+			PodBindAttempts: podStatus.PodBindAttempts,
+		})
+	}
+	sort.Slice(snapshot.PodScheduleStatuses, func(i, j int) bool {
+		return snapshot.PodScheduleStatuses[i].Pod < snapshot.PodScheduleStatuses[j].Pod
+	})
+	return snapshot
+}
+
+func (s *HivedScheduler) getRecoveryReport() si.RecoveryReport {
+	return s.schedulerAlgorithm.GetRecoveryReport()
+}
+
+// persistReservationsIfChanged persists the changes of the Reservations made by
+// the scheduling, i.e. the moves by the drain of the cordoned cells or by the time
+// windows, if the Reservations are changed from the given ones.
+// A failure is only logged, since the changes cannot be rolled back.
+func (s *HivedScheduler) persistReservationsIfChanged(reservations si.ReservationList) {
+	if !reflect.DeepEqual(reservations, s.schedulerAlgorithm.GetReservations()) {
+		s.persistReservations(reservations, nil)
+	}
+}
+
+// persistReservations persists the changes of the Reservations made at runtime,
+// including the ones from the given Reservations, to the ReservationFilePath, so
+// that they survive the Scheduler restart.
+// If it fails, the latest changes are rolled back by rollback, and the failure is
+// returned to the caller.
+func (s *HivedScheduler) persistReservations(reservations si.ReservationList, rollback func()) {
+	filePath := *s.sConfig.ReservationFilePath
+	if filePath == "" {
+		return
+	}
+	changes := s.getReservationChanges(reservations)
+	err := writeReservationChanges(filePath, changes)
+	if err == nil {
+		s.reservationChanges = changes
+		klog.Infof("Reservations persisted to %v", filePath)
+		return
+	}
+	if rollback == nil {
+		s.reservationChanges = changes
+		klog.Errorf("Failed to persist Reservations to %v: %v", filePath, err)
+		return
+	}
+	func() {
+		defer func() {
+			if r := recover(); r != nil {
+				klog.Errorf("Failed to roll back the Reservations: %v", r)
+			}
+		}()
+		rollback()
+	}()
+	panic(fmt.Errorf("Failed to persist Reservations to %v, the change is rolled back: %v", filePath, err))
+}
+
+// getReservationChanges returns the changes of the Reservations made at runtime,
+// updated with the current Reservations changed from the given ones.
+func (s *HivedScheduler) getReservationChanges(reservations si.ReservationList) map[string]reservationChange {
+	changes := map[string]reservationChange{}
+	for name, c := range s.reservationChanges {
+		changes[name] = c
+	}
+	getChange := func(name string) reservationChange {
+		if c, ok := changes[name]; ok {
+			return c
+		}
+		c := reservationChange{}
+		if r, ok := s.configReservations[name]; ok {
+			spec := r.Spec
+			c.ConfigSpec = &spec
+		}
+		return c
+	}
+
+	previous := map[string]si.Reservation{}
+	for _, r := range reservations.Items {
+		previous[r.Name] = r
+	}
+	current := map[string]bool{}
+	for _, r := range s.schedulerAlgorithm.GetReservations().Items {
+		current[r.Name] = true
+		if p, ok := previous[r.Name]; ok && reflect.DeepEqual(p.Spec, r.Spec) {
+			continue
+		}
+		c := getChange(r.Name)
+		if c.ConfigSpec != nil && reflect.DeepEqual(*c.ConfigSpec, r.Spec) {
+			// moved back to the config
+			delete(changes, r.Name)
+			continue
+		}
+		reservation := r
+		c.Reservation = &reservation
+		changes[r.Name] = c
+	}
+	for name := range previous {
+		if current[name] {
+			continue
+		}
+		if c := getChange(name); c.ConfigSpec == nil {
+			// created and deleted at runtime
+			delete(changes, name)
+		} else {
+			c.Reservation = nil
+			changes[name] = c
+		}
+	}
+	return changes
+}
+
+// writeReservationChanges writes the changes of the Reservations to a file atomically.
+func writeReservationChanges(filePath string, changes map[string]reservationChange) error {
+	tmpFilePath := filePath + ".tmp"
+	if err := ioutil.WriteFile(tmpFilePath, common.ToJsonBytes(changes), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpFilePath, filePath)
+}
+
+// restoreReservations replays the changes of the Reservations made at runtime,
+// persisted in the ReservationFilePath, on top of the Reservations in the config.
+// The config is the source of truth: a change conflicting with the config, i.e.
+// a Reservation created at runtime but added to the config since, or changed at
+// runtime but removed or changed in the config since, is dropped with a warning.
+func (s *HivedScheduler) restoreReservations() {
+	s.configReservations = map[string]si.Reservation{}
+	s.reservationChanges = map[string]reservationChange{}
+	for _, r := range s.schedulerAlgorithm.GetReservations().Items {
+		s.configReservations[r.Name] = r
+	}
+	filePath := *s.sConfig.ReservationFilePath
+	if filePath == "" {
+		klog.Infof("Reservations changed at runtime are not persisted since reservationFilePath is empty")
+		return
+	}
+	data, err := ioutil.ReadFile(filePath)
+	if os.IsNotExist(err) {
+		klog.Infof("Reservations not restored since %v does not exist", filePath)
+		return
+	} else if err != nil {
+		panic(fmt.Errorf("Failed to read Reservations from %v: %v", filePath, err))
+	}
+
+	changes := map[string]reservationChange{}
+	common.FromJsonBytes(data, &changes)
+	var names []string
+	for name := range changes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		c := changes[name]
+		r, inConfig := s.configReservations[name]
+		conflict := ""
+		if c.ConfigSpec == nil && inConfig {
+			conflict = "created at runtime, but added to the config since"
+		} else if c.ConfigSpec != nil && !inConfig {
+			conflict = "changed at runtime, but removed from the config since"
+		} else if c.ConfigSpec != nil && !reflect.DeepEqual(*c.ConfigSpec, r.Spec) {
+			conflict = "changed at runtime, but changed in the config since"
+		}
+		if conflict != "" {
+			klog.Warningf("[%v]: restoreReservations: change dropped since the config wins: %v", name, conflict)
+			continue
+		}
+		func() {
+			defer internal.HandleInformerPanic(fmt.Sprintf("[%v]: restoreReservations: ", name), true)
+			if c.Reservation == nil {
+				s.schedulerAlgorithm.DeleteReservation(name)
+			} else if !inConfig {
+				s.schedulerAlgorithm.CreateReservation(*c.Reservation)
+			} else {
+				s.schedulerAlgorithm.MoveReservation(name, c.Reservation.Spec)
+			}
+			s.reservationChanges[name] = c
+		}()
+	}
+	if !reflect.DeepEqual(changes, s.reservationChanges) {
+		if err := writeReservationChanges(filePath, s.reservationChanges); err != nil {
+			klog.Errorf("Failed to persist Reservations to %v: %v", filePath, err)
+		}
+	}
+}
@@ -24,16 +24,20 @@ package webserver
 
 import (
 	"context"
+	"crypto/subtle"
 	"encoding/json"
 	"fmt"
 	si "github.com/microsoft/hivedscheduler/pkg/api"
 	"github.com/microsoft/hivedscheduler/pkg/common"
 	"github.com/microsoft/hivedscheduler/pkg/internal"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/klog"
 	ei "k8s.io/kubernetes/pkg/scheduler/api"
 	"net"
 	"net/http"
+	"reflect"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -57,11 +61,15 @@ type WebServer struct {
 
 	// Scheduler Inspect Callbacks
 	iHandlers internal.InspectHandlers
+
+	// Admission Webhook Callbacks from K8S ApiServer
+	aHandlers internal.AdmissionHandlers
 }
 
 func NewWebServer(sConfig *si.Config,
 	eHandlers internal.ExtenderHandlers,
-	iHandlers internal.InspectHandlers) *WebServer {
+	iHandlers internal.InspectHandlers,
+	aHandlers internal.AdmissionHandlers) *WebServer {
 	klog.Infof("Initializing " + ComponentName)
 
 	ws := &WebServer{
@@ -72,13 +80,24 @@ func NewWebServer(sConfig *si.Config,
 		paths:     si.WebServerPaths{Paths: []string{}},
 		eHandlers: eHandlers,
 		iHandlers: iHandlers,
+		aHandlers: aHandlers,
 	}
 
 	ws.route(si.RootPath, ws.serve(ws.serveRootPath))
 	ws.route(si.FilterPath, ws.serve(ws.serveFilterPath))
 	ws.route(si.BindPath, ws.serve(ws.serveBindPath))
 	ws.route(si.PreemptPath, ws.serve(ws.servePreemptPath))
+	ws.route(si.ValidatePodPath, ws.serve(ws.serveValidatePodPath))
+	ws.route(si.MutatePodPath, ws.serve(ws.serveMutatePodPath))
 	ws.route(si.AffinityGroupsPath, ws.serve(ws.serveAffinityGroups))
+	ws.route(si.ReservationsPath, ws.serve(ws.serveReservations))
+	ws.route(si.CellCordonsPath, ws.serve(ws.serveCellCordons))
+	ws.route(si.TimeWindowsPath, ws.serve(ws.serveTimeWindows))
+	ws.route(si.VirtualClustersPath, ws.serve(ws.serveVirtualClusters))
+	ws.route(si.GpuHoursPath, ws.serve(ws.serveGpuHours))
+	ws.route(si.CapacityPath, ws.serve(ws.serveCapacity))
+	ws.route(si.SnapshotPath, ws.serve(ws.serveSnapshot))
+	ws.route(si.RecoveryPath, ws.serve(ws.serveRecoveryReport))
 	return ws
 }
 
@@ -108,7 +127,14 @@ func (ws *WebServer) AsyncRun(stopCh <-chan struct{}) <-chan struct{} {
 
 	go func() {
 		// Blocking until error
-		if err := ws.server.Serve(tcpKeepAliveListener{ln.(*net.TCPListener)}); err != nil {
+		var err error
+		if *ws.sConfig.WebServerCertFilePath != "" {
+			err = ws.server.ServeTLS(tcpKeepAliveListener{ln.(*net.TCPListener)},
+				*ws.sConfig.WebServerCertFilePath, *ws.sConfig.WebServerKeyFilePath)
+		} else {
+			err = ws.server.Serve(tcpKeepAliveListener{ln.(*net.TCPListener)})
+		}
+		if err != nil {
 			panic(fmt.Errorf("Error occurred while running WebServer: %v", err))
 		}
 	}()
@@ -236,6 +262,167 @@ func (ws *WebServer) servePreemptPath(w http.ResponseWriter, r *http.Request) {
 	w.Write(common.ToJsonBytes(ws.eHandlers.PreemptHandler(args)))
 }
 
+func (ws *WebServer) serveValidatePodPath(w http.ResponseWriter, r *http.Request) {
+	var review si.AdmissionReview
+	if err := json.NewDecoder(r.Body).Decode(&review); err != nil {
+		panic(internal.NewBadRequestError(fmt.Sprintf(
+			"Failed to unmarshal web request body to AdmissionReview: %v", err)))
+	}
+
+	// Args Validation
+	if review.Request == nil {
+		panic(internal.NewBadRequestError(fmt.Sprintf(
+			"AdmissionReview: Request field should not be nil: %v",
+			common.ToJson(review))))
+	}
+
+	review.Response = &si.AdmissionResponse{UID: review.Request.UID, Allowed: true}
+	if pod := review.Request.Object; pod != nil {
+		// The Pod to be created may not have its namespace set yet.
+		if pod.Namespace == "" {
+			pod.Namespace = review.Request.Namespace
+		}
+		func() {
+			// recoverPanic to send the rejection message to K8S
+			defer internal.HandleWebServerPanic(func(err *si.WebServerError) {
+				review.Response.Allowed = false
+				review.Response.Result = &meta.Status{Code: int32(err.Code), Message: err.Message}
+			})
+			ws.aHandlers.ValidatePodHandler(pod)
+		}()
+	}
+	review.Request = nil
+	w.Write(common.ToJsonBytes(review))
+}
+
+type jsonPatchOperation struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+func (ws *WebServer) serveMutatePodPath(w http.ResponseWriter, r *http.Request) {
+	var review si.AdmissionReview
+	if err := json.NewDecoder(r.Body).Decode(&review); err != nil {
+		panic(internal.NewBadRequestError(fmt.Sprintf(
+			"Failed to unmarshal web request body to AdmissionReview: %v", err)))
+	}
+
+	// Args Validation
+	if review.Request == nil {
+		panic(internal.NewBadRequestError(fmt.Sprintf(
+			"AdmissionReview: Request field should not be nil: %v",
+			common.ToJson(review))))
+	}
+
+	review.Response = &si.AdmissionResponse{UID: review.Request.UID, Allowed: true}
+	if pod := review.Request.Object; pod != nil {
+		// The Pod to be created may not have its namespace set yet.
+		if pod.Namespace == "" {
+			pod.Namespace = review.Request.Namespace
+		}
+		func() {
+			// recoverPanic to send the rejection message to K8S
+			defer internal.HandleWebServerPanic(func(err *si.WebServerError) {
+				review.Response.Allowed = false
+				review.Response.Result = &meta.Status{Code: int32(err.Code), Message: err.Message}
+			})
+			mutatedPod := ws.aHandlers.MutatePodHandler(pod)
+
+			// The "add" operation replaces the existing value, so the whole changed
+			// fields are patched.
+			patch := []jsonPatchOperation{}
+			if mutatedPod.Spec.SchedulerName != pod.Spec.SchedulerName {
+				patch = append(patch, jsonPatchOperation{
+					Op: "add", Path: "/spec/schedulerName", Value: mutatedPod.Spec.SchedulerName})
+			}
+			if !reflect.DeepEqual(mutatedPod.Spec.Containers, pod.Spec.Containers) {
+				patch = append(patch, jsonPatchOperation{
+					Op: "add", Path: "/spec/containers", Value: mutatedPod.Spec.Containers})
+			}
+			if !reflect.DeepEqual(mutatedPod.Annotations, pod.Annotations) {
+				patch = append(patch, jsonPatchOperation{
+					Op: "add", Path: "/metadata/annotations", Value: mutatedPod.Annotations})
+			}
+			if len(patch) > 0 {
+				review.Response.Patch = common.ToJsonBytes(patch)
+				review.Response.PatchType = common.PtrString("JSONPatch")
+			}
+		}()
+	}
+	review.Request = nil
+	w.Write(common.ToJsonBytes(review))
+}
+
+// checkPermission checks whether the bearer token of the request is permitted to
+// modify the AffinityGroup. The token is required before the group is looked up, and
+// a nonexistent group is refused the same as a group in another VC, so that the
+// names of the groups cannot be probed without permission.
+func (ws *WebServer) checkPermission(r *http.Request, name string) {
+	token := getBearerToken(r)
+	if containsToken(*ws.sConfig.ClusterAdminTokens, token) {
+		return
+	}
+	// The admins of a VC are also permitted in its descendant VCs.
+	for v := ws.getAffinityGroupVirtualCluster(name); v != ""; v = (*ws.sConfig.VirtualClusters)[v].Parent {
+		if containsToken((*ws.sConfig.VirtualClusters)[v].AdminTokens, token) {
+			return
+		}
+	}
+	panic(si.NewWebServerError(
+		http.StatusForbidden,
+		fmt.Sprintf("Bearer token is not permitted to modify AffinityGroup %v", name)))
+}
+
+// getAffinityGroupVirtualCluster returns the VC of the AffinityGroup, or empty if the
+// group does not exist or is not allocated in any VC.
+func (ws *WebServer) getAffinityGroupVirtualCluster(name string) (vc si.VirtualClusterName) {
+	defer func() {
+		if err := recover(); err != nil {
+			if _, ok := err.(*si.WebServerError); !ok {
+				panic(err)
+			}
+			vc = ""
+		}
+	}()
+	return ws.iHandlers.GetAffinityGroupHandler(name).Status.VirtualCluster
+}
+
+// checkClusterAdminPermission checks whether the bearer token of the request is
+// a cluster admin token, which is permitted to modify the cluster, such as the
+// Reservations and the CellCordons, and to run the costly inspection, such as
+// the Capacity.
+func (ws *WebServer) checkClusterAdminPermission(r *http.Request) {
+	if !containsToken(*ws.sConfig.ClusterAdminTokens, getBearerToken(r)) {
+		panic(si.NewWebServerError(
+			http.StatusForbidden,
+			"Bearer token is not a cluster admin token"))
+	}
+}
+
+// getBearerToken returns the bearer token in the Authorization header of the request.
+func getBearerToken(r *http.Request) string {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if token == "" {
+		panic(si.NewWebServerError(
+			http.StatusUnauthorized,
+			"Bearer token is required in the Authorization header"))
+	}
+	return token
+}
+
+// containsToken checks whether a token is one of the permitted tokens. The tokens are
+// compared in constant time, so that the comparison does not leak them by timing.
+func containsToken(tokens []string, token string) bool {
+	found := false
+	for _, t := range tokens {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			found = true
+		}
+	}
+	return found
+}
+
 func (ws *WebServer) serveAffinityGroups(w http.ResponseWriter, r *http.Request) {
 	name := strings.TrimPrefix(r.URL.Path, si.AffinityGroupsPath)
 	if name == "" {
@@ -243,6 +430,19 @@ func (ws *WebServer) serveAffinityGroups(w http.ResponseWriter, r *http.Request)
 			w.Write(common.ToJsonBytes(ws.iHandlers.GetAffinityGroupsHandler()))
 			return
 		}
+	} else if strings.HasSuffix(name, si.AffinityGroupPrioritySubPath) {
+		name = strings.TrimSuffix(name, si.AffinityGroupPrioritySubPath)
+		if r.Method == http.MethodPut {
+			ws.checkPermission(r, name)
+			var args si.AffinityGroupPriority
+			if err := json.NewDecoder(r.Body).Decode(&args); err != nil {
+				panic(internal.NewBadRequestError(fmt.Sprintf(
+					"Failed to unmarshal web request body to AffinityGroupPriority: %v", err)))
+			}
+
+			w.Write(common.ToJsonBytes(ws.iHandlers.UpdateAffinityGroupPriorityHandler(name, args.Priority)))
+			return
+		}
 	} else {
 		if r.Method == http.MethodGet {
 			w.Write(common.ToJsonBytes(ws.iHandlers.GetAffinityGroupHandler(name)))
@@ -254,3 +454,174 @@ func (ws *WebServer) serveAffinityGroups(w http.ResponseWriter, r *http.Request)
 		"NotImplemented: %v: %v",
 		r.Method, r.URL.Path)))
 }
+
+func (ws *WebServer) serveReservations(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, si.ReservationsPath)
+	if name == "" {
+		if r.Method == http.MethodGet {
+			w.Write(common.ToJsonBytes(ws.iHandlers.GetReservationsHandler()))
+			return
+		} else if r.Method == http.MethodPost {
+			var args si.Reservation
+			if err := json.NewDecoder(r.Body).Decode(&args); err != nil {
+				panic(internal.NewBadRequestError(fmt.Sprintf(
+					"Failed to unmarshal web request body to Reservation: %v", err)))
+			}
+
+			ws.checkClusterAdminPermission(r)
+			w.Write(common.ToJsonBytes(ws.iHandlers.CreateReservationHandler(args)))
+			return
+		}
+	} else {
+		if r.Method == http.MethodGet {
+			w.Write(common.ToJsonBytes(ws.iHandlers.GetReservationHandler(name)))
+			return
+		} else if r.Method == http.MethodPut {
+			var args si.ReservationSpec
+			if err := json.NewDecoder(r.Body).Decode(&args); err != nil {
+				panic(internal.NewBadRequestError(fmt.Sprintf(
+					"Failed to unmarshal web request body to ReservationSpec: %v", err)))
+			}
+
+			ws.checkClusterAdminPermission(r)
+			w.Write(common.ToJsonBytes(ws.iHandlers.MoveReservationHandler(name, args)))
+			return
+		} else if r.Method == http.MethodDelete {
+			ws.checkClusterAdminPermission(r)
+			w.Write(common.ToJsonBytes(ws.iHandlers.DeleteReservationHandler(name)))
+			return
+		}
+	}
+
+	panic(internal.NewBadRequestError(fmt.Sprintf(
+		"NotImplemented: %v: %v",
+		r.Method, r.URL.Path)))
+}
+
+func (ws *WebServer) serveTimeWindows(w http.ResponseWriter, r *http.Request) {
+	vc := strings.TrimPrefix(r.URL.Path, si.TimeWindowsPath)
+	if r.Method == http.MethodGet {
+		w.Write(common.ToJsonBytes(ws.iHandlers.GetTimeWindowSchedulesHandler(vc)))
+		return
+	}
+
+	panic(internal.NewBadRequestError(fmt.Sprintf(
+		"NotImplemented: %v: %v",
+		r.Method, r.URL.Path)))
+}
+
+func (ws *WebServer) serveVirtualClusters(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, si.VirtualClustersPath)
+	if r.Method == http.MethodGet {
+		if name == "" {
+			w.Write(common.ToJsonBytes(ws.iHandlers.GetVirtualClustersHandler()))
+		} else {
+			w.Write(common.ToJsonBytes(ws.iHandlers.GetVirtualClusterHandler(name)))
+		}
+		return
+	}
+
+	panic(internal.NewBadRequestError(fmt.Sprintf(
+		"NotImplemented: %v: %v",
+		r.Method, r.URL.Path)))
+}
+
+func (ws *WebServer) serveGpuHours(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		query := r.URL.Query()
+		var times [2]time.Time
+		for i, key := range []string{"startTime", "endTime"} {
+			if value := query.Get(key); value != "" {
+				t, err := time.Parse(time.RFC3339, value)
+				if err != nil {
+					panic(internal.NewBadRequestError(fmt.Sprintf(
+						"Failed to parse %v in RFC3339 format: %v", key, err)))
+				}
+				times[i] = t
+			}
+		}
+		w.Write(common.ToJsonBytes(ws.iHandlers.GetGpuHoursHandler(
+			times[0], times[1], query.Get("vc"), query.Get("user"))))
+		return
+	}
+
+	panic(internal.NewBadRequestError(fmt.Sprintf(
+		"NotImplemented: %v: %v",
+		r.Method, r.URL.Path)))
+}
+
+func (ws *WebServer) serveCapacity(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		ws.checkClusterAdminPermission(r)
+		priority := si.MinGuaranteedPriority
+		if value := r.URL.Query().Get("priority"); value != "" {
+			p, err := strconv.ParseInt(value, 10, 32)
+			if err != nil {
+				panic(internal.NewBadRequestError(fmt.Sprintf(
+					"Failed to parse priority: %v", err)))
+			}
+			priority = int32(p)
+		}
+		w.Write(common.ToJsonBytes(ws.iHandlers.GetCapacityHandler(priority)))
+		return
+	}
+
+	panic(internal.NewBadRequestError(fmt.Sprintf(
+		"NotImplemented: %v: %v",
+		r.Method, r.URL.Path)))
+}
+
+func (ws *WebServer) serveSnapshot(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		w.Write(common.ToJsonBytes(ws.iHandlers.GetSnapshotHandler()))
+		return
+	}
+
+	panic(internal.NewBadRequestError(fmt.Sprintf(
+		"NotImplemented: %v: %v",
+		r.Method, r.URL.Path)))
+}
+
+func (ws *WebServer) serveRecoveryReport(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		w.Write(common.ToJsonBytes(ws.iHandlers.GetRecoveryReportHandler()))
+		return
+	}
+
+	panic(internal.NewBadRequestError(fmt.Sprintf(
+		"NotImplemented: %v: %v",
+		r.Method, r.URL.Path)))
+}
+
+func (ws *WebServer) serveCellCordons(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, si.CellCordonsPath)
+	if name == "" {
+		if r.Method == http.MethodGet {
+			w.Write(common.ToJsonBytes(ws.iHandlers.GetCellCordonsHandler()))
+			return
+		} else if r.Method == http.MethodPost {
+			var args si.CellCordon
+			if err := json.NewDecoder(r.Body).Decode(&args); err != nil {
+				panic(internal.NewBadRequestError(fmt.Sprintf(
+					"Failed to unmarshal web request body to CellCordon: %v", err)))
+			}
+
+			ws.checkClusterAdminPermission(r)
+			w.Write(common.ToJsonBytes(ws.iHandlers.CreateCellCordonHandler(args)))
+			return
+		}
+	} else {
+		if r.Method == http.MethodGet {
+			w.Write(common.ToJsonBytes(ws.iHandlers.GetCellCordonHandler(name)))
+			return
+		} else if r.Method == http.MethodDelete {
+			ws.checkClusterAdminPermission(r)
+			w.Write(common.ToJsonBytes(ws.iHandlers.DeleteCellCordonHandler(name)))
+			return
+		}
+	}
+
+	panic(internal.NewBadRequestError(fmt.Sprintf(
+		"NotImplemented: %v: %v",
+		r.Method, r.URL.Path)))
+}